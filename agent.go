@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+type AgentUpdateResult struct {
+	InstanceId           string `json:"instanceId"`
+	ContainerInstanceArn string `json:"containerInstanceArn"`
+	OldVersion           string `json:"oldVersion"`
+	NewVersion           string `json:"newVersion"`
+	Status               string `json:"status"`
+}
+
+// updateAgents updates the ECS agent of all container instances in the cluster, batchSize instances at a time.
+// It stops after the first batch with a failed update.
+func updateAgents(ctx context.Context, e ECS, clusterName string, batchSize int, timing Timing) ([]AgentUpdateResult, error) {
+	var results []AgentUpdateResult
+	containerInstanceArns, err := e.listContainerInstances(ctx, clusterName)
+	if err != nil {
+		return results, err
+	}
+	containerInstances, err := e.describeContainerInstanceDetails(ctx, clusterName, containerInstanceArns)
+	if err != nil {
+		return results, err
+	}
+	// update in a predictable order
+	instanceIds := make([]string, 0, len(containerInstances))
+	for instanceId := range containerInstances {
+		instanceIds = append(instanceIds, instanceId)
+	}
+	sort.Strings(instanceIds)
+
+	for i := 0; i < len(instanceIds); i += batchSize {
+		toIndex := i + batchSize
+		if toIndex > len(instanceIds) {
+			toIndex = len(instanceIds)
+		}
+		var batch []AgentUpdateResult
+		for _, instanceId := range instanceIds[i:toIndex] {
+			containerInstance := containerInstances[instanceId]
+			result := AgentUpdateResult{
+				InstanceId:           instanceId,
+				ContainerInstanceArn: containerInstance.ContainerInstanceArn,
+				OldVersion:           containerInstance.AgentVersion,
+			}
+			updating, err := e.updateContainerAgent(ctx, clusterName, containerInstance.ContainerInstanceArn)
+			if err != nil {
+				result.Status = ecs.AgentUpdateStatusFailed
+				ecsLogger.Instance(instanceId).Errorf("updateAgents: could not update agent on %s: %v", instanceId, err)
+			} else if !updating {
+				result.Status = "UP_TO_DATE"
+				result.NewVersion = containerInstance.AgentVersion
+			}
+			batch = append(batch, result)
+		}
+		mainLogger.Infof("Updating ECS agent on %d instance(s) (%d/%d)", len(batch), toIndex, len(instanceIds))
+		batch, err = waitForAgentUpdates(ctx, e, clusterName, batch, timing)
+		results = append(results, batch...)
+		if err != nil {
+			return results, err
+		}
+		var failed []string
+		for _, result := range batch {
+			if result.Status != ecs.AgentUpdateStatusUpdated && result.Status != "UP_TO_DATE" {
+				failed = append(failed, fmt.Sprintf("%s (%s)", result.InstanceId, result.Status))
+			}
+		}
+		if len(failed) > 0 {
+			return results, fmt.Errorf("Agent update failed on: %s", strings.Join(failed, ", "))
+		}
+	}
+	return results, nil
+}
+
+// waitForAgentUpdates waits until the agent update status of every instance in the batch is UPDATED or FAILED
+func waitForAgentUpdates(ctx context.Context, e ECS, clusterName string, batch []AgentUpdateResult, timing Timing) ([]AgentUpdateResult, error) {
+	done, err := poll(ctx, e.clock, timing, func() (bool, error) {
+		var containerInstanceArns []string
+		for _, result := range batch {
+			if result.Status == "" {
+				containerInstanceArns = append(containerInstanceArns, result.ContainerInstanceArn)
+			}
+		}
+		containerInstances, err := e.describeContainerInstanceDetails(ctx, clusterName, containerInstanceArns)
+		if err != nil {
+			return false, err
+		}
+		var pending int
+		for k, result := range batch {
+			if result.Status != "" {
+				continue
+			}
+			containerInstance := containerInstances[result.InstanceId]
+			switch containerInstance.AgentUpdateStatus {
+			case ecs.AgentUpdateStatusUpdated, ecs.AgentUpdateStatusFailed:
+				batch[k].Status = containerInstance.AgentUpdateStatus
+				batch[k].NewVersion = containerInstance.AgentVersion
+			default:
+				pending++
+				ecsLogger.Instance(result.InstanceId).Debugf("waitForAgentUpdates: agent update on %s: %s", result.InstanceId, containerInstance.AgentUpdateStatus)
+			}
+		}
+		if pending == 0 {
+			return true, nil
+		}
+		ecsLogger.Debugf("waitForAgentUpdates: waiting for %d agent update(s): sleeping %s", pending, timing.Interval)
+		return false, nil
+	})
+	if err != nil {
+		return batch, err
+	}
+	if !done {
+		for k, result := range batch {
+			if result.Status == "" {
+				batch[k].Status = "TIMEOUT"
+			}
+		}
+	}
+	return batch, nil
+}
+
+func logAgentUpdateResults(results []AgentUpdateResult) {
+	for _, result := range results {
+		mainLogger.Instance(result.InstanceId).Infof("Agent update %s: %s (%s -> %s)", result.InstanceId, result.Status, result.OldVersion, result.NewVersion)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+var testAgentUpdateTiming = Timing{Interval: 10 * time.Second, Timeout: time.Minute}
+
+// fakeInstanceIds returns the sorted instance ids of the container instances, in the order of the agent updates
+func fakeInstanceIds(f *fakeAWS) []string {
+	var instanceIds []string
+	for _, ci := range f.containerInstances {
+		instanceIds = append(instanceIds, ci.InstanceId)
+	}
+	sort.Strings(instanceIds)
+	return instanceIds
+}
+
+func checkAgentUpdateStatuses(t *testing.T, results []AgentUpdateResult, expected map[string]string) {
+	t.Helper()
+	statuses := make(map[string]string)
+	for _, result := range results {
+		statuses[result.InstanceId] = result.Status
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected statuses %v, got %v", expected, statuses)
+	}
+}
+
+func TestUpdateAgents(t *testing.T) {
+	f := newFakeAWS(5, 1, false)
+	instanceIds := fakeInstanceIds(f)
+	f.containerInstances[0].AgentVersion = f.agentVersions[fakeNewAMI]
+	upToDate := f.containerInstances[0].InstanceId
+	results, err := updateAgents(context.Background(), f.clients().ECS, f.cluster, 2, testAgentUpdateTiming)
+	if err != nil {
+		t.Fatalf("updateAgents error: %v", err)
+	}
+	expected := make(map[string]string)
+	var updated []string
+	for _, instanceId := range instanceIds {
+		expected[instanceId] = ecs.AgentUpdateStatusUpdated
+		if instanceId == upToDate {
+			expected[instanceId] = "UP_TO_DATE"
+			continue
+		}
+		updated = append(updated, instanceId)
+	}
+	checkAgentUpdateStatuses(t, results, expected)
+	if !reflect.DeepEqual(f.agentUpdates, updated) {
+		t.Errorf("expected agent updates on %v, got %v", updated, f.agentUpdates)
+	}
+	for _, result := range results {
+		if result.NewVersion != f.agentVersions[fakeNewAMI] {
+			t.Errorf("expected new version %s on %s, got %s", f.agentVersions[fakeNewAMI], result.InstanceId, result.NewVersion)
+		}
+	}
+}
+
+// TestUpdateAgentsTimeout stops after the batch with an update that didn't finish
+func TestUpdateAgentsTimeout(t *testing.T) {
+	f := newFakeAWS(4, 1, false)
+	instanceIds := fakeInstanceIds(f)
+	f.agentUpdateStatuses = map[string]string{instanceIds[1]: ecs.AgentUpdateStatusPending}
+	start := f.clock.Now()
+	results, err := updateAgents(context.Background(), f.clients().ECS, f.cluster, 2, testAgentUpdateTiming)
+	if err == nil || !strings.Contains(err.Error(), instanceIds[1]+" (TIMEOUT)") {
+		t.Fatalf("expected a timeout of %s, got %v", instanceIds[1], err)
+	}
+	checkAgentUpdateStatuses(t, results, map[string]string{instanceIds[0]: ecs.AgentUpdateStatusUpdated, instanceIds[1]: "TIMEOUT"})
+	if !reflect.DeepEqual(f.agentUpdates, instanceIds[:2]) {
+		t.Errorf("expected agent updates on the first batch %v, got %v", instanceIds[:2], f.agentUpdates)
+	}
+	if waited := f.clock.Now().Sub(start); waited != testAgentUpdateTiming.Timeout {
+		t.Errorf("expected to wait %s, waited %s", testAgentUpdateTiming.Timeout, waited)
+	}
+}
+
+// TestUpdateAgentsFailed finishes the batch with a failed update and doesn't start the next batch
+func TestUpdateAgentsFailed(t *testing.T) {
+	f := newFakeAWS(5, 1, false)
+	instanceIds := fakeInstanceIds(f)
+	f.agentUpdateStatuses = map[string]string{instanceIds[2]: ecs.AgentUpdateStatusFailed}
+	results, err := updateAgents(context.Background(), f.clients().ECS, f.cluster, 2, testAgentUpdateTiming)
+	if err == nil || !strings.Contains(err.Error(), instanceIds[2]+" (FAILED)") {
+		t.Fatalf("expected a failed update of %s, got %v", instanceIds[2], err)
+	}
+	checkAgentUpdateStatuses(t, results, map[string]string{
+		instanceIds[0]: ecs.AgentUpdateStatusUpdated,
+		instanceIds[1]: ecs.AgentUpdateStatusUpdated,
+		instanceIds[2]: ecs.AgentUpdateStatusFailed,
+		instanceIds[3]: ecs.AgentUpdateStatusUpdated,
+	})
+	if !reflect.DeepEqual(f.agentUpdates, instanceIds[:4]) {
+		t.Errorf("expected agent updates on the first two batches %v, got %v", instanceIds[:4], f.agentUpdates)
+	}
+}
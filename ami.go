@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// amiCreationDateLayout is the layout of the creation date of an AMI
+const amiCreationDateLayout = "2006-01-02T15:04:05.000Z"
+
+// AMISelection is the AMI to upgrade to and why it was chosen
+type AMISelection struct {
+	ImageId      string `json:"imageId"`
+	Source       string `json:"source"`
+	CreationDate string `json:"creationDate,omitempty"`
+	MinAgeDays   int    `json:"minAgeDays,omitempty"`
+	// Skipped are the newer AMIs that are younger than the minimum age
+	Skipped []SkippedAMI `json:"skipped,omitempty"`
+	Reason  string       `json:"reason"`
+}
+
+// SkippedAMI is an AMI that was not chosen because it is younger than the minimum age
+type SkippedAMI struct {
+	ImageId      string `json:"imageId"`
+	CreationDate string `json:"creationDate"`
+}
+
+// getAMIMinAge returns the minimum age of the AMI to upgrade to: the amiMinAgeDays of the target, or AMI_MIN_AGE_DAYS
+func getAMIMinAge(target Target) (time.Duration, error) {
+	days := 0
+	if target.AMIMinAgeDays != nil {
+		days = *target.AMIMinAgeDays
+	} else {
+		var err error
+		days, err = getEnvInt("AMI_MIN_AGE_DAYS")
+		if err != nil {
+			return 0, err
+		}
+	}
+	if days < 0 {
+		return 0, fmt.Errorf("the minimum AMI age must be a number of days")
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// selectNewestAMI returns the newest of the images that is at least amiMinAge old. The newer images are skipped
+func (a *Autoscaling) selectNewestAMI(source string, images []*ec2.Image) (AMISelection, error) {
+	type candidate struct {
+		image   *ec2.Image
+		created time.Time
+	}
+	var candidates []candidate
+	for _, image := range images {
+		created, err := time.Parse(amiCreationDateLayout, aws.StringValue(image.CreationDate))
+		if err != nil {
+			return AMISelection{}, err
+		}
+		candidates = append(candidates, candidate{image, created})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].created.After(candidates[j].created)
+	})
+	selection := AMISelection{Source: source, MinAgeDays: int(a.amiMinAge / (24 * time.Hour))}
+	cutoff := a.clock.Now().Add(-a.amiMinAge)
+	for _, c := range candidates {
+		if c.created.After(cutoff) {
+			selection.Skipped = append(selection.Skipped, SkippedAMI{ImageId: aws.StringValue(c.image.ImageId), CreationDate: aws.StringValue(c.image.CreationDate)})
+			continue
+		}
+		selection.ImageId = aws.StringValue(c.image.ImageId)
+		selection.CreationDate = aws.StringValue(c.image.CreationDate)
+		switch {
+		case a.amiMinAge <= 0:
+			selection.Reason = "newest of the " + source
+		case len(selection.Skipped) == 0:
+			selection.Reason = fmt.Sprintf("newest of the %s, older than the minimum age of %d days", source, selection.MinAgeDays)
+		case len(selection.Skipped) == 1:
+			selection.Reason = fmt.Sprintf("newest of the %s older than the minimum age of %d days, 1 newer AMI is soaking", source, selection.MinAgeDays)
+		default:
+			selection.Reason = fmt.Sprintf("newest of the %s older than the minimum age of %d days, %d newer AMIs are soaking", source, selection.MinAgeDays, len(selection.Skipped))
+		}
+		return selection, nil
+	}
+	return selection, fmt.Errorf("none of the %s is older than the minimum age of %d days", source, selection.MinAgeDays)
+}
+
+// isNewerAMI returns true when the candidate AMI was created after the current AMI, or when the current AMI doesn't exist anymore
+func (a *Autoscaling) isNewerAMI(ctx context.Context, candidate, current string) (bool, error) {
+	result, err := a.svcEC2.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{candidate, current})})
+	if err != nil {
+		return false, err
+	}
+	created := make(map[string]time.Time)
+	for _, image := range result.Images {
+		t, err := time.Parse(amiCreationDateLayout, aws.StringValue(image.CreationDate))
+		if err != nil {
+			return false, err
+		}
+		created[aws.StringValue(image.ImageId)] = t
+	}
+	if _, ok := created[candidate]; !ok {
+		return false, fmt.Errorf("AMI %s not found", candidate)
+	}
+	if _, ok := created[current]; !ok {
+		return true, nil
+	}
+	return created[candidate].After(created[current]), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestGetAMIMinAge(t *testing.T) {
+	t.Setenv("AMI_MIN_AGE_DAYS", "7")
+	minAge, err := getAMIMinAge(Target{Cluster: "production"})
+	if err != nil || minAge != 7*24*time.Hour {
+		t.Errorf("expected 7 days, got %v (%v)", minAge, err)
+	}
+	// the target overrides AMI_MIN_AGE_DAYS
+	minAge, err = getAMIMinAge(Target{Cluster: "staging", AMIMinAgeDays: aws.Int(0)})
+	if err != nil || minAge != 0 {
+		t.Errorf("expected no minimum age, got %v (%v)", minAge, err)
+	}
+	t.Setenv("AMI_MIN_AGE_DAYS", "-1")
+	if _, err := getAMIMinAge(Target{Cluster: "production"}); err == nil {
+		t.Errorf("expected an error for a negative minimum age")
+	}
+}
+
+func TestSelectNewestAMI(t *testing.T) {
+	images := []*ec2.Image{
+		{ImageId: aws.String("ami-1"), CreationDate: aws.String("2024-05-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-3"), CreationDate: aws.String("2024-06-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-2"), CreationDate: aws.String("2024-05-20T00:00:00.000Z")},
+	}
+	tests := []struct {
+		days     int
+		expected AMISelection
+	}{
+		{0, AMISelection{ImageId: "ami-3", Source: "test AMIs", CreationDate: "2024-06-01T00:00:00.000Z", Reason: "newest of the test AMIs"}},
+		{7, AMISelection{ImageId: "ami-2", Source: "test AMIs", CreationDate: "2024-05-20T00:00:00.000Z", MinAgeDays: 7,
+			Skipped: []SkippedAMI{{ImageId: "ami-3", CreationDate: "2024-06-01T00:00:00.000Z"}},
+			Reason:  "newest of the test AMIs older than the minimum age of 7 days, 1 newer AMI is soaking"}},
+		{30, AMISelection{ImageId: "ami-1", Source: "test AMIs", CreationDate: "2024-05-01T00:00:00.000Z", MinAgeDays: 30,
+			Skipped: []SkippedAMI{{ImageId: "ami-3", CreationDate: "2024-06-01T00:00:00.000Z"}, {ImageId: "ami-2", CreationDate: "2024-05-20T00:00:00.000Z"}},
+			Reason:  "newest of the test AMIs older than the minimum age of 30 days, 2 newer AMIs are soaking"}},
+	}
+	for _, test := range tests {
+		a := Autoscaling{clock: newFakeClock(), amiMinAge: time.Duration(test.days) * 24 * time.Hour}
+		selection, err := a.selectNewestAMI("test AMIs", images)
+		if err != nil {
+			t.Fatalf("selectNewestAMI error: %v", err)
+		}
+		if !reflect.DeepEqual(selection, test.expected) {
+			t.Errorf("expected %+v, got %+v", test.expected, selection)
+		}
+	}
+	a := Autoscaling{clock: newFakeClock(), amiMinAge: 60 * 24 * time.Hour}
+	if _, err := a.selectNewestAMI("test AMIs", images); err == nil || !strings.Contains(err.Error(), "minimum age of 60 days") {
+		t.Errorf("expected an error when no AMI is old enough, got %v", err)
+	}
+}
+
+// TestSelectAMIFromParameterHistory picks the newest AMI of the parameter history that is old enough
+func TestSelectAMIFromParameterHistory(t *testing.T) {
+	f := newFakeAWS(1, 1, false)
+	name := "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended"
+	f.ssmParameters[name] = `{"image_id":"` + fakeNewAMI + `"}`
+	f.ssmParameterHistory[name] = []string{`{"image_id":"ami-deregistered"}`, `{"image_id":"` + fakeOldAMI + `"}`}
+	a := f.clients().Autoscaling
+	a.amiParameter = name
+	a.amiMinAge = 7 * 24 * time.Hour
+	selection, err := a.selectECSAMI(context.Background())
+	if err != nil {
+		t.Fatalf("selectECSAMI error: %v", err)
+	}
+	if selection.ImageId != fakeOldAMI || len(selection.Skipped) != 1 || selection.Skipped[0].ImageId != fakeNewAMI {
+		t.Errorf("unexpected selection %+v", selection)
+	}
+	a.amiMinAge = 0
+	if imageId, err := a.getECSAMI(context.Background()); err != nil || imageId != fakeNewAMI {
+		t.Errorf("expected the current AMI of the parameter, got %s (%v)", imageId, err)
+	}
+}
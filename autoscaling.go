@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"math"
+	"reflect"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,7 +15,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
-	"github.com/juju/loggo"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 
 	"errors"
 	"strings"
@@ -19,11 +24,19 @@ import (
 )
 
 // logging
-var autoscalingLogger = loggo.GetLogger("autoscaling")
+var autoscalingLogger = getLogger("autoscaling")
 
 type Autoscaling struct {
 	svcAutoscaling autoscalingiface.AutoScalingAPI
 	svcEC2         ec2iface.EC2API
+	svcSSM         ssmiface.SSMAPI
+	clock          Clock
+	// amiParameter is the SSM parameter with the AMI to upgrade to. When empty, the latest ECS optimized AMI is used
+	amiParameter string
+	// amiMinAge is the minimum age of the AMI to upgrade to, newer AMIs are skipped
+	amiMinAge time.Duration
+	// overrides are the launch parameters that change together with the AMI
+	overrides LaunchOverrides
 }
 
 type AutoscalingInstance struct {
@@ -38,59 +51,104 @@ type AutoscalingGroup struct {
 	AutoscalingGroupName    string
 	LaunchConfigurationName string
 	LaunchTemplateName      string
+	LaunchTemplateVersion   string
+	Subnets                 []string
 	DesiredCapacity         int64
 	MinSize                 int64
 	MaxSize                 int64
 }
 
-func NewAutoscaling() Autoscaling {
-	sess := session.New()
+func NewAutoscaling(sess *session.Session) Autoscaling {
 	return Autoscaling{
 		svcAutoscaling: autoscaling.New(sess),
 		svcEC2:         ec2.New(sess),
+		svcSSM:         ssm.New(sess),
+		clock:          realClock{},
 	}
 }
 
-func (a *Autoscaling) newLaunchTemplateVersion(launchTemplateName string) (string, string, string, error) {
-	lt, err := a.getLatestLaunchTemplate(launchTemplateName)
-	if err != nil {
-		return "", "", "", err
-	}
-	imageId, err := a.getECSAMI()
+func (a *Autoscaling) newLaunchTemplateVersion(ctx context.Context, launchTemplateName, imageId string) (string, string, string, error) {
+	lt, data, err := a.planLaunchTemplateVersion(ctx, launchTemplateName, imageId)
 	if err != nil {
 		return "", "", "", err
 	}
 	if strings.Compare(imageId, aws.StringValue(lt.LaunchTemplateData.ImageId)) == 0 {
-		autoscalingLogger.Infof("ECS Cluster already running latest AMI")
-		return "", "", "", nil
+		if reflect.DeepEqual(data, *lt.LaunchTemplateData) {
+			autoscalingLogger.Infof("ECS Cluster already running latest AMI")
+			return "", "", "", nil
+		}
+		autoscalingLogger.Infof("ECS Cluster already running latest AMI, replacing the instances to change the launch parameters")
 	}
+	lt.LaunchTemplateData = &data
 
-	return a.createLaunchTemplateVersion(launchTemplateName, lt, imageId)
+	return a.createLaunchTemplateVersion(ctx, launchTemplateName, lt, imageId)
 }
 
-func (a *Autoscaling) newLaunchConfigFromExisting(launchConfig string) (string, error) {
-	lc, err := a.getLaunchConfig(launchConfig)
+// planLaunchTemplateVersion returns the latest version of the launch template and the data of the new version,
+// with the AMI imageId and the launch overrides
+func (a *Autoscaling) planLaunchTemplateVersion(ctx context.Context, launchTemplateName, imageId string) (ec2.LaunchTemplateVersion, ec2.ResponseLaunchTemplateData, error) {
+	lt, err := a.getLatestLaunchTemplate(ctx, launchTemplateName)
 	if err != nil {
-		return "", err
+		return lt, ec2.ResponseLaunchTemplateData{}, err
+	}
+	if lt.LaunchTemplateData == nil {
+		return lt, ec2.ResponseLaunchTemplateData{}, fmt.Errorf("launch template %s not found", launchTemplateName)
 	}
-	imageId, err := a.getECSAMI()
+	rootDevice, err := a.rootDeviceName(ctx, imageId)
+	if err != nil {
+		return lt, ec2.ResponseLaunchTemplateData{}, err
+	}
+	data, err := a.overrides.applyToLaunchTemplateData(*lt.LaunchTemplateData, rootDevice)
+	if err != nil {
+		return lt, data, err
+	}
+	data.ImageId = aws.String(imageId)
+	return lt, data, nil
+}
+
+func (a *Autoscaling) newLaunchConfigFromExisting(ctx context.Context, launchConfig, imageId string) (string, error) {
+	lc, newLc, err := a.planLaunchConfig(ctx, launchConfig, imageId)
 	if err != nil {
 		return "", err
 	}
 	if strings.Compare(imageId, aws.StringValue(lc.ImageId)) == 0 {
-		autoscalingLogger.Infof("ECS Cluster already running latest AMI")
-		return "", nil
+		if reflect.DeepEqual(newLc, lc) {
+			autoscalingLogger.Infof("ECS Cluster already running latest AMI")
+			return "", nil
+		}
+		autoscalingLogger.Infof("ECS Cluster already running latest AMI, replacing the instances to change the launch parameters")
 	}
 
-	return a.createLaunchConfig(launchConfig, lc, imageId)
+	return a.createLaunchConfig(ctx, launchConfig, newLc, imageId)
+}
+
+// planLaunchConfig returns the launch configuration and the new launch configuration, with the AMI imageId and the launch overrides
+func (a *Autoscaling) planLaunchConfig(ctx context.Context, launchConfig, imageId string) (autoscaling.LaunchConfiguration, autoscaling.LaunchConfiguration, error) {
+	lc, err := a.getLaunchConfig(ctx, launchConfig)
+	if err != nil {
+		return lc, lc, err
+	}
+	if lc.LaunchConfigurationName == nil {
+		return lc, lc, fmt.Errorf("launch configuration %s not found", launchConfig)
+	}
+	rootDevice, err := a.rootDeviceName(ctx, imageId)
+	if err != nil {
+		return lc, lc, err
+	}
+	newLc, err := a.overrides.applyToLaunchConfig(lc, rootDevice)
+	if err != nil {
+		return lc, newLc, err
+	}
+	newLc.ImageId = aws.String(imageId)
+	return lc, newLc, nil
 }
 
-func (a *Autoscaling) createLaunchConfig(launchConfig string, lc autoscaling.LaunchConfiguration, imageId string) (string, error) {
+func (a *Autoscaling) createLaunchConfig(ctx context.Context, launchConfig string, lc autoscaling.LaunchConfiguration, imageId string) (string, error) {
 	var newLaunchConfigName string
 	if strings.Index(launchConfig, "-ecsupgrade") > 0 {
-		newLaunchConfigName = launchConfig[0:strings.Index(launchConfig, "-ecsupgrade")] + "-ecsupgrade" + time.Now().UTC().Format("20060102150405")
+		newLaunchConfigName = launchConfig[0:strings.Index(launchConfig, "-ecsupgrade")] + "-ecsupgrade" + a.clock.Now().UTC().Format("20060102150405")
 	} else {
-		newLaunchConfigName = launchConfig + "-ecsupgrade" + time.Now().UTC().Format("20060102150405")
+		newLaunchConfigName = launchConfig + "-ecsupgrade" + a.clock.Now().UTC().Format("20060102150405")
 	}
 
 	input := &autoscaling.CreateLaunchConfigurationInput{
@@ -105,6 +163,7 @@ func (a *Autoscaling) createLaunchConfig(launchConfig string, lc autoscaling.Lau
 		InstanceType:                 lc.InstanceType,
 		KeyName:                      lc.KeyName,
 		LaunchConfigurationName:      aws.String(newLaunchConfigName),
+		MetadataOptions:              lc.MetadataOptions,
 		PlacementTenancy:             lc.PlacementTenancy,
 		SecurityGroups:               lc.SecurityGroups,
 		SpotPrice:                    lc.SpotPrice,
@@ -117,124 +176,418 @@ func (a *Autoscaling) createLaunchConfig(launchConfig string, lc autoscaling.Lau
 		input.SetRamdiskId(aws.StringValue(lc.RamdiskId))
 	}
 	autoscalingLogger.Debugf("created LaunchConfiguration")
-	_, err := a.svcAutoscaling.CreateLaunchConfiguration(input)
+	_, err := a.svcAutoscaling.CreateLaunchConfigurationWithContext(ctx, input)
 	return newLaunchConfigName, err
 }
 
-func (a *Autoscaling) getLaunchConfig(launchConfig string) (autoscaling.LaunchConfiguration, error) {
+// launchTemplateNameFromLaunchConfig returns the name of the launch template that replaces a launch configuration,
+// the name of the launch configuration without the suffix added by earlier upgrades
+func launchTemplateNameFromLaunchConfig(launchConfig string) string {
+	if strings.Index(launchConfig, "-ecsupgrade") > 0 {
+		return launchConfig[0:strings.Index(launchConfig, "-ecsupgrade")]
+	}
+	return launchConfig
+}
+
+// launchTemplateDataFromLaunchConfig converts the settings of a launch configuration to launch template data with imageId.
+// The spot price becomes spot market options, and the security groups move to the network interface when the
+// launch configuration sets a public IP address
+func launchTemplateDataFromLaunchConfig(lc autoscaling.LaunchConfiguration, imageId string) (*ec2.RequestLaunchTemplateData, error) {
+	if aws.StringValue(lc.ClassicLinkVPCId) != "" {
+		return nil, fmt.Errorf("launch configuration %s uses ClassicLink, which launch templates don't support", aws.StringValue(lc.LaunchConfigurationName))
+	}
+	data := &ec2.RequestLaunchTemplateData{
+		EbsOptimized: lc.EbsOptimized,
+		ImageId:      aws.String(imageId),
+		InstanceType: lc.InstanceType,
+	}
+	for _, bdm := range lc.BlockDeviceMappings {
+		mapping := &ec2.LaunchTemplateBlockDeviceMappingRequest{
+			DeviceName:  bdm.DeviceName,
+			VirtualName: bdm.VirtualName,
+		}
+		if aws.BoolValue(bdm.NoDevice) {
+			mapping.NoDevice = aws.String("")
+		}
+		if bdm.Ebs != nil {
+			mapping.Ebs = &ec2.LaunchTemplateEbsBlockDeviceRequest{
+				DeleteOnTermination: bdm.Ebs.DeleteOnTermination,
+				Encrypted:           bdm.Ebs.Encrypted,
+				Iops:                bdm.Ebs.Iops,
+				SnapshotId:          bdm.Ebs.SnapshotId,
+				Throughput:          bdm.Ebs.Throughput,
+				VolumeSize:          bdm.Ebs.VolumeSize,
+				VolumeType:          bdm.Ebs.VolumeType,
+			}
+		}
+		data.BlockDeviceMappings = append(data.BlockDeviceMappings, mapping)
+	}
+	// the instance profile of a launch configuration is a name or an arn
+	if profile := aws.StringValue(lc.IamInstanceProfile); strings.HasPrefix(profile, "arn:") {
+		data.IamInstanceProfile = &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{Arn: aws.String(profile)}
+	} else if profile != "" {
+		data.IamInstanceProfile = &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{Name: aws.String(profile)}
+	}
+	if lc.AssociatePublicIpAddress != nil {
+		data.NetworkInterfaces = []*ec2.LaunchTemplateInstanceNetworkInterfaceSpecificationRequest{
+			{
+				AssociatePublicIpAddress: lc.AssociatePublicIpAddress,
+				DeleteOnTermination:      aws.Bool(true),
+				DeviceIndex:              aws.Int64(0),
+				Groups:                   lc.SecurityGroups,
+			},
+		}
+	} else {
+		for _, sg := range lc.SecurityGroups {
+			// launch configurations in a default VPC can refer to security groups by name
+			if strings.HasPrefix(aws.StringValue(sg), "sg-") {
+				data.SecurityGroupIds = append(data.SecurityGroupIds, sg)
+			} else {
+				data.SecurityGroups = append(data.SecurityGroups, sg)
+			}
+		}
+	}
+	if aws.StringValue(lc.SpotPrice) != "" {
+		data.InstanceMarketOptions = &ec2.LaunchTemplateInstanceMarketOptionsRequest{
+			MarketType: aws.String(ec2.MarketTypeSpot),
+			SpotOptions: &ec2.LaunchTemplateSpotMarketOptionsRequest{
+				MaxPrice: lc.SpotPrice,
+			},
+		}
+	}
+	if lc.InstanceMonitoring != nil {
+		data.Monitoring = &ec2.LaunchTemplatesMonitoringRequest{Enabled: lc.InstanceMonitoring.Enabled}
+	}
+	if lc.MetadataOptions != nil {
+		data.MetadataOptions = &ec2.LaunchTemplateInstanceMetadataOptionsRequest{
+			HttpEndpoint:            lc.MetadataOptions.HttpEndpoint,
+			HttpPutResponseHopLimit: lc.MetadataOptions.HttpPutResponseHopLimit,
+			HttpTokens:              lc.MetadataOptions.HttpTokens,
+		}
+	}
+	if aws.StringValue(lc.PlacementTenancy) != "" {
+		data.Placement = &ec2.LaunchTemplatePlacementRequest{Tenancy: lc.PlacementTenancy}
+	}
+	if aws.StringValue(lc.KeyName) != "" {
+		data.KeyName = lc.KeyName
+	}
+	if aws.StringValue(lc.KernelId) != "" {
+		data.KernelId = lc.KernelId
+	}
+	if aws.StringValue(lc.RamdiskId) != "" {
+		data.RamDiskId = lc.RamdiskId
+	}
+	// the user data of a launch configuration is returned base64 encoded, as launch templates expect it
+	if aws.StringValue(lc.UserData) != "" {
+		data.UserData = lc.UserData
+	}
+	return data, nil
+}
+
+// createLaunchTemplateFromLaunchConfig creates a launch template with the settings of the launch configuration and imageId.
+// When the launch template exists already, e.g. after a migration that was rolled back, a new version is created.
+// The name and version of the launch template are returned
+func (a *Autoscaling) createLaunchTemplateFromLaunchConfig(ctx context.Context, launchTemplateName string, lc autoscaling.LaunchConfiguration, imageId string) (string, string, error) {
+	data, err := launchTemplateDataFromLaunchConfig(lc, imageId)
+	if err != nil {
+		return "", "", err
+	}
+	autoscalingLogger.Debugf("creating LaunchTemplate %s from LaunchConfiguration %s", launchTemplateName, aws.StringValue(lc.LaunchConfigurationName))
+	result, err := a.svcEC2.CreateLaunchTemplateWithContext(ctx, &ec2.CreateLaunchTemplateInput{
+		LaunchTemplateName: aws.String(launchTemplateName),
+		LaunchTemplateData: data,
+		VersionDescription: aws.String("migrated from " + aws.StringValue(lc.LaunchConfigurationName)),
+	})
+	if err == nil {
+		return launchTemplateName, strconv.FormatInt(aws.Int64Value(result.LaunchTemplate.LatestVersionNumber), 10), nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "InvalidLaunchTemplateName.AlreadyExistsException" {
+		autoscalingLogger.Errorf("%v", err.Error())
+		return "", "", err
+	}
+	autoscalingLogger.Infof("Launch template %s exists already, creating a new version", launchTemplateName)
+	version, err := a.svcEC2.CreateLaunchTemplateVersionWithContext(ctx, &ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateName: aws.String(launchTemplateName),
+		LaunchTemplateData: data,
+		VersionDescription: aws.String("migrated from " + aws.StringValue(lc.LaunchConfigurationName)),
+	})
+	if err != nil {
+		autoscalingLogger.Errorf("%v", err.Error())
+		return "", "", err
+	}
+	return launchTemplateName, strconv.FormatInt(aws.Int64Value(version.LaunchTemplateVersion.VersionNumber), 10), nil
+}
+
+func (a *Autoscaling) getLaunchConfig(ctx context.Context, launchConfig string) (autoscaling.LaunchConfiguration, error) {
 	input := &autoscaling.DescribeLaunchConfigurationsInput{
 		LaunchConfigurationNames: aws.StringSlice([]string{launchConfig}),
 	}
 
 	var result autoscaling.LaunchConfiguration
 
-	pageNum := 0
-	err := a.svcAutoscaling.DescribeLaunchConfigurationsPages(input,
+	err := a.svcAutoscaling.DescribeLaunchConfigurationsPagesWithContext(ctx, input,
 		func(page *autoscaling.DescribeLaunchConfigurationsOutput, lastPage bool) bool {
-			pageNum++
 			for _, lc := range page.LaunchConfigurations {
 				autoscalingLogger.Debugf("Found launch configuration: %s", aws.StringValue(lc.LaunchConfigurationName))
 				result = *lc
 			}
-			return pageNum <= 5
+			return true
 		})
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
-			autoscalingLogger.Errorf(aerr.Error())
+			autoscalingLogger.Errorf("%v", aerr.Error())
 		} else {
-			autoscalingLogger.Errorf(err.Error())
+			autoscalingLogger.Errorf("%v", err.Error())
 		}
 	}
 	return result, err
 }
-func (a *Autoscaling) createLaunchTemplateVersion(launchTemplateName string, lt ec2.LaunchTemplateVersion, imageId string) (string, string, string, error) {
+func (a *Autoscaling) createLaunchTemplateVersion(ctx context.Context, launchTemplateName string, lt ec2.LaunchTemplateVersion, imageId string) (string, string, string, error) {
 	input := &ec2.CreateLaunchTemplateVersionInput{
 		LaunchTemplateName: aws.String(launchTemplateName),
-		LaunchTemplateData: &ec2.RequestLaunchTemplateData{
-			ImageId: aws.String(imageId),
-		},
-		SourceVersion: aws.String(strconv.FormatInt(aws.Int64Value(lt.VersionNumber), 10)),
+		LaunchTemplateData: a.overrides.launchTemplateRequestData(*lt.LaunchTemplateData, imageId),
+		SourceVersion:      aws.String(strconv.FormatInt(aws.Int64Value(lt.VersionNumber), 10)),
 	}
 
 	autoscalingLogger.Debugf("creating new LaunchTemplateVersion")
 
-	result, err := a.svcEC2.CreateLaunchTemplateVersion(input)
-	return aws.StringValue(result.LaunchTemplateVersion.LaunchTemplateId), aws.StringValue(result.LaunchTemplateVersion.LaunchTemplateName), strconv.FormatInt(aws.Int64Value(result.LaunchTemplateVersion.VersionNumber), 10), err
+	result, err := a.svcEC2.CreateLaunchTemplateVersionWithContext(ctx, input)
+	if err != nil {
+		autoscalingLogger.Errorf("%v", err.Error())
+		return "", "", "", err
+	}
+	return aws.StringValue(result.LaunchTemplateVersion.LaunchTemplateId), aws.StringValue(result.LaunchTemplateVersion.LaunchTemplateName), strconv.FormatInt(aws.Int64Value(result.LaunchTemplateVersion.VersionNumber), 10), nil
+}
+
+func (a *Autoscaling) getLatestLaunchTemplate(ctx context.Context, launchTemplateName string) (ec2.LaunchTemplateVersion, error) {
+	return a.getLaunchTemplateVersion(ctx, launchTemplateName, "$Latest")
 }
 
-func (a *Autoscaling) getLatestLaunchTemplate(launchTemplateName string) (ec2.LaunchTemplateVersion, error) {
+func (a *Autoscaling) getLaunchTemplateVersion(ctx context.Context, launchTemplateName, version string) (ec2.LaunchTemplateVersion, error) {
 	input := &ec2.DescribeLaunchTemplateVersionsInput{
 		LaunchTemplateName: aws.String(launchTemplateName),
-		Versions:           aws.StringSlice([]string{"$Latest"}),
+		Versions:           aws.StringSlice([]string{version}),
 	}
 
 	var result ec2.LaunchTemplateVersion
 
-	pageNum := 0
-	err := a.svcEC2.DescribeLaunchTemplateVersionsPages(input,
+	err := a.svcEC2.DescribeLaunchTemplateVersionsPagesWithContext(ctx, input,
 		func(page *ec2.DescribeLaunchTemplateVersionsOutput, lastPage bool) bool {
-			pageNum++
 			for _, lt := range page.LaunchTemplateVersions {
 				autoscalingLogger.Debugf("Found launch configuration: %s", aws.StringValue(lt.LaunchTemplateName))
 				result = *lt
 			}
-			return pageNum <= 5
+			return true
 		})
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
-			autoscalingLogger.Errorf(aerr.Error())
+			autoscalingLogger.Errorf("%v", aerr.Error())
 		} else {
-			autoscalingLogger.Errorf(err.Error())
+			autoscalingLogger.Errorf("%v", err.Error())
 		}
 	}
 	return result, err
 }
 
-func (a *Autoscaling) getECSAMI() (string, error) {
-	var amiId string
+// getLaunchImage returns the AMI of a launch configuration, or of a launch template version when launchIdentifier is name:version
+func (a *Autoscaling) getLaunchImage(ctx context.Context, useLaunchTemplates, launchIdentifier string) (string, error) {
+	if useLaunchTemplates == "true" {
+		name, version := launchIdentifier, "$Latest"
+		if i := strings.LastIndex(launchIdentifier, ":"); i > 0 {
+			name, version = launchIdentifier[:i], launchIdentifier[i+1:]
+		}
+		lt, err := a.getLaunchTemplateVersion(ctx, name, version)
+		if err != nil || lt.LaunchTemplateData == nil {
+			return "", err
+		}
+		return aws.StringValue(lt.LaunchTemplateData.ImageId), nil
+	}
+	lc, err := a.getLaunchConfig(ctx, launchIdentifier)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(lc.ImageId), nil
+}
+
+// getImage returns the AMI with imageId
+func (a *Autoscaling) getImage(ctx context.Context, imageId string) (*ec2.Image, error) {
+	result, err := a.svcEC2.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{imageId})})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			autoscalingLogger.Errorf("%v", aerr.Error())
+		} else {
+			autoscalingLogger.Errorf("%v", err.Error())
+		}
+		return nil, err
+	}
+	if len(result.Images) == 0 {
+		return nil, fmt.Errorf("AMI %s not found", imageId)
+	}
+	return result.Images[0], nil
+}
+
+func (a *Autoscaling) getECSAMI(ctx context.Context) (string, error) {
+	selection, err := a.selectECSAMI(ctx)
+	return selection.ImageId, err
+}
+
+// selectECSAMI returns the AMI to upgrade to: the newest AMI in the SSM parameter or the newest ECS optimized AMI
+// for the architecture of the instance type that is at least amiMinAge old
+func (a *Autoscaling) selectECSAMI(ctx context.Context) (AMISelection, error) {
+	if a.amiParameter != "" {
+		return a.selectAMIFromParameter(ctx, a.amiParameter)
+	}
+	architecture, err := a.getAMIArchitecture(ctx)
+	if err != nil {
+		return AMISelection{}, err
+	}
 	input := &ec2.DescribeImagesInput{
 		Owners: []*string{aws.String("591542846629")}, // AWS
 		Filters: []*ec2.Filter{
 			{Name: aws.String("name"), Values: []*string{aws.String("amzn2-ami-ecs-*")}},
 			{Name: aws.String("virtualization-type"), Values: []*string{aws.String("hvm")}},
-			{Name: aws.String("architecture"), Values: []*string{aws.String("x86_64")}},
+			{Name: aws.String("architecture"), Values: []*string{aws.String(architecture)}},
 		},
 	}
-	result, err := a.svcEC2.DescribeImages(input)
+	result, err := a.svcEC2.DescribeImagesWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			autoscalingLogger.Errorf("%v", aerr.Error())
 		} else {
 			autoscalingLogger.Errorf("%v", err.Error())
 		}
-		return amiId, err
+		return AMISelection{}, err
 	}
 	if len(result.Images) == 0 {
-		return amiId, errors.New("No ECS AMI found")
+		return AMISelection{}, fmt.Errorf("No ECS AMI found for architecture %s", architecture)
+	}
+	source := "ECS optimized AMIs"
+	if architecture != "x86_64" {
+		source = "ECS optimized " + architecture + " AMIs"
+	}
+	return a.selectNewestAMI(source, result.Images)
+}
+
+// getAMIArchitecture returns the architecture of the ECS optimized AMI: the architecture of the instance type
+// in INSTANCE_TYPE, x86_64 when it supports x86_64 or the instance type isn't changed
+func (a *Autoscaling) getAMIArchitecture(ctx context.Context) (string, error) {
+	if a.overrides.InstanceType == "" {
+		return "x86_64", nil
+	}
+	result, err := a.svcEC2.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{InstanceTypes: aws.StringSlice([]string{a.overrides.InstanceType})})
+	if err != nil {
+		return "", fmt.Errorf("instance type %s: %v", a.overrides.InstanceType, err)
+	}
+	if len(result.InstanceTypes) == 0 || result.InstanceTypes[0].ProcessorInfo == nil {
+		return "", fmt.Errorf("instance type %s not found", a.overrides.InstanceType)
 	}
-	layout := "2006-01-02T15:04:05.000Z"
-	var lastTime time.Time
-	for _, v := range result.Images {
-		t, err := time.Parse(layout, *v.CreationDate)
+	architectures := aws.StringValueSlice(result.InstanceTypes[0].ProcessorInfo.SupportedArchitectures)
+	for _, architecture := range []string{"x86_64", "arm64"} {
+		if stringInSlice(architecture, architectures) {
+			return architecture, nil
+		}
+	}
+	return "", fmt.Errorf("instance type %s doesn't support the architecture of an ECS optimized AMI (%s)", a.overrides.InstanceType, strings.Join(architectures, ", "))
+}
+
+// selectAMIFromParameter returns the AMI in the SSM parameter. With a minimum age, the newest AMI in the history of the
+// parameter that is old enough is returned
+func (a *Autoscaling) selectAMIFromParameter(ctx context.Context, name string) (AMISelection, error) {
+	if a.amiMinAge <= 0 {
+		imageId, err := a.getAMIFromParameter(ctx, name)
 		if err != nil {
-			return amiId, err
+			return AMISelection{}, err
+		}
+		return AMISelection{ImageId: imageId, Source: "SSM parameter " + name, Reason: "current AMI of SSM parameter " + name}, nil
+	}
+	var imageIds []string
+	var parseErr error
+	err := a.svcSSM.GetParameterHistoryPagesWithContext(ctx, &ssm.GetParameterHistoryInput{Name: aws.String(name)},
+		func(page *ssm.GetParameterHistoryOutput, lastPage bool) bool {
+			for _, parameter := range page.Parameters {
+				imageId, err := parseAMIParameter(name, aws.StringValue(parameter.Value))
+				if err != nil {
+					parseErr = err
+					return false
+				}
+				if !stringInSlice(imageId, imageIds) {
+					imageIds = append(imageIds, imageId)
+				}
+			}
+			return true
+		})
+	if err == nil {
+		err = parseErr
+	}
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			autoscalingLogger.Errorf("%v", aerr.Error())
+		} else {
+			autoscalingLogger.Errorf("%v", err.Error())
+		}
+		return AMISelection{}, err
+	}
+	if len(imageIds) == 0 {
+		return AMISelection{}, errors.New("No AMI found in SSM parameter " + name)
+	}
+	// deregistered AMIs are not returned
+	result, err := a.svcEC2.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: aws.StringSlice(imageIds)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			autoscalingLogger.Errorf("%v", aerr.Error())
+		} else {
+			autoscalingLogger.Errorf("%v", err.Error())
 		}
-		if t.After(lastTime) {
-			lastTime = t
-			amiId = *v.ImageId
+		return AMISelection{}, err
+	}
+	return a.selectNewestAMI("AMIs in the history of SSM parameter "+name, result.Images)
+}
+
+// getAMIFromParameter returns the AMI in an SSM parameter
+func (a *Autoscaling) getAMIFromParameter(ctx context.Context, name string) (string, error) {
+	input := &ssm.GetParameterInput{
+		Name: aws.String(name),
+	}
+	result, err := a.svcSSM.GetParameterWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			autoscalingLogger.Errorf("%v", aerr.Error())
+		} else {
+			autoscalingLogger.Errorf("%v", err.Error())
+		}
+		return "", err
+	}
+	return parseAMIParameter(name, aws.StringValue(result.Parameter.Value))
+}
+
+// parseAMIParameter returns the AMI in the value of an SSM parameter. The value is an image id, or a JSON object with an image_id,
+// like /aws/service/ecs/optimized-ami/amazon-linux-2/recommended
+func parseAMIParameter(name, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "{") {
+		var recommended struct {
+			ImageId string `json:"image_id"`
+		}
+		err := json.Unmarshal([]byte(value), &recommended)
+		if err != nil {
+			return "", err
 		}
+		value = recommended.ImageId
 	}
-	return amiId, nil
+	if value == "" {
+		return "", errors.New("No AMI found in SSM parameter " + name)
+	}
+	return value, nil
 }
 
-func (a *Autoscaling) scaleAutoscalingGroup(autoScalingGroupName string, desired int64) error {
+func (a *Autoscaling) scaleAutoscalingGroup(ctx context.Context, autoScalingGroupName string, desired int64) error {
 	input := &autoscaling.UpdateAutoScalingGroupInput{
 		AutoScalingGroupName: aws.String(autoScalingGroupName),
 		DesiredCapacity:      aws.Int64(desired),
 	}
-	_, err := a.svcAutoscaling.UpdateAutoScalingGroup(input)
+	_, err := a.svcAutoscaling.UpdateAutoScalingGroupWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			autoscalingLogger.Errorf("%v", aerr.Error())
@@ -246,12 +599,12 @@ func (a *Autoscaling) scaleAutoscalingGroup(autoScalingGroupName string, desired
 	return nil
 }
 
-func (a *Autoscaling) updateAutoscalingLaunchConfig(autoscalingGroupName, launchConfig string) error {
+func (a *Autoscaling) updateAutoscalingLaunchConfig(ctx context.Context, autoscalingGroupName, launchConfig string) error {
 	input := &autoscaling.UpdateAutoScalingGroupInput{
 		AutoScalingGroupName:    aws.String(autoscalingGroupName),
 		LaunchConfigurationName: aws.String(launchConfig),
 	}
-	_, err := a.svcAutoscaling.UpdateAutoScalingGroup(input)
+	_, err := a.svcAutoscaling.UpdateAutoScalingGroupWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			autoscalingLogger.Errorf("%v", aerr.Error())
@@ -263,7 +616,7 @@ func (a *Autoscaling) updateAutoscalingLaunchConfig(autoscalingGroupName, launch
 	return nil
 }
 
-func (a *Autoscaling) updateAutoscalingLaunchTemplate(autoscalingGroupName, launchTemplateName string, launchTemplateVersion string) error {
+func (a *Autoscaling) updateAutoscalingLaunchTemplate(ctx context.Context, autoscalingGroupName, launchTemplateName string, launchTemplateVersion string) error {
 	input := &autoscaling.UpdateAutoScalingGroupInput{
 		AutoScalingGroupName: aws.String(autoscalingGroupName),
 		LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
@@ -271,7 +624,7 @@ func (a *Autoscaling) updateAutoscalingLaunchTemplate(autoscalingGroupName, laun
 			Version:            aws.String(launchTemplateVersion),
 		},
 	}
-	_, err := a.svcAutoscaling.UpdateAutoScalingGroup(input)
+	_, err := a.svcAutoscaling.UpdateAutoScalingGroupWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			autoscalingLogger.Errorf("%v", aerr.Error())
@@ -283,11 +636,11 @@ func (a *Autoscaling) updateAutoscalingLaunchTemplate(autoscalingGroupName, laun
 	return nil
 }
 
-func (a *Autoscaling) describeAutoscalingGroup(autoScalingGroupName string) (AutoscalingGroup, error) {
+func (a *Autoscaling) describeAutoscalingGroup(ctx context.Context, autoScalingGroupName string) (AutoscalingGroup, error) {
 	input := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []*string{aws.String(autoScalingGroupName)},
 	}
-	result, err := a.svcAutoscaling.DescribeAutoScalingGroups(input)
+	result, err := a.svcAutoscaling.DescribeAutoScalingGroupsWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			autoscalingLogger.Errorf("%v", aerr.Error())
@@ -306,19 +659,25 @@ func (a *Autoscaling) describeAutoscalingGroup(autoScalingGroupName string) (Aut
 		DesiredCapacity:         aws.Int64Value(result.AutoScalingGroups[0].DesiredCapacity),
 		MaxSize:                 aws.Int64Value(result.AutoScalingGroups[0].MaxSize),
 		LaunchConfigurationName: aws.StringValue(result.AutoScalingGroups[0].LaunchConfigurationName),
-		LaunchTemplateName:      aws.StringValue(result.AutoScalingGroups[0].LaunchTemplate.LaunchTemplateName),
+	}
+	if result.AutoScalingGroups[0].LaunchTemplate != nil {
+		asg.LaunchTemplateName = aws.StringValue(result.AutoScalingGroups[0].LaunchTemplate.LaunchTemplateName)
+		asg.LaunchTemplateVersion = aws.StringValue(result.AutoScalingGroups[0].LaunchTemplate.Version)
+	}
+	if zoneIdentifier := aws.StringValue(result.AutoScalingGroups[0].VPCZoneIdentifier); zoneIdentifier != "" {
+		asg.Subnets = strings.Split(zoneIdentifier, ",")
 	}
 
 	return asg, nil
 }
 
-func (a *Autoscaling) getAutoscalingInstanceHealth(autoScalingGroupName string) ([]AutoscalingInstance, error) {
+func (a *Autoscaling) getAutoscalingInstanceHealth(ctx context.Context, autoScalingGroupName string) ([]AutoscalingInstance, error) {
 	var instances []AutoscalingInstance
 
 	input := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []*string{aws.String(autoScalingGroupName)},
 	}
-	result, err := a.svcAutoscaling.DescribeAutoScalingGroups(input)
+	result, err := a.svcAutoscaling.DescribeAutoScalingGroupsWithContext(ctx, input)
 	if err != nil {
 		autoscalingLogger.Errorf("%v", err.Error())
 		return instances, err
@@ -341,61 +700,73 @@ func (a *Autoscaling) getAutoscalingInstanceHealth(autoScalingGroupName string)
 			InstanceIds: instanceIdsSlice[i:toIndex],
 		}
 
-		pageNum := 0
-		err = a.svcAutoscaling.DescribeAutoScalingInstancesPages(input2,
+		err = a.svcAutoscaling.DescribeAutoScalingInstancesPagesWithContext(ctx, input2,
 			func(page *autoscaling.DescribeAutoScalingInstancesOutput, lastPage bool) bool {
-				pageNum++
 				for _, instance := range page.AutoScalingInstances {
-					instances = append(instances, AutoscalingInstance{
-						InstanceId:            aws.StringValue(instance.InstanceId),
-						LaunchConfig:          aws.StringValue(instance.LaunchConfigurationName),
-						LaunchTemplateName:    aws.StringValue(instance.LaunchTemplate.LaunchTemplateName),
-						LaunchTemplateVersion: aws.StringValue(instance.LaunchTemplate.Version),
-						HealthStatus:          aws.StringValue(instance.HealthStatus),
-					})
+					autoscalingInstance := AutoscalingInstance{
+						InstanceId:   aws.StringValue(instance.InstanceId),
+						LaunchConfig: aws.StringValue(instance.LaunchConfigurationName),
+						HealthStatus: aws.StringValue(instance.HealthStatus),
+					}
+					if instance.LaunchTemplate != nil {
+						autoscalingInstance.LaunchTemplateName = aws.StringValue(instance.LaunchTemplate.LaunchTemplateName)
+						autoscalingInstance.LaunchTemplateVersion = aws.StringValue(instance.LaunchTemplate.Version)
+					}
+					instances = append(instances, autoscalingInstance)
 				}
-				return pageNum <= 10
+				return true
 			})
 
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); ok {
-				autoscalingLogger.Errorf(aerr.Error())
+				autoscalingLogger.Errorf("%v", aerr.Error())
 			} else {
-				autoscalingLogger.Errorf(err.Error())
+				autoscalingLogger.Errorf("%v", err.Error())
 			}
-		}
-
-		if len(instanceIdsSlice) > batchSize {
-			autoscalingLogger.Infof("Sleeping 10s to avoid ratelimiting (instance size: %d)", len(instanceIdsSlice))
-			time.Sleep(10 * time.Second)
+			return instances, err
 		}
 	}
 
 	// get IPs
-	instancesIPs, err := a.getInstancesIPs(instanceIds)
+	instancesIPs, err := a.getInstancesIPs(ctx, instanceIds)
 	if err != nil {
 		autoscalingLogger.Errorf("Could not determine instance IPs")
 	}
-	for instanceID, IPs := range instancesIPs {
-		for k, instance := range instances {
-			if instance.InstanceId == instanceID {
-				instances[k].IPs = IPs
-			}
+	for k := range instances {
+		if IPs, ok := instancesIPs[instances[k].InstanceId]; ok {
+			instances[k].IPs = IPs
 		}
 	}
 
 	return instances, nil
 }
 
-func (a *Autoscaling) deleteLaunchConfig(launchConfigName string) error {
+func (a *Autoscaling) terminateInstance(ctx context.Context, instanceId string, decrementDesiredCapacity bool) error {
+	input := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(instanceId),
+		ShouldDecrementDesiredCapacity: aws.Bool(decrementDesiredCapacity),
+	}
+	_, err := a.svcAutoscaling.TerminateInstanceInAutoScalingGroupWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			autoscalingLogger.Errorf("%v", aerr.Error())
+		} else {
+			autoscalingLogger.Errorf("%v", err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *Autoscaling) deleteLaunchConfig(ctx context.Context, launchConfigName string) error {
 	input := &autoscaling.DeleteLaunchConfigurationInput{
 		LaunchConfigurationName: aws.String(launchConfigName),
 	}
-	_, err := a.svcAutoscaling.DeleteLaunchConfiguration(input)
+	_, err := a.svcAutoscaling.DeleteLaunchConfigurationWithContext(ctx, input)
 	return err
 }
 
-func (a *Autoscaling) getInstancesIPs(instanceIds []string) (map[string][]string, error) {
+func (a *Autoscaling) getInstancesIPs(ctx context.Context, instanceIds []string) (map[string][]string, error) {
 	instances := make(map[string][]string)
 
 	// describe instances
@@ -403,10 +774,8 @@ func (a *Autoscaling) getInstancesIPs(instanceIds []string) (map[string][]string
 		InstanceIds: aws.StringSlice(instanceIds),
 	}
 
-	pageNum := 0
-	err := a.svcEC2.DescribeInstancesPages(input,
+	err := a.svcEC2.DescribeInstancesPagesWithContext(ctx, input,
 		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
-			pageNum++
 			for _, reservation := range page.Reservations {
 				for _, instance := range reservation.Instances {
 					var IPs []string
@@ -416,14 +785,14 @@ func (a *Autoscaling) getInstancesIPs(instanceIds []string) (map[string][]string
 					instances[aws.StringValue(instance.InstanceId)] = IPs
 				}
 			}
-			return pageNum <= 10
+			return true
 		})
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
-			autoscalingLogger.Errorf(aerr.Error())
+			autoscalingLogger.Errorf("%v", aerr.Error())
 		} else {
-			autoscalingLogger.Errorf(err.Error())
+			autoscalingLogger.Errorf("%v", err.Error())
 		}
 	}
 	return instances, nil
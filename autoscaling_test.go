@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -23,11 +25,11 @@ type ec2Mock struct {
 	DescribeInstancesOutput *ec2.DescribeInstancesOutput
 }
 
-func (a autoscalingMock) DescribeAutoScalingGroups(*autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+func (a autoscalingMock) DescribeAutoScalingGroupsWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	return a.DescribeAutoScalingGroupsOutput, nil
 }
 
-func (a autoscalingMock) DescribeAutoScalingInstancesPages(instances *autoscaling.DescribeAutoScalingInstancesInput, f func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool) error {
+func (a autoscalingMock) DescribeAutoScalingInstancesPagesWithContext(ctx aws.Context, instances *autoscaling.DescribeAutoScalingInstancesInput, f func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool, opts ...request.Option) error {
 	if len(instances.InstanceIds) > 50 {
 		return fmt.Errorf("ValidationError: The number of instance ids that may be passed in is limited to 50")
 	}
@@ -44,7 +46,7 @@ func (a autoscalingMock) DescribeAutoScalingInstancesPages(instances *autoscalin
 	}, false)
 	return nil
 }
-func (e ec2Mock) DescribeInstancesPages(input *ec2.DescribeInstancesInput, f func(page *ec2.DescribeInstancesOutput, lastPage bool) bool) error {
+func (e ec2Mock) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, f func(page *ec2.DescribeInstancesOutput, lastPage bool) bool, opts ...request.Option) error {
 	f(e.DescribeInstancesOutput, false)
 	return nil
 }
@@ -101,7 +103,7 @@ func TestGetAutoscalingInstanceHealth(t *testing.T) {
 			svcAutoscaling: autoscalingMock,
 			svcEC2:         ec2Mock,
 		}
-		res, err := a.getAutoscalingInstanceHealth("asg-test")
+		res, err := a.getAutoscalingInstanceHealth(context.Background(), "asg-test")
 		if err != nil {
 			t.Errorf("getAutoscalingInstanceHealth error: %s", err)
 			return
@@ -114,3 +116,80 @@ func TestGetAutoscalingInstanceHealth(t *testing.T) {
 		}
 	}
 }
+
+func TestLaunchTemplateDataFromLaunchConfig(t *testing.T) {
+	lc := autoscaling.LaunchConfiguration{
+		LaunchConfigurationName: aws.String("ecs-ecsupgrade20240101000000"),
+		ImageId:                 aws.String("ami-old"),
+		InstanceType:            aws.String("m5.large"),
+		IamInstanceProfile:      aws.String("arn:aws:iam::123456789012:instance-profile/ecs"),
+		SecurityGroups:          aws.StringSlice([]string{"sg-1", "sg-2"}),
+		SpotPrice:               aws.String("0.05"),
+		InstanceMonitoring:      &autoscaling.InstanceMonitoring{Enabled: aws.Bool(true)},
+		UserData:                aws.String("IyEvYmluL2Jhc2gK"),
+		KeyName:                 aws.String(""),
+		BlockDeviceMappings: []*autoscaling.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &autoscaling.Ebs{VolumeSize: aws.Int64(30), VolumeType: aws.String("gp3"), Encrypted: aws.Bool(true)}},
+			{DeviceName: aws.String("/dev/xvdb"), NoDevice: aws.Bool(true)},
+		},
+	}
+	data, err := launchTemplateDataFromLaunchConfig(lc, "ami-new")
+	if err != nil {
+		t.Fatalf("launchTemplateDataFromLaunchConfig error: %v", err)
+	}
+	if aws.StringValue(data.ImageId) != "ami-new" || aws.StringValue(data.InstanceType) != "m5.large" || aws.StringValue(data.UserData) != "IyEvYmluL2Jhc2gK" || data.KeyName != nil {
+		t.Errorf("unexpected launch template data %+v", data)
+	}
+	if aws.StringValue(data.IamInstanceProfile.Arn) != aws.StringValue(lc.IamInstanceProfile) || data.IamInstanceProfile.Name != nil {
+		t.Errorf("unexpected instance profile %+v", data.IamInstanceProfile)
+	}
+	if len(data.SecurityGroupIds) != 2 || data.NetworkInterfaces != nil {
+		t.Errorf("unexpected security groups %v", data.SecurityGroupIds)
+	}
+	if aws.StringValue(data.InstanceMarketOptions.MarketType) != "spot" || aws.StringValue(data.InstanceMarketOptions.SpotOptions.MaxPrice) != "0.05" {
+		t.Errorf("unexpected market options %+v", data.InstanceMarketOptions)
+	}
+	if !aws.BoolValue(data.Monitoring.Enabled) {
+		t.Errorf("monitoring not enabled")
+	}
+	if len(data.BlockDeviceMappings) != 2 || aws.Int64Value(data.BlockDeviceMappings[0].Ebs.VolumeSize) != 30 || aws.StringValue(data.BlockDeviceMappings[0].Ebs.VolumeType) != "gp3" ||
+		data.BlockDeviceMappings[1].NoDevice == nil || data.BlockDeviceMappings[1].Ebs != nil {
+		t.Errorf("unexpected block device mappings %v", data.BlockDeviceMappings)
+	}
+	// with a public IP address, the security groups are set on the network interface
+	lc.AssociatePublicIpAddress = aws.Bool(true)
+	lc.IamInstanceProfile = aws.String("ecs")
+	data, err = launchTemplateDataFromLaunchConfig(lc, "ami-new")
+	if err != nil {
+		t.Fatalf("launchTemplateDataFromLaunchConfig error: %v", err)
+	}
+	if len(data.NetworkInterfaces) != 1 || !aws.BoolValue(data.NetworkInterfaces[0].AssociatePublicIpAddress) || len(data.NetworkInterfaces[0].Groups) != 2 || data.SecurityGroupIds != nil {
+		t.Errorf("unexpected network interfaces %v", data.NetworkInterfaces)
+	}
+	if aws.StringValue(data.IamInstanceProfile.Name) != "ecs" {
+		t.Errorf("unexpected instance profile %+v", data.IamInstanceProfile)
+	}
+	lc.ClassicLinkVPCId = aws.String("vpc-1")
+	if _, err := launchTemplateDataFromLaunchConfig(lc, "ami-new"); err == nil {
+		t.Errorf("expected an error for ClassicLink")
+	}
+	if name := launchTemplateNameFromLaunchConfig(aws.StringValue(lc.LaunchConfigurationName)); name != "ecs" {
+		t.Errorf("expected launch template name ecs, got %s", name)
+	}
+}
+
+// TestCreateLaunchTemplateVersionFailed returns the error of a failed call
+func TestCreateLaunchTemplateVersionFailed(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	a := f.clients().Autoscaling
+	lt, err := a.getLatestLaunchTemplate(context.Background(), "lt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the source version doesn't exist
+	lt.VersionNumber = aws.Int64(10)
+	id, name, version, err := a.createLaunchTemplateVersion(context.Background(), "lt", lt, fakeNewAMI)
+	if err == nil || id != "" || name != "" || version != "" {
+		t.Errorf("expected an error, got %q %q %q (%v)", id, name, version, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getCanaryCount returns the number of canary instances. The canary can be a number of instances or a percentage of the desired capacity
+func getCanaryCount(canary string, desiredCapacity int64) (int64, error) {
+	if canary == "" {
+		return 0, nil
+	}
+	var count int64
+	if strings.HasSuffix(canary, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(canary, "%"), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return 0, fmt.Errorf("CANARY: invalid percentage %s", canary)
+		}
+		count = int64(math.Ceil(float64(desiredCapacity) * percentage / 100))
+	} else {
+		i, err := strconv.ParseInt(canary, 10, 64)
+		if err != nil || i < 0 {
+			return 0, fmt.Errorf("CANARY: invalid number of instances %s", canary)
+		}
+		count = i
+	}
+	if count > desiredCapacity {
+		count = desiredCapacity
+	}
+	return count, nil
+}
+
+// runCanary waits for the canary instances, drains the same number of old instances and watches
+// target health, alarms and stopped tasks on the canary instances during the bake time.
+// The drained container instance arns are returned, also when the canary failed, with the versions of the canary instances.
+func runCanary(ctx context.Context, a Autoscaling, e ECS, lb LB, cw CloudWatch, alarmNames []string, clusterName, asgName, newLaunchIdentifier, useLaunchTemplates string, canaryCount int64, bakeTime time.Duration, maxTaskFailures int, ignoreAttributes []string, timings Timings) ([]string, *VersionReport, error) {
+	var drainedContainerArns []string
+	var versions *VersionReport
+	canaryStart := e.clock.Now()
+
+	instances, err := waitForHealthyInstances(ctx, a, cw, alarmNames, asgName, newLaunchIdentifier, useLaunchTemplates, canaryCount, timings.InstanceHealth)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	err = e.waitForNewNodes(ctx, clusterName, len(instances), timings.NewNodes)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	// container instances of the canary
+	containerInstanceArns, err := e.listContainerInstances(ctx, clusterName)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	containerInstanceDetails, err := e.describeContainerInstanceDetails(ctx, clusterName, containerInstanceArns)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	versionReport, err := checkVersions(containerInstanceDetails, instances, newLaunchIdentifier, useLaunchTemplates, ignoreAttributes)
+	versions = &versionReport
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	containerInstances := getContainerInstanceArnMap(containerInstanceDetails)
+	canaryContainerArns := getNewContainerInstanceArns(containerInstances, instances, newLaunchIdentifier, useLaunchTemplates)
+
+	mainLogger.Debugf("Canary: draining %d instance(s)", canaryCount)
+	drainedContainerArns, err = drain(ctx, e, clusterName, instances, newLaunchIdentifier, useLaunchTemplates, canaryCount, nil)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	err = e.waitForDrainedNode(ctx, clusterName, drainedContainerArns, canaryContainerArns, maxTaskFailures, canaryStart, alarmCheck(ctx, cw, alarmNames), timings.Drain)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	targetHealth, err := checkTargetHealth(ctx, a, e, lb, cw, alarmNames, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName, timings.TargetHealth)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	if len(targetHealth.TargetGroups) > 0 && !targetHealth.AllHealthy {
+		return drainedContainerArns, versions, gateError{reason: fmt.Sprintf("Canary: targets of the canary instances are not healthy (%s)", formatTargetStates(targetHealth.States))}
+	}
+
+	services, err := e.listServices(ctx, clusterName)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	targetGroups, err := lb.getTargets(ctx)
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+
+	// bake
+	mainLogger.Debugf("Canary: baking for %s", bakeTime)
+	deadline := e.clock.Now().Add(bakeTime)
+	_, err = poll(ctx, e.clock, Timing{Interval: timings.Bake.Interval, Timeout: bakeTime}, func() (bool, error) {
+		err := checkAlarms(ctx, cw, alarmNames)
+		if err != nil {
+			return false, err
+		}
+		targetStates, err := getNewTargetsHealth(ctx, a, e, lb, targetGroups, containerInstances, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName)
+		if err != nil {
+			return false, err
+		}
+		for state, count := range targetStates {
+			if state != "healthy" && count > 0 {
+				return false, gateError{reason: fmt.Sprintf("Canary: targets of the canary instances are not healthy (%s)", formatTargetStates(targetStates))}
+			}
+		}
+		err = e.checkTaskFailures(ctx, clusterName, canaryContainerArns, services, canaryStart, maxTaskFailures)
+		if err != nil {
+			return false, err
+		}
+		mainLogger.Debugf("Canary: healthy, %s remaining", deadline.Sub(e.clock.Now()).Round(time.Second))
+		return false, nil
+	})
+	if err != nil {
+		return drainedContainerArns, versions, err
+	}
+	return drainedContainerArns, versions, nil
+}
+
+// formatTargetStates returns the number of targets per health state, e.g. "healthy: 1, unhealthy: 2"
+func formatTargetStates(targetStates map[string]int64) string {
+	var states []string
+	for state, count := range targetStates {
+		states = append(states, fmt.Sprintf("%s: %d", state, count))
+	}
+	sort.Strings(states)
+	if len(states) == 0 {
+		return "no targets"
+	}
+	return strings.Join(states, ", ")
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestGetCanaryCount(t *testing.T) {
+	tests := []struct {
+		canary          string
+		desiredCapacity int64
+		expected        int64
+	}{
+		{"", 10, 0},
+		{"1", 10, 1},
+		{"10%", 10, 1},
+		{"25%", 10, 3},
+		{"20", 10, 10},
+	}
+	for _, test := range tests {
+		count, err := getCanaryCount(test.canary, test.desiredCapacity)
+		if err != nil {
+			t.Errorf("getCanaryCount error: %s", err)
+			continue
+		}
+		if count != test.expected {
+			t.Errorf("getCanaryCount(%s, %d): expected %d, got %d", test.canary, test.desiredCapacity, test.expected, count)
+		}
+	}
+	if _, err := getCanaryCount("0%", 10); err == nil {
+		t.Errorf("expected error for canary 0%%")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Clock is used by every wait and polling loop, so tests can replace the wall clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// sleep waits for d, or returns the error of the context when it is cancelled first
+func sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Timing configures a polling loop: the time between two checks and the total time before giving up
+type Timing struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Timings holds the timing of every phase of the upgrade
+type Timings struct {
+	InstanceHealth Timing
+	NewNodes       Timing
+	Drain          Timing
+	TargetHealth   Timing
+	Bake           Timing
+	AgentUpdate    Timing
+}
+
+func defaultTimings() Timings {
+	return Timings{
+		InstanceHealth: Timing{Interval: 30 * time.Second, Timeout: 12*time.Minute + 30*time.Second},
+		NewNodes:       Timing{Interval: 15 * time.Second, Timeout: 20 * time.Minute},
+		Drain:          Timing{Interval: 15 * time.Second, Timeout: 20 * time.Minute},
+		TargetHealth:   Timing{Interval: 30 * time.Second, Timeout: 12*time.Minute + 30*time.Second},
+		Bake:           Timing{Interval: 30 * time.Second},
+		AgentUpdate:    Timing{Interval: 15 * time.Second, Timeout: 20 * time.Minute},
+	}
+}
+
+// getTimingsFromEnv returns the default timings, overridden by <PHASE>_INTERVAL and <PHASE>_TIMEOUT.
+// The bake has no timeout: it lasts ALARM_BAKE_PERIOD or CANARY_BAKE_TIME
+func getTimingsFromEnv() (Timings, error) {
+	timings := defaultTimings()
+	phases := map[string]*Timing{
+		"INSTANCE_HEALTH": &timings.InstanceHealth,
+		"NEW_NODES":       &timings.NewNodes,
+		"DRAIN":           &timings.Drain,
+		"TARGET_HEALTH":   &timings.TargetHealth,
+		"BAKE":            &timings.Bake,
+		"AGENT_UPDATE":    &timings.AgentUpdate,
+	}
+	if os.Getenv("BAKE_TIMEOUT") != "" {
+		return timings, fmt.Errorf("BAKE_TIMEOUT is not used, set ALARM_BAKE_PERIOD or CANARY_BAKE_TIME")
+	}
+	for phase, timing := range phases {
+		for suffix, d := range map[string]*time.Duration{"_INTERVAL": &timing.Interval, "_TIMEOUT": &timing.Timeout} {
+			if os.Getenv(phase+suffix) == "" {
+				continue
+			}
+			value, err := getEnvDuration(phase + suffix)
+			if err != nil {
+				return timings, err
+			}
+			*d = value
+		}
+		if timing.Interval <= 0 {
+			return timings, fmt.Errorf("%s_INTERVAL must be greater than 0", phase)
+		}
+	}
+	return timings, nil
+}
+
+// poll calls check every interval until check returns true or the timeout has passed. It returns false when the timeout has passed
+// and stops with the error of the context when the context is cancelled
+func poll(ctx context.Context, clock Clock, timing Timing, check func() (bool, error)) (bool, error) {
+	deadline := clock.Now().Add(timing.Timeout)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		done, err := check()
+		if err != nil || done {
+			return done, err
+		}
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			return false, nil
+		}
+		// the last check is at the timeout, not up to an interval after it
+		interval := timing.Interval
+		if remaining < interval {
+			interval = remaining
+		}
+		if err := sleep(ctx, clock, interval); err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock returns immediately from After and moves the time forward instead
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestPoll(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	checks := 0
+	done, err := poll(context.Background(), clock, Timing{Interval: 30 * time.Second, Timeout: 5 * time.Minute}, func() (bool, error) {
+		checks++
+		return checks == 3, nil
+	})
+	if err != nil || !done {
+		t.Fatalf("expected poll to be done, got %v, %v", done, err)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != time.Minute {
+		t.Errorf("expected 1m to pass, got %s", elapsed)
+	}
+
+	checks = 0
+	done, err = poll(context.Background(), clock, Timing{Interval: 30 * time.Second, Timeout: 5 * time.Minute}, func() (bool, error) {
+		checks++
+		return false, nil
+	})
+	if err != nil || done {
+		t.Fatalf("expected poll to time out, got %v, %v", done, err)
+	}
+	if checks != 11 {
+		t.Errorf("expected 11 checks before the timeout, got %d", checks)
+	}
+
+	// the last sleep is cut short at the timeout
+	start = clock.Now()
+	checks = 0
+	_, err = poll(context.Background(), clock, Timing{Interval: 30 * time.Second, Timeout: 100 * time.Second}, func() (bool, error) {
+		checks++
+		return false, nil
+	})
+	if err != nil || checks != 5 {
+		t.Errorf("expected 5 checks before the timeout, got %d (%v)", checks, err)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 100*time.Second {
+		t.Errorf("expected 1m40s to pass, got %s", elapsed)
+	}
+}
+
+func TestPollCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	checks := 0
+	_, err := poll(ctx, newFakeClock(), Timing{Interval: time.Second, Timeout: time.Hour}, func() (bool, error) {
+		checks++
+		if checks == 2 {
+			cancel()
+		}
+		return false, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if checks != 2 {
+		t.Errorf("expected 2 checks, got %d", checks)
+	}
+}
+
+func TestGetTimingsFromEnv(t *testing.T) {
+	t.Setenv("DRAIN_INTERVAL", "5s")
+	t.Setenv("DRAIN_TIMEOUT", "1h")
+	timings, err := getTimingsFromEnv()
+	if err != nil {
+		t.Fatalf("getTimingsFromEnv error: %v", err)
+	}
+	if timings.Drain.Interval != 5*time.Second || timings.Drain.Timeout != time.Hour {
+		t.Errorf("unexpected drain timing: %+v", timings.Drain)
+	}
+	if timings.NewNodes != defaultTimings().NewNodes {
+		t.Errorf("expected default new nodes timing, got %+v", timings.NewNodes)
+	}
+
+	t.Setenv("BAKE_TIMEOUT", "1h")
+	if _, err := getTimingsFromEnv(); err == nil {
+		t.Errorf("expected an error for BAKE_TIMEOUT")
+	}
+
+	t.Setenv("BAKE_TIMEOUT", "")
+	t.Setenv("BAKE_INTERVAL", "0s")
+	if _, err := getTimingsFromEnv(); err == nil {
+		t.Errorf("expected an error for a zero interval")
+	}
+}
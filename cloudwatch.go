@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// logging
+var cloudwatchLogger = getLogger("cloudwatch")
+
+type CloudWatch struct {
+	svc cloudwatchiface.CloudWatchAPI
+}
+
+func NewCloudWatch(sess *session.Session) CloudWatch {
+	return CloudWatch{
+		svc: cloudwatch.New(sess),
+	}
+}
+
+// getAlarmsInAlarmState returns the names of the alarms in ALARM state. An alarm name ending with * is used as a prefix
+func (c *CloudWatch) getAlarmsInAlarmState(ctx context.Context, alarmNames []string) ([]string, error) {
+	var alarms []string
+	var names, prefixes []string
+	for _, alarmName := range alarmNames {
+		if strings.HasSuffix(alarmName, "*") {
+			prefixes = append(prefixes, strings.TrimSuffix(alarmName, "*"))
+		} else {
+			names = append(names, alarmName)
+		}
+	}
+
+	var inputs []*cloudwatch.DescribeAlarmsInput
+	// describe alarms accepts up to 100 alarm names
+	batchSize := 100
+	for i := 0; i < len(names); i += batchSize {
+		toIndex := i + batchSize
+		if toIndex > len(names) {
+			toIndex = len(names)
+		}
+		inputs = append(inputs, &cloudwatch.DescribeAlarmsInput{
+			AlarmNames: aws.StringSlice(names[i:toIndex]),
+		})
+	}
+	for _, prefix := range prefixes {
+		inputs = append(inputs, &cloudwatch.DescribeAlarmsInput{
+			AlarmNamePrefix: aws.String(prefix),
+		})
+	}
+
+	for _, input := range inputs {
+		input.SetStateValue(cloudwatch.StateValueAlarm)
+		input.SetAlarmTypes(aws.StringSlice([]string{cloudwatch.AlarmTypeMetricAlarm, cloudwatch.AlarmTypeCompositeAlarm}))
+		err := c.svc.DescribeAlarmsPagesWithContext(ctx, input,
+			func(page *cloudwatch.DescribeAlarmsOutput, lastPage bool) bool {
+				for _, alarm := range page.MetricAlarms {
+					alarms = append(alarms, aws.StringValue(alarm.AlarmName))
+				}
+				for _, alarm := range page.CompositeAlarms {
+					alarms = append(alarms, aws.StringValue(alarm.AlarmName))
+				}
+				return true
+			})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				cloudwatchLogger.Errorf("%v", aerr.Error())
+			} else {
+				cloudwatchLogger.Errorf("%v", err.Error())
+			}
+			return alarms, err
+		}
+	}
+	return alarms, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+type cloudwatchMock struct {
+	cloudwatchiface.CloudWatchAPI
+	MetricAlarms []*cloudwatch.MetricAlarm
+}
+
+func (c cloudwatchMock) DescribeAlarmsPagesWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsInput, f func(*cloudwatch.DescribeAlarmsOutput, bool) bool, opts ...request.Option) error {
+	alarms := []*cloudwatch.MetricAlarm{}
+	for _, alarm := range c.MetricAlarms {
+		if input.StateValue != nil && aws.StringValue(alarm.StateValue) != aws.StringValue(input.StateValue) {
+			continue
+		}
+		if input.AlarmNamePrefix != nil && strings.HasPrefix(aws.StringValue(alarm.AlarmName), aws.StringValue(input.AlarmNamePrefix)) {
+			alarms = append(alarms, alarm)
+		}
+		for _, name := range input.AlarmNames {
+			if aws.StringValue(name) == aws.StringValue(alarm.AlarmName) {
+				alarms = append(alarms, alarm)
+			}
+		}
+	}
+	f(&cloudwatch.DescribeAlarmsOutput{MetricAlarms: alarms}, true)
+	return nil
+}
+
+func TestGetAlarmsInAlarmState(t *testing.T) {
+	cw := CloudWatch{
+		svc: cloudwatchMock{
+			MetricAlarms: []*cloudwatch.MetricAlarm{
+				{AlarmName: aws.String("api-5xx"), StateValue: aws.String("ALARM")},
+				{AlarmName: aws.String("api-latency"), StateValue: aws.String("OK")},
+				{AlarmName: aws.String("worker-errors"), StateValue: aws.String("ALARM")},
+			},
+		},
+	}
+	alarms, err := cw.getAlarmsInAlarmState(context.Background(), []string{"api-*"})
+	if err != nil {
+		t.Errorf("getAlarmsInAlarmState error: %s", err)
+		return
+	}
+	if len(alarms) != 1 || alarms[0] != "api-5xx" {
+		t.Errorf("expected api-5xx in ALARM state, got %v", alarms)
+	}
+	alarms, err = cw.getAlarmsInAlarmState(context.Background(), []string{"api-latency", "worker-errors"})
+	if err != nil {
+		t.Errorf("getAlarmsInAlarmState error: %s", err)
+		return
+	}
+	if len(alarms) != 1 || alarms[0] != "worker-errors" {
+		t.Errorf("expected worker-errors in ALARM state, got %v", alarms)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// defaultConcurrency is the number of calls of a fan-out that run at the same time
+const defaultConcurrency = 10
+
+// getConcurrencyFromEnv returns MAX_CONCURRENCY, the number of calls of a fan-out that run at the same time
+func getConcurrencyFromEnv() (int, error) {
+	if os.Getenv("MAX_CONCURRENCY") == "" {
+		return defaultConcurrency, nil
+	}
+	concurrency, err := getEnvInt("MAX_CONCURRENCY")
+	if err != nil {
+		return 0, err
+	}
+	if concurrency < 1 {
+		return 0, fmt.Errorf("MAX_CONCURRENCY must be at least 1")
+	}
+	return concurrency, nil
+}
+
+// forEach calls fn for every index below n, with at most concurrency calls at the same time. After the first error
+// no new calls are started, the context of the running calls is cancelled and the error is returned
+func forEach(ctx context.Context, concurrency, n int, fn func(ctx context.Context, i int) error) error {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	workers := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	var mu sync.Mutex
+	var running, maxRunning int
+	done := make([]bool, 25)
+	err := forEach(context.Background(), 3, len(done), func(ctx context.Context, i int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEach error: %v", err)
+	}
+	if maxRunning > 3 {
+		t.Errorf("expected at most 3 concurrent calls, got %d", maxRunning)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("call %d not done", i)
+		}
+	}
+}
+
+func TestForEachError(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	failure := errors.New("describe failed")
+	err := forEach(context.Background(), 2, 100, func(ctx context.Context, i int) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		if i == 1 {
+			return failure
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != failure {
+		t.Fatalf("expected the first error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected no new calls after the error, got %d calls", calls)
+	}
+}
+
+func TestGetConcurrencyFromEnv(t *testing.T) {
+	if concurrency, err := getConcurrencyFromEnv(); err != nil || concurrency != defaultConcurrency {
+		t.Errorf("expected the default concurrency, got %d (%v)", concurrency, err)
+	}
+	t.Setenv("MAX_CONCURRENCY", "0")
+	if _, err := getConcurrencyFromEnv(); err == nil {
+		t.Errorf("expected an error for MAX_CONCURRENCY=0")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // maintenance window time zones, the runtime image has no zoneinfo
+)
+
+// logging
+var daemonLogger = getLogger("daemon")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceWindow is a daily time range on some days of the week. A range that ends before it starts
+// crosses midnight and belongs to the day it starts on
+type maintenanceWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+// Daemon watches the AMI source and upgrades when a newer AMI is available inside a maintenance window
+type Daemon struct {
+	clients            Clients
+	target             Target
+	useLaunchTemplates string
+	interval           time.Duration
+	backoff            time.Duration
+	maxBackoff         time.Duration
+	windows            []maintenanceWindow
+	location           *time.Location
+	failures           int
+}
+
+// newDaemonFromEnv returns a daemon of the target configured with DAEMON_INTERVAL, DAEMON_BACKOFF, DAEMON_MAX_BACKOFF,
+// MAINTENANCE_WINDOW and MAINTENANCE_WINDOW_TIMEZONE
+func newDaemonFromEnv(c Clients, target Target) (*Daemon, error) {
+	d := &Daemon{
+		clients:            c,
+		target:             target,
+		useLaunchTemplates: getUseLaunchTemplates(target),
+		interval:           15 * time.Minute,
+		backoff:            5 * time.Minute,
+		maxBackoff:         6 * time.Hour,
+		location:           time.UTC,
+	}
+	if target.Cluster == "" {
+		return nil, fmt.Errorf("ECS_CLUSTER not set")
+	}
+	if target.AutoscalingGroup == "" {
+		return nil, fmt.Errorf("ECS_ASG not set")
+	}
+	d.clients.Autoscaling.amiParameter = os.Getenv("AMI_SSM_PARAMETER")
+	var err error
+	d.clients.Autoscaling.amiMinAge, err = getAMIMinAge(target)
+	if err != nil {
+		return nil, err
+	}
+	// the instance type decides the architecture of the latest AMI
+	d.clients.Autoscaling.overrides, err = getLaunchOverrides(target)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]*time.Duration{"DAEMON_INTERVAL": &d.interval, "DAEMON_BACKOFF": &d.backoff, "DAEMON_MAX_BACKOFF": &d.maxBackoff} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		duration, err := getEnvDuration(name)
+		if err != nil {
+			return nil, err
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("%s must be greater than 0", name)
+		}
+		*value = duration
+	}
+	d.windows, err = parseMaintenanceWindows(os.Getenv("MAINTENANCE_WINDOW"))
+	if err != nil {
+		return nil, err
+	}
+	if timezone := os.Getenv("MAINTENANCE_WINDOW_TIMEZONE"); timezone != "" {
+		d.location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("MAINTENANCE_WINDOW_TIMEZONE: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// run checks for a new AMI every interval until ctx is done
+func (d *Daemon) run(ctx context.Context) int {
+	daemonLogger.Infof("Watching for new AMIs every %s", d.interval)
+	for ctx.Err() == nil {
+		wait := d.tick(ctx)
+		daemonLogger.Debugf("Next check in %s", wait)
+		sleep(ctx, d.clients.Clock, wait)
+	}
+	daemonLogger.Infof("Stopped")
+	return 0
+}
+
+// tick starts an upgrade when a newer AMI is available and the current time is inside a maintenance window.
+// It returns the time to wait until the next check: the interval, or the backoff after a failure
+func (d *Daemon) tick(ctx context.Context) time.Duration {
+	current, latest, err := d.getAMIs(ctx)
+	if err != nil {
+		daemonLogger.Errorf("Could not check for a new AMI: %v", err)
+		return d.fail()
+	}
+	if current == latest {
+		daemonLogger.Debugf("Already running the latest AMI %s", latest)
+		return d.interval
+	}
+	newer, err := d.clients.Autoscaling.isNewerAMI(ctx, latest, current)
+	if err != nil {
+		daemonLogger.Errorf("Could not check for a new AMI: %v", err)
+		return d.fail()
+	}
+	if !newer {
+		daemonLogger.Debugf("Running AMI %s, which is newer than %s", current, latest)
+		return d.interval
+	}
+	now := d.clients.Clock.Now().In(d.location)
+	if !inMaintenanceWindow(d.windows, now) {
+		daemonLogger.Infof("New AMI %s available, waiting for the maintenance window", latest)
+		return d.interval
+	}
+	daemonLogger.Infof("New AMI %s available (running %s), starting upgrade", latest, current)
+	ret := runWithReturnCode(ctx, d.clients, d.target)
+	if ctx.Err() != nil {
+		return d.interval
+	}
+	if ret != 0 {
+		return d.fail()
+	}
+	d.failures = 0
+	return d.interval
+}
+
+// fail returns the backoff after a failure, doubled after every consecutive failure up to the maximum backoff
+func (d *Daemon) fail() time.Duration {
+	d.failures++
+	backoff := d.backoff
+	for i := 1; i < d.failures && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxBackoff {
+		backoff = d.maxBackoff
+	}
+	daemonLogger.Warningf("%d consecutive failure(s), retrying in %s", d.failures, backoff)
+	return backoff
+}
+
+// getAMIs returns the AMI of the autoscaling group and the latest AMI
+func (d *Daemon) getAMIs(ctx context.Context) (string, string, error) {
+	a := d.clients.Autoscaling
+	asg, err := a.describeAutoscalingGroup(ctx, d.target.AutoscalingGroup)
+	if err != nil {
+		return "", "", err
+	}
+	current, err := a.getLaunchImage(ctx, d.useLaunchTemplates, getLaunchIdentifier(asg, d.useLaunchTemplates))
+	if err != nil {
+		return "", "", err
+	}
+	if current == "" {
+		return "", "", fmt.Errorf("the launch configuration or template of %s has no AMI", d.target.AutoscalingGroup)
+	}
+	latest, err := a.getECSAMI(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return current, latest, nil
+}
+
+// parseMaintenanceWindows parses a comma separated list of windows like "02:00-06:00", "Sat 22:00-04:00" or "Mon-Fri 01:00-03:00"
+func parseMaintenanceWindows(value string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, window := range strings.Split(value, ",") {
+		window = strings.TrimSpace(window)
+		if window == "" {
+			continue
+		}
+		w, err := parseMaintenanceWindow(window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAINTENANCE_WINDOW %s: %v", window, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(window string) (maintenanceWindow, error) {
+	var w maintenanceWindow
+	fields := strings.Fields(window)
+	timeRange := fields[len(fields)-1]
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		first, last, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			last = first
+		}
+		from, ok := weekdays[strings.ToLower(first)]
+		if !ok {
+			return w, fmt.Errorf("unknown day %s", first)
+		}
+		to, ok := weekdays[strings.ToLower(last)]
+		if !ok {
+			return w, fmt.Errorf("unknown day %s", last)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	default:
+		return w, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+	start, end, ok := strings.Cut(timeRange, "-")
+	if !ok {
+		return w, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	var err error
+	w.start, err = parseTimeOfDay(start)
+	if err != nil {
+		return w, err
+	}
+	w.end, err = parseTimeOfDay(end)
+	if err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("window is empty")
+	}
+	return w, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of HH:MM
+func parseTimeOfDay(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	return h*60 + m, nil
+}
+
+func (w maintenanceWindow) contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minutes >= w.start && minutes < w.end
+	}
+	// the window crosses midnight
+	if minutes >= w.start {
+		return w.days[t.Weekday()]
+	}
+	return minutes < w.end && w.days[(t.Weekday()+6)%7]
+}
+
+// inMaintenanceWindow returns whether t is inside one of the windows. Without windows, every time is inside
+func inMaintenanceWindow(windows []maintenanceWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
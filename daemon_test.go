@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	// 2024-06-01 is a Saturday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		windows string
+		t       time.Time
+		inside  bool
+	}{
+		{"", at(1, 12, 0), true},
+		{"02:00-06:00", at(1, 2, 0), true},
+		{"02:00-06:00", at(1, 6, 0), false},
+		{"Sat 22:00-04:00", at(1, 23, 0), true},
+		{"Sat 22:00-04:00", at(2, 3, 59), true},
+		{"Sat 22:00-04:00", at(2, 23, 0), false},
+		{"Mon-Fri 01:00-03:00", at(1, 2, 0), false},
+		{"Mon-Fri 01:00-03:00", at(3, 2, 0), true},
+		{"Fri-Sun 01:00-03:00, Wed 12:00-13:00", at(2, 2, 0), true},
+		{"Fri-Sun 01:00-03:00, Wed 12:00-13:00", at(5, 12, 30), true},
+		{"Fri-Sun 01:00-03:00, Wed 12:00-13:00", at(4, 2, 0), false},
+	}
+	for _, test := range tests {
+		windows, err := parseMaintenanceWindows(test.windows)
+		if err != nil {
+			t.Fatalf("%s: %v", test.windows, err)
+		}
+		if inside := inMaintenanceWindow(windows, test.t); inside != test.inside {
+			t.Errorf("%s at %s: expected %v, got %v", test.windows, test.t.Format(time.RFC1123), test.inside, inside)
+		}
+	}
+	for _, invalid := range []string{"02:00", "Someday 02:00-03:00", "02:00-02:00", "25:00-26:00", "Mon 02:00-03:00 UTC"} {
+		if _, err := parseMaintenanceWindows(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func newTestDaemon(t *testing.T, f *fakeAWS, env map[string]string) *Daemon {
+	setUpgradeEnv(t, f, env)
+	t.Setenv("REPORT_FILE", t.TempDir()+"/report.json")
+	d, err := newDaemonFromEnv(f.clients(), f.target())
+	if err != nil {
+		t.Fatalf("newDaemonFromEnv: %v", err)
+	}
+	return d
+}
+
+func TestDaemonUpgradesNewAMI(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	d := newTestDaemon(t, f, map[string]string{"LAUNCH_TEMPLATES": "true", "DAEMON_INTERVAL": "10m"})
+	if wait := d.tick(context.Background()); wait != 10*time.Minute {
+		t.Errorf("expected to wait the interval, got %s", wait)
+	}
+	checkUpgraded(t, f, 2)
+	versions := len(f.launchTemplates["lt"])
+	if wait := d.tick(context.Background()); wait != 10*time.Minute {
+		t.Errorf("expected to wait the interval, got %s", wait)
+	}
+	if len(f.launchTemplates["lt"]) != versions {
+		t.Errorf("upgraded again without a new AMI")
+	}
+}
+
+func TestDaemonMaintenanceWindow(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	// the fake clock starts on Sunday 00:00 UTC, which is Sunday 02:00 in Amsterdam
+	d := newTestDaemon(t, f, map[string]string{"MAINTENANCE_WINDOW": "Sat 01:00-05:00, Sun 03:00-05:00", "MAINTENANCE_WINDOW_TIMEZONE": "Europe/Amsterdam"})
+	d.tick(context.Background())
+	if f.currentImage() != fakeOldAMI {
+		t.Fatalf("upgraded outside the maintenance window")
+	}
+	<-f.clock.After(time.Hour)
+	d.tick(context.Background())
+	checkUpgraded(t, f, 2)
+}
+
+func TestDaemonBackoff(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("ALARM")}}
+	d := newTestDaemon(t, f, map[string]string{"ALARM_NAMES": "api-5xx", "DAEMON_BACKOFF": "1m", "DAEMON_MAX_BACKOFF": "3m"})
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if wait := d.tick(context.Background()); wait != expected {
+			t.Errorf("failure %d: expected a backoff of %s, got %s", i+1, expected, wait)
+		}
+	}
+	f.alarms[0].StateValue = aws.String("OK")
+	if wait := d.tick(context.Background()); wait != 15*time.Minute {
+		t.Errorf("expected to wait the interval after a successful upgrade, got %s", wait)
+	}
+	checkUpgraded(t, f, 2)
+	if d.failures != 0 {
+		t.Errorf("failures not reset after a successful upgrade")
+	}
+}
+
+func TestDaemonSSMParameter(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.ssmParameters["/aws/service/ecs/optimized-ami/amazon-linux-2/recommended"] = `{"image_id":"` + fakeOldAMI + `","image_name":"amzn2-ami-ecs-hvm"}`
+	d := newTestDaemon(t, f, map[string]string{"AMI_SSM_PARAMETER": "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended"})
+	current, latest, err := d.getAMIs(context.Background())
+	if err != nil || current != fakeOldAMI || latest != fakeOldAMI {
+		t.Fatalf("expected %s from the parameter, got %s and %s (%v)", fakeOldAMI, current, latest, err)
+	}
+	d.tick(context.Background())
+	if f.currentImage() != fakeOldAMI {
+		t.Errorf("upgraded to an AMI that isn't in the parameter")
+	}
+}
+
+// TestDaemonNoDowngrade doesn't upgrade when the autoscaling group runs a newer AMI than the selected one
+func TestDaemonNoDowngrade(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.launchConfigs["lc"].ImageId = aws.String(fakeNewAMI)
+	// the new AMI is a day old, so the old AMI is selected
+	d := newTestDaemon(t, f, map[string]string{"AMI_MIN_AGE_DAYS": "7"})
+	for i := 0; i < 2; i++ {
+		if wait := d.tick(context.Background()); wait != 15*time.Minute {
+			t.Errorf("expected to wait the interval, got %s", wait)
+		}
+	}
+	if f.launchConfig != "lc" || f.currentImage() != fakeNewAMI {
+		t.Errorf("downgraded to %s", f.currentImage())
+	}
+}
+
+// TestDaemonNoCurrentAMI fails the check when the launch configuration has no image
+func TestDaemonNoCurrentAMI(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.launchConfigs["lc"].ImageId = nil
+	d := newTestDaemon(t, f, nil)
+	if _, _, err := d.getAMIs(context.Background()); err == nil || !strings.Contains(err.Error(), "has no AMI") {
+		t.Fatalf("expected an error for a launch configuration without AMI, got %v", err)
+	}
+	d.tick(context.Background())
+	if d.failures != 1 || f.launchConfig != "lc" {
+		t.Errorf("expected a failure without an upgrade, got %d failure(s) and launch configuration %s", d.failures, f.launchConfig)
+	}
+}
+
+func TestDaemonRunStops(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	d := newTestDaemon(t, f, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ret := d.run(ctx); ret != 0 {
+		t.Errorf("expected 0 when stopped, got %d", ret)
+	}
+}
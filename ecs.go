@@ -1,142 +1,332 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
-	ecslib "github.com/in4it/ecs-deploy/provider/ecs"
-	"github.com/juju/loggo"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 
 	"time"
 )
 
-var ecsLogger = loggo.GetLogger("ecs")
+var ecsLogger = getLogger("ecs")
 
-type ECS struct{}
+type ECS struct {
+	svc   ecsiface.ECSAPI
+	clock Clock
+	// concurrency is the number of describe and list calls that run at the same time
+	concurrency int
+}
+
+type ContainerInstance struct {
+	InstanceId           string
+	ContainerInstanceArn string
+	Status               string
+	RunningTasksCount    int64
+	AgentVersion         string
+	AgentUpdateStatus    string
+	DockerVersion        string
+	Attributes           []string
+}
+
+type StoppedTask struct {
+	TaskArn              string
+	ContainerInstanceArn string
+	Group                string
+	StopCode             string
+	StoppedReason        string
+	ExitCodes            []int64
+	StoppedAt            time.Time
+}
+
+func NewECS(sess *session.Session) ECS {
+	return ECS{
+		svc:         ecs.New(sess),
+		clock:       realClock{},
+		concurrency: defaultConcurrency,
+	}
+}
+
+// the API limits of the calls that take a list of resources
+const (
+	describeContainerInstancesBatchSize = 100
+	updateContainerInstancesBatchSize   = 10
+	describeTasksBatchSize              = 100
+	describeServicesBatchSize           = 10
+)
 
-func (e *ECS) listContainerInstances(clusterName string) ([]string, error) {
+// ecsTrunkAttribute is registered on container instances with a trunk network interface (ENI trunking)
+const ecsTrunkAttribute = "ecs.awsvpc-trunk-id"
+
+func (e *ECS) listContainerInstances(ctx context.Context, clusterName string) ([]string, error) {
 	var instanceArns []string
-	svc := ecs.New(session.New())
 	input := &ecs.ListContainerInstancesInput{
 		Cluster: aws.String(clusterName),
 	}
-	result, err := svc.ListContainerInstances(input)
+	err := e.svc.ListContainerInstancesPagesWithContext(ctx, input,
+		func(page *ecs.ListContainerInstancesOutput, lastPage bool) bool {
+			instanceArns = append(instanceArns, aws.StringValueSlice(page.ContainerInstanceArns)...)
+			return true
+		})
 	if err != nil {
 		ecsLogger.Errorf("%v", err.Error())
 		return instanceArns, err
 	}
-	for _, instance := range result.ContainerInstanceArns {
-		instanceArns = append(instanceArns, aws.StringValue(instance))
-	}
 	return instanceArns, nil
 }
-func (e *ECS) describeContainerInstances(clusterName string, instanceArns []string) (map[string]string, error) {
+func (e *ECS) describeContainerInstances(ctx context.Context, clusterName string, instanceArns []string) (map[string]string, error) {
+	instances := make(map[string]string)
+	containerInstances, err := e.describeContainerInstanceDetails(ctx, clusterName, instanceArns)
+	if err != nil {
+		return instances, err
+	}
+	return getContainerInstanceArnMap(containerInstances), nil
+}
+
+// getContainerInstanceArnMap returns the container instance arns by EC2 instance id
+func getContainerInstanceArnMap(containerInstances map[string]ContainerInstance) map[string]string {
 	instances := make(map[string]string)
-	svc := ecs.New(session.New())
+	for instanceId, containerInstance := range containerInstances {
+		instances[instanceId] = containerInstance.ContainerInstanceArn
+	}
+	return instances
+}
+
+// describeContainerInstanceDetails returns the container instances by EC2 instance id
+func (e *ECS) describeContainerInstanceDetails(ctx context.Context, clusterName string, instanceArns []string) (map[string]ContainerInstance, error) {
+	instances := make(map[string]ContainerInstance)
+	for i := 0; i < len(instanceArns); i += describeContainerInstancesBatchSize {
+		toIndex := i + int(math.Min(float64(len(instanceArns)-i), float64(describeContainerInstancesBatchSize)))
+		err := e.describeContainerInstanceBatch(ctx, clusterName, instanceArns[i:toIndex], instances)
+		if err != nil {
+			return instances, err
+		}
+	}
+	return instances, nil
+}
+
+// describeContainerInstanceBatch adds the container instances of one DescribeContainerInstances call to instances
+func (e *ECS) describeContainerInstanceBatch(ctx context.Context, clusterName string, instanceArns []string, instances map[string]ContainerInstance) error {
 	input := &ecs.DescribeContainerInstancesInput{
 		Cluster:            aws.String(clusterName),
 		ContainerInstances: aws.StringSlice(instanceArns),
 	}
-	result, err := svc.DescribeContainerInstances(input)
+	result, err := e.svc.DescribeContainerInstancesWithContext(ctx, input)
 	if err != nil {
 		ecsLogger.Errorf("%v", err.Error())
-		return instances, err
+		return err
+	}
+	for _, failure := range result.Failures {
+		ecsLogger.Debugf("Could not describe container instance %s: %s", aws.StringValue(failure.Arn), aws.StringValue(failure.Reason))
 	}
 	for _, instance := range result.ContainerInstances {
-		instances[aws.StringValue(instance.Ec2InstanceId)] = aws.StringValue(instance.ContainerInstanceArn)
+		containerInstance := ContainerInstance{
+			InstanceId:           aws.StringValue(instance.Ec2InstanceId),
+			ContainerInstanceArn: aws.StringValue(instance.ContainerInstanceArn),
+			Status:               aws.StringValue(instance.Status),
+			RunningTasksCount:    aws.Int64Value(instance.RunningTasksCount),
+		}
+		if instance.VersionInfo != nil {
+			containerInstance.AgentVersion = aws.StringValue(instance.VersionInfo.AgentVersion)
+			containerInstance.DockerVersion = aws.StringValue(instance.VersionInfo.DockerVersion)
+		}
+		containerInstance.AgentUpdateStatus = aws.StringValue(instance.AgentUpdateStatus)
+		for _, attribute := range instance.Attributes {
+			containerInstance.Attributes = append(containerInstance.Attributes, aws.StringValue(attribute.Name))
+		}
+		instances[containerInstance.InstanceId] = containerInstance
 	}
-	return instances, nil
+	return nil
 }
 
-func (e *ECS) drainNode(clusterName, instance string) error {
-	svc := ecs.New(session.New())
-	input := &ecs.UpdateContainerInstancesStateInput{
-		Cluster:            aws.String(clusterName),
-		ContainerInstances: aws.StringSlice([]string{instance}),
-		Status:             aws.String("DRAINING"),
+// drainNodes drains the container instances. It returns the container instances that were drained, also on error
+func (e *ECS) drainNodes(ctx context.Context, clusterName string, instances []string) ([]string, error) {
+	return e.setContainerInstancesState(ctx, clusterName, instances, "DRAINING")
+}
+
+// usesENITrunking returns whether container instances of the cluster have a trunk network interface (ENI trunking)
+func (e *ECS) usesENITrunking(ctx context.Context, clusterName string) (bool, error) {
+	arns, err := e.listContainerInstances(ctx, clusterName)
+	if err != nil {
+		return false, err
+	}
+	instances, err := e.describeContainerInstanceDetails(ctx, clusterName, arns)
+	if err != nil {
+		return false, err
+	}
+	for _, instance := range instances {
+		if stringInSlice(ecsTrunkAttribute, instance.Attributes) {
+			return true, nil
+		}
 	}
-	_, err := svc.UpdateContainerInstancesState(input)
+	return false, nil
+}
+
+// updateContainerAgent starts the agent update of a container instance. It returns false when no update is available
+func (e *ECS) updateContainerAgent(ctx context.Context, clusterName, containerInstanceArn string) (bool, error) {
+	input := &ecs.UpdateContainerAgentInput{
+		Cluster:           aws.String(clusterName),
+		ContainerInstance: aws.String(containerInstanceArn),
+	}
+	_, err := e.svc.UpdateContainerAgentWithContext(ctx, input)
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case ecs.ErrCodeNoUpdateAvailableException:
+				return false, nil
+			case ecs.ErrCodeUpdateInProgressException:
+				return true, nil
+			}
+		}
 		ecsLogger.Errorf("%v", err.Error())
-		return err
+		return false, err
 	}
-	return nil
+	return true, nil
 }
-func (e *ECS) waitForDrainedNode(clusterName string, drainedContainerArns []string) error {
-	var tasksDrained bool
-	ecsLib := ecslib.ECS{}
-	for i := 0; i < 80 && !tasksDrained; i++ {
-		cis, err := ecsLib.DescribeContainerInstances(clusterName, drainedContainerArns)
-		if err != nil || len(cis) == 0 {
-			ecsLogger.Errorf("waitForDrainedNode: %v", err.Error())
+
+func (e *ECS) activateNodes(ctx context.Context, clusterName string, instances []string) error {
+	_, err := e.setContainerInstancesState(ctx, clusterName, instances, "ACTIVE")
+	return err
+}
+
+// setContainerInstancesState sets the status of the container instances, in batches of the API limit.
+// It returns the container instances that were updated, also on error
+func (e *ECS) setContainerInstancesState(ctx context.Context, clusterName string, instances []string, status string) ([]string, error) {
+	var updated []string
+	for i := 0; i < len(instances); i += updateContainerInstancesBatchSize {
+		toIndex := i + int(math.Min(float64(len(instances)-i), float64(updateContainerInstancesBatchSize)))
+		input := &ecs.UpdateContainerInstancesStateInput{
+			Cluster:            aws.String(clusterName),
+			ContainerInstances: aws.StringSlice(instances[i:toIndex]),
+			Status:             aws.String(status),
+		}
+		result, err := e.svc.UpdateContainerInstancesStateWithContext(ctx, input)
+		if err != nil {
+			ecsLogger.Errorf("%v", err.Error())
+			return updated, err
+		}
+		failed := make(map[string]bool)
+		for _, failure := range result.Failures {
+			failed[aws.StringValue(failure.Arn)] = true
+			ecsLogger.Errorf("Could not set container instance %s to %s: %s", aws.StringValue(failure.Arn), status, aws.StringValue(failure.Reason))
+		}
+		for _, instance := range instances[i:toIndex] {
+			if !failed[instance] {
+				updated = append(updated, instance)
+			}
+		}
+		if len(failed) > 0 {
+			return updated, fmt.Errorf("could not set %d container instance(s) to %s", len(failed), status)
+		}
+	}
+	return updated, nil
+}
+
+// waitForDrainedNode waits until the drained container instances have no more running tasks. When tasks keep
+// failing on the new container instances since the drain started, it stops waiting and returns an error with a diagnosis.
+// alarmCheck is called on every poll, the wait stops with its error (e.g. an alarm went off)
+func (e *ECS) waitForDrainedNode(ctx context.Context, clusterName string, drainedContainerArns, newContainerArns []string, maxTaskFailures int, drainStart time.Time, alarmCheck func() error, timing Timing) error {
+	var services []string
+	var err error
+	if len(newContainerArns) > 0 {
+		services, err = e.listServices(ctx, clusterName)
+		if err != nil {
 			return err
 		}
+	}
+	tasksDrained, err := poll(ctx, e.clock, timing, func() (bool, error) {
+		err := alarmCheck()
+		if err != nil {
+			return false, err
+		}
+		if len(newContainerArns) > 0 {
+			err := e.checkTaskFailures(ctx, clusterName, newContainerArns, services, drainStart, maxTaskFailures)
+			if err != nil {
+				ecsLogger.Errorf("waitForDrainedNode: %v", err.Error())
+				return false, err
+			}
+		}
+		cis, err := e.describeContainerInstanceDetails(ctx, clusterName, drainedContainerArns)
+		if err != nil {
+			ecsLogger.Errorf("waitForDrainedNode: %v", err.Error())
+			return false, err
+		}
+		if len(cis) == 0 {
+			return false, fmt.Errorf("waitForDrainedNode: drained container instances not found")
+		}
 		var runningTasksCount int64
 		for _, ci := range cis {
 			runningTasksCount += ci.RunningTasksCount
 		}
 		if runningTasksCount == 0 {
-			tasksDrained = true
-		} else {
-			ecsLogger.Infof("launchWaitForDrainedNode(s): still %d tasks running", runningTasksCount)
+			return true, nil
 		}
-		time.Sleep(15 * time.Second)
+		ecsLogger.Infof("launchWaitForDrainedNode(s): still %d tasks running: sleeping %s", runningTasksCount, timing.Interval)
+		return false, nil
+	})
+	if err != nil {
+		return err
 	}
 	if !tasksDrained {
-		ecsLogger.Errorf("waitForDrainedNode(s): Not able to drain tasks: timeout of 20m reached")
+		ecsLogger.Errorf("waitForDrainedNode(s): Not able to drain tasks: timeout of %s reached", timing.Timeout)
 	}
 	ecsLogger.Infof("waitForDrainedNode(s): Node drained, completed lifecycle action")
 	return nil
 }
-func (e *ECS) waitForNewNodes(clusterName string, asgInstancesCount int) error {
-	var newInstancesOnline bool
+func (e *ECS) waitForNewNodes(ctx context.Context, clusterName string, asgInstancesCount int, timing Timing) error {
 	var containerInstanceArns []string
-	var err error
 	// waiting for new nodes to come online
-	for i := 0; i < 80 && !newInstancesOnline; i++ {
-		containerInstanceArns, err = e.listContainerInstances(clusterName)
+	_, err := poll(ctx, e.clock, timing, func() (bool, error) {
+		var err error
+		containerInstanceArns, err = e.listContainerInstances(ctx, clusterName)
 		if err != nil {
 			ecsLogger.Errorf("waitNewnodes: %v", err.Error())
-			return err
+			return false, err
 		}
 		if len(containerInstanceArns) == asgInstancesCount {
 			ecsLogger.Debugf("waitForNewNodes: new instances online")
-			newInstancesOnline = true
-		} else {
-			ecsLogger.Debugf("waitForNewNodes: waiting for instances to come online: sleeping 15s (%d/%d online)", len(containerInstanceArns), asgInstancesCount)
-			time.Sleep(15 * time.Second)
+			return true, nil
 		}
+		ecsLogger.Debugf("waitForNewNodes: waiting for instances to come online: sleeping %s (%d/%d online)", timing.Interval, len(containerInstanceArns), asgInstancesCount)
+		return false, nil
+	})
+	if err != nil {
+		return err
 	}
 	// waiting for new nodes to have ACTIVE status
-	ecsLib := ecslib.ECS{}
-	var newInstancesActive bool
-	for i := 0; i < 80 && !newInstancesActive; i++ {
-		cis, err := ecsLib.DescribeContainerInstances(clusterName, containerInstanceArns)
-		if err != nil || len(cis) == 0 {
+	_, err = poll(ctx, e.clock, timing, func() (bool, error) {
+		cis, err := e.describeContainerInstanceDetails(ctx, clusterName, containerInstanceArns)
+		if err != nil {
 			ecsLogger.Errorf("waitForNewNodes: %v", err.Error())
-			return err
+			return false, err
+		}
+		if len(cis) == 0 {
+			return false, fmt.Errorf("waitForNewNodes: no container instances found")
 		}
 		var notActive int64
 		for _, ci := range cis {
-			if ci.Status != "ACTIVE" {
+			// draining instances (e.g. drained by the canary) won't become active again
+			if ci.Status != "ACTIVE" && ci.Status != "DRAINING" {
 				notActive++
 			}
 		}
 		if notActive == 0 {
 			ecsLogger.Debugf("waitForNewNodes: All nodes have ACTIVE status")
-			newInstancesActive = true
-		} else {
-			ecsLogger.Debugf("waitForNewNodes: New nodes online, but not active: sleeping 15s (%d not active)", notActive)
-			time.Sleep(15 * time.Second)
+			return true, nil
 		}
-	}
-	return nil
+		ecsLogger.Debugf("waitForNewNodes: New nodes online, but not active: sleeping %s (%d not active)", timing.Interval, notActive)
+		return false, nil
+	})
+	return err
 }
 
-func (e *ECS) ListTasks(clusterName, desiredStatus string) ([]string, error) {
-	svc := ecs.New(session.New())
+func (e *ECS) ListTasks(ctx context.Context, clusterName, desiredStatus string) ([]string, error) {
 	var tasks []*string
 
 	input := &ecs.ListTasksInput{
@@ -144,53 +334,234 @@ func (e *ECS) ListTasks(clusterName, desiredStatus string) ([]string, error) {
 		DesiredStatus: aws.String(desiredStatus),
 	}
 
-	pageNum := 0
-	err := svc.ListTasksPages(input,
+	err := e.svc.ListTasksPagesWithContext(ctx, input,
 		func(page *ecs.ListTasksOutput, lastPage bool) bool {
-			pageNum++
 			tasks = append(tasks, page.TaskArns...)
-			return pageNum <= 100
+			return true
 		})
 
 	if err != nil {
-		ecsLogger.Errorf(err.Error())
+		ecsLogger.Errorf("%v", err.Error())
 	}
 	return aws.StringValueSlice(tasks), err
 }
 
-func (e *ECS) getTaskIPsPerContainerInstance(clusterName string, tasks []string) (map[string][]string, error) {
+func (e *ECS) getTaskIPsPerContainerInstance(ctx context.Context, clusterName string, tasks []string) (map[string][]string, error) {
 
 	result := make(map[string][]string)
-	svc := ecs.New(session.New())
 
-	// fetch per 100
-	var y float64 = float64(len(tasks)) / 100
-	for i := 0; i < int(math.Ceil(y)); i++ {
+	described, err := e.describeTasks(ctx, clusterName, tasks)
+	if err != nil {
+		return result, err
+	}
+	for _, task := range described {
+		for _, attachment := range task.Attachments {
+			for _, detail := range attachment.Details {
+				if aws.StringValue(detail.Name) == "privateIPv4Address" {
+					result[aws.StringValue(task.ContainerInstanceArn)] = append(result[aws.StringValue(task.ContainerInstanceArn)], aws.StringValue(detail.Value))
+				}
+
+			}
+		}
 
-		f := i * 100
-		t := int(math.Min(float64(100+100*i), float64(len(tasks))))
+	}
+	return result, nil
+}
 
+// describeTasks describes the tasks in batches of the API limit, with up to concurrency batches at the same time.
+// The tasks are returned in the order of the batches
+func (e *ECS) describeTasks(ctx context.Context, clusterName string, taskArns []string) ([]*ecs.Task, error) {
+	batches := make([][]*ecs.Task, (len(taskArns)+describeTasksBatchSize-1)/describeTasksBatchSize)
+	err := forEach(ctx, e.concurrency, len(batches), func(ctx context.Context, batch int) error {
+		i := batch * describeTasksBatchSize
+		toIndex := i + int(math.Min(float64(len(taskArns)-i), float64(describeTasksBatchSize)))
 		input := &ecs.DescribeTasksInput{
 			Cluster: aws.String(clusterName),
-			Tasks:   aws.StringSlice(tasks[f:t]),
+			Tasks:   aws.StringSlice(taskArns[i:toIndex]),
 		}
+		result, err := e.svc.DescribeTasksWithContext(ctx, input)
+		if err != nil {
+			ecsLogger.Errorf("%v", err.Error())
+			return err
+		}
+		batches[batch] = result.Tasks
+		return nil
+	})
+	var tasks []*ecs.Task
+	for _, batch := range batches {
+		tasks = append(tasks, batch...)
+	}
+	return tasks, err
+}
+
+// getStoppedTasks returns the tasks on the container instances that stopped after since
+func (e *ECS) getStoppedTasks(ctx context.Context, clusterName string, containerInstanceArns []string, since time.Time) ([]StoppedTask, error) {
+	var stoppedTasks []StoppedTask
 
-		tasks, err := svc.DescribeTasks(input)
+	taskArnsPerInstance := make([][]string, len(containerInstanceArns))
+	err := forEach(ctx, e.concurrency, len(containerInstanceArns), func(ctx context.Context, i int) error {
+		input := &ecs.ListTasksInput{
+			Cluster:           aws.String(clusterName),
+			ContainerInstance: aws.String(containerInstanceArns[i]),
+			DesiredStatus:     aws.String("STOPPED"),
+		}
+		err := e.svc.ListTasksPagesWithContext(ctx, input,
+			func(page *ecs.ListTasksOutput, lastPage bool) bool {
+				taskArnsPerInstance[i] = append(taskArnsPerInstance[i], aws.StringValueSlice(page.TaskArns)...)
+				return true
+			})
 		if err != nil {
-			ecsLogger.Errorf(err.Error())
-			return result, err
-		}
-		for _, task := range tasks.Tasks {
-			for _, attachment := range task.Attachments {
-				for _, detail := range attachment.Details {
-					if aws.StringValue(detail.Name) == "privateIPv4Address" {
-						result[aws.StringValue(task.ContainerInstanceArn)] = append(result[aws.StringValue(task.ContainerInstanceArn)], aws.StringValue(detail.Value))
-					}
+			ecsLogger.Errorf("%v", err.Error())
+		}
+		return err
+	})
+	if err != nil {
+		return stoppedTasks, err
+	}
+	var taskArns []string
+	for _, instanceTaskArns := range taskArnsPerInstance {
+		taskArns = append(taskArns, instanceTaskArns...)
+	}
 
+	tasks, err := e.describeTasks(ctx, clusterName, taskArns)
+	if err != nil {
+		return stoppedTasks, err
+	}
+	for _, task := range tasks {
+		if task.StoppedAt != nil && task.StoppedAt.Before(since) {
+			continue
+		}
+		stoppedTask := StoppedTask{
+			TaskArn:              aws.StringValue(task.TaskArn),
+			ContainerInstanceArn: aws.StringValue(task.ContainerInstanceArn),
+			Group:                aws.StringValue(task.Group),
+			StopCode:             aws.StringValue(task.StopCode),
+			StoppedReason:        aws.StringValue(task.StoppedReason),
+			StoppedAt:            aws.TimeValue(task.StoppedAt),
+		}
+		for _, container := range task.Containers {
+			if container.ExitCode != nil {
+				stoppedTask.ExitCodes = append(stoppedTask.ExitCodes, aws.Int64Value(container.ExitCode))
+			}
+		}
+		stoppedTasks = append(stoppedTasks, stoppedTask)
+	}
+	return stoppedTasks, nil
+}
+
+func (e *ECS) listServices(ctx context.Context, clusterName string) ([]string, error) {
+	var services []string
+	input := &ecs.ListServicesInput{
+		Cluster: aws.String(clusterName),
+	}
+	err := e.svc.ListServicesPagesWithContext(ctx, input,
+		func(page *ecs.ListServicesOutput, lastPage bool) bool {
+			services = append(services, aws.StringValueSlice(page.ServiceArns)...)
+			return true
+		})
+	if err != nil {
+		ecsLogger.Errorf("%v", err.Error())
+	}
+	return services, err
+}
+
+// getPlacementFailures returns the service events since the given time that report tasks that couldn't be placed on one of
+// the container instances, e.g. "... The closest matching container-instance 5a1d... has insufficient memory available".
+// Events about other instances are not counted, tasks that fail to start are counted with the stopped tasks
+func (e *ECS) getPlacementFailures(ctx context.Context, clusterName string, containerInstanceArns, services []string, since time.Time) ([]string, error) {
+	var events []string
+	// events name the container instance by the id at the end of its arn
+	containerInstanceIds := make([]string, len(containerInstanceArns))
+	for k, arn := range containerInstanceArns {
+		containerInstanceIds[k] = arn[strings.LastIndex(arn, "/")+1:]
+	}
+	for i := 0; i < len(services); i += describeServicesBatchSize {
+		toIndex := i + int(math.Min(float64(len(services)-i), float64(describeServicesBatchSize)))
+		input := &ecs.DescribeServicesInput{
+			Cluster:  aws.String(clusterName),
+			Services: aws.StringSlice(services[i:toIndex]),
+		}
+		result, err := e.svc.DescribeServicesWithContext(ctx, input)
+		if err != nil {
+			ecsLogger.Errorf("%v", err.Error())
+			return events, err
+		}
+		for _, service := range result.Services {
+			for _, event := range service.Events {
+				if aws.TimeValue(event.CreatedAt).Before(since) {
+					continue
+				}
+				message := aws.StringValue(event.Message)
+				if !strings.Contains(message, "unable to place a task") {
+					continue
 				}
+				for _, id := range containerInstanceIds {
+					if strings.Contains(message, id) {
+						events = append(events, message)
+						break
+					}
+				}
+			}
+		}
+	}
+	return events, nil
+}
+
+// checkTaskFailures returns an error with a diagnosis when more than maxTaskFailures tasks failed on the
+// container instances or couldn't be placed since the given time
+func (e *ECS) checkTaskFailures(ctx context.Context, clusterName string, containerInstanceArns, services []string, since time.Time, maxTaskFailures int) error {
+	stoppedTasks, err := e.getStoppedTasks(ctx, clusterName, containerInstanceArns, since)
+	if err != nil {
+		return err
+	}
+	placementFailures, err := e.getPlacementFailures(ctx, clusterName, containerInstanceArns, services, since)
+	if err != nil {
+		return err
+	}
+	var failures int
+	var reasons []string
+	reasonCount := make(map[string]int)
+	for _, task := range stoppedTasks {
+		if task.failed() {
+			failures++
+			reason := fmt.Sprintf("%s (%s: %s)", task.Group, task.StopCode, task.StoppedReason)
+			if reasonCount[reason] == 0 {
+				reasons = append(reasons, reason)
 			}
+			reasonCount[reason]++
+		}
+	}
+	for _, message := range placementFailures {
+		failures++
+		if reasonCount[message] == 0 {
+			reasons = append(reasons, message)
+		}
+		reasonCount[message]++
+	}
+	if failures <= maxTaskFailures {
+		if failures > 0 {
+			ecsLogger.Infof("checkTaskFailures: %d task failure(s) on new instances (max: %d)", failures, maxTaskFailures)
+		}
+		return nil
+	}
+	diagnosis := make([]string, len(reasons))
+	for k, reason := range reasons {
+		diagnosis[k] = fmt.Sprintf("%dx %s", reasonCount[reason], reason)
+	}
+	return gateError{reason: fmt.Sprintf("%d task(s) failed or couldn't be placed on the new instances: %s", failures, strings.Join(diagnosis, "; "))}
+}
 
+// failed returns true when the task didn't stop because of a deployment, scaling activity or the user
+func (t StoppedTask) failed() bool {
+	switch t.StopCode {
+	case ecs.TaskStopCodeTaskFailedToStart:
+		return true
+	case ecs.TaskStopCodeEssentialContainerExited:
+		for _, exitCode := range t.ExitCodes {
+			if exitCode != 0 {
+				return true
+			}
 		}
 	}
-	return result, nil
+	return false
 }
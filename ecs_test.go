@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestStoppedTaskFailed(t *testing.T) {
+	tests := []struct {
+		task     StoppedTask
+		expected bool
+	}{
+		{StoppedTask{StopCode: "TaskFailedToStart", StoppedReason: "CannotPullContainerError"}, true},
+		{StoppedTask{StopCode: "EssentialContainerExited", ExitCodes: []int64{0, 137}}, true},
+		{StoppedTask{StopCode: "EssentialContainerExited", ExitCodes: []int64{0}}, false},
+		{StoppedTask{StopCode: "ServiceSchedulerInitiated", StoppedReason: "Scaling activity initiated by deployment"}, false},
+		{StoppedTask{StopCode: "UserInitiated"}, false},
+	}
+	for _, test := range tests {
+		if test.task.failed() != test.expected {
+			t.Errorf("task with stop code %s and exit codes %v: expected failed to be %v", test.task.StopCode, test.task.ExitCodes, test.expected)
+		}
+	}
+}
+
+func TestContainerInstancesLarge(t *testing.T) {
+	f := newFakeAWS(550, 1, false)
+	e := f.clients().ECS
+	arns, err := e.listContainerInstances(context.Background(), f.cluster)
+	if err != nil || len(arns) != 550 {
+		t.Fatalf("expected 550 container instances, got %d (%v)", len(arns), err)
+	}
+	containerInstances, err := e.describeContainerInstanceDetails(context.Background(), f.cluster, arns)
+	if err != nil || len(containerInstances) != 550 {
+		t.Fatalf("expected 550 described container instances, got %d (%v)", len(containerInstances), err)
+	}
+	drained, err := e.drainNodes(context.Background(), f.cluster, arns[:275])
+	if err != nil || len(drained) != 275 {
+		t.Fatalf("expected 275 drained container instances, got %d (%v)", len(drained), err)
+	}
+	containerInstances, err = e.describeContainerInstanceDetails(context.Background(), f.cluster, arns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var draining int
+	for _, ci := range containerInstances {
+		if ci.Status == "DRAINING" {
+			draining++
+		}
+	}
+	if draining != 275 {
+		t.Errorf("expected 275 draining container instances, got %d", draining)
+	}
+	tasks, err := e.ListTasks(context.Background(), f.cluster, "RUNNING")
+	if err != nil || len(tasks) != 550 {
+		t.Errorf("expected 550 tasks, got %d (%v)", len(tasks), err)
+	}
+}
+
+func TestDrainNodesFailure(t *testing.T) {
+	f := newFakeAWS(12, 1, false)
+	e := f.clients().ECS
+	arns, err := e.listContainerInstances(context.Background(), f.cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drained, err := e.drainNodes(context.Background(), f.cluster, append(arns[:3], "arn:aws:ecs:container-instance/missing"))
+	if err == nil || len(drained) != 3 {
+		t.Errorf("expected an error and 3 drained container instances, got %v (%v)", drained, err)
+	}
+}
+
+// TestPlacementFailures only counts the placement failures on the given container instances
+func TestPlacementFailures(t *testing.T) {
+	f := newFakeAWS(2, 1, false)
+	e := f.clients().ECS
+	ctx := context.Background()
+	arns, err := e.listContainerInstances(ctx, f.cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := f.clock.Now()
+	id := func(arn string) string {
+		return arn[strings.LastIndex(arn, "/")+1:]
+	}
+	event := func(message string) *ecs.ServiceEvent {
+		return &ecs.ServiceEvent{CreatedAt: aws.Time(since.Add(time.Second)), Message: aws.String(message)}
+	}
+	f.serviceEvents = []*ecs.ServiceEvent{
+		event("(service web) was unable to place a task because no container instance met all of its requirements. The closest matching (container-instance " + id(arns[1]) + ") has insufficient memory available."),
+		event("(service batch) was unable to place a task because no container instance met all of its requirements. Reason: No Container Instances were found in your cluster."),
+		event("(service web) has reached a steady state."),
+	}
+	services := []string{"arn:aws:ecs:service/web"}
+	// the failing placement on the other instance doesn't count
+	if err := e.checkTaskFailures(ctx, f.cluster, arns[:1], services, since, 0); err != nil {
+		t.Errorf("expected no task failures, got %v", err)
+	}
+	err = e.checkTaskFailures(ctx, f.cluster, arns[1:], services, since, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "1 task(s) failed") {
+		t.Errorf("expected 1 task failure, got %v", err)
+	}
+}
+
+// BenchmarkGetTaskIPsPerContainerInstance measures describing the tasks of a large cluster, one batch at a time and concurrently
+func BenchmarkGetTaskIPsPerContainerInstance(b *testing.B) {
+	f := newFakeAWS(500, 4, false)
+	f.latency = 2 * time.Millisecond
+	e := f.clients().ECS
+	ctx := context.Background()
+	tasks, err := e.ListTasks(ctx, f.cluster, "RUNNING")
+	if err != nil || len(tasks) != 2000 {
+		b.Fatalf("expected 2000 tasks, got %d (%v)", len(tasks), err)
+	}
+	for _, concurrency := range []int{1, defaultConcurrency} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			e.concurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				if _, err := e.getTaskIPsPerContainerInstance(ctx, f.cluster, tasks); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// logging
+var eventsLogger = getLogger("events")
+
+// Event is a machine-readable event of a run: UpgradeStarted, AMIResolved, InstancesLaunched, DrainStarted,
+// DrainCompleted, UpgradeSucceeded, UpgradeFailed or RolledBack
+type Event struct {
+	Type             string                 `json:"type"`
+	Mode             string                 `json:"mode"`
+	RunID            string                 `json:"runId"`
+	Cluster          string                 `json:"cluster"`
+	AutoscalingGroup string                 `json:"autoscalingGroup,omitempty"`
+	Region           string                 `json:"region,omitempty"`
+	Time             time.Time              `json:"time"`
+	Detail           map[string]interface{} `json:"detail,omitempty"`
+}
+
+// EventSink publishes events
+type EventSink interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Events emits the events of a run to the sinks. Publish failures are logged and never fail the run
+type Events struct {
+	sinks  []EventSink
+	report *Report
+	clock  Clock
+}
+
+type SNS struct {
+	svc snsiface.SNSAPI
+}
+
+type EventBridge struct {
+	svc eventbridgeiface.EventBridgeAPI
+}
+
+func NewSNS(sess *session.Session) SNS {
+	return SNS{
+		svc: sns.New(sess),
+	}
+}
+
+func NewEventBridge(sess *session.Session) EventBridge {
+	return EventBridge{
+		svc: eventbridge.New(sess),
+	}
+}
+
+// newEventsFromEnv returns the events of the run in the report, published to the given sinks, to EVENTS_SNS_TOPIC_ARN
+// and to EVENTS_EVENTBRIDGE_BUS
+func newEventsFromEnv(c Clients, report *Report) *Events {
+	e := &Events{
+		sinks:  append([]EventSink{}, c.EventSinks...),
+		report: report,
+		clock:  c.Clock,
+	}
+	if topicArn := os.Getenv("EVENTS_SNS_TOPIC_ARN"); topicArn != "" {
+		e.sinks = append(e.sinks, snsEventSink{sns: c.SNS, topicArn: topicArn})
+	}
+	if busName := os.Getenv("EVENTS_EVENTBRIDGE_BUS"); busName != "" {
+		source := os.Getenv("EVENTS_SOURCE")
+		if source == "" {
+			source = "ecs-upgrade"
+		}
+		e.sinks = append(e.sinks, eventBridgeEventSink{eventBridge: c.EventBridge, busName: busName, source: source})
+	}
+	return e
+}
+
+// emit publishes an event to all sinks
+func (e *Events) emit(eventType string, detail map[string]interface{}) {
+	if len(e.sinks) == 0 {
+		return
+	}
+	event := Event{
+		Type:             eventType,
+		Mode:             e.report.Mode,
+		RunID:            e.report.RunID,
+		Cluster:          e.report.Cluster,
+		AutoscalingGroup: e.report.AutoscalingGroup,
+		Region:           e.report.Region,
+		Time:             e.clock.Now(),
+		Detail:           detail,
+	}
+	// the run context can be cancelled already, and the final event should still be published
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	published := 0
+	for _, sink := range e.sinks {
+		err := sink.Publish(ctx, event)
+		if err != nil {
+			eventsLogger.Errorf("Could not publish %s event: %v", eventType, err)
+			continue
+		}
+		published++
+	}
+	if published > 0 {
+		eventsLogger.Debugf("Published %s event to %d of %d sink(s)", eventType, published, len(e.sinks))
+	}
+}
+
+// emitFinished publishes UpgradeSucceeded or UpgradeFailed with the outcome of the run
+func (e *Events) emitFinished() {
+	detail := map[string]interface{}{
+		"outcome":             e.report.Outcome,
+		"duration":            e.report.Duration,
+		"instancesLaunched":   e.report.InstancesLaunched,
+		"instancesDrained":    e.report.InstancesDrained,
+		"instancesTerminated": e.report.InstancesTerminated,
+	}
+	if e.report.Outcome == "succeeded" || e.report.Outcome == "already-latest" {
+		e.emit("UpgradeSucceeded", detail)
+		return
+	}
+	detail["error"] = e.report.Error
+	e.emit("UpgradeFailed", detail)
+}
+
+type snsEventSink struct {
+	sns      SNS
+	topicArn string
+}
+
+func (s snsEventSink) Publish(ctx context.Context, event Event) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.sns.publish(ctx, s.topicArn, event.Type, string(message))
+}
+
+func (s *SNS) publish(ctx context.Context, topicArn, eventType, message string) error {
+	input := &sns.PublishInput{
+		TopicArn: aws.String(topicArn),
+		Message:  aws.String(message),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"eventType": {DataType: aws.String("String"), StringValue: aws.String(eventType)},
+		},
+	}
+	_, err := s.svc.PublishWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			eventsLogger.Errorf("%v", aerr.Error())
+		} else {
+			eventsLogger.Errorf("%v", err.Error())
+		}
+	}
+	return err
+}
+
+type eventBridgeEventSink struct {
+	eventBridge EventBridge
+	busName     string
+	source      string
+}
+
+func (s eventBridgeEventSink) Publish(ctx context.Context, event Event) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.eventBridge.putEvent(ctx, s.busName, s.source, event.Type, event.Time, string(detail))
+}
+
+func (e *EventBridge) putEvent(ctx context.Context, busName, source, detailType string, eventTime time.Time, detail string) error {
+	input := &eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(busName),
+				Source:       aws.String(source),
+				DetailType:   aws.String(detailType),
+				Detail:       aws.String(detail),
+				Time:         aws.Time(eventTime),
+			},
+		},
+	}
+	result, err := e.svc.PutEventsWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			eventsLogger.Errorf("%v", aerr.Error())
+		} else {
+			eventsLogger.Errorf("%v", err.Error())
+		}
+		return err
+	}
+	if aws.Int64Value(result.FailedEntryCount) > 0 && len(result.Entries) > 0 {
+		return fmt.Errorf("event not accepted: %s: %s", aws.StringValue(result.Entries[0].ErrorCode), aws.StringValue(result.Entries[0].ErrorMessage))
+	}
+	return nil
+}
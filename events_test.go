@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// captureSink keeps the published events
+type captureSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (c *captureSink) Publish(ctx context.Context, event Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, event)
+	return nil
+}
+
+func (c *captureSink) types() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var types []string
+	for _, event := range c.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// failSink fails to publish
+type failSink struct{}
+
+func (failSink) Publish(ctx context.Context, event Event) error {
+	return fmt.Errorf("publish failed")
+}
+
+func checkEventTypes(t *testing.T, expected, types []string) {
+	t.Helper()
+	if len(types) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, types)
+		}
+	}
+}
+
+func TestUpgradeEvents(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": "true", "REPORT_FILE": t.TempDir() + "/report.json", "EVENTS_SNS_TOPIC_ARN": "arn:aws:sns:topic", "EVENTS_EVENTBRIDGE_BUS": "ops"})
+	sink := &captureSink{}
+	c := f.clients()
+	c.EventSinks = []EventSink{sink}
+	if ret := runWithReturnCode(context.Background(), c, f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	expected := []string{"UpgradeStarted", "AMIResolved", "InstancesLaunched", "DrainStarted", "DrainCompleted", "UpgradeSucceeded"}
+	checkEventTypes(t, expected, sink.types())
+	resolved := sink.events[1]
+	if resolved.Cluster != "cluster" || resolved.AutoscalingGroup != "asg" || resolved.RunID == "" || resolved.Detail["newAmi"] != fakeNewAMI || resolved.Detail["oldAmi"] != fakeOldAMI {
+		t.Errorf("unexpected AMIResolved event %+v", resolved)
+	}
+	if len(f.snsMessages) != len(expected) || len(f.eventBridgeEvents) != len(expected) {
+		t.Fatalf("expected %d events on SNS and EventBridge, got %d and %d", len(expected), len(f.snsMessages), len(f.eventBridgeEvents))
+	}
+	for i, message := range f.snsMessages {
+		var event Event
+		err := json.Unmarshal([]byte(aws.StringValue(message.Message)), &event)
+		if err != nil || event.Type != expected[i] || aws.StringValue(message.TopicArn) != "arn:aws:sns:topic" {
+			t.Errorf("unexpected SNS message %v (%v)", message, err)
+		}
+		if aws.StringValue(message.MessageAttributes["eventType"].StringValue) != expected[i] {
+			t.Errorf("unexpected eventType attribute %v", message.MessageAttributes)
+		}
+	}
+	for i, entry := range f.eventBridgeEvents {
+		if aws.StringValue(entry.DetailType) != expected[i] || aws.StringValue(entry.EventBusName) != "ops" || aws.StringValue(entry.Source) != "ecs-upgrade" {
+			t.Errorf("unexpected EventBridge event %v", entry)
+		}
+	}
+}
+
+func TestUpgradeEventsRolledBack(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	f.alarmOnImage = fakeNewAMI
+	setUpgradeEnv(t, f, map[string]string{"ALARM_NAMES": "api-5xx", "ROLLBACK_ON_FAILURE": "true", "REPORT_FILE": t.TempDir() + "/report.json"})
+	sink := &captureSink{}
+	c := f.clients()
+	c.EventSinks = []EventSink{sink}
+	if ret := runWithReturnCode(context.Background(), c, f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	checkEventTypes(t, []string{"UpgradeStarted", "AMIResolved", "RolledBack", "UpgradeFailed"}, sink.types())
+	failed := sink.events[3]
+	if failed.Detail["outcome"] != "rolled-back" || failed.Detail["error"] == "" {
+		t.Errorf("unexpected UpgradeFailed event %+v", failed)
+	}
+}
+
+// TestPlanNotPublished doesn't send notifications or events for a plan
+func TestPlanNotPublished(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	webhook := newFakeWebhook(t, 0)
+	setUpgradeEnv(t, f, map[string]string{"MODE": "plan", "REPORT_FILE": t.TempDir() + "/report.json", "NOTIFY_WEBHOOK_URL": webhook.server.URL, "EVENTS_SNS_TOPIC_ARN": "arn:aws:sns:topic"})
+	sink := &captureSink{}
+	c := f.clients()
+	c.EventSinks = []EventSink{sink}
+	if ret := runWithReturnCode(context.Background(), c, f.target()); ret != 0 {
+		t.Fatalf("plan returned %d", ret)
+	}
+	if len(sink.types()) != 0 || len(f.snsMessages) != 0 {
+		t.Errorf("expected no events, got %v", sink.types())
+	}
+	if len(webhook.requests) != 0 {
+		t.Errorf("expected no notifications, got %v", webhook.requests)
+	}
+}
+
+// TestEmitFailed logs a failed publish as an error, and success only for the sinks that published the event
+func TestEmitFailed(t *testing.T) {
+	var out bytes.Buffer
+	err := configureLogging(&out, "text", "debug", "")
+	if err != nil {
+		t.Fatalf("configureLogging error: %v", err)
+	}
+	t.Cleanup(func() {
+		configureLogging(os.Stderr, "text", "", "")
+	})
+	sink := &captureSink{}
+	e := &Events{sinks: []EventSink{failSink{}}, report: &Report{}, clock: newFakeClock()}
+	e.emit("UpgradeStarted", nil)
+	if !strings.Contains(out.String(), "level=ERROR") || strings.Contains(out.String(), "Published") {
+		t.Errorf("expected only an error, got %s", out.String())
+	}
+	out.Reset()
+	e.sinks = append(e.sinks, sink)
+	e.emit("UpgradeStarted", nil)
+	if !strings.Contains(out.String(), "Published UpgradeStarted event to 1 of 2 sink(s)") {
+		t.Errorf("expected the event published to 1 of 2 sinks, got %s", out.String())
+	}
+	checkEventTypes(t, []string{"UpgradeStarted"}, sink.types())
+}
@@ -0,0 +1,1147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// fakeAWS simulates an autoscaling group, an ECS cluster running on it and the target groups in front of it.
+// New instances become healthy, join the cluster and get registered in the target groups immediately,
+// tasks move from draining container instances to active container instances immediately.
+type fakeAWS struct {
+	mu sync.Mutex
+
+	asgName           string
+	desiredCapacity   int64
+	launchConfig      string
+	launchTemplate    string
+	launchTemplateVer string
+	instances         []*fakeInstance
+	launchConfigs     map[string]*autoscaling.LaunchConfiguration
+	launchTemplates   map[string][]*ec2.LaunchTemplateVersion
+	images            []*ec2.Image
+	tags              map[string]string
+	// launchTemplateRequests is the data of the launch templates and versions created with CreateLaunchTemplate(Version)
+	launchTemplateRequests []*ec2.RequestLaunchTemplateData
+	// subnets of the autoscaling group, the instance types with the availability zones they are offered in and the security groups
+	subnets        []*ec2.Subnet
+	instanceTypes  []*ec2.InstanceTypeInfo
+	offerings      map[string][]string
+	securityGroups []*ec2.SecurityGroup
+
+	cluster            string
+	clusterTags        map[string]string
+	containerInstances []*fakeContainerInstance
+	stoppedTasks       []*ecs.Task
+	serviceEvents      []*ecs.ServiceEvent
+	targetGroups       []string
+	alarms             []*cloudwatch.MetricAlarm
+	s3Objects          map[string][]byte
+	snsMessages        []*sns.PublishInput
+	ssmParameters      map[string]string
+	// ssmParameterHistory are the previous values of the SSM parameters, oldest first
+	ssmParameterHistory map[string][]string
+	eventBridgeEvents   []*eventbridge.PutEventsRequestEntry
+
+	// agentVersions and attributes per AMI, used when instances join the cluster
+	agentVersions map[string]string
+	attributes    map[string][]string
+	// alarmOnImage puts all alarms in ALARM state when an instance with this AMI launches
+	alarmOnImage string
+	// alarmAt puts all alarms in ALARM state from this time on
+	alarmAt time.Time
+	// failTasksOnImage makes tasks fail to start on instances with this AMI
+	failTasksOnImage string
+	// unhealthyOnImage keeps the instances with this AMI unhealthy in the autoscaling group
+	unhealthyOnImage string
+	// initialTargetsOnImage keeps the targets of the instances with this AMI in the initial state
+	initialTargetsOnImage string
+	// agentUpdateStatuses leaves the agent update of these instances in the given status, e.g. PENDING or FAILED
+	agentUpdateStatuses map[string]string
+	// agentUpdates are the instances of the UpdateContainerAgent calls
+	agentUpdates []string
+	// launchConfigInUse makes deleting a launch configuration fail
+	launchConfigInUse bool
+	// listServicesErr is returned when the services are listed
+	listServicesErr error
+	// onDrain is called when a container instance is set to DRAINING
+	onDrain func()
+	// latency is the time the describe calls of target health and tasks take, to measure fan-outs in benchmarks
+	latency time.Duration
+
+	clock *fakeClock
+	seq   int
+}
+
+type fakeInstance struct {
+	InstanceId            string
+	ImageId               string
+	LaunchConfig          string
+	LaunchTemplateName    string
+	LaunchTemplateVersion string
+	IP                    string
+}
+
+type fakeContainerInstance struct {
+	Arn               string
+	InstanceId        string
+	ImageId           string
+	Status            string
+	AgentVersion      string
+	AgentUpdateStatus string
+	Attributes        []string
+	RunningTasks      int64
+}
+
+const (
+	fakeOldAMI = "ami-old"
+	fakeNewAMI = "ami-new"
+)
+
+// newFakeAWS returns a cluster with instanceCount instances running the old AMI, with tasksPerInstance tasks on every instance
+func newFakeAWS(instanceCount int, tasksPerInstance int64, useLaunchTemplates bool) *fakeAWS {
+	f := &fakeAWS{
+		clock:               newFakeClock(),
+		asgName:             "asg",
+		cluster:             "cluster",
+		desiredCapacity:     int64(instanceCount),
+		launchConfigs:       make(map[string]*autoscaling.LaunchConfiguration),
+		launchTemplates:     make(map[string][]*ec2.LaunchTemplateVersion),
+		tags:                make(map[string]string),
+		clusterTags:         make(map[string]string),
+		s3Objects:           make(map[string][]byte),
+		ssmParameters:       make(map[string]string),
+		ssmParameterHistory: make(map[string][]string),
+		images: []*ec2.Image{
+			{ImageId: aws.String(fakeOldAMI), CreationDate: aws.String("2024-01-01T00:00:00.000Z"), Architecture: aws.String("x86_64"), RootDeviceName: aws.String("/dev/xvda")},
+			{ImageId: aws.String(fakeNewAMI), CreationDate: aws.String("2024-06-01T00:00:00.000Z"), Architecture: aws.String("x86_64"), RootDeviceName: aws.String("/dev/xvda"),
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{{DeviceName: aws.String("/dev/xvda"), Ebs: &ec2.EbsBlockDevice{VolumeSize: aws.Int64(30)}}}},
+		},
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a"), AvailabilityZone: aws.String("eu-west-1a"), VpcId: aws.String("vpc-1")},
+			{SubnetId: aws.String("subnet-b"), AvailabilityZone: aws.String("eu-west-1b"), VpcId: aws.String("vpc-1")},
+		},
+		instanceTypes: []*ec2.InstanceTypeInfo{
+			{InstanceType: aws.String("m5.large"), Hypervisor: aws.String("nitro"), ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{"x86_64"})}},
+			{InstanceType: aws.String("m6i.large"), Hypervisor: aws.String("nitro"), ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{"x86_64"})}},
+			{InstanceType: aws.String("m7g.large"), Hypervisor: aws.String("nitro"), ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{"arm64"})}},
+			{InstanceType: aws.String("m4.large"), Hypervisor: aws.String("xen"), ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{"i386", "x86_64"})}},
+			{InstanceType: aws.String("m7i.large"), Hypervisor: aws.String("nitro"), ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{"x86_64"})}},
+		},
+		offerings: map[string][]string{
+			"m5.large":  {"eu-west-1a", "eu-west-1b"},
+			"m6i.large": {"eu-west-1a", "eu-west-1b"},
+			"m7g.large": {"eu-west-1a", "eu-west-1b"},
+			"m4.large":  {"eu-west-1a", "eu-west-1b"},
+			"m7i.large": {"eu-west-1a"},
+		},
+		securityGroups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-1"), VpcId: aws.String("vpc-1")},
+			{GroupId: aws.String("sg-2"), VpcId: aws.String("vpc-2")},
+		},
+		targetGroups:  []string{"arn:aws:elasticloadbalancing:tg/web"},
+		agentVersions: map[string]string{fakeOldAMI: "1.70.0", fakeNewAMI: "1.80.0"},
+		attributes: map[string][]string{
+			fakeOldAMI: {"ecs.capability.secrets.ssm.environment-variables", "ecs.os-type"},
+			fakeNewAMI: {"ecs.capability.secrets.ssm.environment-variables", "ecs.os-type"},
+		},
+	}
+	if useLaunchTemplates {
+		f.launchTemplate = "lt"
+		f.launchTemplateVer = "1"
+		f.launchTemplates["lt"] = []*ec2.LaunchTemplateVersion{
+			{
+				LaunchTemplateId:   aws.String("lt-1"),
+				LaunchTemplateName: aws.String("lt"),
+				VersionNumber:      aws.Int64(1),
+				LaunchTemplateData: &ec2.ResponseLaunchTemplateData{ImageId: aws.String(fakeOldAMI), InstanceType: aws.String("m5.large")},
+			},
+		}
+	} else {
+		f.launchConfig = "lc"
+		f.launchConfigs["lc"] = &autoscaling.LaunchConfiguration{
+			LaunchConfigurationName: aws.String("lc"),
+			ImageId:                 aws.String(fakeOldAMI),
+			InstanceType:            aws.String("m5.large"),
+		}
+	}
+	for i := 0; i < instanceCount; i++ {
+		ci := f.launchInstance()
+		ci.RunningTasks = tasksPerInstance
+	}
+	return f
+}
+
+func (f *fakeAWS) clients() Clients {
+	return Clients{
+		Autoscaling: Autoscaling{svcAutoscaling: fakeAutoscaling{fakeAWS: f}, svcEC2: fakeEC2{fakeAWS: f}, svcSSM: fakeSSM{fakeAWS: f}, clock: f.clock},
+		ECS:         ECS{svc: fakeECS{fakeAWS: f}, clock: f.clock},
+		LB:          LB{svc: fakeELBV2{fakeAWS: f}},
+		CloudWatch:  CloudWatch{svc: fakeCloudWatch{fakeAWS: f}},
+		Lock:        Lock{svcAutoscaling: fakeAutoscaling{fakeAWS: f}, svcECS: fakeECS{fakeAWS: f}, clock: f.clock},
+		S3:          S3{svc: fakeS3{fakeAWS: f}},
+		SNS:         SNS{svc: fakeSNS{fakeAWS: f}},
+		EventBridge: EventBridge{svc: fakeEventBridge{fakeAWS: f}},
+		Clock:       f.clock,
+	}
+}
+
+func (f *fakeAWS) target() Target {
+	return Target{Cluster: f.cluster, AutoscalingGroup: f.asgName}
+}
+
+func (f *fakeAWS) currentImage() string {
+	if f.launchTemplate != "" {
+		return aws.StringValue(f.getLaunchTemplateVersion(f.launchTemplate, f.launchTemplateVer).LaunchTemplateData.ImageId)
+	}
+	return aws.StringValue(f.launchConfigs[f.launchConfig].ImageId)
+}
+
+func (f *fakeAWS) getLaunchTemplateVersion(name, version string) *ec2.LaunchTemplateVersion {
+	versions := f.launchTemplates[name]
+	if version == "$Latest" || version == "" {
+		return versions[len(versions)-1]
+	}
+	for _, v := range versions {
+		if strconv.FormatInt(aws.Int64Value(v.VersionNumber), 10) == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// launchInstance launches an instance with the current launch configuration or template and registers it in the cluster
+func (f *fakeAWS) launchInstance() *fakeContainerInstance {
+	f.seq++
+	instance := &fakeInstance{
+		InstanceId:            fmt.Sprintf("i-%04d", f.seq),
+		ImageId:               f.currentImage(),
+		LaunchConfig:          f.launchConfig,
+		LaunchTemplateName:    f.launchTemplate,
+		LaunchTemplateVersion: f.launchTemplateVer,
+		IP:                    fmt.Sprintf("10.0.%d.%d", f.seq/250, f.seq%250),
+	}
+	f.instances = append(f.instances, instance)
+	ci := &fakeContainerInstance{
+		Arn:          "arn:aws:ecs:container-instance/" + instance.InstanceId,
+		InstanceId:   instance.InstanceId,
+		ImageId:      instance.ImageId,
+		Status:       "ACTIVE",
+		AgentVersion: f.agentVersions[instance.ImageId],
+		Attributes:   f.attributes[instance.ImageId],
+	}
+	f.containerInstances = append(f.containerInstances, ci)
+	if f.alarmOnImage != "" && instance.ImageId == f.alarmOnImage {
+		for _, alarm := range f.alarms {
+			alarm.StateValue = aws.String(cloudwatch.StateValueAlarm)
+		}
+	}
+	return ci
+}
+
+func (f *fakeAWS) terminateInstance(instanceId string) {
+	for k, instance := range f.instances {
+		if instance.InstanceId == instanceId {
+			f.instances = append(f.instances[:k], f.instances[k+1:]...)
+			break
+		}
+	}
+	for k, ci := range f.containerInstances {
+		if ci.InstanceId == instanceId {
+			f.containerInstances = append(f.containerInstances[:k], f.containerInstances[k+1:]...)
+			f.placeTasks(ci.RunningTasks)
+			break
+		}
+	}
+}
+
+// placeTasks places tasks on the active container instances, or records failed tasks when the instance can't run them
+func (f *fakeAWS) placeTasks(count int64) int64 {
+	var placed int64
+	for i := int64(0); i < count; i++ {
+		var target *fakeContainerInstance
+		for _, ci := range f.containerInstances {
+			if ci.Status == "ACTIVE" && (target == nil || ci.RunningTasks < target.RunningTasks) {
+				target = ci
+			}
+		}
+		if target == nil {
+			return placed
+		}
+		if f.failTasksOnImage != "" && target.ImageId == f.failTasksOnImage {
+			f.seq++
+			f.stoppedTasks = append(f.stoppedTasks, &ecs.Task{
+				TaskArn:              aws.String(fmt.Sprintf("arn:aws:ecs:task/stopped-%d", f.seq)),
+				ContainerInstanceArn: aws.String(target.Arn),
+				Group:                aws.String("service:web"),
+				StopCode:             aws.String(ecs.TaskStopCodeTaskFailedToStart),
+				StoppedReason:        aws.String("CannotStartContainerError"),
+				StoppedAt:            aws.Time(f.clock.Now()),
+			})
+			continue
+		}
+		target.RunningTasks++
+		placed++
+	}
+	return placed
+}
+
+func (f *fakeAWS) isCurrent(instance *fakeInstance) bool {
+	if f.launchTemplate != "" {
+		return instance.LaunchTemplateName == f.launchTemplate && instance.LaunchTemplateVersion == f.launchTemplateVer
+	}
+	return instance.LaunchConfig == f.launchConfig
+}
+
+// scale launches or terminates instances. Instances not using the current launch configuration or template are terminated first
+func (f *fakeAWS) scale(desired int64) {
+	f.desiredCapacity = desired
+	for int64(len(f.instances)) < desired {
+		f.launchInstance()
+	}
+	for int64(len(f.instances)) > desired {
+		victim := f.instances[0]
+		for _, instance := range f.instances {
+			if !f.isCurrent(instance) {
+				victim = instance
+				break
+			}
+		}
+		f.terminateInstance(victim.InstanceId)
+	}
+}
+
+func (f *fakeAWS) containerInstance(arn string) *fakeContainerInstance {
+	for _, ci := range f.containerInstances {
+		if ci.Arn == arn || strings.HasSuffix(ci.Arn, "/"+arn) {
+			return ci
+		}
+	}
+	return nil
+}
+
+func (f *fakeAWS) instancesWithImage(imageId string) []*fakeInstance {
+	var instances []*fakeInstance
+	for _, instance := range f.instances {
+		if instance.ImageId == imageId {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// fakePages calls page with the bounds of every page of total items, like the Pages methods of the SDK, until page returns false
+func fakePages(total, pageSize int, page func(from, to int, lastPage bool) bool) {
+	for from := 0; from == 0 || from < total; from += pageSize {
+		to := from + pageSize
+		if to > total {
+			to = total
+		}
+		if !page(from, to, to == total) {
+			return
+		}
+	}
+}
+
+/*
+ * autoscaling
+ */
+type fakeAutoscaling struct {
+	autoscalingiface.AutoScalingAPI
+	*fakeAWS
+}
+
+func (f fakeAutoscaling) DescribeAutoScalingGroupsWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String(f.asgName),
+		DesiredCapacity:      aws.Int64(f.desiredCapacity),
+		MinSize:              aws.Int64(0),
+		MaxSize:              aws.Int64(1000),
+	}
+	var subnets []string
+	for _, subnet := range f.subnets {
+		subnets = append(subnets, aws.StringValue(subnet.SubnetId))
+	}
+	group.VPCZoneIdentifier = aws.String(strings.Join(subnets, ","))
+	if f.launchTemplate != "" {
+		group.LaunchTemplate = &autoscaling.LaunchTemplateSpecification{
+			LaunchTemplateName: aws.String(f.launchTemplate),
+			Version:            aws.String(f.launchTemplateVer),
+		}
+	} else {
+		group.LaunchConfigurationName = aws.String(f.launchConfig)
+	}
+	for _, instance := range f.instances {
+		group.Instances = append(group.Instances, &autoscaling.Instance{InstanceId: aws.String(instance.InstanceId)})
+	}
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{group}}, nil
+}
+
+func (f fakeAutoscaling) DescribeAutoScalingInstancesPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingInstancesInput, fn func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(input.InstanceIds) > 50 {
+		return awserr.New("ValidationError", "The number of instance ids that may be passed in is limited to 50", nil)
+	}
+	output := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	for _, instance := range f.instances {
+		if !stringInSlice(instance.InstanceId, aws.StringValueSlice(input.InstanceIds)) {
+			continue
+		}
+		details := &autoscaling.InstanceDetails{
+			InstanceId:   aws.String(instance.InstanceId),
+			HealthStatus: aws.String("HEALTHY"),
+		}
+		if f.unhealthyOnImage != "" && instance.ImageId == f.unhealthyOnImage {
+			details.HealthStatus = aws.String("UNHEALTHY")
+		}
+		if instance.LaunchTemplateName != "" {
+			details.LaunchTemplate = &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateName: aws.String(instance.LaunchTemplateName),
+				Version:            aws.String(instance.LaunchTemplateVersion),
+			}
+		} else {
+			details.LaunchConfigurationName = aws.String(instance.LaunchConfig)
+		}
+		output.AutoScalingInstances = append(output.AutoScalingInstances, details)
+	}
+	fakePages(len(output.AutoScalingInstances), 20, func(from, to int, lastPage bool) bool {
+		return fn(&autoscaling.DescribeAutoScalingInstancesOutput{AutoScalingInstances: output.AutoScalingInstances[from:to]}, lastPage)
+	})
+	return nil
+}
+
+func (f fakeAutoscaling) UpdateAutoScalingGroupWithContext(ctx aws.Context, input *autoscaling.UpdateAutoScalingGroupInput, opts ...request.Option) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// a group uses either a launch configuration or a launch template
+	if input.LaunchConfigurationName != nil {
+		f.launchConfig = aws.StringValue(input.LaunchConfigurationName)
+		f.launchTemplate, f.launchTemplateVer = "", ""
+	}
+	if input.LaunchTemplate != nil {
+		f.launchTemplate = aws.StringValue(input.LaunchTemplate.LaunchTemplateName)
+		f.launchTemplateVer = aws.StringValue(input.LaunchTemplate.Version)
+		f.launchConfig = ""
+	}
+	if input.DesiredCapacity != nil {
+		f.scale(aws.Int64Value(input.DesiredCapacity))
+	}
+	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
+}
+
+func (f fakeAutoscaling) DescribeLaunchConfigurationsPagesWithContext(ctx aws.Context, input *autoscaling.DescribeLaunchConfigurationsInput, fn func(*autoscaling.DescribeLaunchConfigurationsOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &autoscaling.DescribeLaunchConfigurationsOutput{}
+	for _, name := range input.LaunchConfigurationNames {
+		if lc, ok := f.launchConfigs[aws.StringValue(name)]; ok {
+			output.LaunchConfigurations = append(output.LaunchConfigurations, lc)
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (f fakeAutoscaling) CreateLaunchConfigurationWithContext(ctx aws.Context, input *autoscaling.CreateLaunchConfigurationInput, opts ...request.Option) (*autoscaling.CreateLaunchConfigurationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.StringValue(input.LaunchConfigurationName)
+	if _, ok := f.launchConfigs[name]; ok {
+		return nil, awserr.New(autoscaling.ErrCodeAlreadyExistsFault, "launch configuration already exists", nil)
+	}
+	f.launchConfigs[name] = &autoscaling.LaunchConfiguration{
+		LaunchConfigurationName: input.LaunchConfigurationName,
+		ImageId:                 input.ImageId,
+		InstanceType:            input.InstanceType,
+		UserData:                input.UserData,
+		BlockDeviceMappings:     input.BlockDeviceMappings,
+		MetadataOptions:         input.MetadataOptions,
+		InstanceMonitoring:      input.InstanceMonitoring,
+		SecurityGroups:          input.SecurityGroups,
+	}
+	return &autoscaling.CreateLaunchConfigurationOutput{}, nil
+}
+
+func (f fakeAutoscaling) DeleteLaunchConfigurationWithContext(ctx aws.Context, input *autoscaling.DeleteLaunchConfigurationInput, opts ...request.Option) (*autoscaling.DeleteLaunchConfigurationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.StringValue(input.LaunchConfigurationName)
+	if f.launchConfigInUse {
+		return nil, awserr.New(autoscaling.ErrCodeResourceInUseFault, "launch configuration in use", nil)
+	}
+	for _, instance := range f.instances {
+		if instance.LaunchConfig == name {
+			return nil, awserr.New(autoscaling.ErrCodeResourceInUseFault, "launch configuration in use", nil)
+		}
+	}
+	delete(f.launchConfigs, name)
+	return &autoscaling.DeleteLaunchConfigurationOutput{}, nil
+}
+
+func (f fakeAutoscaling) TerminateInstanceInAutoScalingGroupWithContext(ctx aws.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, opts ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.terminateInstance(aws.StringValue(input.InstanceId))
+	if aws.BoolValue(input.ShouldDecrementDesiredCapacity) {
+		f.desiredCapacity--
+	} else {
+		f.launchInstance()
+	}
+	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+}
+
+func (f fakeAutoscaling) DescribeTagsWithContext(ctx aws.Context, input *autoscaling.DescribeTagsInput, opts ...request.Option) (*autoscaling.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Name) == "auto-scaling-group" && !stringInSlice(f.asgName, aws.StringValueSlice(filter.Values)) {
+			return &autoscaling.DescribeTagsOutput{}, nil
+		}
+		if aws.StringValue(filter.Name) == "key" {
+			keys = aws.StringValueSlice(filter.Values)
+		}
+	}
+	var tags []*autoscaling.TagDescription
+	for key, value := range f.tags {
+		if keys == nil || stringInSlice(key, keys) {
+			tags = append(tags, &autoscaling.TagDescription{ResourceId: aws.String(f.asgName), Key: aws.String(key), Value: aws.String(value)})
+		}
+	}
+	return &autoscaling.DescribeTagsOutput{Tags: tags}, nil
+}
+
+func (f fakeAutoscaling) CreateOrUpdateTagsWithContext(ctx aws.Context, input *autoscaling.CreateOrUpdateTagsInput, opts ...request.Option) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, tag := range input.Tags {
+		f.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (f fakeAutoscaling) DeleteTagsWithContext(ctx aws.Context, input *autoscaling.DeleteTagsInput, opts ...request.Option) (*autoscaling.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, tag := range input.Tags {
+		delete(f.tags, aws.StringValue(tag.Key))
+	}
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
+/*
+ * ec2
+ */
+type fakeEC2 struct {
+	ec2iface.EC2API
+	*fakeAWS
+}
+
+func (f fakeEC2) DescribeImagesWithContext(ctx aws.Context, input *ec2.DescribeImagesInput, opts ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeImagesOutput{}
+	for _, image := range f.images {
+		if len(input.ImageIds) > 0 && !stringInSlice(aws.StringValue(image.ImageId), aws.StringValueSlice(input.ImageIds)) {
+			continue
+		}
+		match := true
+		for _, filter := range input.Filters {
+			if aws.StringValue(filter.Name) == "architecture" && !stringInSlice(aws.StringValue(image.Architecture), aws.StringValueSlice(filter.Values)) {
+				match = false
+			}
+		}
+		if match {
+			output.Images = append(output.Images, image)
+		}
+	}
+	return output, nil
+}
+
+func (f fakeEC2) DescribeSubnetsWithContext(ctx aws.Context, input *ec2.DescribeSubnetsInput, opts ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeSubnetsOutput{}
+	for _, subnet := range f.subnets {
+		if stringInSlice(aws.StringValue(subnet.SubnetId), aws.StringValueSlice(input.SubnetIds)) {
+			output.Subnets = append(output.Subnets, subnet)
+		}
+	}
+	return output, nil
+}
+
+func (f fakeEC2) DescribeInstanceTypesWithContext(ctx aws.Context, input *ec2.DescribeInstanceTypesInput, opts ...request.Option) (*ec2.DescribeInstanceTypesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeInstanceTypesOutput{}
+	for _, instanceType := range input.InstanceTypes {
+		found := false
+		for _, info := range f.instanceTypes {
+			if aws.StringValue(info.InstanceType) == aws.StringValue(instanceType) {
+				output.InstanceTypes = append(output.InstanceTypes, info)
+				found = true
+			}
+		}
+		if !found {
+			return nil, awserr.New("InvalidInstanceType", "The following supplied instance types do not exist: ["+aws.StringValue(instanceType)+"]", nil)
+		}
+	}
+	return output, nil
+}
+
+func (f fakeEC2) DescribeInstanceTypeOfferingsPagesWithContext(ctx aws.Context, input *ec2.DescribeInstanceTypeOfferingsInput, fn func(*ec2.DescribeInstanceTypeOfferingsOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var instanceTypes, locations []string
+	for _, filter := range input.Filters {
+		switch aws.StringValue(filter.Name) {
+		case "instance-type":
+			instanceTypes = aws.StringValueSlice(filter.Values)
+		case "location":
+			locations = aws.StringValueSlice(filter.Values)
+		}
+	}
+	output := &ec2.DescribeInstanceTypeOfferingsOutput{}
+	for _, instanceType := range instanceTypes {
+		for _, zone := range f.offerings[instanceType] {
+			if stringInSlice(zone, locations) {
+				output.InstanceTypeOfferings = append(output.InstanceTypeOfferings, &ec2.InstanceTypeOffering{InstanceType: aws.String(instanceType), Location: aws.String(zone), LocationType: input.LocationType})
+			}
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (f fakeEC2) DescribeSecurityGroupsWithContext(ctx aws.Context, input *ec2.DescribeSecurityGroupsInput, opts ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range input.GroupIds {
+		found := false
+		for _, sg := range f.securityGroups {
+			if aws.StringValue(sg.GroupId) == aws.StringValue(id) {
+				output.SecurityGroups = append(output.SecurityGroups, sg)
+				found = true
+			}
+		}
+		if !found {
+			return nil, awserr.New("InvalidGroup.NotFound", "The security group '"+aws.StringValue(id)+"' does not exist", nil)
+		}
+	}
+	return output, nil
+}
+
+func (f fakeEC2) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var reservations []*ec2.Reservation
+	for _, instance := range f.instances {
+		if !stringInSlice(instance.InstanceId, aws.StringValueSlice(input.InstanceIds)) {
+			continue
+		}
+		reservations = append(reservations, &ec2.Reservation{Instances: []*ec2.Instance{{
+			InstanceId:        aws.String(instance.InstanceId),
+			ImageId:           aws.String(instance.ImageId),
+			PrivateIpAddress:  aws.String(instance.IP),
+			NetworkInterfaces: []*ec2.InstanceNetworkInterface{{PrivateIpAddress: aws.String(instance.IP)}},
+		}}})
+	}
+	fakePages(len(reservations), 100, func(from, to int, lastPage bool) bool {
+		return fn(&ec2.DescribeInstancesOutput{Reservations: reservations[from:to]}, lastPage)
+	})
+	return nil
+}
+
+func (f fakeEC2) DescribeLaunchTemplateVersionsPagesWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplateVersionsInput, fn func(*ec2.DescribeLaunchTemplateVersionsOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeLaunchTemplateVersionsOutput{}
+	for _, version := range input.Versions {
+		if v := f.getLaunchTemplateVersion(aws.StringValue(input.LaunchTemplateName), aws.StringValue(version)); v != nil {
+			output.LaunchTemplateVersions = append(output.LaunchTemplateVersions, v)
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (f fakeEC2) CreateLaunchTemplateVersionWithContext(ctx aws.Context, input *ec2.CreateLaunchTemplateVersionInput, opts ...request.Option) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.StringValue(input.LaunchTemplateName)
+	if len(f.launchTemplates[name]) == 0 {
+		return nil, awserr.New("InvalidLaunchTemplateName.NotFoundException", "launch template not found", nil)
+	}
+	// without a source version, the data of the new version is the data of the request
+	data := ec2.ResponseLaunchTemplateData{}
+	if input.SourceVersion != nil {
+		source := f.getLaunchTemplateVersion(name, aws.StringValue(input.SourceVersion))
+		if source == nil {
+			return nil, awserr.New("InvalidLaunchTemplateName.NotFoundException", "launch template version not found", nil)
+		}
+		data = *source.LaunchTemplateData
+	}
+	fakeMergeLaunchTemplateData(&data, input.LaunchTemplateData)
+	f.launchTemplateRequests = append(f.launchTemplateRequests, input.LaunchTemplateData)
+	version := &ec2.LaunchTemplateVersion{
+		LaunchTemplateId:   f.launchTemplates[name][0].LaunchTemplateId,
+		LaunchTemplateName: aws.String(name),
+		VersionNumber:      aws.Int64(int64(len(f.launchTemplates[name]) + 1)),
+		LaunchTemplateData: &data,
+	}
+	f.launchTemplates[name] = append(f.launchTemplates[name], version)
+	return &ec2.CreateLaunchTemplateVersionOutput{LaunchTemplateVersion: version}, nil
+}
+
+func (f fakeEC2) CreateLaunchTemplateWithContext(ctx aws.Context, input *ec2.CreateLaunchTemplateInput, opts ...request.Option) (*ec2.CreateLaunchTemplateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.StringValue(input.LaunchTemplateName)
+	if _, ok := f.launchTemplates[name]; ok {
+		return nil, awserr.New("InvalidLaunchTemplateName.AlreadyExistsException", "launch template already exists", nil)
+	}
+	f.launchTemplateRequests = append(f.launchTemplateRequests, input.LaunchTemplateData)
+	id := fmt.Sprintf("lt-%d", len(f.launchTemplates)+1)
+	f.launchTemplates[name] = []*ec2.LaunchTemplateVersion{
+		{
+			LaunchTemplateId:   aws.String(id),
+			LaunchTemplateName: aws.String(name),
+			VersionNumber:      aws.Int64(1),
+			LaunchTemplateData: fakeLaunchTemplateData(input.LaunchTemplateData),
+		},
+	}
+	return &ec2.CreateLaunchTemplateOutput{LaunchTemplate: &ec2.LaunchTemplate{
+		LaunchTemplateId:    aws.String(id),
+		LaunchTemplateName:  aws.String(name),
+		LatestVersionNumber: aws.Int64(1),
+	}}, nil
+}
+
+// fakeLaunchTemplateData returns the data of a launch template version created with data
+func fakeLaunchTemplateData(data *ec2.RequestLaunchTemplateData) *ec2.ResponseLaunchTemplateData {
+	response := &ec2.ResponseLaunchTemplateData{}
+	fakeMergeLaunchTemplateData(response, data)
+	return response
+}
+
+// fakeMergeLaunchTemplateData overrides the settings of data that are set in request
+func fakeMergeLaunchTemplateData(data *ec2.ResponseLaunchTemplateData, request *ec2.RequestLaunchTemplateData) {
+	if request.ImageId != nil {
+		data.ImageId = request.ImageId
+	}
+	if request.InstanceType != nil {
+		data.InstanceType = request.InstanceType
+	}
+	if request.KeyName != nil {
+		data.KeyName = request.KeyName
+	}
+	if request.UserData != nil {
+		data.UserData = request.UserData
+	}
+	if request.SecurityGroupIds != nil {
+		data.SecurityGroupIds = request.SecurityGroupIds
+	}
+	if request.BlockDeviceMappings != nil {
+		data.BlockDeviceMappings = nil
+		for _, bdm := range request.BlockDeviceMappings {
+			mapping := &ec2.LaunchTemplateBlockDeviceMapping{DeviceName: bdm.DeviceName}
+			if bdm.Ebs != nil {
+				mapping.Ebs = &ec2.LaunchTemplateEbsBlockDevice{VolumeSize: bdm.Ebs.VolumeSize, VolumeType: bdm.Ebs.VolumeType, Encrypted: bdm.Ebs.Encrypted}
+			}
+			data.BlockDeviceMappings = append(data.BlockDeviceMappings, mapping)
+		}
+	}
+	if request.MetadataOptions != nil {
+		data.MetadataOptions = &ec2.LaunchTemplateInstanceMetadataOptions{
+			HttpEndpoint:            request.MetadataOptions.HttpEndpoint,
+			HttpPutResponseHopLimit: request.MetadataOptions.HttpPutResponseHopLimit,
+			HttpTokens:              request.MetadataOptions.HttpTokens,
+		}
+	}
+	if request.Monitoring != nil {
+		data.Monitoring = &ec2.LaunchTemplatesMonitoring{Enabled: request.Monitoring.Enabled}
+	}
+}
+
+/*
+ * ecs
+ */
+type fakeECS struct {
+	ecsiface.ECSAPI
+	*fakeAWS
+}
+
+func (f fakeECS) ListContainerInstancesPagesWithContext(ctx aws.Context, input *ecs.ListContainerInstancesInput, fn func(*ecs.ListContainerInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var arns []*string
+	for _, ci := range f.containerInstances {
+		arns = append(arns, aws.String(ci.Arn))
+	}
+	fakePages(len(arns), 100, func(from, to int, lastPage bool) bool {
+		return fn(&ecs.ListContainerInstancesOutput{ContainerInstanceArns: arns[from:to]}, lastPage)
+	})
+	return nil
+}
+
+func (f fakeECS) DescribeContainerInstancesWithContext(ctx aws.Context, input *ecs.DescribeContainerInstancesInput, opts ...request.Option) (*ecs.DescribeContainerInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(input.ContainerInstances) > 100 {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "too many container instances", nil)
+	}
+	output := &ecs.DescribeContainerInstancesOutput{}
+	for _, arn := range input.ContainerInstances {
+		ci := f.containerInstance(aws.StringValue(arn))
+		if ci == nil {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: arn, Reason: aws.String("MISSING")})
+			continue
+		}
+		containerInstance := &ecs.ContainerInstance{
+			ContainerInstanceArn: aws.String(ci.Arn),
+			Ec2InstanceId:        aws.String(ci.InstanceId),
+			Status:               aws.String(ci.Status),
+			RunningTasksCount:    aws.Int64(ci.RunningTasks),
+			VersionInfo:          &ecs.VersionInfo{AgentVersion: aws.String(ci.AgentVersion), DockerVersion: aws.String("20.10.25")},
+		}
+		if ci.AgentUpdateStatus != "" {
+			containerInstance.AgentUpdateStatus = aws.String(ci.AgentUpdateStatus)
+		}
+		for _, attribute := range ci.Attributes {
+			containerInstance.Attributes = append(containerInstance.Attributes, &ecs.Attribute{Name: aws.String(attribute)})
+		}
+		output.ContainerInstances = append(output.ContainerInstances, containerInstance)
+	}
+	return output, nil
+}
+
+func (f fakeECS) UpdateContainerInstancesStateWithContext(ctx aws.Context, input *ecs.UpdateContainerInstancesStateInput, opts ...request.Option) (*ecs.UpdateContainerInstancesStateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(input.ContainerInstances) > 10 {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "too many container instances", nil)
+	}
+	output := &ecs.UpdateContainerInstancesStateOutput{}
+	var draining []*fakeContainerInstance
+	for _, arn := range input.ContainerInstances {
+		ci := f.containerInstance(aws.StringValue(arn))
+		if ci == nil {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: arn, Reason: aws.String("MISSING")})
+			continue
+		}
+		ci.Status = aws.StringValue(input.Status)
+		if ci.Status == "DRAINING" {
+			draining = append(draining, ci)
+		}
+	}
+	for _, ci := range draining {
+		ci.RunningTasks -= f.placeTasks(ci.RunningTasks)
+	}
+	if len(draining) > 0 && f.onDrain != nil {
+		f.onDrain()
+	}
+	return output, nil
+}
+
+func (f fakeECS) UpdateContainerAgentWithContext(ctx aws.Context, input *ecs.UpdateContainerAgentInput, opts ...request.Option) (*ecs.UpdateContainerAgentOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ci := f.containerInstance(aws.StringValue(input.ContainerInstance))
+	if ci == nil {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "container instance not found", nil)
+	}
+	if ci.AgentVersion == f.agentVersions[fakeNewAMI] {
+		return nil, awserr.New(ecs.ErrCodeNoUpdateAvailableException, "no update available", nil)
+	}
+	f.agentUpdates = append(f.agentUpdates, ci.InstanceId)
+	if status, ok := f.agentUpdateStatuses[ci.InstanceId]; ok {
+		ci.AgentUpdateStatus = status
+		return &ecs.UpdateContainerAgentOutput{}, nil
+	}
+	ci.AgentVersion = f.agentVersions[fakeNewAMI]
+	ci.AgentUpdateStatus = ecs.AgentUpdateStatusUpdated
+	return &ecs.UpdateContainerAgentOutput{}, nil
+}
+
+func (f fakeECS) ListTasksPagesWithContext(ctx aws.Context, input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var taskArns []*string
+	if aws.StringValue(input.DesiredStatus) == "STOPPED" {
+		for _, task := range f.stoppedTasks {
+			if input.ContainerInstance == nil || aws.StringValue(task.ContainerInstanceArn) == aws.StringValue(input.ContainerInstance) {
+				taskArns = append(taskArns, task.TaskArn)
+			}
+		}
+	} else {
+		for _, ci := range f.containerInstances {
+			for i := int64(0); i < ci.RunningTasks; i++ {
+				taskArns = append(taskArns, aws.String(fmt.Sprintf("arn:aws:ecs:task/%s/%d", ci.InstanceId, i)))
+			}
+		}
+	}
+	fakePages(len(taskArns), 100, func(from, to int, lastPage bool) bool {
+		return fn(&ecs.ListTasksOutput{TaskArns: taskArns[from:to]}, lastPage)
+	})
+	return nil
+}
+
+func (f fakeECS) DescribeTasksWithContext(ctx aws.Context, input *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	time.Sleep(f.latency)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(input.Tasks) > 100 {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "too many tasks", nil)
+	}
+	output := &ecs.DescribeTasksOutput{}
+	for _, taskArn := range aws.StringValueSlice(input.Tasks) {
+		found := false
+		for _, task := range f.stoppedTasks {
+			if aws.StringValue(task.TaskArn) == taskArn {
+				output.Tasks = append(output.Tasks, task)
+				found = true
+			}
+		}
+		if !found {
+			s := strings.Split(taskArn, "/")
+			output.Tasks = append(output.Tasks, &ecs.Task{
+				TaskArn:              aws.String(taskArn),
+				ContainerInstanceArn: aws.String("arn:aws:ecs:container-instance/" + s[1]),
+				LastStatus:           aws.String("RUNNING"),
+			})
+		}
+	}
+	return output, nil
+}
+
+func (f fakeECS) DescribeClustersWithContext(ctx aws.Context, input *ecs.DescribeClustersInput, opts ...request.Option) (*ecs.DescribeClustersOutput, error) {
+	output := &ecs.DescribeClustersOutput{}
+	if stringInSlice(f.cluster, aws.StringValueSlice(input.Clusters)) {
+		output.Clusters = append(output.Clusters, &ecs.Cluster{ClusterName: aws.String(f.cluster), ClusterArn: aws.String("arn:aws:ecs:cluster/" + f.cluster)})
+	}
+	return output, nil
+}
+
+func (f fakeECS) ListTagsForResourceWithContext(ctx aws.Context, input *ecs.ListTagsForResourceInput, opts ...request.Option) (*ecs.ListTagsForResourceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ecs.ListTagsForResourceOutput{}
+	for key, value := range f.clusterTags {
+		output.Tags = append(output.Tags, &ecs.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return output, nil
+}
+
+func (f fakeECS) TagResourceWithContext(ctx aws.Context, input *ecs.TagResourceInput, opts ...request.Option) (*ecs.TagResourceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, tag := range input.Tags {
+		f.clusterTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &ecs.TagResourceOutput{}, nil
+}
+
+func (f fakeECS) UntagResourceWithContext(ctx aws.Context, input *ecs.UntagResourceInput, opts ...request.Option) (*ecs.UntagResourceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range input.TagKeys {
+		delete(f.clusterTags, aws.StringValue(key))
+	}
+	return &ecs.UntagResourceOutput{}, nil
+}
+
+func (f fakeECS) ListServicesPagesWithContext(ctx aws.Context, input *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool, opts ...request.Option) error {
+	if f.listServicesErr != nil {
+		return f.listServicesErr
+	}
+	fn(&ecs.ListServicesOutput{ServiceArns: aws.StringSlice([]string{"arn:aws:ecs:service/web"})}, true)
+	return nil
+}
+
+func (f fakeECS) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ecs.DescribeServicesOutput{}
+	for _, service := range input.Services {
+		output.Services = append(output.Services, &ecs.Service{ServiceArn: service, Events: f.serviceEvents})
+	}
+	return output, nil
+}
+
+/*
+ * elbv2
+ */
+type fakeELBV2 struct {
+	elbv2iface.ELBV2API
+	*fakeAWS
+}
+
+func (f fakeELBV2) DescribeTargetGroupsPagesWithContext(ctx aws.Context, input *elbv2.DescribeTargetGroupsInput, fn func(*elbv2.DescribeTargetGroupsOutput, bool) bool, opts ...request.Option) error {
+	var targetGroups []*elbv2.TargetGroup
+	for _, targetGroup := range f.targetGroups {
+		targetGroups = append(targetGroups, &elbv2.TargetGroup{TargetGroupArn: aws.String(targetGroup)})
+	}
+	fakePages(len(targetGroups), 2, func(from, to int, lastPage bool) bool {
+		return fn(&elbv2.DescribeTargetGroupsOutput{TargetGroups: targetGroups[from:to]}, lastPage)
+	})
+	return nil
+}
+
+func (f fakeELBV2) DescribeTargetHealthWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	time.Sleep(f.latency)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &elbv2.DescribeTargetHealthOutput{}
+	draining := make(map[string]bool)
+	for _, ci := range f.containerInstances {
+		draining[ci.InstanceId] = ci.Status == "DRAINING"
+	}
+	for _, instance := range f.instances {
+		state := "healthy"
+		if draining[instance.InstanceId] {
+			state = "draining"
+		} else if f.initialTargetsOnImage != "" && instance.ImageId == f.initialTargetsOnImage {
+			state = "initial"
+		}
+		output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(instance.InstanceId)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		})
+	}
+	return output, nil
+}
+
+/*
+ * cloudwatch
+ */
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	*fakeAWS
+}
+
+func (f fakeCloudWatch) DescribeAlarmsPagesWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsInput, fn func(*cloudwatch.DescribeAlarmsOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &cloudwatch.DescribeAlarmsOutput{}
+	for _, alarm := range f.alarms {
+		if !f.alarmAt.IsZero() && !f.clock.Now().Before(f.alarmAt) {
+			alarm.StateValue = aws.String(cloudwatch.StateValueAlarm)
+		}
+		if input.StateValue != nil && aws.StringValue(alarm.StateValue) != aws.StringValue(input.StateValue) {
+			continue
+		}
+		name := aws.StringValue(alarm.AlarmName)
+		if (input.AlarmNamePrefix != nil && strings.HasPrefix(name, aws.StringValue(input.AlarmNamePrefix))) || stringInSlice(name, aws.StringValueSlice(input.AlarmNames)) {
+			output.MetricAlarms = append(output.MetricAlarms, alarm)
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+/*
+ * s3
+ */
+type fakeS3 struct {
+	s3iface.S3API
+	*fakeAWS
+}
+
+func (f fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.s3Objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	*fakeAWS
+}
+
+func (f fakeSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.snsMessages = append(f.snsMessages, input)
+	return &sns.PublishOutput{MessageId: aws.String(fmt.Sprintf("message-%d", len(f.snsMessages)))}, nil
+}
+
+type fakeEventBridge struct {
+	eventbridgeiface.EventBridgeAPI
+	*fakeAWS
+}
+
+func (f fakeEventBridge) PutEventsWithContext(ctx aws.Context, input *eventbridge.PutEventsInput, opts ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}
+	for _, entry := range input.Entries {
+		f.eventBridgeEvents = append(f.eventBridgeEvents, entry)
+		output.Entries = append(output.Entries, &eventbridge.PutEventsResultEntry{EventId: aws.String(fmt.Sprintf("event-%d", len(f.eventBridgeEvents)))})
+	}
+	return output, nil
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	*fakeAWS
+}
+
+func (f fakeSSM) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.ssmParameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(value)}}, nil
+}
+
+func (f fakeSSM) GetParameterHistoryPagesWithContext(ctx aws.Context, input *ssm.GetParameterHistoryInput, fn func(*ssm.GetParameterHistoryOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.ssmParameters[aws.StringValue(input.Name)]
+	if !ok {
+		return awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	output := &ssm.GetParameterHistoryOutput{}
+	for i, v := range append(append([]string{}, f.ssmParameterHistory[aws.StringValue(input.Name)]...), value) {
+		output.Parameters = append(output.Parameters, &ssm.ParameterHistory{Name: input.Name, Value: aws.String(v), Version: aws.Int64(int64(i + 1))})
+	}
+	fn(output, true)
+	return nil
+}
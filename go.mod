@@ -2,17 +2,6 @@ module github.com/in4it/ecs-upgrade
 
 go 1.24.7
 
-require (
-	github.com/aws/aws-sdk-go v1.55.8
-	github.com/in4it/ecs-deploy v1.0.45
-	github.com/juju/loggo v1.0.0
-)
+require github.com/aws/aws-sdk-go v1.55.8
 
-require (
-	github.com/cenkalti/backoff/v4 v4.3.0 // indirect
-	github.com/guregu/dynamo v1.23.0 // indirect
-	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	golang.org/x/crypto v0.42.0 // indirect
-	golang.org/x/sync v0.17.0 // indirect
-	golang.org/x/sys v0.36.0 // indirect
-)
+require github.com/jmespath/go-jmespath v0.4.0 // indirect
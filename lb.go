@@ -1,46 +1,57 @@
 package main
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elbv2"
-	"github.com/juju/loggo"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 )
 
 // logging
-var lbLogger = loggo.GetLogger("lb")
+var lbLogger = getLogger("lb")
 
-type LB struct{}
+type LB struct {
+	svc elbv2iface.ELBV2API
+	// concurrency is the number of target groups that are described at the same time
+	concurrency int
+}
+
+func NewLB(sess *session.Session) LB {
+	return LB{
+		svc:         elbv2.New(sess),
+		concurrency: defaultConcurrency,
+	}
+}
 
-func (l *LB) getTargets() ([]string, error) {
+func (l *LB) getTargets(ctx context.Context) ([]string, error) {
 	var targets []string
 
-	svc := elbv2.New(session.New())
 	input := &elbv2.DescribeTargetGroupsInput{}
 
-	pageNum := 0
-	err := svc.DescribeTargetGroupsPages(input,
+	err := l.svc.DescribeTargetGroupsPagesWithContext(ctx, input,
 		func(page *elbv2.DescribeTargetGroupsOutput, lastPage bool) bool {
-			pageNum++
 			for _, target := range page.TargetGroups {
 				targets = append(targets, aws.StringValue(target.TargetGroupArn))
 			}
-			return pageNum <= 20
+			return true
 		})
 
 	if err != nil {
-		autoscalingLogger.Errorf(err.Error())
+		lbLogger.Errorf("%v", err.Error())
 	}
 
-	return targets, nil
+	return targets, err
 }
-func (l *LB) getTargetHealth(targetGroupArn string) (map[string]string, error) {
+
+// getTargetHealth returns the state of the targets by target id. DescribeTargetHealth isn't paginated,
+// it returns all targets of the target group in one response
+func (l *LB) getTargetHealth(ctx context.Context, targetGroupArn string) (map[string]string, error) {
 	targetHealth := make(map[string]string)
-	svc := elbv2.New(session.New())
 	input := &elbv2.DescribeTargetHealthInput{
 		TargetGroupArn: aws.String(targetGroupArn),
 	}
-	result, err := svc.DescribeTargetHealth(input)
+	result, err := l.svc.DescribeTargetHealthWithContext(ctx, input)
 	if err != nil {
 		lbLogger.Errorf("%v", err.Error())
 		return targetHealth, err
@@ -50,3 +61,14 @@ func (l *LB) getTargetHealth(targetGroupArn string) (map[string]string, error) {
 	}
 	return targetHealth, nil
 }
+
+// getTargetsHealth returns the state of the targets by target id of every target group, in the order of the target groups
+func (l *LB) getTargetsHealth(ctx context.Context, targetGroupArns []string) ([]map[string]string, error) {
+	targetsHealth := make([]map[string]string, len(targetGroupArns))
+	err := forEach(ctx, l.concurrency, len(targetGroupArns), func(ctx context.Context, i int) error {
+		var err error
+		targetsHealth[i], err = l.getTargetHealth(ctx, targetGroupArns[i])
+		return err
+	})
+	return targetsHealth, err
+}
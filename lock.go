@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// logging
+var lockLogger = getLogger("lock")
+
+// lockTagKey is the tag on the autoscaling group that holds the lock with the asg-tags backend
+const lockTagKey = "ecs-upgrade-lock"
+
+// Lock makes sure only one upgrade runs on a cluster and autoscaling group at a time
+type Lock struct {
+	svcAutoscaling autoscalingiface.AutoScalingAPI
+	svcECS         ecsiface.ECSAPI
+	svcDynamoDB    dynamodbiface.DynamoDBAPI
+	// region of the cluster, part of the lock key
+	region string
+	clock  Clock
+}
+
+// LockInfo describes who holds a lock and until when. The nonce is unique per run, so two runs with the same owner
+// don't take each other's lock
+type LockInfo struct {
+	Key        string    `json:"key"`
+	Owner      string    `json:"owner"`
+	Nonce      string    `json:"nonce"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// lockBackend stores locks. put only succeeds when the stored lock is still previous (nil when there was no lock)
+type lockBackend interface {
+	get(ctx context.Context, key string) (*LockInfo, error)
+	put(ctx context.Context, lock LockInfo, previous *LockInfo) error
+	delete(ctx context.Context, lock LockInfo) error
+}
+
+// lockHeldError is returned when another upgrade holds the lock
+type lockHeldError struct {
+	holder LockInfo
+}
+
+func (l lockHeldError) Error() string {
+	return fmt.Sprintf("%s is locked by %s since %s (expires at %s)", l.holder.Key, l.holder.Owner, l.holder.AcquiredAt.Format(time.RFC3339), l.holder.ExpiresAt.Format(time.RFC3339))
+}
+
+// errLockChanged is returned by a backend when the lock changed between reading and writing it
+var errLockChanged = errors.New("lock changed while acquiring it")
+
+// HeldLock is an acquired lock that is kept alive until it is released
+type HeldLock struct {
+	backend lockBackend
+	clock   Clock
+	ttl     time.Duration
+	mu      sync.Mutex
+	info    LockInfo
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewLock(sess *session.Session) Lock {
+	return Lock{
+		svcAutoscaling: autoscaling.New(sess),
+		svcECS:         ecs.New(sess),
+		svcDynamoDB:    dynamodb.New(sess),
+		region:         aws.StringValue(sess.Config.Region),
+		clock:          realClock{},
+	}
+}
+
+// getLockOwner returns LOCK_OWNER, or the hostname and pid of this process
+func getLockOwner() string {
+	if owner := os.Getenv("LOCK_OWNER"); owner != "" {
+		return owner
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+// newLockNonce returns a random nonce for a lock
+func newLockNonce() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// backend returns the lock backend set in LOCK: asg-tags (default, the tags of the cluster without an autoscaling group),
+// dynamodb (table in LOCK_TABLE) or file (directory in LOCK_DIR).
+// A nil backend means locking is disabled
+func (l *Lock) backend(name, clusterName, asgName string) (lockBackend, error) {
+	switch name {
+	case "", "asg-tags":
+		if asgName == "" {
+			return tagLock{tags: clusterLockTags{svc: l.svcECS, clusterName: clusterName}}, nil
+		}
+		return tagLock{tags: asgLockTags{svc: l.svcAutoscaling, asgName: asgName}}, nil
+	case "dynamodb":
+		table := os.Getenv("LOCK_TABLE")
+		if table == "" {
+			return nil, fmt.Errorf("LOCK_TABLE not set")
+		}
+		return dynamoDBLock{svc: l.svcDynamoDB, table: table}, nil
+	case "file":
+		dir := os.Getenv("LOCK_DIR")
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		return fileLock{dir: dir}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("LOCK must be asg-tags, dynamodb, file or none (got %s)", name)
+}
+
+// acquire takes the lock for key. An expired lock of another run is taken over and reported.
+// The lock is refreshed every third of the ttl until it is released, also when ctx is cancelled. When refreshing fails, lost is called
+func (l *Lock) acquire(ctx context.Context, backend lockBackend, key, owner string, ttl time.Duration, lost func(error)) (*HeldLock, error) {
+	current, err := backend.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// tags store the times in seconds
+	now := l.clock.Now().UTC().Truncate(time.Second)
+	if current != nil {
+		if now.Before(current.ExpiresAt) {
+			return nil, lockHeldError{holder: *current}
+		}
+		lockLogger.Infof("Taking over stale lock of %s: held by %s since %s, expired at %s", key, current.Owner, current.AcquiredAt.Format(time.RFC3339), current.ExpiresAt.Format(time.RFC3339))
+	}
+	info := LockInfo{Key: key, Owner: owner, Nonce: newLockNonce(), AcquiredAt: now, ExpiresAt: now.Add(ttl)}
+	err = backend.put(ctx, info, current)
+	if err == errLockChanged {
+		// someone else was faster, report the new holder
+		current, err = backend.get(ctx, key)
+		if err == nil && current != nil {
+			return nil, lockHeldError{holder: *current}
+		}
+		return nil, errLockChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockLogger.Debugf("Acquired lock %s as %s until %s", key, owner, info.ExpiresAt.Format(time.RFC3339))
+	h := &HeldLock{
+		backend: backend,
+		clock:   l.clock,
+		ttl:     ttl,
+		info:    info,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// keep the lock while a cancelled run rolls back, until it is released
+	go h.heartbeat(context.WithoutCancel(ctx), lost)
+	return h, nil
+}
+
+// heartbeat extends the lock every third of the ttl until the lock is released. It runs on wall-clock time, as it runs next to the upgrade
+func (h *HeldLock) heartbeat(ctx context.Context, lost func(error)) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			err := h.refresh(ctx)
+			if err != nil {
+				lockLogger.Errorf("Could not refresh lock %s: %v", h.info.Key, err)
+				if lost != nil {
+					lost(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (h *HeldLock) refresh(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.info
+	next := h.info
+	next.ExpiresAt = h.clock.Now().UTC().Truncate(time.Second).Add(h.ttl)
+	err := h.backend.put(ctx, next, &previous)
+	if err != nil {
+		return err
+	}
+	h.info = next
+	return nil
+}
+
+// release stops the heartbeat and removes the lock
+func (h *HeldLock) release(ctx context.Context) error {
+	close(h.stop)
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.backend.delete(ctx, h.info)
+	if err != nil {
+		return err
+	}
+	lockLogger.Debugf("Released lock %s", h.info.Key)
+	return nil
+}
+
+// tagLock stores the lock in a tag of the autoscaling group or of the cluster. Tags have no conditional writes,
+// so the tag is read back after writing it to detect a concurrent writer
+type tagLock struct {
+	tags lockTags
+}
+
+// lockTags reads and writes the lock tag of a resource
+type lockTags interface {
+	getTag(ctx context.Context) (string, bool, error)
+	putTag(ctx context.Context, value string) error
+	deleteTag(ctx context.Context) error
+}
+
+func (t tagLock) get(ctx context.Context, key string) (*LockInfo, error) {
+	value, ok, err := t.tags.getTag(ctx)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return decodeLockTag(key, value)
+}
+
+func (t tagLock) put(ctx context.Context, lock LockInfo, previous *LockInfo) error {
+	current, err := t.get(ctx, lock.Key)
+	if err != nil {
+		return err
+	}
+	if !sameLock(current, previous) {
+		return errLockChanged
+	}
+	err = t.tags.putTag(ctx, encodeLockTag(lock))
+	if err != nil {
+		return err
+	}
+	written, err := t.get(ctx, lock.Key)
+	if err != nil {
+		return err
+	}
+	if !sameLock(written, &lock) {
+		return errLockChanged
+	}
+	return nil
+}
+
+func (t tagLock) delete(ctx context.Context, lock LockInfo) error {
+	current, err := t.get(ctx, lock.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Nonce != lock.Nonce {
+		return nil
+	}
+	return t.tags.deleteTag(ctx)
+}
+
+// asgLockTags is the lock tag of the autoscaling group
+type asgLockTags struct {
+	svc     autoscalingiface.AutoScalingAPI
+	asgName string
+}
+
+func (a asgLockTags) getTag(ctx context.Context) (string, bool, error) {
+	input := &autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{Name: aws.String("auto-scaling-group"), Values: aws.StringSlice([]string{a.asgName})},
+			{Name: aws.String("key"), Values: aws.StringSlice([]string{lockTagKey})},
+		},
+	}
+	result, err := a.svc.DescribeTagsWithContext(ctx, input)
+	if err != nil {
+		logLockError(err)
+		return "", false, err
+	}
+	for _, tag := range result.Tags {
+		return aws.StringValue(tag.Value), true, nil
+	}
+	return "", false, nil
+}
+
+func (a asgLockTags) putTag(ctx context.Context, value string) error {
+	input := &autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{{
+			ResourceId:        aws.String(a.asgName),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(lockTagKey),
+			Value:             aws.String(value),
+			PropagateAtLaunch: aws.Bool(false),
+		}},
+	}
+	_, err := a.svc.CreateOrUpdateTagsWithContext(ctx, input)
+	if err != nil {
+		logLockError(err)
+	}
+	return err
+}
+
+func (a asgLockTags) deleteTag(ctx context.Context) error {
+	input := &autoscaling.DeleteTagsInput{
+		Tags: []*autoscaling.Tag{{
+			ResourceId:   aws.String(a.asgName),
+			ResourceType: aws.String("auto-scaling-group"),
+			Key:          aws.String(lockTagKey),
+		}},
+	}
+	_, err := a.svc.DeleteTagsWithContext(ctx, input)
+	if err != nil {
+		logLockError(err)
+	}
+	return err
+}
+
+// clusterLockTags is the lock tag of the ECS cluster, used when there is no autoscaling group
+type clusterLockTags struct {
+	svc         ecsiface.ECSAPI
+	clusterName string
+}
+
+// clusterArn returns the arn of the cluster, as the tag calls don't take a cluster name
+func (c clusterLockTags) clusterArn(ctx context.Context) (string, error) {
+	result, err := c.svc.DescribeClustersWithContext(ctx, &ecs.DescribeClustersInput{Clusters: aws.StringSlice([]string{c.clusterName})})
+	if err != nil {
+		logLockError(err)
+		return "", err
+	}
+	if len(result.Clusters) == 0 {
+		return "", fmt.Errorf("cluster %s not found", c.clusterName)
+	}
+	return aws.StringValue(result.Clusters[0].ClusterArn), nil
+}
+
+func (c clusterLockTags) getTag(ctx context.Context) (string, bool, error) {
+	arn, err := c.clusterArn(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	result, err := c.svc.ListTagsForResourceWithContext(ctx, &ecs.ListTagsForResourceInput{ResourceArn: aws.String(arn)})
+	if err != nil {
+		logLockError(err)
+		return "", false, err
+	}
+	for _, tag := range result.Tags {
+		if aws.StringValue(tag.Key) == lockTagKey {
+			return aws.StringValue(tag.Value), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (c clusterLockTags) putTag(ctx context.Context, value string) error {
+	arn, err := c.clusterArn(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.svc.TagResourceWithContext(ctx, &ecs.TagResourceInput{
+		ResourceArn: aws.String(arn),
+		Tags:        []*ecs.Tag{{Key: aws.String(lockTagKey), Value: aws.String(value)}},
+	})
+	if err != nil {
+		logLockError(err)
+	}
+	return err
+}
+
+func (c clusterLockTags) deleteTag(ctx context.Context) error {
+	arn, err := c.clusterArn(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.svc.UntagResourceWithContext(ctx, &ecs.UntagResourceInput{ResourceArn: aws.String(arn), TagKeys: aws.StringSlice([]string{lockTagKey})})
+	if err != nil {
+		logLockError(err)
+	}
+	return err
+}
+
+// encodeLockTag encodes a lock as owner|nonce|acquiredAt|expiresAt, to stay within the 256 characters of a tag value
+func encodeLockTag(lock LockInfo) string {
+	return strings.Join([]string{lock.Owner, lock.Nonce, lock.AcquiredAt.UTC().Format(time.RFC3339), lock.ExpiresAt.UTC().Format(time.RFC3339)}, "|")
+}
+
+// decodeLockTag decodes a lock tag. A tag of an older version without a nonce has an empty nonce
+func decodeLockTag(key, value string) (*LockInfo, error) {
+	parts := strings.Split(value, "|")
+	if len(parts) == 3 {
+		parts = []string{parts[0], "", parts[1], parts[2]}
+	}
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid lock tag %s: %s", lockTagKey, value)
+	}
+	acquiredAt, err := time.Parse(time.RFC3339, parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock tag %s: %s", lockTagKey, err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock tag %s: %s", lockTagKey, err)
+	}
+	return &LockInfo{Key: key, Owner: parts[0], Nonce: parts[1], AcquiredAt: acquiredAt, ExpiresAt: expiresAt}, nil
+}
+
+// dynamoDBLock stores the lock in a DynamoDB table with the string partition key LockKey, using conditional writes
+type dynamoDBLock struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (d dynamoDBLock) get(ctx context.Context, key string) (*LockInfo, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]*dynamodb.AttributeValue{"LockKey": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := d.svc.GetItemWithContext(ctx, input)
+	if err != nil {
+		logLockError(err)
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	lock := LockInfo{Key: key, Owner: aws.StringValue(result.Item["Owner"].S)}
+	if nonce, ok := result.Item["Nonce"]; ok {
+		lock.Nonce = aws.StringValue(nonce.S)
+	}
+	lock.AcquiredAt, err = parseLockTime(result.Item["AcquiredAt"])
+	if err != nil {
+		return nil, err
+	}
+	lock.ExpiresAt, err = parseLockTime(result.Item["ExpiresAt"])
+	if err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+func (d dynamoDBLock) put(ctx context.Context, lock LockInfo, previous *LockInfo) error {
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockKey":    {S: aws.String(lock.Key)},
+			"Owner":      {S: aws.String(lock.Owner)},
+			"Nonce":      {S: aws.String(lock.Nonce)},
+			"AcquiredAt": {S: aws.String(lock.AcquiredAt.UTC().Format(time.RFC3339Nano))},
+			"ExpiresAt":  {S: aws.String(lock.ExpiresAt.UTC().Format(time.RFC3339Nano))},
+		},
+	}
+	if previous == nil {
+		input.ConditionExpression = aws.String("attribute_not_exists(LockKey)")
+	} else {
+		input.ConditionExpression = aws.String("#owner = :owner AND ExpiresAt = :expiresAt AND " + nonceCondition(previous.Nonce))
+		input.ExpressionAttributeNames = map[string]*string{"#owner": aws.String("Owner")}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":owner":     {S: aws.String(previous.Owner)},
+			":expiresAt": {S: aws.String(previous.ExpiresAt.UTC().Format(time.RFC3339Nano))},
+		}
+		if previous.Nonce != "" {
+			input.ExpressionAttributeValues[":nonce"] = &dynamodb.AttributeValue{S: aws.String(previous.Nonce)}
+		}
+	}
+	_, err := d.svc.PutItemWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errLockChanged
+	}
+	if err != nil {
+		logLockError(err)
+	}
+	return err
+}
+
+func (d dynamoDBLock) delete(ctx context.Context, lock LockInfo) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(d.table),
+		Key:                       map[string]*dynamodb.AttributeValue{"LockKey": {S: aws.String(lock.Key)}},
+		ConditionExpression:       aws.String("Nonce = :nonce"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":nonce": {S: aws.String(lock.Nonce)}},
+	}
+	_, err := d.svc.DeleteItemWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// the lock was taken over, nothing to release
+		return nil
+	}
+	if err != nil {
+		logLockError(err)
+	}
+	return err
+}
+
+// nonceCondition is the condition on the nonce of the stored lock. Locks of an older version have no nonce
+func nonceCondition(nonce string) string {
+	if nonce == "" {
+		return "attribute_not_exists(Nonce)"
+	}
+	return "Nonce = :nonce"
+}
+
+func parseLockTime(value *dynamodb.AttributeValue) (time.Time, error) {
+	if value == nil {
+		return time.Time{}, fmt.Errorf("invalid lock item: missing time")
+	}
+	return time.Parse(time.RFC3339Nano, aws.StringValue(value.S))
+}
+
+// fileLock stores the lock as a json file in a local directory. It is meant for tests and single hosts
+type fileLock struct {
+	dir string
+}
+
+func (f fileLock) filename(key string) string {
+	return filepath.Join(f.dir, "ecs-upgrade-"+strings.ReplaceAll(key, "/", "_")+".lock")
+}
+
+func (f fileLock) get(ctx context.Context, key string) (*LockInfo, error) {
+	out, err := os.ReadFile(f.filename(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lock LockInfo
+	err = json.Unmarshal(out, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %s", f.filename(key), err)
+	}
+	return &lock, nil
+}
+
+func (f fileLock) put(ctx context.Context, lock LockInfo, previous *LockInfo) error {
+	out, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		// only create the file when it doesn't exist yet
+		file, err := os.OpenFile(f.filename(lock.Key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return errLockChanged
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.Write(out)
+		return err
+	}
+	current, err := f.get(ctx, lock.Key)
+	if err != nil {
+		return err
+	}
+	if !sameLock(current, previous) {
+		return errLockChanged
+	}
+	return os.WriteFile(f.filename(lock.Key), out, 0644)
+}
+
+func (f fileLock) delete(ctx context.Context, lock LockInfo) error {
+	current, err := f.get(ctx, lock.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Nonce != lock.Nonce {
+		return nil
+	}
+	return os.Remove(f.filename(lock.Key))
+}
+
+// sameLock returns true when both locks are absent, or have the same owner, nonce and expiry
+func sameLock(a, b *LockInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Owner == b.Owner && a.Nonce == b.Nonce && a.ExpiresAt.Equal(b.ExpiresAt)
+}
+
+func logLockError(err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		lockLogger.Errorf("%v", aerr.Error())
+	} else {
+		lockLogger.Errorf("%v", err.Error())
+	}
+}
+
+// lockUpgrade acquires the lock of the cluster and autoscaling group of the target, or of the cluster without an
+// autoscaling group, with the backend in LOCK and the ttl in LOCK_TTL.
+// It returns a nil lock when locking is disabled. lost is called when the lock can't be refreshed anymore
+func lockUpgrade(ctx context.Context, l Lock, target Target, lost func(error)) (*HeldLock, error) {
+	clusterName, asgName := target.Cluster, target.AutoscalingGroup
+	backend, err := l.backend(os.Getenv("LOCK"), clusterName, asgName)
+	if err != nil || backend == nil {
+		return nil, err
+	}
+	ttl := 5 * time.Minute
+	if os.Getenv("LOCK_TTL") != "" {
+		ttl, err = getEnvDuration("LOCK_TTL")
+		if err != nil {
+			return nil, err
+		}
+		if ttl < 3*time.Second {
+			return nil, fmt.Errorf("LOCK_TTL must be at least 3s")
+		}
+	}
+	return l.acquire(ctx, backend, l.key(target), getLockOwner(), ttl, lost)
+}
+
+// key returns the lock key of the target: the account of its role, the region, the cluster and the autoscaling group,
+// e.g. 111111111111/eu-west-1/cluster/asg. Clusters with the same name in other accounts or regions don't share a lock
+func (l Lock) key(target Target) string {
+	var parts []string
+	for _, part := range []string{target.account(), l.region, target.Cluster, target.AutoscalingGroup} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
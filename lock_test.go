@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	clock := newFakeClock()
+	l := Lock{clock: clock}
+	backend := fileLock{dir: t.TempDir()}
+	ctx := context.Background()
+
+	first, err := l.acquire(ctx, backend, "cluster/asg", "first", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("acquire error: %v", err)
+	}
+	_, err = l.acquire(ctx, backend, "cluster/asg", "second", time.Minute, nil)
+	held, ok := err.(lockHeldError)
+	if !ok {
+		t.Fatalf("expected lockHeldError, got %v", err)
+	}
+	if held.holder.Owner != "first" || !held.holder.AcquiredAt.Equal(clock.Now()) {
+		t.Errorf("unexpected holder: %+v", held.holder)
+	}
+	// another key is not locked
+	other, err := l.acquire(ctx, backend, "cluster/other-asg", "second", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("acquire error: %v", err)
+	}
+	if err := other.release(ctx); err != nil {
+		t.Fatalf("release error: %v", err)
+	}
+
+	// the lock expires when it isn't refreshed
+	err = first.refresh(ctx)
+	if err != nil {
+		t.Fatalf("refresh error: %v", err)
+	}
+	sleep(ctx, clock, 2*time.Minute)
+	second, err := l.acquire(ctx, backend, "cluster/asg", "second", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("expected to take over the stale lock, got %v", err)
+	}
+	// the first owner lost the lock
+	if err := first.refresh(ctx); err != errLockChanged {
+		t.Errorf("expected errLockChanged, got %v", err)
+	}
+	// releasing a lock that was taken over leaves the new lock in place
+	if err := first.release(ctx); err != nil {
+		t.Fatalf("release error: %v", err)
+	}
+	if _, err := os.Stat(backend.filename("cluster/asg")); err != nil {
+		t.Errorf("lock of the second owner was removed")
+	}
+	if err := second.release(ctx); err != nil {
+		t.Fatalf("release error: %v", err)
+	}
+	if _, err := os.Stat(backend.filename("cluster/asg")); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed")
+	}
+}
+
+// TestLockSameOwner doesn't let a second run with the same owner take the lock of the first run
+func TestLockSameOwner(t *testing.T) {
+	l := Lock{clock: newFakeClock()}
+	backend := fileLock{dir: t.TempDir()}
+	ctx := context.Background()
+	first, err := l.acquire(ctx, backend, "cluster/asg", "host/1", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("acquire error: %v", err)
+	}
+	if _, err := l.acquire(ctx, backend, "cluster/asg", "host/1", time.Minute, nil); err == nil {
+		t.Fatalf("expected the lock to be held by the first run")
+	}
+	if err := first.release(ctx); err != nil {
+		t.Fatalf("release error: %v", err)
+	}
+	if _, err := os.Stat(backend.filename("cluster/asg")); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed")
+	}
+}
+
+// TestLockHeartbeatAfterCancel keeps refreshing the lock after the run is cancelled, until it is released
+func TestLockHeartbeatAfterCancel(t *testing.T) {
+	clock := newFakeClock()
+	l := Lock{clock: clock}
+	backend := fileLock{dir: t.TempDir()}
+	ctx, cancel := context.WithCancel(context.Background())
+	held, err := l.acquire(ctx, backend, "cluster/asg", "host/1", 300*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("acquire error: %v", err)
+	}
+	cancel()
+	clock.After(time.Minute)
+	time.Sleep(250 * time.Millisecond)
+	lock, err := backend.get(context.Background(), "cluster/asg")
+	if err != nil || lock == nil {
+		t.Fatalf("lock not found: %v", err)
+	}
+	if !lock.ExpiresAt.After(clock.Now()) {
+		t.Errorf("lock not refreshed after the cancel, expires at %s", lock.ExpiresAt)
+	}
+	if err := held.release(context.Background()); err != nil {
+		t.Fatalf("release error: %v", err)
+	}
+}
+
+func TestLockTag(t *testing.T) {
+	lock := LockInfo{Key: "cluster/asg", Owner: "host/123", Nonce: "0123456789abcdef", AcquiredAt: time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC), ExpiresAt: time.Date(2024, 6, 2, 0, 5, 0, 0, time.UTC)}
+	decoded, err := decodeLockTag(lock.Key, encodeLockTag(lock))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if *decoded != lock {
+		t.Errorf("expected %+v, got %+v", lock, *decoded)
+	}
+	// a tag without a nonce
+	decoded, err = decodeLockTag(lock.Key, "host/123|2024-06-02T00:00:00Z|2024-06-02T00:05:00Z")
+	if err != nil || decoded.Owner != "host/123" || decoded.Nonce != "" || !decoded.ExpiresAt.Equal(lock.ExpiresAt) {
+		t.Errorf("unexpected lock %+v (%v)", decoded, err)
+	}
+	if _, err := decodeLockTag(lock.Key, "invalid"); err == nil {
+		t.Errorf("expected an error for an invalid tag")
+	}
+}
+
+// TestLockUpgradeKey locks clusters with the same name in other accounts and regions separately
+func TestLockUpgradeKey(t *testing.T) {
+	t.Setenv("LOCK", "file")
+	t.Setenv("LOCK_DIR", t.TempDir())
+	ctx := context.Background()
+	target := Target{Cluster: "cluster", AutoscalingGroup: "asg", RoleArn: "arn:aws:iam::111111111111:role/ecs-upgrade"}
+	l := Lock{region: "eu-west-1", clock: newFakeClock()}
+	if key := l.key(target); key != "111111111111/eu-west-1/cluster/asg" {
+		t.Errorf("unexpected key %s", key)
+	}
+	first, err := lockUpgrade(ctx, l, target, nil)
+	if err != nil {
+		t.Fatalf("lock error: %v", err)
+	}
+	defer first.release(ctx)
+	other := Lock{region: "us-east-1", clock: l.clock}
+	otherAccount := target
+	otherAccount.RoleArn = "arn:aws:iam::222222222222:role/ecs-upgrade"
+	for _, tc := range []struct {
+		l      Lock
+		target Target
+	}{{other, target}, {l, otherAccount}} {
+		held, err := lockUpgrade(ctx, tc.l, tc.target, nil)
+		if err != nil {
+			t.Fatalf("expected %s in %s to have its own lock, got %v", tc.target, tc.l.region, err)
+		}
+		held.release(ctx)
+	}
+	if _, err := lockUpgrade(ctx, l, target, nil); err == nil {
+		t.Errorf("expected the same target to be locked")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger logs the messages of a component with the correlation fields of the run
+type Logger struct {
+	component string
+	attrs     []slog.Attr
+}
+
+// logConfig is shared by all loggers
+var logConfig = struct {
+	mu           sync.RWMutex
+	handler      slog.Handler
+	defaultLevel slog.Level
+	levels       map[string]slog.Level
+	fields       []slog.Attr
+	phase        string
+}{
+	handler:      slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	defaultLevel: slog.LevelInfo,
+}
+
+func getLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// configureLogging sets the output format (text or json) and the log levels. levels is a list of component=level,
+// e.g. ecs=debug,lock=error; components that are not in the list log at defaultLevel
+func configureLogging(out io.Writer, format, defaultLevel, levels string) error {
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})
+	case "json":
+		handler = slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json (got %s)", format)
+	}
+	level := slog.LevelInfo
+	if defaultLevel != "" {
+		err := level.UnmarshalText([]byte(defaultLevel))
+		if err != nil {
+			return fmt.Errorf("invalid log level %s", defaultLevel)
+		}
+	}
+	componentLevels := make(map[string]slog.Level)
+	for _, componentLevel := range strings.Split(levels, ",") {
+		if strings.TrimSpace(componentLevel) == "" {
+			continue
+		}
+		parts := strings.SplitN(componentLevel, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid component log level %s, expected component=level", componentLevel)
+		}
+		var l slog.Level
+		err := l.UnmarshalText([]byte(strings.TrimSpace(parts[1])))
+		if err != nil {
+			return fmt.Errorf("invalid log level %s for %s", parts[1], parts[0])
+		}
+		componentLevels[strings.TrimSpace(parts[0])] = l
+	}
+	logConfig.mu.Lock()
+	defer logConfig.mu.Unlock()
+	logConfig.handler = handler
+	logConfig.defaultLevel = level
+	logConfig.levels = componentLevels
+	return nil
+}
+
+// configureLoggingFromEnv configures logging with LOG_FORMAT, LOG_LEVEL (or DEBUG=true) and LOG_LEVELS
+func configureLoggingFromEnv() error {
+	level := os.Getenv("LOG_LEVEL")
+	if level == "" && os.Getenv("DEBUG") == "true" {
+		level = "debug"
+	}
+	return configureLogging(os.Stderr, os.Getenv("LOG_FORMAT"), level, os.Getenv("LOG_LEVELS"))
+}
+
+// setLogFields sets the correlation fields that are added to every line
+func setLogFields(clusterName, asgName, runID, region string) {
+	logConfig.mu.Lock()
+	defer logConfig.mu.Unlock()
+	logConfig.fields = []slog.Attr{slog.String("cluster", clusterName), slog.String("run_id", runID)}
+	if asgName != "" {
+		logConfig.fields = append(logConfig.fields, slog.String("asg", asgName))
+	}
+	if region != "" {
+		logConfig.fields = append(logConfig.fields, slog.String("region", region))
+	}
+	logConfig.phase = ""
+}
+
+// setLogPhase sets the phase that is added to every line
+func setLogPhase(phase string) {
+	logConfig.mu.Lock()
+	defer logConfig.mu.Unlock()
+	logConfig.phase = phase
+}
+
+// newRunID returns RUN_ID, or a random id for this run
+func newRunID() string {
+	if runID := os.Getenv("RUN_ID"); runID != "" {
+		return runID
+	}
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Instance returns a logger that adds the instance id to every line
+func (l *Logger) Instance(instanceId string) *Logger {
+	return l.With("instance_id", instanceId)
+}
+
+// With returns a logger that adds a field to every line
+func (l *Logger) With(key, value string) *Logger {
+	attrs := append(append([]slog.Attr{}, l.attrs...), slog.String(key, value))
+	return &Logger{component: l.component, attrs: attrs}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(slog.LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, format, args...)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(slog.LevelError, format, args...)
+}
+
+func (l *Logger) log(level slog.Level, format string, args ...interface{}) {
+	logConfig.mu.RLock()
+	defer logConfig.mu.RUnlock()
+	minLevel, ok := logConfig.levels[l.component]
+	if !ok {
+		minLevel = logConfig.defaultLevel
+	}
+	if level < minLevel {
+		return
+	}
+	record := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), 0)
+	record.AddAttrs(slog.String("component", l.component))
+	record.AddAttrs(logConfig.fields...)
+	if logConfig.phase != "" {
+		record.AddAttrs(slog.String("phase", logConfig.phase))
+	}
+	record.AddAttrs(l.attrs...)
+	logConfig.handler.Handle(context.Background(), record)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggingJSON(t *testing.T) {
+	var out bytes.Buffer
+	err := configureLogging(&out, "json", "info", "ecs=debug, lock=error")
+	if err != nil {
+		t.Fatalf("configureLogging error: %v", err)
+	}
+	t.Cleanup(func() {
+		configureLogging(os.Stderr, "text", "", "")
+		setLogFields("", "", "", "")
+	})
+	setLogFields("cluster", "asg", "run-1", "eu-west-1")
+	setLogPhase("drain")
+
+	getLogger("ecs").Instance("i-1").Debugf("draining %s", "i-1")
+	getLogger("autoscaling").Debugf("not logged")
+	getLogger("lock").Infof("not logged")
+	getLogger("autoscaling").Infof("logged")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %s", len(lines), out.String())
+	}
+	var line map[string]string
+	err = json.Unmarshal([]byte(lines[0]), &line)
+	if err != nil {
+		t.Fatalf("invalid json line %s: %v", lines[0], err)
+	}
+	expected := map[string]string{"level": "DEBUG", "msg": "draining i-1", "component": "ecs", "cluster": "cluster", "asg": "asg", "run_id": "run-1", "region": "eu-west-1", "phase": "drain", "instance_id": "i-1"}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("expected %s=%s, got %s", k, v, line[k])
+		}
+	}
+}
+
+func TestConfigureLoggingInvalid(t *testing.T) {
+	t.Cleanup(func() {
+		configureLogging(os.Stderr, "text", "", "")
+	})
+	for _, c := range [][3]string{{"xml", "", ""}, {"text", "verbose", ""}, {"text", "", "ecs"}, {"text", "", "ecs=loud"}} {
+		if err := configureLogging(os.Stderr, c[0], c[1], c[2]); err == nil {
+			t.Errorf("expected an error for %v", c)
+		}
+	}
+}
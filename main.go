@@ -1,249 +1,806 @@
 package main
 
 import (
+	"context"
+	"strconv"
 	"strings"
 
-	"github.com/juju/loggo"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 // logging
-var mainLogger = loggo.GetLogger("ecs-upgrade")
+var mainLogger = getLogger("ecs-upgrade")
 
 func main() {
-	if os.Getenv("DEBUG") == "true" {
-		loggo.ConfigureLoggers(`<root>=DEBUG`)
-	} else {
-		loggo.ConfigureLoggers(`<root>=INFO`)
+	err := configureLoggingFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 	os.Exit(mainWithReturnCode())
 }
 
+// Clients holds the AWS service clients used during the upgrade
+type Clients struct {
+	Autoscaling Autoscaling
+	ECS         ECS
+	LB          LB
+	CloudWatch  CloudWatch
+	Lock        Lock
+	S3          S3
+	SNS         SNS
+	EventBridge EventBridge
+	// EventSinks receive the events of the run, in addition to the sinks configured in the environment
+	EventSinks []EventSink
+	// Metrics are updated by the run. They are served on METRICS_ADDR for the whole process, across runs
+	Metrics *Metrics
+	Clock   Clock
+}
+
+func NewClients(sess *session.Session) Clients {
+	return Clients{
+		Autoscaling: NewAutoscaling(sess),
+		ECS:         NewECS(sess),
+		LB:          NewLB(sess),
+		CloudWatch:  NewCloudWatch(sess),
+		Lock:        NewLock(sess),
+		S3:          NewS3(sess),
+		SNS:         NewSNS(sess),
+		EventBridge: NewEventBridge(sess),
+		Clock:       realClock{},
+	}
+}
+
 func mainWithReturnCode() int {
 	// initialize
-	e := ECS{}
-	var err error
-	asgName := os.Getenv("ECS_ASG")
-	if len(asgName) == 0 {
-		fmt.Printf("ECS_ASG not set\n")
+	sess, err := newSessionFromEnv(realClock{})
+	if err != nil {
+		mainLogger.Errorf("%v", err)
 		return 1
 	}
-	clusterName := os.Getenv("ECS_CLUSTER")
+	// stop at the next safe point on SIGTERM (e.g. when ECS stops the task) or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	targets, err := getTargetsFromEnv()
+	if err != nil {
+		mainLogger.Errorf("%v", err)
+		return 1
+	}
+	// the metrics endpoint stays up between the runs of the targets and the daemon, every run updates the metrics
+	metrics := newMetrics()
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsCtx, stopMetrics := context.WithCancel(context.Background())
+		defer stopMetrics()
+		err = metrics.serve(metricsCtx, addr)
+		if err != nil {
+			mainLogger.Errorf("Could not serve metrics: %v", err)
+		}
+	}
+	clients := func(target Target) Clients {
+		c := newClientsForTarget(sess, target)
+		c.Metrics = metrics
+		return c
+	}
+	if os.Getenv("MODE") == "daemon" {
+		if len(targets) != 1 {
+			mainLogger.Errorf("the daemon upgrades one target, got %d", len(targets))
+			return 1
+		}
+		daemon, err := newDaemonFromEnv(clients(targets[0]), targets[0])
+		if err != nil {
+			mainLogger.Errorf("%v", err)
+			return 1
+		}
+		return daemon.run(ctx)
+	}
+	return runTargets(ctx, targets, clients)
+}
+
+// runWithReturnCode runs the upgrade of the target, or the mode set in MODE, using the given clients
+func runWithReturnCode(ctx context.Context, c Clients, target Target) (ret int) {
+	var err error
+	a, e, lb, cw, clock := c.Autoscaling, c.ECS, c.LB, c.CloudWatch, c.Clock
+	clusterName := target.Cluster
 	if len(clusterName) == 0 {
-		fmt.Printf("ECS_CLUSTER not set\n")
+		mainLogger.Errorf("ECS_CLUSTER not set")
 		return 1
 	}
-	useLaunchTemplates := os.Getenv("LAUNCH_TEMPLATES")
-	a := NewAutoscaling()
+	mode := "upgrade"
+	if m := os.Getenv("MODE"); m == "agent-update" || m == "migrate" || m == "plan" {
+		mode = m
+	}
+	runID := newRunID()
+	setLogFields(clusterName, target.AutoscalingGroup, runID, target.Region)
+	report := newReport(mode, clusterName, target.AutoscalingGroup, runID, clock.Now())
+	report.Region = target.Region
+	report.startPhase("prepare", clock.Now())
+	setLogPhase("prepare")
+	metrics := c.Metrics
+	if metrics == nil {
+		metrics = newMetrics()
+	}
+	metrics.update(report, clock.Now())
+	var notifier *Notifier
+	events := newEventsFromEnv(c, report)
+	if mode == "plan" {
+		// a plan changes nothing, so it isn't published as an upgrade
+		events.sinks = nil
+	}
+	defer func() {
+		report.finish(clock.Now(), ret)
+		notifier.notify(notificationFromReport("finished", "", report, clock.Now()))
+		notifier.flush()
+		events.emitFinished()
+		err := report.write(c.S3, targetFile(os.Getenv("REPORT_FILE"), target))
+		if err != nil {
+			mainLogger.Errorf("Could not write the report: %v", err)
+		}
+		metrics.update(report, clock.Now())
+		err = metrics.pushFromEnv(report)
+		if err != nil {
+			mainLogger.Errorf("Could not push the metrics: %v", err)
+		}
+	}()
+	// fail stops the run before anything was changed
+	fail := func(err error) int {
+		mainLogger.Errorf("%v", err)
+		report.Error = err.Error()
+		return 1
+	}
+	if mode != "plan" {
+		notifier, err = newNotifierFromEnv(clock)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	notifier.notify(notificationFromReport("started", "", report, clock.Now()))
+	events.emit("UpgradeStarted", nil)
+	timings, err := getTimingsFromEnv()
+	if err != nil {
+		return fail(err)
+	}
+	a.amiParameter = os.Getenv("AMI_SSM_PARAMETER")
+	a.amiMinAge, err = getAMIMinAge(target)
+	if err != nil {
+		return fail(err)
+	}
+	a.overrides, err = getLaunchOverrides(target)
+	if err != nil {
+		return fail(err)
+	}
+	concurrency, err := getConcurrencyFromEnv()
+	if err != nil {
+		return fail(err)
+	}
+	e.concurrency, lb.concurrency = concurrency, concurrency
+	asgName := target.AutoscalingGroup
+	// lock the cluster and autoscaling group before changing anything, and stop when the lock is lost. A plan doesn't change anything
+	ctx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	var lock *HeldLock
+	if mode != "plan" {
+		lock, err = lockUpgrade(ctx, c.Lock, target, func(err error) {
+			mainLogger.Errorf("Lost the lock: %v", err)
+			cancelRun()
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if lock != nil {
+		defer func() {
+			// the run context can be cancelled already
+			releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer releaseCancel()
+			err := lock.release(releaseCtx)
+			if err != nil {
+				mainLogger.Errorf("Could not release the lock: %v", err)
+			}
+		}()
+	}
+	if mode == "agent-update" {
+		report.startPhase("agent-update", clock.Now())
+		setLogPhase("agent-update")
+		metrics.update(report, clock.Now())
+		notifier.notify(notificationFromReport("phase", "agent-update", report, clock.Now()))
+		return agentUpdateWithReturnCode(ctx, e, clusterName, timings.AgentUpdate, report)
+	}
+	if len(asgName) == 0 {
+		return fail(fmt.Errorf("ECS_ASG not set"))
+	}
+	useLaunchTemplates := getUseLaunchTemplates(target)
+	// newUseLaunchTemplates is set when the new instances are launched from a launch template
+	newUseLaunchTemplates := useLaunchTemplates
+	if mode == "migrate" {
+		// the autoscaling group moves from its launch configuration to a launch template
+		useLaunchTemplates, newUseLaunchTemplates = "false", "true"
+	}
+	alarmNames := splitEnv("ALARM_NAMES")
+	// ROLLBACK_ON_ALARM is the old name of ROLLBACK_ON_FAILURE
+	rollbackOnFailure := os.Getenv("ROLLBACK_ON_FAILURE") == "true" || os.Getenv("ROLLBACK_ON_ALARM") == "true"
+	alarmBakePeriod, err := getEnvDuration("ALARM_BAKE_PERIOD")
+	if err != nil {
+		return fail(err)
+	}
+	ignoreAttributes := splitEnv("IGNORE_ATTRIBUTES")
+	stateFile := targetFile(os.Getenv("STATE_FILE"), target)
+	cancelAction, err := getCancelAction()
+	if err != nil {
+		return fail(err)
+	}
+	cancelTimeout := 90 * time.Second
+	if os.Getenv("CANCEL_TIMEOUT") != "" {
+		cancelTimeout, err = getEnvDuration("CANCEL_TIMEOUT")
+		if err != nil {
+			return fail(err)
+		}
+	}
+	maxTaskFailures := 2
+	if os.Getenv("MAX_TASK_FAILURES") != "" {
+		maxTaskFailures, err = getEnvInt("MAX_TASK_FAILURES")
+		if err != nil {
+			return fail(err)
+		}
+		if maxTaskFailures < 0 {
+			return fail(fmt.Errorf("MAX_TASK_FAILURES can't be negative"))
+		}
+	}
+	canaryBakeTime, err := getEnvDuration("CANARY_BAKE_TIME")
+	if err != nil {
+		return fail(err)
+	}
+	if canaryBakeTime < 0 {
+		return fail(fmt.Errorf("CANARY_BAKE_TIME can't be negative"))
+	}
+	canaryMaxTaskFailures := 2
+	if os.Getenv("CANARY_MAX_TASK_FAILURES") != "" {
+		canaryMaxTaskFailures, err = getEnvInt("CANARY_MAX_TASK_FAILURES")
+		if err != nil {
+			return fail(err)
+		}
+		if canaryMaxTaskFailures < 0 {
+			return fail(fmt.Errorf("CANARY_MAX_TASK_FAILURES can't be negative"))
+		}
+	}
 	// get asg
-	asg, err := a.describeAutoscalingGroup(asgName)
+	asg, err := a.describeAutoscalingGroup(ctx, asgName)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return fail(err)
 	}
-	var newLaunchIdentifier string
-	if useLaunchTemplates == "true" {
-		newLaunchIdentifier, err = scaleWithLaunchTemplate(a, asg)
+	if mode == "migrate" && asg.LaunchConfigurationName == "" {
+		return fail(fmt.Errorf("autoscaling group %s has no launch configuration to migrate", asgName))
+	}
+	// don't start an upgrade while an alarm is already firing
+	err = checkAlarms(ctx, cw, alarmNames)
+	if err != nil {
+		return fail(err)
+	}
+	if useLaunchTemplates == "true" && (asg.LaunchTemplateVersion == "" || asg.LaunchTemplateVersion == "$Latest") {
+		// the new version will become $Latest, so keep the current version number for rollbacks
+		lt, err := a.getLatestLaunchTemplate(ctx, asg.LaunchTemplateName)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return 1
+			return fail(err)
 		}
-	} else {
-		newLaunchIdentifier, err = scaleWithLaunchConfig(a, asg)
+		asg.LaunchTemplateVersion = strconv.FormatInt(aws.Int64Value(lt.VersionNumber), 10)
+	}
+	// with a canary, only launch the canary instances first
+	canaryCount, err := getCanaryCount(os.Getenv("CANARY"), asg.DesiredCapacity)
+	if err != nil {
+		return fail(err)
+	}
+	scaleOutCapacity := asg.DesiredCapacity * 2
+	if canaryCount > 0 {
+		scaleOutCapacity = asg.DesiredCapacity + canaryCount
+	}
+	report.OldAMI, err = a.getLaunchImage(ctx, useLaunchTemplates, getLaunchIdentifier(asg, useLaunchTemplates))
+	if err != nil {
+		return fail(err)
+	}
+	// the AMI to upgrade to. A migration without a new AMI keeps the AMI of the launch configuration
+	imageId := report.OldAMI
+	if mode != "migrate" || os.Getenv("MIGRATE_NEW_AMI") == "true" {
+		selection, err := a.selectECSAMI(ctx)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return 1
+			return fail(err)
+		}
+		mainLogger.Infof("Selected AMI %s: %s", selection.ImageId, selection.Reason)
+		report.AMISelection = &selection
+		imageId = selection.ImageId
+	}
+	// check the launch parameter overrides before anything is rolled out
+	if !a.overrides.empty() {
+		trunking, err := e.usesENITrunking(ctx, clusterName)
+		if err != nil {
+			return fail(err)
+		}
+		err = a.validateLaunchOverrides(ctx, asg, imageId, trunking)
+		if err != nil {
+			return fail(err)
 		}
 	}
+	if mode == "plan" {
+		return planWithReturnCode(ctx, a, asg, useLaunchTemplates, imageId, report)
+	}
+	var newLaunchIdentifier string
+	var drainedContainerArns []string
+	var containerInstanceDetails map[string]ContainerInstance
+	state := newUpgradeState(clusterName, asg, useLaunchTemplates, runID, clock.Now())
+	setPhase := func(phase string) {
+		state.Phase = phase
+		report.startPhase(phase, clock.Now())
+		setLogPhase(phase)
+		metrics.update(report, clock.Now())
+		notifier.notify(notificationFromReport("phase", phase, report, clock.Now()))
+	}
+	rollbackOnError := rollbackOnFailure
+	// abort stops the upgrade. When the upgrade was cancelled, the cancel action runs. Otherwise the upgrade is rolled back if enabled.
+	// The state of the upgrade is written in both cases
+	abort := func(err error) int {
+		fail(err)
+		report.InstancesDrained = getInstanceIds(containerInstanceDetails, drainedContainerArns)
+		state.NewLaunchIdentifier = newLaunchIdentifier
+		state.DrainedContainerInstanceArns = drainedContainerArns
+		state.Error = err.Error()
+		if ctx.Err() != nil {
+			state.Cancelled = true
+			state.CancelAction = cancelAction
+			mainLogger.Infof("Upgrade cancelled during phase %s", state.Phase)
+			report.Outcome = "cancelled"
+			// the upgrade context is cancelled, the cancel action gets its own
+			cancelCtx, cancelFunc := context.WithTimeout(context.Background(), cancelTimeout)
+			defer cancelFunc()
+			switch cancelAction {
+			case "rollback":
+				report.InstancesTerminated, err = rollback(cancelCtx, a, e, clusterName, asg, newLaunchIdentifier, newUseLaunchTemplates, drainedContainerArns)
+				if err == nil {
+					events.emit("RolledBack", map[string]interface{}{"reason": "cancelled", "instancesTerminated": report.InstancesTerminated})
+				}
+			case "restore":
+				err = restoreCapacity(cancelCtx, a, e, clusterName, asg, drainedContainerArns)
+			default:
+				err = nil
+			}
+			if err != nil {
+				mainLogger.Errorf("Error during %s: %v", cancelAction, err)
+				state.CancelActionError = err.Error()
+			}
+		} else if rollbackOnError {
+			report.InstancesTerminated, err = rollback(ctx, a, e, clusterName, asg, newLaunchIdentifier, newUseLaunchTemplates, drainedContainerArns)
+			if err != nil {
+				mainLogger.Errorf("Rollback error: %v", err)
+			} else {
+				report.Outcome = "rolled-back"
+				events.emit("RolledBack", map[string]interface{}{"reason": state.Error, "instancesTerminated": report.InstancesTerminated})
+			}
+		}
+		state.StoppedAt = clock.Now()
+		err = state.write(stateFile)
+		if err != nil {
+			mainLogger.Errorf("Could not write state: %v", err)
+		}
+		return 1
+	}
+	setPhase("scale-out")
+	if mode == "migrate" {
+		launchTemplateName := os.Getenv("MIGRATE_LAUNCH_TEMPLATE_NAME")
+		if launchTemplateName == "" {
+			launchTemplateName = launchTemplateNameFromLaunchConfig(asg.LaunchConfigurationName)
+		}
+		newLaunchIdentifier, err = scaleWithMigratedLaunchTemplate(ctx, a, asg, scaleOutCapacity, launchTemplateName, imageId)
+	} else if useLaunchTemplates == "true" {
+		newLaunchIdentifier, err = scaleWithLaunchTemplate(ctx, a, asg, scaleOutCapacity, imageId)
+	} else {
+		newLaunchIdentifier, err = scaleWithLaunchConfig(ctx, a, asg, scaleOutCapacity, imageId)
+	}
+	if err != nil {
+		return abort(err)
+	}
 	if newLaunchIdentifier == "" {
-		fmt.Printf("Launch configuration is already at latest version")
+		mainLogger.Infof("Launch configuration is already at latest version")
+		report.NewAMI = report.OldAMI
+		report.Outcome = "already-latest"
+		events.emit("AMIResolved", map[string]interface{}{"oldAmi": report.OldAMI, "newAmi": report.NewAMI, "oldLaunchIdentifier": getLaunchIdentifier(asg, useLaunchTemplates)})
 		return 0
 	}
-	// wait until new instances are healthy
-	var healthy bool
-	var instances []AutoscalingInstance
-	for i := 0; !healthy && i < 25; i++ {
-		instances, err = a.getAutoscalingInstanceHealth(asgName)
+	report.setLaunchIdentifiers(asg, newLaunchIdentifier, newUseLaunchTemplates)
+	report.NewAMI, err = a.getLaunchImage(ctx, newUseLaunchTemplates, newLaunchIdentifier)
+	if err != nil {
+		return abort(err)
+	}
+	report.LaunchChanges, report.UserDataDiff, err = a.getLaunchChanges(ctx, useLaunchTemplates, getLaunchIdentifier(asg, useLaunchTemplates), newUseLaunchTemplates, newLaunchIdentifier)
+	if err != nil {
+		return abort(err)
+	}
+	logLaunchChanges(report)
+	events.emit("AMIResolved", map[string]interface{}{"oldAmi": report.OldAMI, "newAmi": report.NewAMI, "oldLaunchIdentifier": getLaunchIdentifier(asg, useLaunchTemplates), "newLaunchIdentifier": newLaunchIdentifier})
+	// canary
+	if canaryCount > 0 {
+		setPhase("canary")
+		// a failing canary is always rolled back
+		rollbackOnError = true
+		mainLogger.Debugf("Starting canary with %d instance(s)", canaryCount)
+		drainedContainerArns, report.Versions, err = runCanary(ctx, a, e, lb, cw, alarmNames, clusterName, asgName, newLaunchIdentifier, newUseLaunchTemplates, canaryCount, canaryBakeTime, canaryMaxTaskFailures, ignoreAttributes, timings)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return 1
+			return abort(err)
 		}
-		var healthyInstances int64
-		for _, instance := range instances {
-			if checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
-				if instance.HealthStatus == "HEALTHY" {
-					healthyInstances += 1
-				} else {
-					mainLogger.Debugf("Waiting for instance %s to become healthy (currently %s)", instance.InstanceId, instance.HealthStatus)
-				}
-			}
+		rollbackOnError = rollbackOnFailure
+		// canary passed, continue with the rest of the fleet
+		mainLogger.Debugf("Canary completed, upgrading the remaining instances")
+		err = a.scaleAutoscalingGroup(ctx, asgName, asg.DesiredCapacity*2)
+		if err != nil {
+			return abort(err)
 		}
-		if healthyInstances >= asg.DesiredCapacity {
-			healthy = true
+	}
+	// wait until new instances are healthy
+	setPhase("instance-health")
+	instances, err := waitForHealthyInstances(ctx, a, cw, alarmNames, asgName, newLaunchIdentifier, newUseLaunchTemplates, asg.DesiredCapacity, timings.InstanceHealth)
+	if err != nil {
+		return abort(err)
+	}
+	var oldInstanceIds []string
+	for _, instance := range instances {
+		if checkInstanceLaunchConfigOrTemplate(newUseLaunchTemplates, instance, newLaunchIdentifier) {
+			report.InstancesLaunched = append(report.InstancesLaunched, instance.InstanceId)
 		} else {
-			waitTime := int(math.Max(float64(len(instances)), 30))
-			mainLogger.Debugf("Checking autoscaling instances health: Waiting %ds", waitTime)
-			time.Sleep(time.Duration(waitTime) * time.Second)
+			oldInstanceIds = append(oldInstanceIds, instance.InstanceId)
 		}
 	}
+	events.emit("InstancesLaunched", map[string]interface{}{"instances": report.InstancesLaunched})
 	// wait for new nodes to attach
-	err = e.waitForNewNodes(clusterName, len(instances))
+	setPhase("new-nodes")
+	err = e.waitForNewNodes(ctx, clusterName, len(instances), timings.NewNodes)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return abort(err)
+	}
+	err = checkAlarms(ctx, cw, alarmNames)
+	if err != nil {
+		return abort(err)
 	}
+	// compare old and new container instances
+	containerInstanceArns, err := e.listContainerInstances(ctx, clusterName)
+	if err != nil {
+		return abort(err)
+	}
+	containerInstanceDetails, err = e.describeContainerInstanceDetails(ctx, clusterName, containerInstanceArns)
+	if err != nil {
+		return abort(err)
+	}
+	versions, err := checkVersions(containerInstanceDetails, instances, newLaunchIdentifier, newUseLaunchTemplates, ignoreAttributes)
+	report.Versions = &versions
+	if err != nil {
+		return abort(err)
+	}
+	// new container instances, to watch for failing tasks during the drain
+	newContainerArns := getNewContainerInstanceArns(getContainerInstanceArnMap(containerInstanceDetails), instances, newLaunchIdentifier, newUseLaunchTemplates)
 	// drain
+	setPhase("drain")
 	mainLogger.Debugf("Draining instances")
-	drainedContainerArns, err := drain(clusterName, instances, newLaunchIdentifier, useLaunchTemplates)
+	drainStart := clock.Now()
+	drained, err := drain(ctx, e, clusterName, instances, newLaunchIdentifier, newUseLaunchTemplates, 0, drainedContainerArns)
+	drainedContainerArns = append(drainedContainerArns, drained...)
+	report.TasksRescheduled = getRunningTasksCount(containerInstanceDetails, drainedContainerArns)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return abort(err)
 	}
+	events.emit("DrainStarted", map[string]interface{}{"instances": getInstanceIds(containerInstanceDetails, drainedContainerArns), "tasks": report.TasksRescheduled})
 	// wait until nodes are drained
 	mainLogger.Debugf("Wait for Drained instances")
-	err = e.waitForDrainedNode(clusterName, drainedContainerArns)
+	err = e.waitForDrainedNode(ctx, clusterName, drainedContainerArns, newContainerArns, maxTaskFailures, drainStart, alarmCheck(ctx, cw, alarmNames), timings.Drain)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return abort(err)
 	}
+	events.emit("DrainCompleted", map[string]interface{}{"instances": getInstanceIds(containerInstanceDetails, drainedContainerArns), "duration": clock.Now().Sub(drainStart).String()})
 	// check target health
+	setPhase("target-health")
 	mainLogger.Debugf("Checking targets health")
-	err = checkTargetHealth(a, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName)
+	targetHealth, err := checkTargetHealth(ctx, a, e, lb, cw, alarmNames, asgName, newLaunchIdentifier, newUseLaunchTemplates, clusterName, timings.TargetHealth)
+	report.TargetHealth = &targetHealth
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return abort(err)
+	}
+	// bake: new instances are taking traffic, keep watching the alarms before removing the old instances
+	if len(alarmNames) > 0 {
+		setPhase("bake")
+		mainLogger.Debugf("Watching alarms during bake period of %s", alarmBakePeriod)
+		err = bakeWithAlarms(ctx, cw, alarmNames, clock, Timing{Interval: timings.Bake.Interval, Timeout: alarmBakePeriod})
+		if err != nil {
+			return abort(err)
+		}
 	}
 	// scale down
+	setPhase("scale-down")
+	report.InstancesDrained = getInstanceIds(containerInstanceDetails, drainedContainerArns)
 	mainLogger.Debugf("Scaling down")
-	err = a.scaleAutoscalingGroup(asgName, asg.DesiredCapacity)
+	err = a.scaleAutoscalingGroup(ctx, asgName, asg.DesiredCapacity)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return abort(err)
 	}
+	// the autoscaling group terminates the old instances
+	report.InstancesTerminated = oldInstanceIds
+	// the old instances are on their way out, a rollback would terminate the new instances as well
+	rollbackOnError = false
+	cancelAction = "none"
 	// delete old launchconfig
 	if useLaunchTemplates != "true" {
-		err = a.deleteLaunchConfig(asg.LaunchConfigurationName)
+		setPhase("cleanup")
+		err = a.deleteLaunchConfig(ctx, asg.LaunchConfigurationName)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return 1
+			return abort(err)
 		}
 	}
 
-	fmt.Printf("Upgrade completed\n")
+	mainLogger.Infof("Upgrade completed")
+	return 0
+}
+
+func agentUpdateWithReturnCode(ctx context.Context, e ECS, clusterName string, timing Timing, report *Report) int {
+	batchSize := 1
+	if os.Getenv("AGENT_UPDATE_BATCH_SIZE") != "" {
+		var err error
+		batchSize, err = getEnvInt("AGENT_UPDATE_BATCH_SIZE")
+		if err != nil || batchSize < 1 {
+			mainLogger.Errorf("AGENT_UPDATE_BATCH_SIZE must be a number greater than 0")
+			report.Error = "AGENT_UPDATE_BATCH_SIZE must be a number greater than 0"
+			return 1
+		}
+	}
+	results, err := updateAgents(ctx, e, clusterName, batchSize, timing)
+	logAgentUpdateResults(results)
+	report.AgentUpdates = results
+	if err != nil {
+		mainLogger.Errorf("%v", err)
+		report.Error = err.Error()
+		if ctx.Err() != nil {
+			report.Outcome = "cancelled"
+		}
+		return 1
+	}
+	mainLogger.Infof("Agent update completed")
 	return 0
 }
 
-func drain(clusterName string, instances []AutoscalingInstance, newLaunchIdentifier string, useLaunchTemplates string) ([]string, error) {
+// gateError is returned when a check during the upgrade (alarms, canary) decided that the upgrade has to stop
+type gateError struct {
+	reason string
+}
+
+func (g gateError) Error() string {
+	return g.reason
+}
+
+// waitForHealthyInstances waits until at least count instances with the new launch configuration or template are healthy.
+// It returns an error when they aren't healthy at the timeout
+func waitForHealthyInstances(ctx context.Context, a Autoscaling, cw CloudWatch, alarmNames []string, asgName, newLaunchIdentifier, useLaunchTemplates string, count int64, timing Timing) ([]AutoscalingInstance, error) {
+	var instances []AutoscalingInstance
+	var healthyInstances int64
+	done, err := poll(ctx, a.clock, timing, func() (bool, error) {
+		err := checkAlarms(ctx, cw, alarmNames)
+		if err != nil {
+			return false, err
+		}
+		instances, err = a.getAutoscalingInstanceHealth(ctx, asgName)
+		if err != nil {
+			return false, err
+		}
+		healthyInstances = 0
+		for _, instance := range instances {
+			if checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
+				if instance.HealthStatus == "HEALTHY" {
+					healthyInstances += 1
+				} else {
+					mainLogger.Instance(instance.InstanceId).Debugf("Waiting for instance %s to become healthy (currently %s)", instance.InstanceId, instance.HealthStatus)
+				}
+			}
+		}
+		if healthyInstances >= count {
+			return true, nil
+		}
+		mainLogger.Debugf("Checking autoscaling instances health: Waiting %s", timing.Interval)
+		return false, nil
+	})
+	if err == nil && !done {
+		err = fmt.Errorf("%d of %d new instances healthy in the autoscaling group: timeout of %s reached", healthyInstances, count, timing.Timeout)
+	}
+	return instances, err
+}
+
+// checkAlarms returns an error when one of the alarms is in ALARM state
+func checkAlarms(ctx context.Context, cw CloudWatch, alarmNames []string) error {
+	if len(alarmNames) == 0 {
+		return nil
+	}
+	alarms, err := cw.getAlarmsInAlarmState(ctx, alarmNames)
+	if err != nil {
+		return err
+	}
+	if len(alarms) > 0 {
+		return gateError{reason: fmt.Sprintf("Alarm(s) in ALARM state: %s", strings.Join(alarms, ", "))}
+	}
+	return nil
+}
+
+// alarmCheck returns a check of the alarms, for the wait loops that have no CloudWatch client
+func alarmCheck(ctx context.Context, cw CloudWatch, alarmNames []string) func() error {
+	return func() error {
+		return checkAlarms(ctx, cw, alarmNames)
+	}
+}
+
+// bakeWithAlarms checks the alarms every interval until the bake period (the timeout) has passed
+func bakeWithAlarms(ctx context.Context, cw CloudWatch, alarmNames []string, clock Clock, timing Timing) error {
+	deadline := clock.Now().Add(timing.Timeout)
+	_, err := poll(ctx, clock, timing, func() (bool, error) {
+		err := checkAlarms(ctx, cw, alarmNames)
+		if err != nil {
+			return false, err
+		}
+		mainLogger.Debugf("Bake period: no alarms firing, %s remaining", deadline.Sub(clock.Now()).Round(time.Second))
+		return false, nil
+	})
+	return err
+}
+
+// drain drains the instances that are not using the new launch configuration or template. When maxInstances is not 0, at most maxInstances are drained.
+// The container instances in alreadyDrained (e.g. drained by the canary) are not drained again
+func drain(ctx context.Context, e ECS, clusterName string, instances []AutoscalingInstance, newLaunchIdentifier string, useLaunchTemplates string, maxInstances int64, alreadyDrained []string) ([]string, error) {
 	var drainedContainerArns []string
 	var instancesToDrain []string
-	e := ECS{}
 	for _, instance := range instances {
+		if maxInstances > 0 && int64(len(instancesToDrain)) >= maxInstances {
+			break
+		}
 		if !checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
 			instancesToDrain = append(instancesToDrain, instance.InstanceId)
-			mainLogger.Debugf("Going to drain %s", instance.InstanceId)
+			mainLogger.Instance(instance.InstanceId).Debugf("Going to drain %s", instance.InstanceId)
 		}
 	}
 	if float64(len(instancesToDrain)) > math.Ceil(float64(len(instances)/2)) {
 		return drainedContainerArns, fmt.Errorf("Going to drain %d instances out of %d, which is more than 50%%", len(instancesToDrain), len(instances))
 	}
-	containerInstanceArns, err := e.listContainerInstances(clusterName)
+	containerInstanceArns, err := e.listContainerInstances(ctx, clusterName)
 	if err != nil {
 		return drainedContainerArns, err
 	}
-	containerInstances, err := e.describeContainerInstances(clusterName, containerInstanceArns)
+	containerInstances, err := e.describeContainerInstances(ctx, clusterName, containerInstanceArns)
 	if err != nil {
 		return drainedContainerArns, err
 	}
+	var containerArnsToDrain []string
 	for _, instanceId := range instancesToDrain {
-		if containerId, ok := containerInstances[instanceId]; ok {
-			err = e.drainNode(clusterName, containerId)
-			if err != nil {
-				return drainedContainerArns, err
-			}
-			drainedContainerArns = append(drainedContainerArns, containerId)
-		} else {
+		containerId, ok := containerInstances[instanceId]
+		if !ok {
 			return drainedContainerArns, fmt.Errorf("Couldn't drain instance %s", instanceId)
 		}
+		if stringInSlice(containerId, alreadyDrained) {
+			continue
+		}
+		containerArnsToDrain = append(containerArnsToDrain, containerId)
 	}
-	return drainedContainerArns, nil
+	return e.drainNodes(ctx, clusterName, containerArnsToDrain)
 }
-func checkTargetHealth(a Autoscaling, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName string) error {
-	lb := LB{}
-	e := ECS{}
-	targetGroups, err := lb.getTargets()
+
+// checkTargetHealth waits until the targets of the new instances are healthy. It stops when one of the alarms goes off
+func checkTargetHealth(ctx context.Context, a Autoscaling, e ECS, lb LB, cw CloudWatch, alarmNames []string, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName string, timing Timing) (TargetHealthReport, error) {
+	var result TargetHealthReport
+	targetGroups, err := lb.getTargets(ctx)
 	if err != nil {
-		return err
+		return result, err
 	}
-	var allHealthy bool
-
+	result.TargetGroups = targetGroups
 	// get container instances
-	containerInstanceArns, err := e.listContainerInstances(clusterName)
+	containerInstanceArns, err := e.listContainerInstances(ctx, clusterName)
 	if err != nil {
-		return err
+		return result, err
 	}
-	containerInstances, err := e.describeContainerInstances(clusterName, containerInstanceArns)
+	containerInstances, err := e.describeContainerInstances(ctx, clusterName, containerInstanceArns)
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	for i := 0; !allHealthy && i < 25; i++ {
-		// refresh instances
-		instances, err := a.getAutoscalingInstanceHealth(asgName)
+	result.AllHealthy, err = poll(ctx, a.clock, timing, func() (bool, error) {
+		err := checkAlarms(ctx, cw, alarmNames)
 		if err != nil {
-			return err
+			return false, err
 		}
-
-		// get tasks
-		tasks, err := e.ListTasks(clusterName, "RUNNING")
+		targetStates, err := getNewTargetsHealth(ctx, a, e, lb, targetGroups, containerInstances, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName)
 		if err != nil {
-			return err
+			return false, err
+		}
+		result.States = targetStates
+		var unhealthy, healthy int64
+		for state, count := range targetStates {
+			if state == "healthy" {
+				healthy += count
+			} else {
+				unhealthy += count
+			}
 		}
+		if healthy > 0 && unhealthy == 0 {
+			mainLogger.Debugf("All instances of target groups are healthy")
+			return true, nil
+		}
+		mainLogger.Debugf("Checking loadbalancer target instances health: Waiting %s (healthy: %d, unhealthy: %d)", timing.Interval, healthy, unhealthy)
+		return false, nil
+	})
+	if err != nil {
+		return result, err
+	}
+	if !result.AllHealthy {
+		mainLogger.Infof("Checking loadbalancer target instances health: timeout of %s reached", timing.Timeout)
+	}
+	return result, nil
+}
 
-		IPsPerContainerInstance, err := e.getTaskIPsPerContainerInstance(clusterName, tasks)
+// getNewTargetsHealth returns per target health state the number of targets in the target groups that belong to the new instances
+func getNewTargetsHealth(ctx context.Context, a Autoscaling, e ECS, lb LB, targetGroups []string, containerInstances map[string]string, asgName, newLaunchIdentifier, useLaunchTemplates, clusterName string) (map[string]int64, error) {
+	targetStates := make(map[string]int64)
 
-		// print instances
-		for _, instance := range instances {
-			if checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
-				instanceIPList := getInstanceIPList(containerInstances, instance.InstanceId, IPsPerContainerInstance)
-				autoscalingLogger.Debugf("checkTargetHealth: retrieved instance %s with IPs (%s) and AWSVPC IPs (%s)", instance.InstanceId, strings.Join(instance.IPs, ","), strings.Join(instanceIPList, ","))
+	// refresh instances
+	instances, err := a.getAutoscalingInstanceHealth(ctx, asgName)
+	if err != nil {
+		return targetStates, err
+	}
+
+	// get tasks
+	tasks, err := e.ListTasks(ctx, clusterName, "RUNNING")
+	if err != nil {
+		return targetStates, err
+	}
+
+	IPsPerContainerInstance, err := e.getTaskIPsPerContainerInstance(ctx, clusterName, tasks)
+	if err != nil {
+		return targetStates, err
+	}
+
+	// index the new instances by target id: the id without awsvpc is the instance id, the id with awsvpc is an IP address
+	newInstancesByTarget := make(map[string]string)
+	for _, instance := range instances {
+		if checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
+			instanceIPList := getInstanceIPList(containerInstances, instance.InstanceId, IPsPerContainerInstance)
+			lbLogger.Instance(instance.InstanceId).Debugf("checkTargetHealth: retrieved instance %s with IPs (%s) and AWSVPC IPs (%s)", instance.InstanceId, strings.Join(instance.IPs, ","), strings.Join(instanceIPList, ","))
+			newInstancesByTarget[instance.InstanceId] = instance.InstanceId
+			for _, IP := range instance.IPs {
+				newInstancesByTarget[IP] = instance.InstanceId
+			}
+			for _, IP := range instanceIPList {
+				newInstancesByTarget[IP] = instance.InstanceId
 			}
 		}
+	}
 
-		// check health
-		var unhealthy, healthy int64
-		for _, targetGroup := range targetGroups {
-			targetsHealth, err := lb.getTargetHealth(targetGroup)
-			if err != nil {
-				return err
-			}
-			for id, targetHealth := range targetsHealth {
-				for _, instance := range instances {
-					// id without awsvpc is instanceID, id with awsVPC is IP address. Let's compare both
-					instanceIPList := getInstanceIPList(containerInstances, instance.InstanceId, IPsPerContainerInstance)
-					if (instance.InstanceId == id || stringInSlice(id, instance.IPs) || stringInSlice(id, instanceIPList)) && checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
-						mainLogger.Debugf("Found instance %s in target group %s with health %s", id, targetGroup, targetHealth)
-						if targetHealth == "healthy" {
-							healthy++
-						} else {
-							unhealthy++
-						}
-					}
-				}
+	// check health
+	targetsHealthPerGroup, err := lb.getTargetsHealth(ctx, targetGroups)
+	if err != nil {
+		return targetStates, err
+	}
+	for i, targetGroup := range targetGroups {
+		for id, targetHealth := range targetsHealthPerGroup[i] {
+			if instanceID, ok := newInstancesByTarget[id]; ok {
+				mainLogger.Instance(instanceID).Debugf("Found instance %s in target group %s with health %s", id, targetGroup, targetHealth)
+				targetStates[targetHealth]++
 			}
 		}
-		if healthy > 0 && unhealthy == 0 {
-			mainLogger.Debugf("All instances of target groups are healthy")
-			allHealthy = true
-		} else {
-			mainLogger.Debugf("Checking loadbalancer target instances health: Waiting 30s (healthy: %d, unhealthy: %d)", healthy, unhealthy)
-			time.Sleep(30 * time.Second)
+	}
+	return targetStates, nil
+}
+
+// getNewContainerInstanceArns returns the container instance arns of the instances using the new launch configuration or template
+func getNewContainerInstanceArns(containerInstances map[string]string, instances []AutoscalingInstance, newLaunchIdentifier, useLaunchTemplates string) []string {
+	var containerArns []string
+	for _, instance := range instances {
+		if containerArn, ok := containerInstances[instance.InstanceId]; ok && checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
+			containerArns = append(containerArns, containerArn)
 		}
 	}
-	return nil
+	return containerArns
 }
 
 func getInstanceIPList(containerInstances map[string]string, instanceID string, IPsPerContainerInstance map[string][]string) []string {
@@ -255,55 +812,161 @@ func getInstanceIPList(containerInstances map[string]string, instanceID string,
 	return []string{}
 }
 
-func scaleWithLaunchConfig(a Autoscaling, asg AutoscalingGroup) (string, error) {
+func scaleWithLaunchConfig(ctx context.Context, a Autoscaling, asg AutoscalingGroup, desiredCapacity int64, imageId string) (string, error) {
 	// create new launch config
-	newLaunchConfigName, err := a.newLaunchConfigFromExisting(asg.LaunchConfigurationName)
+	newLaunchConfigName, err := a.newLaunchConfigFromExisting(ctx, asg.LaunchConfigurationName, imageId)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		mainLogger.Errorf("%v", err)
 		return "", err
 	}
 	if newLaunchConfigName == "" {
-		return "", fmt.Errorf("New Launch config name is empty (previous launch config name: %s)", asg.LaunchConfigurationName)
+		return "", nil
 	}
 	// update autoscaling group
-	err = a.updateAutoscalingLaunchConfig(asg.AutoscalingGroupName, newLaunchConfigName)
+	err = a.updateAutoscalingLaunchConfig(ctx, asg.AutoscalingGroupName, newLaunchConfigName)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		mainLogger.Errorf("%v", err)
 		return "", err
 	}
 	// scale
-	err = a.scaleAutoscalingGroup(asg.AutoscalingGroupName, asg.DesiredCapacity*2)
+	err = a.scaleAutoscalingGroup(ctx, asg.AutoscalingGroupName, desiredCapacity)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		mainLogger.Errorf("%v", err)
 		return "", err
 	}
 	return newLaunchConfigName, nil
 }
-func scaleWithLaunchTemplate(a Autoscaling, asg AutoscalingGroup) (string, error) {
+
+// planWithReturnCode logs and reports the launch settings and the user data that an upgrade would change, without
+// creating a launch configuration or launch template version
+func planWithReturnCode(ctx context.Context, a Autoscaling, asg AutoscalingGroup, useLaunchTemplates, imageId string, report *Report) int {
+	before, after, err := planLaunchSettings(ctx, a, asg, useLaunchTemplates, imageId)
+	if err != nil {
+		mainLogger.Errorf("%v", err)
+		report.Error = err.Error()
+		return 1
+	}
+	report.NewAMI = after["imageId"]
+	report.LaunchChanges = diffLaunchSettings(before, after)
+	report.UserDataDiff = userDataDiff(aws.String(before["userData"]), aws.String(after["userData"]))
+	if len(report.LaunchChanges) == 0 && report.UserDataDiff == "" {
+		mainLogger.Infof("ECS Cluster already running latest AMI, nothing to upgrade")
+		report.Outcome = "already-latest"
+		return 0
+	}
+	mainLogger.Infof("Upgrade of autoscaling group %s would replace its instances", asg.AutoscalingGroupName)
+	logLaunchChanges(report)
+	report.Outcome = "planned"
+	return 0
+}
+
+// planLaunchSettings returns the launch settings of the launch configuration or latest launch template version of the
+// autoscaling group, and of the new one an upgrade would create
+func planLaunchSettings(ctx context.Context, a Autoscaling, asg AutoscalingGroup, useLaunchTemplates, imageId string) (map[string]string, map[string]string, error) {
+	if useLaunchTemplates == "true" {
+		lt, data, err := a.planLaunchTemplateVersion(ctx, asg.LaunchTemplateName, imageId)
+		if err != nil {
+			return nil, nil, err
+		}
+		image, err := a.getImage(ctx, aws.StringValue(data.ImageId))
+		if err != nil {
+			return nil, nil, err
+		}
+		return launchTemplateSettings(*lt.LaunchTemplateData, aws.StringValue(image.RootDeviceName)), launchTemplateSettings(data, aws.StringValue(image.RootDeviceName)), nil
+	}
+	lc, newLc, err := a.planLaunchConfig(ctx, asg.LaunchConfigurationName, imageId)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := a.getImage(ctx, aws.StringValue(newLc.ImageId))
+	if err != nil {
+		return nil, nil, err
+	}
+	return launchConfigSettings(lc, aws.StringValue(image.RootDeviceName)), launchConfigSettings(newLc, aws.StringValue(image.RootDeviceName)), nil
+}
+
+// logLaunchChanges logs the launch settings and the user data that change in the report
+func logLaunchChanges(report *Report) {
+	for _, change := range report.LaunchChanges {
+		mainLogger.Infof("Launch setting %s changed from %q to %q", change.Setting, change.Old, change.New)
+	}
+	if report.UserDataDiff != "" {
+		mainLogger.Infof("User data changed:\n%s", report.UserDataDiff)
+	}
+}
+
+// scaleWithMigratedLaunchTemplate creates a launch template from the launch configuration of the autoscaling group,
+// with the AMI imageId and the launch overrides, switches the autoscaling group to it and scales out
+func scaleWithMigratedLaunchTemplate(ctx context.Context, a Autoscaling, asg AutoscalingGroup, desiredCapacity int64, launchTemplateName, imageId string) (string, error) {
+	lc, err := a.getLaunchConfig(ctx, asg.LaunchConfigurationName)
+	if err != nil {
+		return "", err
+	}
+	if lc.LaunchConfigurationName == nil {
+		return "", fmt.Errorf("launch configuration %s not found", asg.LaunchConfigurationName)
+	}
+	rootDevice, err := a.rootDeviceName(ctx, imageId)
+	if err != nil {
+		return "", err
+	}
+	newLc, err := a.overrides.applyToLaunchConfig(lc, rootDevice)
+	if err != nil {
+		return "", err
+	}
+	newLaunchTemplateName, newLaunchTemplateVersion, err := a.createLaunchTemplateFromLaunchConfig(ctx, launchTemplateName, newLc, imageId)
+	if err != nil {
+		mainLogger.Errorf("%v", err)
+		return "", err
+	}
+	mainLogger.Infof("Migrating autoscaling group %s from launch configuration %s to launch template %s version %s", asg.AutoscalingGroupName, asg.LaunchConfigurationName, newLaunchTemplateName, newLaunchTemplateVersion)
+	// update autoscaling group
+	err = a.updateAutoscalingLaunchTemplate(ctx, asg.AutoscalingGroupName, newLaunchTemplateName, newLaunchTemplateVersion)
+	if err != nil {
+		mainLogger.Errorf("%v", err)
+		return "", err
+	}
+	// scale
+	err = a.scaleAutoscalingGroup(ctx, asg.AutoscalingGroupName, desiredCapacity)
+	if err != nil {
+		mainLogger.Errorf("%v", err)
+		return "", err
+	}
+	return newLaunchTemplateName + ":" + newLaunchTemplateVersion, nil
+}
+
+func scaleWithLaunchTemplate(ctx context.Context, a Autoscaling, asg AutoscalingGroup, desiredCapacity int64, imageId string) (string, error) {
 	// create new launch config
-	_, newLaunchTemplateName, newLaunchTemplateVersion, err := a.newLaunchTemplateVersion(asg.LaunchTemplateName)
+	_, newLaunchTemplateName, newLaunchTemplateVersion, err := a.newLaunchTemplateVersion(ctx, asg.LaunchTemplateName, imageId)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		mainLogger.Errorf("%v", err)
 		return "", err
 	}
 	if newLaunchTemplateName == "" {
 		return "", nil
 	}
 	// update autoscaling group
-	err = a.updateAutoscalingLaunchTemplate(asg.AutoscalingGroupName, newLaunchTemplateName, newLaunchTemplateVersion)
+	err = a.updateAutoscalingLaunchTemplate(ctx, asg.AutoscalingGroupName, newLaunchTemplateName, newLaunchTemplateVersion)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		mainLogger.Errorf("%v", err)
 		return "", err
 	}
 	// scale
-	err = a.scaleAutoscalingGroup(asg.AutoscalingGroupName, asg.DesiredCapacity*2)
+	err = a.scaleAutoscalingGroup(ctx, asg.AutoscalingGroupName, desiredCapacity)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		mainLogger.Errorf("%v", err)
 		return "", err
 	}
 	return newLaunchTemplateName + ":" + newLaunchTemplateVersion, nil
 }
 
+// getLaunchIdentifier returns the launch configuration name, or name:version of the launch template of the autoscaling group
+func getLaunchIdentifier(asg AutoscalingGroup, useLaunchTemplates string) string {
+	if useLaunchTemplates == "true" {
+		return asg.LaunchTemplateName + ":" + asg.LaunchTemplateVersion
+	}
+	return asg.LaunchConfigurationName
+}
+
 func checkInstanceLaunchConfigOrTemplate(useLaunchTemplates string, instance AutoscalingInstance, newName string) bool {
 	if useLaunchTemplates == "true" {
 		s := strings.Split(newName, ":")
@@ -321,6 +984,37 @@ func checkInstanceLaunchConfigOrTemplate(useLaunchTemplates string, instance Aut
 	return false
 
 }
+
+// splitEnv returns the comma separated values of an environment variable
+func splitEnv(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if strings.TrimSpace(value) != "" {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
+func getEnvDuration(name string) (time.Duration, error) {
+	if os.Getenv(name) == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return d, nil
+}
+func getEnvInt(name string) (int, error) {
+	if os.Getenv(name) == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return i, nil
+}
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
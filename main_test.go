@@ -0,0 +1,765 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func setUpgradeEnv(t *testing.T, f *fakeAWS, env map[string]string) {
+	t.Setenv("ECS_CLUSTER", f.cluster)
+	t.Setenv("ECS_ASG", f.asgName)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+}
+
+func checkUpgraded(t *testing.T, f *fakeAWS, instanceCount int) {
+	if f.desiredCapacity != int64(instanceCount) {
+		t.Errorf("expected desired capacity %d, got %d", instanceCount, f.desiredCapacity)
+	}
+	if len(f.instances) != instanceCount {
+		t.Errorf("expected %d instances, got %d", instanceCount, len(f.instances))
+	}
+	if newInstances := f.instancesWithImage(fakeNewAMI); len(newInstances) != instanceCount {
+		t.Errorf("expected %d instances with the new AMI, got %d", instanceCount, len(newInstances))
+	}
+	var runningTasks int64
+	for _, ci := range f.containerInstances {
+		if ci.Status != "ACTIVE" {
+			t.Errorf("container instance %s has status %s", ci.InstanceId, ci.Status)
+		}
+		runningTasks += ci.RunningTasks
+	}
+	if runningTasks != int64(instanceCount)*2 {
+		t.Errorf("expected %d running tasks, got %d", instanceCount*2, runningTasks)
+	}
+}
+
+func TestUpgradeLaunchConfig(t *testing.T) {
+	f := newFakeAWS(3, 2, false)
+	setUpgradeEnv(t, f, nil)
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 3)
+	if _, ok := f.launchConfigs["lc"]; ok {
+		t.Errorf("old launch configuration was not deleted")
+	}
+	if f.launchConfig == "lc" {
+		t.Errorf("autoscaling group still uses the old launch configuration")
+	}
+}
+
+func TestUpgradeLaunchTemplate(t *testing.T) {
+	f := newFakeAWS(3, 2, true)
+	setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": "true"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 3)
+	if f.launchTemplateVer != "2" {
+		t.Errorf("expected launch template version 2, got %s", f.launchTemplateVer)
+	}
+}
+
+func TestUpgradeLaunchOverrides(t *testing.T) {
+	env := map[string]string{"INSTANCE_TYPE": "m6i.large", "ROOT_VOLUME_SIZE": "50", "REQUIRE_IMDSV2": "true", "SECURITY_GROUPS": "sg-1"}
+	t.Run("launch configuration", func(t *testing.T) {
+		f := newFakeAWS(2, 2, false)
+		setUpgradeEnv(t, f, env)
+		if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+			t.Fatalf("upgrade returned %d", ret)
+		}
+		checkUpgraded(t, f, 2)
+		lc := f.launchConfigs[f.launchConfig]
+		if aws.StringValue(lc.InstanceType) != "m6i.large" || aws.StringValue(lc.MetadataOptions.HttpTokens) != "required" || aws.StringValueSlice(lc.SecurityGroups)[0] != "sg-1" ||
+			len(lc.BlockDeviceMappings) != 1 || aws.Int64Value(lc.BlockDeviceMappings[0].Ebs.VolumeSize) != 50 {
+			t.Errorf("overrides not applied to the launch configuration: %+v", lc)
+		}
+	})
+	t.Run("launch template", func(t *testing.T) {
+		f := newFakeAWS(2, 2, true)
+		env["LAUNCH_TEMPLATES"] = "true"
+		setUpgradeEnv(t, f, env)
+		if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+			t.Fatalf("upgrade returned %d", ret)
+		}
+		checkUpgraded(t, f, 2)
+		request := f.launchTemplateRequests[0]
+		if aws.StringValue(request.InstanceType) != "m6i.large" || aws.StringValue(request.MetadataOptions.HttpTokens) != "required" || aws.StringValueSlice(request.SecurityGroupIds)[0] != "sg-1" ||
+			len(request.BlockDeviceMappings) != 1 || aws.Int64Value(request.BlockDeviceMappings[0].Ebs.VolumeSize) != 50 {
+			t.Errorf("overrides not applied to the launch template version: %+v", request)
+		}
+	})
+}
+
+// TestUpgradeTargetLaunchSettings uses the launch settings of the target instead of the environment
+func TestUpgradeTargetLaunchSettings(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	setUpgradeEnv(t, f, map[string]string{"INSTANCE_TYPE": "m4.large", "SECURITY_GROUPS": "sg-2", "LAUNCH_TEMPLATES": "false"})
+	target := f.target()
+	target.InstanceType, target.SecurityGroups, target.LaunchTemplates = "m6i.large", []string{"sg-1"}, aws.Bool(true)
+	if ret := runWithReturnCode(context.Background(), f.clients(), target); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 2)
+	request := f.launchTemplateRequests[0]
+	if aws.StringValue(request.InstanceType) != "m6i.large" || !reflect.DeepEqual(aws.StringValueSlice(request.SecurityGroupIds), []string{"sg-1"}) {
+		t.Errorf("launch settings of the target not applied to the launch template version: %+v", request)
+	}
+}
+
+// TestUpgradeInstanceTypeOnly replaces the instances when only the instance type changes
+func TestUpgradeInstanceTypeOnly(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.launchConfigs["lc"].ImageId = aws.String(fakeNewAMI)
+	setUpgradeEnv(t, f, map[string]string{"INSTANCE_TYPE": "m6i.large"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	if f.launchConfig == "lc" || aws.StringValue(f.launchConfigs[f.launchConfig].InstanceType) != "m6i.large" || len(f.instances) != 2 {
+		t.Errorf("autoscaling group was not moved to the new instance type")
+	}
+	for _, instance := range f.instances {
+		if instance.LaunchConfig != f.launchConfig {
+			t.Errorf("instance %s was not replaced", instance.InstanceId)
+		}
+	}
+}
+
+// TestUpgradeInvalidLaunchOverrides stops before anything is rolled out
+func TestUpgradeInvalidLaunchOverrides(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	setUpgradeEnv(t, f, map[string]string{"INSTANCE_TYPE": "m7i.large"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	if f.launchConfig != "lc" || len(f.launchConfigs) != 1 || len(f.instances) != 2 || f.desiredCapacity != 2 {
+		t.Errorf("autoscaling group was changed")
+	}
+}
+
+// TestUpgradeArm64InstanceType upgrades to the ECS optimized AMI for the architecture of the new instance type
+func TestUpgradeArm64InstanceType(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.images = append(f.images, &ec2.Image{ImageId: aws.String("ami-arm64"), CreationDate: aws.String("2024-06-01T00:00:00.000Z"), Architecture: aws.String("arm64"), RootDeviceName: aws.String("/dev/xvda")})
+	f.agentVersions["ami-arm64"] = f.agentVersions[fakeNewAMI]
+	f.attributes["ami-arm64"] = f.attributes[fakeNewAMI]
+	setUpgradeEnv(t, f, map[string]string{"INSTANCE_TYPE": "m7g.large"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	if image := f.currentImage(); image != "ami-arm64" {
+		t.Errorf("expected the arm64 AMI, got %s", image)
+	}
+}
+
+// TestUpgradeECSConfig changes ecs.config in the user data of the new launch configuration or launch template version
+func TestUpgradeECSConfig(t *testing.T) {
+	userData := base64.StdEncoding.EncodeToString([]byte(testUserData))
+	expected := LaunchSettingChange{Setting: "ecsConfig.ECS_CONTAINER_STOP_TIMEOUT", Old: "30s", New: "2m"}
+	for _, useLaunchTemplates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("launch templates %v", useLaunchTemplates), func(t *testing.T) {
+			f := newFakeAWS(2, 2, useLaunchTemplates)
+			if useLaunchTemplates {
+				f.launchTemplates["lt"][0].LaunchTemplateData.UserData = aws.String(userData)
+			} else {
+				f.launchConfigs["lc"].UserData = aws.String(userData)
+			}
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": fmt.Sprintf("%v", useLaunchTemplates), "ECS_CONFIG": `{"ECS_CONTAINER_STOP_TIMEOUT":"2m"}`, "REPORT_FILE": reportFile})
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+				t.Fatalf("upgrade returned %d", ret)
+			}
+			checkUpgraded(t, f, 2)
+			var newUserData *string
+			if useLaunchTemplates {
+				newUserData = f.getLaunchTemplateVersion(f.launchTemplate, f.launchTemplateVer).LaunchTemplateData.UserData
+			} else {
+				newUserData = f.launchConfigs[f.launchConfig].UserData
+			}
+			if config := ecsConfigFromUserData(newUserData); config["ECS_CONTAINER_STOP_TIMEOUT"] != "2m" || config["ECS_CLUSTER"] != "cluster" {
+				t.Errorf("unexpected ecs.config %v", config)
+			}
+			report := readReport(t, reportFile)
+			if len(report.LaunchChanges) != 2 || report.LaunchChanges[1] != expected {
+				t.Errorf("expected launch change %+v, got %+v", expected, report.LaunchChanges)
+			}
+			if !strings.Contains(report.UserDataDiff, `+echo "ECS_CONTAINER_STOP_TIMEOUT=2m" >> /etc/ecs/ecs.config`) {
+				t.Errorf("unexpected user data diff:\n%s", report.UserDataDiff)
+			}
+		})
+	}
+}
+
+// TestPlan reports the changes of an upgrade without changing the autoscaling group
+func TestPlan(t *testing.T) {
+	for _, useLaunchTemplates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("launch templates %v", useLaunchTemplates), func(t *testing.T) {
+			f := newFakeAWS(2, 2, useLaunchTemplates)
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			setUpgradeEnv(t, f, map[string]string{"MODE": "plan", "LAUNCH_TEMPLATES": fmt.Sprintf("%v", useLaunchTemplates), "INSTANCE_TYPE": "m6i.large",
+				"ECS_CONFIG": `{"ECS_ENABLE_SPOT_INSTANCE_DRAINING":"true"}`, "REPORT_FILE": reportFile})
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+				t.Fatalf("plan returned %d", ret)
+			}
+			if len(f.launchConfigs) > 1 || len(f.launchTemplates["lt"]) > 1 || len(f.instances) != 2 || f.desiredCapacity != 2 {
+				t.Errorf("autoscaling group was changed")
+			}
+			report := readReport(t, reportFile)
+			expected := []LaunchSettingChange{
+				{Setting: "imageId", Old: fakeOldAMI, New: fakeNewAMI},
+				{Setting: "instanceType", Old: "m5.large", New: "m6i.large"},
+				{Setting: "ecsConfig.ECS_ENABLE_SPOT_INSTANCE_DRAINING", Old: "", New: "true"},
+			}
+			if report.Outcome != "planned" || report.NewAMI != fakeNewAMI || !reflect.DeepEqual(report.LaunchChanges, expected) {
+				t.Errorf("unexpected report %+v", report)
+			}
+			if !strings.Contains(report.UserDataDiff, "+echo ECS_ENABLE_SPOT_INSTANCE_DRAINING=true >> /etc/ecs/ecs.config") {
+				t.Errorf("unexpected user data diff:\n%s", report.UserDataDiff)
+			}
+		})
+	}
+	t.Run("already latest", func(t *testing.T) {
+		f := newFakeAWS(2, 2, false)
+		f.launchConfigs["lc"].ImageId = aws.String(fakeNewAMI)
+		reportFile := filepath.Join(t.TempDir(), "report.json")
+		setUpgradeEnv(t, f, map[string]string{"MODE": "plan", "REPORT_FILE": reportFile})
+		if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+			t.Fatalf("plan returned %d", ret)
+		}
+		if report := readReport(t, reportFile); report.Outcome != "already-latest" || len(report.LaunchChanges) != 0 {
+			t.Errorf("unexpected report %+v", report)
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	for _, newAMI := range []bool{false, true} {
+		t.Run(fmt.Sprintf("new AMI %v", newAMI), func(t *testing.T) {
+			f := newFakeAWS(3, 2, false)
+			f.launchConfigs["lc"].UserData = aws.String("IyEvYmluL2Jhc2gK")
+			setUpgradeEnv(t, f, map[string]string{"MODE": "migrate", "MIGRATE_NEW_AMI": fmt.Sprintf("%v", newAMI)})
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+				t.Fatalf("migration returned %d", ret)
+			}
+			if f.launchTemplate != "lc" || f.launchTemplateVer != "1" || f.launchConfig != "" {
+				t.Errorf("expected the autoscaling group on launch template lc version 1, got %q:%q (launch configuration %q)", f.launchTemplate, f.launchTemplateVer, f.launchConfig)
+			}
+			if _, ok := f.launchConfigs["lc"]; ok {
+				t.Errorf("old launch configuration was not deleted")
+			}
+			image := fakeOldAMI
+			if newAMI {
+				image = fakeNewAMI
+			}
+			if instances := f.instancesWithImage(image); len(instances) != 3 || len(f.instances) != 3 {
+				t.Errorf("expected 3 instances with %s, got %d of %d", image, len(instances), len(f.instances))
+			}
+			for _, instance := range f.instances {
+				if instance.LaunchTemplateName != "lc" {
+					t.Errorf("instance %s was not launched from the launch template", instance.InstanceId)
+				}
+			}
+			if data := f.getLaunchTemplateVersion("lc", "1").LaunchTemplateData; aws.StringValue(data.UserData) != "IyEvYmluL2Jhc2gK" || aws.StringValue(data.InstanceType) != "m5.large" {
+				t.Errorf("launch template data doesn't match the launch configuration: %+v", data)
+			}
+		})
+	}
+}
+
+func TestMigrateRollbackOnAlarm(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	f.alarmOnImage = fakeNewAMI
+	setUpgradeEnv(t, f, map[string]string{"MODE": "migrate", "MIGRATE_NEW_AMI": "true", "ALARM_NAMES": "api-*", "ROLLBACK_ON_FAILURE": "true"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected migration to fail, got %d", ret)
+	}
+	if f.launchConfig != "lc" || f.launchTemplate != "" {
+		t.Errorf("autoscaling group was not rolled back to the launch configuration (got %q, %q)", f.launchConfig, f.launchTemplate)
+	}
+	if oldInstances := f.instancesWithImage(fakeOldAMI); len(oldInstances) != 2 || len(f.instances) != 2 || f.desiredCapacity != 2 {
+		t.Errorf("expected 2 old instances after rollback, got %d old instances out of %d", len(oldInstances), len(f.instances))
+	}
+	// a next migration creates a new version of the launch template
+	f.alarmOnImage = ""
+	f.alarms[0].StateValue = aws.String("OK")
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("second migration returned %d", ret)
+	}
+	if f.launchTemplate != "lc" || f.launchTemplateVer != "2" {
+		t.Errorf("expected launch template lc version 2, got %q:%q", f.launchTemplate, f.launchTemplateVer)
+	}
+	checkUpgraded(t, f, 2)
+}
+
+func TestMigrateWithoutLaunchConfig(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	setUpgradeEnv(t, f, map[string]string{"MODE": "migrate"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected migration to fail, got %d", ret)
+	}
+	if f.launchTemplateVer != "1" || len(f.instances) != 2 {
+		t.Errorf("autoscaling group was changed")
+	}
+}
+
+// TestUpgradeLargeCluster upgrades clusters larger than the page sizes and batch limits of the APIs.
+// The fakes paginate their results and reject calls over the API limits
+func TestUpgradeLargeCluster(t *testing.T) {
+	for _, useLaunchTemplates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("launch templates %v", useLaunchTemplates), func(t *testing.T) {
+			f := newFakeAWS(520, 2, useLaunchTemplates)
+			f.targetGroups = []string{"arn:aws:elasticloadbalancing:tg/web", "arn:aws:elasticloadbalancing:tg/api", "arn:aws:elasticloadbalancing:tg/admin"}
+			setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": fmt.Sprintf("%v", useLaunchTemplates), "REPORT_FILE": t.TempDir() + "/report.json"})
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+				t.Fatalf("upgrade returned %d", ret)
+			}
+			checkUpgraded(t, f, 520)
+		})
+	}
+}
+
+// BenchmarkGetNewTargetsHealth measures one target health check of a large cluster with many target groups,
+// with the target groups described one by one and concurrently
+func BenchmarkGetNewTargetsHealth(b *testing.B) {
+	f := newFakeAWS(200, 2, false)
+	f.latency = 2 * time.Millisecond
+	f.targetGroups = nil
+	for i := 0; i < 50; i++ {
+		f.targetGroups = append(f.targetGroups, fmt.Sprintf("arn:aws:elasticloadbalancing:tg/%d", i))
+	}
+	c := f.clients()
+	ctx := context.Background()
+	arns, err := c.ECS.listContainerInstances(ctx, f.cluster)
+	if err != nil {
+		b.Fatal(err)
+	}
+	containerInstances, err := c.ECS.describeContainerInstances(ctx, f.cluster, arns)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, concurrency := range []int{1, defaultConcurrency} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			c.ECS.concurrency, c.LB.concurrency = concurrency, concurrency
+			for i := 0; i < b.N; i++ {
+				states, err := getNewTargetsHealth(ctx, c.Autoscaling, c.ECS, c.LB, f.targetGroups, containerInstances, f.asgName, "lc", "false", f.cluster)
+				if err != nil || states["healthy"] != 200*50 {
+					b.Fatalf("expected %d healthy targets, got %v (%v)", 200*50, states, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeAlreadyLatest(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.launchConfigs["lc"].ImageId = aws.String(fakeNewAMI)
+	setUpgradeEnv(t, f, nil)
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	if f.launchConfig != "lc" || len(f.instances) != 2 {
+		t.Errorf("autoscaling group was changed")
+	}
+}
+
+// TestUpgradeAMIMinAge keeps the AMI while the new AMI is younger than the minimum age, unless the target allows it
+func TestUpgradeAMIMinAge(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"AMI_MIN_AGE_DAYS": "7", "REPORT_FILE": reportFile})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	if f.launchConfig != "lc" || len(f.instances) != 2 {
+		t.Errorf("autoscaling group was changed")
+	}
+	report := readReport(t, reportFile)
+	if report.Outcome != "already-latest" || report.AMISelection == nil || report.AMISelection.ImageId != fakeOldAMI ||
+		len(report.AMISelection.Skipped) != 1 || report.AMISelection.Skipped[0].ImageId != fakeNewAMI {
+		t.Errorf("unexpected report %+v", report)
+	}
+	target := f.target()
+	target.AMIMinAgeDays = aws.Int(0)
+	if ret := runWithReturnCode(context.Background(), f.clients(), target); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 2)
+	if report := readReport(t, reportFile); report.AMISelection == nil || report.AMISelection.ImageId != fakeNewAMI || report.AMISelection.Reason != "newest of the ECS optimized AMIs" {
+		t.Errorf("unexpected AMI selection %+v", report.AMISelection)
+	}
+}
+
+// TestUpgradeAMIMinAgeLaunched launches the AMI selected with the minimum age, which is the AMI in the report
+func TestUpgradeAMIMinAgeLaunched(t *testing.T) {
+	for _, useLaunchTemplates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("launch templates %v", useLaunchTemplates), func(t *testing.T) {
+			f := newFakeAWS(2, 2, useLaunchTemplates)
+			f.images = append(f.images, &ec2.Image{ImageId: aws.String("ami-soaked"), CreationDate: aws.String("2024-05-01T00:00:00.000Z"), Architecture: aws.String("x86_64"), RootDeviceName: aws.String("/dev/xvda")})
+			f.agentVersions["ami-soaked"], f.attributes["ami-soaked"] = f.agentVersions[fakeNewAMI], f.attributes[fakeNewAMI]
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": fmt.Sprintf("%v", useLaunchTemplates), "AMI_MIN_AGE_DAYS": "7", "REPORT_FILE": reportFile})
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+				t.Fatalf("upgrade returned %d", ret)
+			}
+			if f.currentImage() != "ami-soaked" || len(f.instancesWithImage("ami-soaked")) != 2 {
+				t.Errorf("expected the instances to run ami-soaked, the autoscaling group has %s", f.currentImage())
+			}
+			if report := readReport(t, reportFile); report.NewAMI != "ami-soaked" || report.AMISelection == nil || report.AMISelection.ImageId != "ami-soaked" {
+				t.Errorf("unexpected report %+v", report)
+			}
+		})
+	}
+}
+
+func TestUpgradeCanary(t *testing.T) {
+	f := newFakeAWS(4, 2, false)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"CANARY": "1", "REPORT_FILE": reportFile})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 4)
+	// the old instance drained by the canary is not drained again
+	report := readReport(t, reportFile)
+	drained := make(map[string]bool)
+	for _, instanceId := range report.InstancesDrained {
+		if drained[instanceId] {
+			t.Errorf("instance %s drained twice", instanceId)
+		}
+		drained[instanceId] = true
+	}
+	if len(drained) != 4 {
+		t.Errorf("expected 4 drained instances, got %v", report.InstancesDrained)
+	}
+}
+
+// TestUpgradeCanaryTaskFailures fails the canary on CANARY_MAX_TASK_FAILURES, also when MAX_TASK_FAILURES is higher
+func TestUpgradeCanaryTaskFailures(t *testing.T) {
+	f := newFakeAWS(4, 2, false)
+	f.failTasksOnImage = fakeNewAMI
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"CANARY": "1", "CANARY_MAX_TASK_FAILURES": "1", "MAX_TASK_FAILURES": "10", "REPORT_FILE": reportFile})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected the canary to fail, got %d", ret)
+	}
+	report := readReport(t, reportFile)
+	last := report.Phases[len(report.Phases)-1]
+	if last.Name != "canary" || !strings.Contains(last.Error, "task(s) failed") {
+		t.Errorf("expected the canary to fail on task failures, got %+v", last)
+	}
+	if len(f.instancesWithImage(fakeOldAMI)) != 4 {
+		t.Errorf("old instances were terminated")
+	}
+}
+
+// TestUpgradeCanaryInvalidSettings fails before the autoscaling group is changed
+func TestUpgradeCanaryInvalidSettings(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"bake time":          {"CANARY": "1", "CANARY_BAKE_TIME": "15"},
+		"negative bake time": {"CANARY": "1", "CANARY_BAKE_TIME": "-15m"},
+		"max task failures":  {"CANARY": "1", "CANARY_MAX_TASK_FAILURES": "-1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFakeAWS(4, 2, false)
+			setUpgradeEnv(t, f, env)
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+				t.Fatalf("expected upgrade to fail, got %d", ret)
+			}
+			if f.desiredCapacity != 4 || f.launchConfig != "lc" || len(f.launchConfigs) != 1 {
+				t.Errorf("autoscaling group was changed")
+			}
+		})
+	}
+}
+
+// TestUpgradeCanaryTargetsNotHealthy fails the canary when its targets never become healthy
+func TestUpgradeCanaryTargetsNotHealthy(t *testing.T) {
+	f := newFakeAWS(4, 2, false)
+	f.initialTargetsOnImage = fakeNewAMI
+	setUpgradeEnv(t, f, map[string]string{"CANARY": "1"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected the canary to fail, got %d", ret)
+	}
+	if len(f.instancesWithImage(fakeOldAMI)) < 3 {
+		t.Errorf("old instances were terminated")
+	}
+}
+
+func TestUpgradeRollbackOnAlarm(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	f.alarmOnImage = fakeNewAMI
+	// ROLLBACK_ON_ALARM is the old name of ROLLBACK_ON_FAILURE
+	setUpgradeEnv(t, f, map[string]string{"ALARM_NAMES": "api-*", "ROLLBACK_ON_ALARM": "true"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	if f.launchConfig != "lc" {
+		t.Errorf("autoscaling group was not rolled back to the old launch configuration (got %s)", f.launchConfig)
+	}
+	if oldInstances := f.instancesWithImage(fakeOldAMI); len(oldInstances) != 2 || len(f.instances) != 2 || f.desiredCapacity != 2 {
+		t.Errorf("expected 2 old instances after rollback, got %d old instances out of %d", len(oldInstances), len(f.instances))
+	}
+}
+
+func TestUpgradeRollbackOnFailure(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.listServicesErr = awserr.New("AccessDeniedException", "not allowed to list services", nil)
+	setUpgradeEnv(t, f, map[string]string{"ROLLBACK_ON_FAILURE": "true"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	if f.launchConfig != "lc" {
+		t.Errorf("autoscaling group was not rolled back to the old launch configuration (got %s)", f.launchConfig)
+	}
+	if oldInstances := f.instancesWithImage(fakeOldAMI); len(oldInstances) != 2 || len(f.instances) != 2 || f.desiredCapacity != 2 {
+		t.Errorf("expected 2 old instances after rollback, got %d old instances out of %d", len(oldInstances), len(f.instances))
+	}
+	for _, ci := range f.containerInstances {
+		if ci.Status != "ACTIVE" {
+			t.Errorf("container instance %s has status %s", ci.InstanceId, ci.Status)
+		}
+	}
+}
+
+func TestUpgradeAlarmDuringTargetHealth(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	// the targets never become healthy and the alarm goes off a minute after the drain
+	f.initialTargetsOnImage = fakeNewAMI
+	f.onDrain = func() {
+		f.alarmAt = f.clock.Now().Add(time.Minute)
+	}
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"ALARM_NAMES": "api-5xx", "ROLLBACK_ON_FAILURE": "true", "REPORT_FILE": reportFile})
+	start := f.clock.Now()
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	report := readReport(t, reportFile)
+	last := report.Phases[len(report.Phases)-1]
+	if last.Name != "target-health" || !strings.Contains(last.Error, "api-5xx") {
+		t.Errorf("expected the alarm to stop the target-health phase, got %+v", last)
+	}
+	if elapsed := f.clock.Now().Sub(start); elapsed >= 10*time.Minute {
+		t.Errorf("expected the upgrade to stop before the target health timeout, took %s", elapsed)
+	}
+	if report.Outcome != "rolled-back" || len(f.instancesWithImage(fakeOldAMI)) != 2 {
+		t.Errorf("expected the upgrade to be rolled back, got %s", report.Outcome)
+	}
+}
+
+func TestUpgradeTaskFailures(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.failTasksOnImage = fakeNewAMI
+	setUpgradeEnv(t, f, nil)
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	if len(f.instancesWithImage(fakeOldAMI)) != 2 {
+		t.Errorf("old instances were terminated")
+	}
+}
+
+// TestUpgradeInstancesNotHealthy stops before the drain when the new instances don't become healthy
+func TestUpgradeInstancesNotHealthy(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.unhealthyOnImage = fakeNewAMI
+	setUpgradeEnv(t, f, map[string]string{"ROLLBACK_ON_FAILURE": "true"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	for _, ci := range f.containerInstances {
+		if ci.Status != "ACTIVE" {
+			t.Errorf("container instance %s was drained", ci.InstanceId)
+		}
+	}
+	if f.launchConfig != "lc" || len(f.instancesWithImage(fakeOldAMI)) != 2 || len(f.instances) != 2 {
+		t.Errorf("autoscaling group was not rolled back")
+	}
+}
+
+func TestUpgradeNegativeMaxTaskFailures(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	setUpgradeEnv(t, f, map[string]string{"MAX_TASK_FAILURES": "-1"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	if f.desiredCapacity != 2 || len(f.launchConfigs) != 1 {
+		t.Errorf("autoscaling group was changed")
+	}
+}
+
+func TestUpgradeMissingAttributes(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	for _, ci := range f.containerInstances {
+		ci.Attributes = append(ci.Attributes, "ecs.capability.gpu-driver-version")
+	}
+	setUpgradeEnv(t, f, nil)
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	for _, ci := range f.containerInstances {
+		if ci.Status != "ACTIVE" {
+			t.Errorf("container instance %s was drained", ci.InstanceId)
+		}
+	}
+}
+
+func TestAgentUpdate(t *testing.T) {
+	f := newFakeAWS(3, 2, false)
+	setUpgradeEnv(t, f, map[string]string{"MODE": "agent-update", "AGENT_UPDATE_BATCH_SIZE": "2"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("agent update returned %d", ret)
+	}
+	for _, ci := range f.containerInstances {
+		if ci.AgentVersion != f.agentVersions[fakeNewAMI] {
+			t.Errorf("agent of %s not updated (version %s)", ci.InstanceId, ci.AgentVersion)
+		}
+	}
+}
+
+// TestAgentUpdateLock locks the cluster when there is no autoscaling group
+func TestAgentUpdateLock(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	setUpgradeEnv(t, f, map[string]string{"MODE": "agent-update", "ECS_ASG": ""})
+	target := Target{Cluster: f.cluster}
+	now := f.clock.Now().UTC()
+	f.clusterTags[lockTagKey] = encodeLockTag(LockInfo{Owner: "other", Nonce: "1", AcquiredAt: now, ExpiresAt: now.Add(time.Hour)})
+	if ret := runWithReturnCode(context.Background(), f.clients(), target); ret != 1 {
+		t.Fatalf("expected agent update to fail while the cluster is locked, got %d", ret)
+	}
+	for _, ci := range f.containerInstances {
+		if ci.AgentVersion == f.agentVersions[fakeNewAMI] {
+			t.Errorf("agent of %s updated while the cluster is locked", ci.InstanceId)
+		}
+	}
+	delete(f.clusterTags, lockTagKey)
+	if ret := runWithReturnCode(context.Background(), f.clients(), target); ret != 0 {
+		t.Fatalf("agent update returned %d", ret)
+	}
+	if _, ok := f.clusterTags[lockTagKey]; ok {
+		t.Errorf("lock of the cluster not released")
+	}
+}
+
+func TestUpgradeBakePeriod(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	setUpgradeEnv(t, f, map[string]string{"ALARM_NAMES": "api-5xx", "ALARM_BAKE_PERIOD": "1h"})
+	start := f.clock.Now()
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 2)
+	if elapsed := f.clock.Now().Sub(start); elapsed < time.Hour {
+		t.Errorf("expected the bake period of 1h to pass, got %s", elapsed)
+	}
+}
+
+func TestUpgradeCancelled(t *testing.T) {
+	for _, action := range []string{"rollback", "restore"} {
+		t.Run(action, func(t *testing.T) {
+			f := newFakeAWS(2, 2, false)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f.onDrain = cancel
+			stateFile := filepath.Join(t.TempDir(), "state.json")
+			setUpgradeEnv(t, f, map[string]string{"ON_CANCEL": action, "STATE_FILE": stateFile})
+			if ret := runWithReturnCode(ctx, f.clients(), f.target()); ret != 1 {
+				t.Fatalf("expected upgrade to stop, got %d", ret)
+			}
+			for _, ci := range f.containerInstances {
+				if ci.Status != "ACTIVE" {
+					t.Errorf("container instance %s has status %s", ci.InstanceId, ci.Status)
+				}
+			}
+			if f.desiredCapacity != 2 {
+				t.Errorf("expected desired capacity 2, got %d", f.desiredCapacity)
+			}
+			if action == "rollback" && (f.launchConfig != "lc" || len(f.instancesWithImage(fakeOldAMI)) != 2 || len(f.instances) != 2) {
+				t.Errorf("autoscaling group was not rolled back")
+			}
+
+			out, err := os.ReadFile(stateFile)
+			if err != nil {
+				t.Fatalf("state file not written: %v", err)
+			}
+			var state UpgradeState
+			if err := json.Unmarshal(out, &state); err != nil {
+				t.Fatalf("invalid state file: %v", err)
+			}
+			if !state.Cancelled || state.Phase != "drain" || state.CancelAction != action || state.CancelActionError != "" {
+				t.Errorf("unexpected state: %+v", state)
+			}
+			if len(state.DrainedContainerInstanceArns) == 0 || state.LaunchConfigurationName != "lc" {
+				t.Errorf("state is missing the drained instances or the launch configuration: %+v", state)
+			}
+		})
+	}
+}
+
+func TestUpgradeCleanupFailed(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.launchConfigInUse = true
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	setUpgradeEnv(t, f, map[string]string{"ROLLBACK_ON_FAILURE": "true", "STATE_FILE": stateFile})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	// the old instances are already gone, the new instances are kept
+	checkUpgraded(t, f, 2)
+	out, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("state file not written: %v", err)
+	}
+	var state UpgradeState
+	if err := json.Unmarshal(out, &state); err != nil {
+		t.Fatalf("invalid state file: %v", err)
+	}
+	if state.Phase != "cleanup" || state.Error == "" || state.NewLaunchIdentifier == "" {
+		t.Errorf("unexpected state: %+v", state)
+	}
+}
+
+func TestUpgradeLocked(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	held := LockInfo{Owner: "scheduled-run", AcquiredAt: f.clock.Now().Add(-time.Minute), ExpiresAt: f.clock.Now().Add(4 * time.Minute)}
+	f.tags[lockTagKey] = encodeLockTag(held)
+	setUpgradeEnv(t, f, nil)
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	if f.launchConfig != "lc" || f.desiredCapacity != 2 || len(f.instances) != 2 {
+		t.Errorf("autoscaling group was changed while locked")
+	}
+	if f.tags[lockTagKey] != encodeLockTag(held) {
+		t.Errorf("lock of the other run was changed: %s", f.tags[lockTagKey])
+	}
+
+	// once the lock is expired, it is taken over and released at the end
+	sleep(context.Background(), f.clock, 5*time.Minute)
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, f, 2)
+	if _, ok := f.tags[lockTagKey]; ok {
+		t.Errorf("lock was not released")
+	}
+}
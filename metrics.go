@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logging
+var metricsLogger = getLogger("metrics")
+
+// Metrics exposes the progress and the result of a run in the Prometheus text format.
+// The metrics are derived from the report every time the phase changes and at the end of the run
+type Metrics struct {
+	mu       sync.RWMutex
+	rendered []byte
+}
+
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string // gauge when empty
+	samples []metricSample
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// update renders the metrics of the report at the given time
+func (m *Metrics) update(r *Report, now time.Time) {
+	rendered := renderMetrics(reportMetrics(r, now))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rendered = rendered
+}
+
+func (m *Metrics) get() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.rendered
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.get())
+}
+
+// serve serves the metrics on addr at /metrics until ctx is done
+func (m *Metrics) serve(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			metricsLogger.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+	metricsLogger.Debugf("Serving metrics on %s/metrics", listener.Addr())
+	return nil
+}
+
+// push replaces the metrics of this cluster, autoscaling group and region on a Pushgateway compatible endpoint
+func (m *Metrics) push(ctx context.Context, gatewayURL, job string, r *Report) error {
+	pushURL := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job) + "/cluster/" + url.PathEscape(r.Cluster)
+	if r.AutoscalingGroup != "" {
+		pushURL += "/asg/" + url.PathEscape(r.AutoscalingGroup)
+	}
+	if r.Region != "" {
+		pushURL += "/region/" + url.PathEscape(r.Region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, pushURL, bytes.NewReader(m.get()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("push to %s failed: %s", pushURL, resp.Status)
+	}
+	metricsLogger.Debugf("Pushed metrics to %s", pushURL)
+	return nil
+}
+
+// pushFromEnv pushes the metrics to PUSHGATEWAY_URL, with the job name in PUSHGATEWAY_JOB (default: ecs-upgrade)
+func (m *Metrics) pushFromEnv(r *Report) error {
+	gatewayURL := os.Getenv("PUSHGATEWAY_URL")
+	if gatewayURL == "" {
+		return nil
+	}
+	job := os.Getenv("PUSHGATEWAY_JOB")
+	if job == "" {
+		job = "ecs-upgrade"
+	}
+	// the run context can be cancelled already
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return m.push(ctx, gatewayURL, job, r)
+}
+
+// reportMetrics returns the metric families of a report. Phases that are still running are measured until now
+func reportMetrics(r *Report, now time.Time) []metricFamily {
+	labels := func(extra ...string) map[string]string {
+		l := map[string]string{"cluster": r.Cluster, "mode": r.Mode}
+		if r.AutoscalingGroup != "" {
+			l["asg"] = r.AutoscalingGroup
+		}
+		if r.Region != "" {
+			l["region"] = r.Region
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			l[extra[i]] = extra[i+1]
+		}
+		return l
+	}
+	finished := !r.FinishedAt.IsZero()
+	end := now
+	if finished {
+		end = r.FinishedAt
+	}
+
+	running := metricFamily{name: "ecs_upgrade_running", help: "1 while the run is in progress"}
+	running.samples = append(running.samples, metricSample{labels: labels(), value: boolToFloat(!finished)})
+
+	duration := metricFamily{name: "ecs_upgrade_duration_seconds", help: "Duration of the run"}
+	duration.samples = append(duration.samples, metricSample{labels: labels(), value: end.Sub(r.StartedAt).Seconds()})
+
+	phaseDuration := metricFamily{name: "ecs_upgrade_phase_duration_seconds", help: "Duration of each phase of the run"}
+	currentPhase := metricFamily{name: "ecs_upgrade_current_phase", help: "1 for the phase that is in progress"}
+	var drainWait float64
+	for _, phase := range r.Phases {
+		phaseEnd := phase.FinishedAt
+		if phaseEnd.IsZero() {
+			phaseEnd = end
+			if !finished {
+				currentPhase.samples = append(currentPhase.samples, metricSample{labels: labels("phase", phase.Name), value: 1})
+			}
+		}
+		seconds := phaseEnd.Sub(phase.StartedAt).Seconds()
+		phaseDuration.samples = append(phaseDuration.samples, metricSample{labels: labels("phase", phase.Name), value: seconds})
+		if phase.Name == "drain" {
+			drainWait += seconds
+		}
+	}
+
+	drainWaitFamily := metricFamily{name: "ecs_upgrade_drain_wait_seconds", help: "Time spent waiting for the old instances to drain"}
+	drainWaitFamily.samples = append(drainWaitFamily.samples, metricSample{labels: labels(), value: drainWait})
+
+	instances := metricFamily{name: "ecs_upgrade_instances", help: "Number of instances launched, drained and terminated by the run"}
+	for _, action := range []struct {
+		name      string
+		instances []string
+	}{{"launched", r.InstancesLaunched}, {"drained", r.InstancesDrained}, {"terminated", r.InstancesTerminated}} {
+		instances.samples = append(instances.samples, metricSample{labels: labels("action", action.name), value: float64(len(action.instances))})
+	}
+
+	replaced := metricFamily{name: "ecs_upgrade_instances_replaced", help: "Number of old instances replaced by new instances"}
+	var replacedCount int
+	if r.Outcome == "succeeded" {
+		replacedCount = len(r.InstancesTerminated)
+	}
+	replaced.samples = append(replaced.samples, metricSample{labels: labels(), value: float64(replacedCount)})
+
+	rescheduled := metricFamily{name: "ecs_upgrade_tasks_rescheduled", help: "Number of tasks that were running on the drained instances"}
+	rescheduled.samples = append(rescheduled.samples, metricSample{labels: labels(), value: float64(r.TasksRescheduled)})
+
+	families := []metricFamily{running, duration, phaseDuration, currentPhase, drainWaitFamily, instances, replaced, rescheduled}
+
+	if r.TargetHealth != nil {
+		targets := metricFamily{name: "ecs_upgrade_target_health_targets", help: "Number of targets of the new instances per health state at the end of the target health check"}
+		var unhealthy int64
+		for _, state := range sortedStates(r.TargetHealth.States) {
+			targets.samples = append(targets.samples, metricSample{labels: labels("state", state), value: float64(r.TargetHealth.States[state])})
+			if state != "healthy" {
+				unhealthy += r.TargetHealth.States[state]
+			}
+		}
+		unhealthyFamily := metricFamily{name: "ecs_upgrade_target_unhealthy_targets", help: "Number of targets of the new instances that were not healthy at the end of the target health check"}
+		unhealthyFamily.samples = append(unhealthyFamily.samples, metricSample{labels: labels(), value: float64(unhealthy)})
+		families = append(families, targets, unhealthyFamily)
+	}
+
+	// the retries are counted for the whole process, so they keep growing across the runs of a daemon
+	retries := metricFamily{name: "ecs_upgrade_aws_retries_total", help: "Number of retried AWS calls per service", typ: "counter"}
+	throttles := metricFamily{name: "ecs_upgrade_aws_throttles_total", help: "Number of throttled AWS calls per service", typ: "counter"}
+	services, retryCounts, throttleCounts := awsStats.snapshot()
+	for _, service := range services {
+		retries.samples = append(retries.samples, metricSample{labels: labels("service", service), value: float64(retryCounts[service])})
+		throttles.samples = append(throttles.samples, metricSample{labels: labels("service", service), value: float64(throttleCounts[service])})
+	}
+	families = append(families, retries, throttles)
+
+	if finished {
+		outcome := metricFamily{name: "ecs_upgrade_outcome", help: "1 for the outcome of the run"}
+		for _, o := range []string{"succeeded", "already-latest", "planned", "failed", "rolled-back", "cancelled"} {
+			outcome.samples = append(outcome.samples, metricSample{labels: labels("outcome", o), value: boolToFloat(r.Outcome == o)})
+		}
+		lastRun := metricFamily{name: "ecs_upgrade_last_run_timestamp_seconds", help: "Time the run finished"}
+		lastRun.samples = append(lastRun.samples, metricSample{labels: labels(), value: float64(r.FinishedAt.Unix())})
+		families = append(families, outcome, lastRun)
+	}
+	return families
+}
+
+// renderMetrics renders metric families in the Prometheus text format
+func renderMetrics(families []metricFamily) []byte {
+	var out bytes.Buffer
+	for _, family := range families {
+		if len(family.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "# HELP %s %s\n", family.name, family.help)
+		typ := family.typ
+		if typ == "" {
+			typ = "gauge"
+		}
+		fmt.Fprintf(&out, "# TYPE %s %s\n", family.name, typ)
+		for _, sample := range family.samples {
+			var labels []string
+			for _, k := range sortedLabelNames(sample.labels) {
+				labels = append(labels, fmt.Sprintf("%s=\"%s\"", k, escapeLabelValue(sample.labels[k])))
+			}
+			fmt.Fprintf(&out, "%s{%s} %g\n", family.name, strings.Join(labels, ","), sample.value)
+		}
+	}
+	return out.Bytes()
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	var names []string
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedStates(states map[string]int64) []string {
+	var names []string
+	for k := range states {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportMetrics(t *testing.T) {
+	start := time.Date(2024, 6, 2, 10, 0, 0, 0, time.UTC)
+	report := newReport("upgrade", "cluster", "asg", "run", start)
+	report.startPhase("prepare", start)
+	report.startPhase("drain", start.Add(10*time.Second))
+	out := string(renderMetrics(reportMetrics(report, start.Add(70*time.Second))))
+	for _, line := range []string{
+		`ecs_upgrade_running{asg="asg",cluster="cluster",mode="upgrade"} 1`,
+		`ecs_upgrade_current_phase{asg="asg",cluster="cluster",mode="upgrade",phase="drain"} 1`,
+		`ecs_upgrade_phase_duration_seconds{asg="asg",cluster="cluster",mode="upgrade",phase="prepare"} 10`,
+		`ecs_upgrade_drain_wait_seconds{asg="asg",cluster="cluster",mode="upgrade"} 60`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "ecs_upgrade_outcome") {
+		t.Errorf("outcome of a running upgrade:\n%s", out)
+	}
+
+	report.finish(start.Add(90*time.Second), 1)
+	out = string(renderMetrics(reportMetrics(report, start.Add(100*time.Second))))
+	for _, line := range []string{
+		`ecs_upgrade_running{asg="asg",cluster="cluster",mode="upgrade"} 0`,
+		`ecs_upgrade_duration_seconds{asg="asg",cluster="cluster",mode="upgrade"} 90`,
+		`ecs_upgrade_outcome{asg="asg",cluster="cluster",mode="upgrade",outcome="failed"} 1`,
+		`ecs_upgrade_outcome{asg="asg",cluster="cluster",mode="upgrade",outcome="succeeded"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "ecs_upgrade_current_phase") {
+		t.Errorf("current phase of a finished upgrade:\n%s", out)
+	}
+}
+
+func TestAWSRetryMetrics(t *testing.T) {
+	awsStats.add("metrics-test", 3, 2)
+	report := newReport("upgrade", "cluster", "asg", "run", time.Now())
+	out := string(renderMetrics(reportMetrics(report, time.Now())))
+	for _, line := range []string{
+		`# TYPE ecs_upgrade_aws_retries_total counter`,
+		`ecs_upgrade_aws_retries_total{asg="asg",cluster="cluster",mode="upgrade",service="metrics-test"} 3`,
+		`ecs_upgrade_aws_throttles_total{asg="asg",cluster="cluster",mode="upgrade",service="metrics-test"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	if got := escapeLabelValue("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("unexpected escaped value %s", got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	metrics := newMetrics()
+	metrics.update(newReport("upgrade", "cluster", "asg", "run", time.Now()), time.Now())
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %s", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "# TYPE ecs_upgrade_running gauge\n") {
+		t.Errorf("unexpected metrics:\n%s", recorder.Body.String())
+	}
+}
+
+func TestUpgradePushMetrics(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+	}))
+	defer gateway.Close()
+	f := newFakeAWS(2, 2, true)
+	setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": "true", "REPORT_FILE": t.TempDir() + "/report.json", "PUSHGATEWAY_URL": gateway.URL + "/"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	if method != http.MethodPut || path != "/metrics/job/ecs-upgrade/cluster/cluster/asg/asg" {
+		t.Errorf("unexpected push %s %s", method, path)
+	}
+	for _, line := range []string{
+		`ecs_upgrade_outcome{asg="asg",cluster="cluster",mode="upgrade",outcome="succeeded"} 1`,
+		`ecs_upgrade_instances_replaced{asg="asg",cluster="cluster",mode="upgrade"} 2`,
+		`ecs_upgrade_tasks_rescheduled{asg="asg",cluster="cluster",mode="upgrade"} 4`,
+		`ecs_upgrade_target_unhealthy_targets{asg="asg",cluster="cluster",mode="upgrade"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, body)
+		}
+	}
+}
+
+func TestUpgradeSharedMetrics(t *testing.T) {
+	metrics := newMetrics()
+	for _, cluster := range []string{"first", "second"} {
+		f := newFakeAWS(2, 2, false)
+		f.cluster = cluster
+		setUpgradeEnv(t, f, map[string]string{"REPORT_FILE": t.TempDir() + "/report.json"})
+		c := f.clients()
+		c.Metrics = metrics
+		if ret := runWithReturnCode(context.Background(), c, f.target()); ret != 0 {
+			t.Fatalf("upgrade of %s returned %d", cluster, ret)
+		}
+		// the served metrics are the metrics of the last run
+		line := `ecs_upgrade_outcome{asg="asg",cluster="` + cluster + `",mode="upgrade",outcome="succeeded"} 1`
+		if out := string(metrics.get()); !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+}
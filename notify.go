@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// logging
+var notifyLogger = getLogger("notify")
+
+const defaultNotifyTemplate = `ecs-upgrade {{.Mode}} of {{.Cluster}}{{if .AutoscalingGroup}}/{{.AutoscalingGroup}}{{end}}{{if .Region}} in {{.Region}}{{end}}: ` +
+	`{{if eq .Event "started"}}started{{else if eq .Event "phase"}}{{.Phase}}{{else}}{{.Outcome}}{{if .Error}}: {{.Error}}{{end}}{{end}}`
+
+// Notification is a phase change of a run
+type Notification struct {
+	// Event is started, phase or finished
+	Event            string    `json:"event"`
+	Phase            string    `json:"phase,omitempty"`
+	Mode             string    `json:"mode"`
+	RunID            string    `json:"runId"`
+	Cluster          string    `json:"cluster"`
+	AutoscalingGroup string    `json:"autoscalingGroup,omitempty"`
+	Region           string    `json:"region,omitempty"`
+	Outcome          string    `json:"outcome,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	Time             time.Time `json:"time"`
+	Text             string    `json:"text"`
+}
+
+// notifyQueueSize is the number of notifications that can wait to be sent. Notifications are dropped when the queue is full
+const notifyQueueSize = 100
+
+// Notifier sends notifications to a webhook in the background, in order, so a slow webhook doesn't hold up the run.
+// Send failures are logged and never fail the run
+type Notifier struct {
+	url      string
+	format   string
+	template *template.Template
+	events   []string
+	retries  int
+	timeout  time.Duration
+	// maxDuration caps the time to send one notification, with all its retries
+	maxDuration time.Duration
+	client      *http.Client
+	clock       Clock
+	mu          sync.Mutex
+	queue       chan queuedNotification
+	closed      bool
+	done        chan struct{}
+}
+
+// queuedNotification is a rendered notification waiting to be sent
+type queuedNotification struct {
+	text string
+	body []byte
+}
+
+// newNotifierFromEnv returns the notifier configured with NOTIFY_WEBHOOK_URL, or nil when it isn't set
+func newNotifierFromEnv(clock Clock) (*Notifier, error) {
+	url := os.Getenv("NOTIFY_WEBHOOK_URL")
+	if url == "" {
+		return nil, nil
+	}
+	n := &Notifier{
+		url:         url,
+		format:      os.Getenv("NOTIFY_FORMAT"),
+		events:      splitEnv("NOTIFY_EVENTS"),
+		retries:     3,
+		timeout:     5 * time.Second,
+		maxDuration: 20 * time.Second,
+		client:      &http.Client{},
+		clock:       clock,
+	}
+	switch n.format {
+	case "":
+		n.format = "generic"
+	case "generic", "slack", "teams":
+	default:
+		return nil, fmt.Errorf("NOTIFY_FORMAT must be generic, slack or teams (got %s)", n.format)
+	}
+	text := os.Getenv("NOTIFY_TEMPLATE")
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+	var err error
+	n.template, err = template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_TEMPLATE: %v", err)
+	}
+	for _, event := range n.events {
+		if !stringInSlice(event, []string{"started", "phase", "finished"}) && !strings.HasPrefix(event, "phase:") {
+			return nil, fmt.Errorf("invalid NOTIFY_EVENTS %s, expected started, phase, phase:<name> or finished", event)
+		}
+	}
+	if os.Getenv("NOTIFY_RETRIES") != "" {
+		n.retries, err = getEnvInt("NOTIFY_RETRIES")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("NOTIFY_TIMEOUT") != "" {
+		n.timeout, err = getEnvDuration("NOTIFY_TIMEOUT")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("NOTIFY_MAX_DURATION") != "" {
+		n.maxDuration, err = getEnvDuration("NOTIFY_MAX_DURATION")
+		if err != nil {
+			return nil, err
+		}
+		if n.maxDuration <= 0 {
+			return nil, fmt.Errorf("NOTIFY_MAX_DURATION must be greater than 0")
+		}
+	}
+	n.queue = make(chan queuedNotification, notifyQueueSize)
+	n.done = make(chan struct{})
+	go n.run()
+	return n, nil
+}
+
+// notificationFromReport returns a notification of the run in the report
+func notificationFromReport(event, phase string, r *Report, now time.Time) Notification {
+	return Notification{
+		Event:            event,
+		Phase:            phase,
+		Mode:             r.Mode,
+		RunID:            r.RunID,
+		Cluster:          r.Cluster,
+		AutoscalingGroup: r.AutoscalingGroup,
+		Region:           r.Region,
+		Outcome:          r.Outcome,
+		Error:            r.Error,
+		Time:             now,
+	}
+}
+
+// wants returns whether the event is selected in NOTIFY_EVENTS (default: all events)
+func (n *Notifier) wants(notification Notification) bool {
+	if len(n.events) == 0 {
+		return true
+	}
+	if notification.Event == "phase" && stringInSlice("phase:"+notification.Phase, n.events) {
+		return true
+	}
+	return stringInSlice(notification.Event, n.events)
+}
+
+// notify queues a notification to be sent. It can be called on a nil notifier
+func (n *Notifier) notify(notification Notification) {
+	if n == nil || !n.wants(notification) {
+		return
+	}
+	var text bytes.Buffer
+	err := n.template.Execute(&text, notification)
+	if err != nil {
+		notifyLogger.Errorf("Could not render the notification: %v", err)
+		return
+	}
+	notification.Text = text.String()
+	body, err := n.payload(notification)
+	if err != nil {
+		notifyLogger.Errorf("Could not encode the notification: %v", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		notifyLogger.Errorf("Notifier closed, dropping notification: %s", notification.Text)
+		return
+	}
+	select {
+	case n.queue <- queuedNotification{text: notification.Text, body: body}:
+	default:
+		notifyLogger.Errorf("Notification queue full, dropping notification: %s", notification.Text)
+	}
+}
+
+// run sends the queued notifications until the notifier is flushed
+func (n *Notifier) run() {
+	defer close(n.done)
+	for q := range n.queue {
+		n.deliver(q)
+	}
+}
+
+// deliver sends a notification, retrying failed sends for at most maxDuration
+func (n *Notifier) deliver(q queuedNotification) {
+	// the run context can be cancelled already, and the final notification should still be sent
+	ctx, cancel := context.WithTimeout(context.Background(), n.maxDuration)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		err := n.send(ctx, q.body)
+		if err == nil {
+			notifyLogger.Debugf("Sent notification: %s", q.text)
+			return
+		}
+		if attempt >= n.retries || ctx.Err() != nil {
+			notifyLogger.Errorf("Could not send notification after %d attempts: %v", attempt+1, err)
+			return
+		}
+		notifyLogger.Warningf("Could not send notification (attempt %d): %v", attempt+1, err)
+		if sleep(ctx, n.clock, time.Duration(1<<uint(attempt))*time.Second) != nil {
+			notifyLogger.Errorf("Could not send notification within %s: %v", n.maxDuration, err)
+			return
+		}
+	}
+}
+
+// flush sends the queued notifications, waiting at most twice maxDuration, and stops the notifier. Notifications after a flush are dropped. It can be called on a nil notifier
+func (n *Notifier) flush() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+	case <-time.After(2 * n.maxDuration):
+		notifyLogger.Errorf("Could not send %d notification(s) within %s", len(n.queue)+1, 2*n.maxDuration)
+	}
+}
+
+// payload returns the body of the notification in the webhook format
+func (n *Notifier) payload(notification Notification) ([]byte, error) {
+	switch n.format {
+	case "slack":
+		return json.Marshal(map[string]string{"text": notification.Text})
+	case "teams":
+		color := "0076D7"
+		if notification.Event == "finished" && notification.Outcome != "succeeded" && notification.Outcome != "already-latest" {
+			color = "D70000"
+		}
+		return json.Marshal(map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    notification.Text,
+			"text":       notification.Text,
+			"themeColor": color,
+		})
+	default:
+		return json.Marshal(notification)
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeWebhook struct {
+	mu       sync.Mutex
+	failures int
+	requests []map[string]interface{}
+	server   *httptest.Server
+}
+
+// newFakeWebhook returns a webhook that fails the first failures requests
+func newFakeWebhook(t *testing.T, failures int) *fakeWebhook {
+	w := &fakeWebhook{failures: failures}
+	w.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.failures != 0 {
+			w.failures--
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			t.Errorf("invalid notification: %v", err)
+		}
+		w.requests = append(w.requests, body)
+	}))
+	t.Cleanup(w.server.Close)
+	return w
+}
+
+func TestUpgradeNotifications(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	webhook := newFakeWebhook(t, 0)
+	setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": "true", "REPORT_FILE": t.TempDir() + "/report.json", "NOTIFY_WEBHOOK_URL": webhook.server.URL})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	var events []string
+	for _, request := range webhook.requests {
+		event := request["event"].(string)
+		if event == "phase" {
+			event += ":" + request["phase"].(string)
+		}
+		events = append(events, event)
+	}
+	expected := []string{"started", "phase:scale-out", "phase:instance-health", "phase:new-nodes", "phase:drain", "phase:target-health", "phase:scale-down", "finished"}
+	if len(events) != len(expected) {
+		t.Fatalf("expected notifications %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected notifications %v, got %v", expected, events)
+		}
+	}
+	if text := webhook.requests[len(webhook.requests)-1]["text"]; text != "ecs-upgrade upgrade of cluster/asg: succeeded" {
+		t.Errorf("unexpected text %s", text)
+	}
+}
+
+func TestUpgradeNotificationsSlackRetried(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	webhook := newFakeWebhook(t, 2)
+	setUpgradeEnv(t, f, map[string]string{
+		"LAUNCH_TEMPLATES":   "true",
+		"REPORT_FILE":        t.TempDir() + "/report.json",
+		"NOTIFY_WEBHOOK_URL": webhook.server.URL,
+		"NOTIFY_FORMAT":      "slack",
+		"NOTIFY_EVENTS":      "started,phase:drain",
+		"NOTIFY_TEMPLATE":    "{{.Cluster}} {{.Event}} {{.Phase}}",
+	})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	if len(webhook.requests) != 2 {
+		t.Fatalf("expected 2 notifications, got %v", webhook.requests)
+	}
+	if webhook.requests[0]["text"] != "cluster started " || webhook.requests[1]["text"] != "cluster phase drain" {
+		t.Errorf("unexpected notifications %v", webhook.requests)
+	}
+	if _, ok := webhook.requests[0]["event"]; ok {
+		t.Errorf("slack notification has generic fields: %v", webhook.requests[0])
+	}
+}
+
+func TestUpgradeNotificationsFailing(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	webhook := newFakeWebhook(t, -1)
+	setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": "true", "REPORT_FILE": t.TempDir() + "/report.json", "NOTIFY_WEBHOOK_URL": webhook.server.URL, "NOTIFY_FORMAT": "teams"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d with a failing webhook", ret)
+	}
+	if len(webhook.requests) != 0 {
+		t.Errorf("unexpected notifications %v", webhook.requests)
+	}
+}
+
+// TestNotifierAsync doesn't hold up the run while the webhook is slow, and sends the notifications in order on flush
+func TestNotifierAsync(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		texts = append(texts, body["phase"].(string))
+		mu.Unlock()
+	}))
+	defer server.Close()
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+	n, err := newNotifierFromEnv(newFakeClock())
+	if err != nil {
+		t.Fatalf("newNotifierFromEnv error: %v", err)
+	}
+	start := time.Now()
+	for _, phase := range []string{"scale-out", "drain", "scale-down"} {
+		n.notify(Notification{Event: "phase", Phase: phase})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("notify blocked for %s", elapsed)
+	}
+	close(release)
+	n.flush()
+	if !reflect.DeepEqual(texts, []string{"scale-out", "drain", "scale-down"}) {
+		t.Errorf("unexpected notifications %v", texts)
+	}
+	// notifications after the flush are dropped
+	n.notify(Notification{Event: "finished"})
+}
+
+func TestNotifierFromEnvInvalid(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"format":       {"NOTIFY_FORMAT": "email"},
+		"template":     {"NOTIFY_TEMPLATE": "{{.Cluster"},
+		"events":       {"NOTIFY_EVENTS": "drained"},
+		"max duration": {"NOTIFY_MAX_DURATION": "0s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("NOTIFY_WEBHOOK_URL", "http://localhost/hook")
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := newNotifierFromEnv(newFakeClock()); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
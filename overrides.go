@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// LaunchOverrides are the launch parameters that change in the new launch configuration or launch template version,
+// together with the AMI. The root volume is the root device of the AMI
+type LaunchOverrides struct {
+	InstanceType      string
+	VolumeSize        int64
+	VolumeType        string
+	EncryptRootVolume bool
+	RequireIMDSv2     bool
+	// MetadataHopLimit is the minimum hop limit of the instance metadata
+	MetadataHopLimit   int64
+	DetailedMonitoring bool
+	SecurityGroups     []string
+	// ECSConfig are the keys of ecs.config to change in the user data
+	ECSConfig ECSConfigChanges
+}
+
+// harden adds the hardening profile to the overrides: IMDSv2 with a hop limit of 2, so tasks in awsvpc and bridge
+// mode can reach the instance metadata, an encrypted root volume and detailed monitoring
+func (o *LaunchOverrides) harden() {
+	o.RequireIMDSv2 = true
+	o.MetadataHopLimit = 2
+	o.EncryptRootVolume = true
+	o.DetailedMonitoring = true
+}
+
+// getLaunchOverrides returns the overrides in INSTANCE_TYPE, ROOT_VOLUME_SIZE, ROOT_VOLUME_TYPE, REQUIRE_IMDSV2,
+// SECURITY_GROUPS and ECS_CONFIG, with the hardening profile when HARDENING is true. The instanceType and
+// securityGroups of the target replace INSTANCE_TYPE and SECURITY_GROUPS
+func getLaunchOverrides(target Target) (LaunchOverrides, error) {
+	o := LaunchOverrides{
+		InstanceType:   os.Getenv("INSTANCE_TYPE"),
+		VolumeType:     os.Getenv("ROOT_VOLUME_TYPE"),
+		RequireIMDSv2:  os.Getenv("REQUIRE_IMDSV2") == "true",
+		SecurityGroups: splitEnv("SECURITY_GROUPS"),
+	}
+	if target.InstanceType != "" {
+		o.InstanceType = target.InstanceType
+	}
+	if len(target.SecurityGroups) > 0 {
+		o.SecurityGroups = target.SecurityGroups
+	}
+	size, err := getEnvInt("ROOT_VOLUME_SIZE")
+	if err != nil {
+		return o, err
+	}
+	if size < 0 {
+		return o, fmt.Errorf("ROOT_VOLUME_SIZE must be a size in GiB")
+	}
+	o.VolumeSize = int64(size)
+	if o.VolumeType != "" && !stringInSlice(o.VolumeType, ec2.VolumeType_Values()) {
+		return o, fmt.Errorf("ROOT_VOLUME_TYPE must be one of %s", strings.Join(ec2.VolumeType_Values(), ", "))
+	}
+	for _, sg := range o.SecurityGroups {
+		if !strings.HasPrefix(sg, "sg-") {
+			return o, fmt.Errorf("SECURITY_GROUPS: %s is not a security group id", sg)
+		}
+	}
+	o.ECSConfig, err = getECSConfigChangesFromEnv()
+	if err != nil {
+		return o, err
+	}
+	if os.Getenv("HARDENING") == "true" {
+		o.harden()
+	}
+	return o, nil
+}
+
+func (o LaunchOverrides) empty() bool {
+	return o.InstanceType == "" && !o.changesVolume() && !o.changesMetadataOptions() && !o.DetailedMonitoring && len(o.SecurityGroups) == 0 && len(o.ECSConfig) == 0
+}
+
+func (o LaunchOverrides) changesVolume() bool {
+	return o.VolumeSize > 0 || o.VolumeType != "" || o.EncryptRootVolume
+}
+
+func (o LaunchOverrides) changesMetadataOptions() bool {
+	return o.RequireIMDSv2 || o.MetadataHopLimit > 0
+}
+
+// rootVolume is the root volume of a launch configuration or launch template
+type rootVolume struct {
+	size       *int64
+	volumeType *string
+	iops       *int64
+	throughput *int64
+	encrypted  *bool
+}
+
+// applyToRootVolume returns the root volume with the overrides
+func (o LaunchOverrides) applyToRootVolume(v rootVolume) rootVolume {
+	if o.VolumeSize > 0 {
+		v.size = aws.Int64(o.VolumeSize)
+	}
+	if o.VolumeType != "" {
+		v.volumeType = aws.String(o.VolumeType)
+		// iops and throughput can only be set for some volume types
+		if o.VolumeType != ec2.VolumeTypeGp3 && o.VolumeType != ec2.VolumeTypeIo1 && o.VolumeType != ec2.VolumeTypeIo2 {
+			v.iops = nil
+		}
+		if o.VolumeType != ec2.VolumeTypeGp3 {
+			v.throughput = nil
+		}
+	}
+	if o.EncryptRootVolume {
+		v.encrypted = aws.Bool(true)
+	}
+	return v
+}
+
+// metadataHopLimit returns the hop limit of the instance metadata with the overrides
+func (o LaunchOverrides) metadataHopLimit(hopLimit *int64) *int64 {
+	if o.MetadataHopLimit > 0 && aws.Int64Value(hopLimit) < o.MetadataHopLimit {
+		return aws.Int64(o.MetadataHopLimit)
+	}
+	return hopLimit
+}
+
+// applyToLaunchConfig returns a copy of the launch configuration with the overrides
+func (o LaunchOverrides) applyToLaunchConfig(lc autoscaling.LaunchConfiguration, rootDevice string) (autoscaling.LaunchConfiguration, error) {
+	if o.InstanceType != "" {
+		lc.InstanceType = aws.String(o.InstanceType)
+	}
+	if o.changesVolume() {
+		var mappings []*autoscaling.BlockDeviceMapping
+		found := false
+		for _, bdm := range lc.BlockDeviceMappings {
+			if aws.StringValue(bdm.DeviceName) != rootDevice || bdm.Ebs == nil {
+				mappings = append(mappings, bdm)
+				continue
+			}
+			mapping, ebs := *bdm, *bdm.Ebs
+			v := o.applyToRootVolume(rootVolume{ebs.VolumeSize, ebs.VolumeType, ebs.Iops, ebs.Throughput, ebs.Encrypted})
+			ebs.VolumeSize, ebs.VolumeType, ebs.Iops, ebs.Throughput, ebs.Encrypted = v.size, v.volumeType, v.iops, v.throughput, v.encrypted
+			mapping.Ebs = &ebs
+			mappings = append(mappings, &mapping)
+			found = true
+		}
+		if !found {
+			v := o.applyToRootVolume(rootVolume{})
+			ebs := autoscaling.Ebs{DeleteOnTermination: aws.Bool(true), VolumeSize: v.size, VolumeType: v.volumeType, Encrypted: v.encrypted}
+			mappings = append(mappings, &autoscaling.BlockDeviceMapping{DeviceName: aws.String(rootDevice), Ebs: &ebs})
+		}
+		lc.BlockDeviceMappings = mappings
+	}
+	if o.changesMetadataOptions() {
+		options := autoscaling.InstanceMetadataOptions{}
+		if lc.MetadataOptions != nil {
+			options = *lc.MetadataOptions
+		}
+		if o.RequireIMDSv2 {
+			options.HttpEndpoint = aws.String(autoscaling.InstanceMetadataEndpointStateEnabled)
+			options.HttpTokens = aws.String(autoscaling.InstanceMetadataHttpTokensStateRequired)
+		}
+		options.HttpPutResponseHopLimit = o.metadataHopLimit(options.HttpPutResponseHopLimit)
+		lc.MetadataOptions = &options
+	}
+	if o.DetailedMonitoring {
+		lc.InstanceMonitoring = &autoscaling.InstanceMonitoring{Enabled: aws.Bool(true)}
+	}
+	if len(o.SecurityGroups) > 0 {
+		lc.SecurityGroups = aws.StringSlice(o.SecurityGroups)
+	}
+	if len(o.ECSConfig) > 0 {
+		userData, err := o.ECSConfig.applyToUserData(lc.UserData)
+		if err != nil {
+			return lc, err
+		}
+		lc.UserData = userData
+	}
+	return lc, nil
+}
+
+// applyToLaunchTemplateData returns a copy of the launch template data with the overrides. With network interfaces,
+// the security groups are set on the primary network interface
+func (o LaunchOverrides) applyToLaunchTemplateData(data ec2.ResponseLaunchTemplateData, rootDevice string) (ec2.ResponseLaunchTemplateData, error) {
+	if o.InstanceType != "" {
+		data.InstanceType = aws.String(o.InstanceType)
+	}
+	if o.changesVolume() {
+		var mappings []*ec2.LaunchTemplateBlockDeviceMapping
+		found := false
+		for _, bdm := range data.BlockDeviceMappings {
+			if aws.StringValue(bdm.DeviceName) != rootDevice || bdm.Ebs == nil {
+				mappings = append(mappings, bdm)
+				continue
+			}
+			mapping, ebs := *bdm, *bdm.Ebs
+			v := o.applyToRootVolume(rootVolume{ebs.VolumeSize, ebs.VolumeType, ebs.Iops, ebs.Throughput, ebs.Encrypted})
+			ebs.VolumeSize, ebs.VolumeType, ebs.Iops, ebs.Throughput, ebs.Encrypted = v.size, v.volumeType, v.iops, v.throughput, v.encrypted
+			mapping.Ebs = &ebs
+			mappings = append(mappings, &mapping)
+			found = true
+		}
+		if !found {
+			v := o.applyToRootVolume(rootVolume{})
+			ebs := ec2.LaunchTemplateEbsBlockDevice{DeleteOnTermination: aws.Bool(true), VolumeSize: v.size, VolumeType: v.volumeType, Encrypted: v.encrypted}
+			mappings = append(mappings, &ec2.LaunchTemplateBlockDeviceMapping{DeviceName: aws.String(rootDevice), Ebs: &ebs})
+		}
+		data.BlockDeviceMappings = mappings
+	}
+	if o.changesMetadataOptions() {
+		options := ec2.LaunchTemplateInstanceMetadataOptions{}
+		if data.MetadataOptions != nil {
+			options = *data.MetadataOptions
+		}
+		if o.RequireIMDSv2 {
+			options.HttpEndpoint = aws.String(ec2.LaunchTemplateInstanceMetadataEndpointStateEnabled)
+			options.HttpTokens = aws.String(ec2.LaunchTemplateHttpTokensStateRequired)
+		}
+		options.HttpPutResponseHopLimit = o.metadataHopLimit(options.HttpPutResponseHopLimit)
+		data.MetadataOptions = &options
+	}
+	if o.DetailedMonitoring {
+		data.Monitoring = &ec2.LaunchTemplatesMonitoring{Enabled: aws.Bool(true)}
+	}
+	if len(o.SecurityGroups) > 0 {
+		if len(data.NetworkInterfaces) > 0 {
+			var interfaces []*ec2.LaunchTemplateInstanceNetworkInterfaceSpecification
+			for _, ni := range data.NetworkInterfaces {
+				if aws.Int64Value(ni.DeviceIndex) == 0 {
+					primary := *ni
+					primary.Groups = aws.StringSlice(o.SecurityGroups)
+					ni = &primary
+				}
+				interfaces = append(interfaces, ni)
+			}
+			data.NetworkInterfaces = interfaces
+		} else {
+			data.SecurityGroupIds = aws.StringSlice(o.SecurityGroups)
+			data.SecurityGroups = nil
+		}
+	}
+	if len(o.ECSConfig) > 0 {
+		userData, err := o.ECSConfig.applyToUserData(data.UserData)
+		if err != nil {
+			return data, err
+		}
+		data.UserData = userData
+	}
+	return data, nil
+}
+
+// launchTemplateRequestData returns the data of a new launch template version with imageId and the overridden
+// settings of data. The other settings come from the source version
+func (o LaunchOverrides) launchTemplateRequestData(data ec2.ResponseLaunchTemplateData, imageId string) *ec2.RequestLaunchTemplateData {
+	request := &ec2.RequestLaunchTemplateData{
+		ImageId: aws.String(imageId),
+	}
+	if o.InstanceType != "" {
+		request.InstanceType = data.InstanceType
+	}
+	if o.changesVolume() {
+		for _, bdm := range data.BlockDeviceMappings {
+			mapping := &ec2.LaunchTemplateBlockDeviceMappingRequest{
+				DeviceName:  bdm.DeviceName,
+				NoDevice:    bdm.NoDevice,
+				VirtualName: bdm.VirtualName,
+			}
+			if bdm.Ebs != nil {
+				mapping.Ebs = &ec2.LaunchTemplateEbsBlockDeviceRequest{
+					DeleteOnTermination: bdm.Ebs.DeleteOnTermination,
+					Encrypted:           bdm.Ebs.Encrypted,
+					Iops:                bdm.Ebs.Iops,
+					KmsKeyId:            bdm.Ebs.KmsKeyId,
+					SnapshotId:          bdm.Ebs.SnapshotId,
+					Throughput:          bdm.Ebs.Throughput,
+					VolumeSize:          bdm.Ebs.VolumeSize,
+					VolumeType:          bdm.Ebs.VolumeType,
+				}
+			}
+			request.BlockDeviceMappings = append(request.BlockDeviceMappings, mapping)
+		}
+	}
+	if o.changesMetadataOptions() && data.MetadataOptions != nil {
+		request.MetadataOptions = &ec2.LaunchTemplateInstanceMetadataOptionsRequest{
+			HttpEndpoint:            data.MetadataOptions.HttpEndpoint,
+			HttpProtocolIpv6:        data.MetadataOptions.HttpProtocolIpv6,
+			HttpPutResponseHopLimit: data.MetadataOptions.HttpPutResponseHopLimit,
+			HttpTokens:              data.MetadataOptions.HttpTokens,
+			InstanceMetadataTags:    data.MetadataOptions.InstanceMetadataTags,
+		}
+	}
+	if o.DetailedMonitoring && data.Monitoring != nil {
+		request.Monitoring = &ec2.LaunchTemplatesMonitoringRequest{Enabled: data.Monitoring.Enabled}
+	}
+	if len(o.SecurityGroups) > 0 {
+		if len(data.NetworkInterfaces) > 0 {
+			for _, ni := range data.NetworkInterfaces {
+				request.NetworkInterfaces = append(request.NetworkInterfaces, &ec2.LaunchTemplateInstanceNetworkInterfaceSpecificationRequest{
+					AssociateCarrierIpAddress:      ni.AssociateCarrierIpAddress,
+					AssociatePublicIpAddress:       ni.AssociatePublicIpAddress,
+					DeleteOnTermination:            ni.DeleteOnTermination,
+					Description:                    ni.Description,
+					DeviceIndex:                    ni.DeviceIndex,
+					Groups:                         ni.Groups,
+					InterfaceType:                  ni.InterfaceType,
+					Ipv6AddressCount:               ni.Ipv6AddressCount,
+					NetworkCardIndex:               ni.NetworkCardIndex,
+					NetworkInterfaceId:             ni.NetworkInterfaceId,
+					PrivateIpAddress:               ni.PrivateIpAddress,
+					SecondaryPrivateIpAddressCount: ni.SecondaryPrivateIpAddressCount,
+					SubnetId:                       ni.SubnetId,
+				})
+			}
+		} else {
+			request.SecurityGroupIds = data.SecurityGroupIds
+		}
+	}
+	if len(o.ECSConfig) > 0 {
+		request.UserData = data.UserData
+	}
+	return request
+}
+
+// rootDeviceName returns the root device of the AMI when the root volume is overridden
+func (a *Autoscaling) rootDeviceName(ctx context.Context, imageId string) (string, error) {
+	if !a.overrides.changesVolume() {
+		return "", nil
+	}
+	image, err := a.getImage(ctx, imageId)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(image.RootDeviceName), nil
+}
+
+// validateLaunchOverrides checks that the overrides work with the AMI, the subnets of the autoscaling group and the cluster
+// before anything is rolled out: the architecture of the instance type and the AMI, ENI trunking when the cluster uses it,
+// the instance type in every availability zone of the group, the size of the root volume and the VPC of the security groups
+func (a *Autoscaling) validateLaunchOverrides(ctx context.Context, asg AutoscalingGroup, imageId string, trunking bool) error {
+	o := a.overrides
+	var zones []string
+	var vpcId string
+	if len(asg.Subnets) > 0 {
+		result, err := a.svcEC2.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{SubnetIds: aws.StringSlice(asg.Subnets)})
+		if err != nil {
+			return err
+		}
+		for _, subnet := range result.Subnets {
+			if !stringInSlice(aws.StringValue(subnet.AvailabilityZone), zones) {
+				zones = append(zones, aws.StringValue(subnet.AvailabilityZone))
+			}
+			vpcId = aws.StringValue(subnet.VpcId)
+		}
+	}
+	var image *ec2.Image
+	if o.InstanceType != "" || o.VolumeSize > 0 {
+		var err error
+		image, err = a.getImage(ctx, imageId)
+		if err != nil {
+			return err
+		}
+	}
+	if o.InstanceType != "" {
+		result, err := a.svcEC2.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{InstanceTypes: aws.StringSlice([]string{o.InstanceType})})
+		if err != nil {
+			return fmt.Errorf("instance type %s: %v", o.InstanceType, err)
+		}
+		if len(result.InstanceTypes) == 0 {
+			return fmt.Errorf("instance type %s not found", o.InstanceType)
+		}
+		info := result.InstanceTypes[0]
+		var architectures []string
+		if info.ProcessorInfo != nil {
+			architectures = aws.StringValueSlice(info.ProcessorInfo.SupportedArchitectures)
+		}
+		if !stringInSlice(aws.StringValue(image.Architecture), architectures) {
+			return fmt.Errorf("instance type %s (%s) doesn't support the architecture %s of AMI %s", o.InstanceType, strings.Join(architectures, ", "), aws.StringValue(image.Architecture), imageId)
+		}
+		// ENI trunking needs an instance type on the Nitro system
+		if trunking && aws.StringValue(info.Hypervisor) != ec2.InstanceTypeHypervisorNitro {
+			return fmt.Errorf("the cluster uses ENI trunking, which instance type %s doesn't support", o.InstanceType)
+		}
+		if len(zones) > 0 {
+			offered := make(map[string]bool)
+			err = a.svcEC2.DescribeInstanceTypeOfferingsPagesWithContext(ctx, &ec2.DescribeInstanceTypeOfferingsInput{
+				LocationType: aws.String(ec2.LocationTypeAvailabilityZone),
+				Filters: []*ec2.Filter{
+					{Name: aws.String("instance-type"), Values: aws.StringSlice([]string{o.InstanceType})},
+					{Name: aws.String("location"), Values: aws.StringSlice(zones)},
+				},
+			}, func(page *ec2.DescribeInstanceTypeOfferingsOutput, lastPage bool) bool {
+				for _, offering := range page.InstanceTypeOfferings {
+					offered[aws.StringValue(offering.Location)] = true
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			var missing []string
+			for _, zone := range zones {
+				if !offered[zone] {
+					missing = append(missing, zone)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("instance type %s is not available in %s", o.InstanceType, strings.Join(missing, ", "))
+			}
+		}
+	}
+	if o.VolumeSize > 0 {
+		for _, bdm := range image.BlockDeviceMappings {
+			if aws.StringValue(bdm.DeviceName) == aws.StringValue(image.RootDeviceName) && bdm.Ebs != nil && aws.Int64Value(bdm.Ebs.VolumeSize) > o.VolumeSize {
+				return fmt.Errorf("root volume of %d GiB is smaller than the %d GiB snapshot of AMI %s", o.VolumeSize, aws.Int64Value(bdm.Ebs.VolumeSize), imageId)
+			}
+		}
+	}
+	if len(o.SecurityGroups) > 0 {
+		result, err := a.svcEC2.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: aws.StringSlice(o.SecurityGroups)})
+		if err != nil {
+			return fmt.Errorf("security groups: %v", err)
+		}
+		for _, sg := range result.SecurityGroups {
+			if vpcId != "" && aws.StringValue(sg.VpcId) != vpcId {
+				return fmt.Errorf("security group %s is not in the VPC %s of the autoscaling group", aws.StringValue(sg.GroupId), vpcId)
+			}
+		}
+	}
+	return nil
+}
+
+// LaunchSettingChange is a launch setting that differs between the old and the new launch configuration or template version
+type LaunchSettingChange struct {
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+// launchSettingNames are the launch settings that are compared, in the order of the report. The keys of ecs.config
+// written by the user data follow as ecsConfig.KEY
+var launchSettingNames = []string{"imageId", "instanceType", "rootVolumeSize", "rootVolumeType", "rootVolumeEncrypted", "httpTokens", "httpPutResponseHopLimit", "detailedMonitoring", "securityGroups"}
+
+// launchConfigSettings returns the launch settings of a launch configuration, with the root volume on rootDevice
+func launchConfigSettings(lc autoscaling.LaunchConfiguration, rootDevice string) map[string]string {
+	settings := map[string]string{
+		"imageId":        aws.StringValue(lc.ImageId),
+		"instanceType":   aws.StringValue(lc.InstanceType),
+		"securityGroups": joinSorted(aws.StringValueSlice(lc.SecurityGroups)),
+	}
+	addECSConfigSettings(settings, lc.UserData)
+	for _, bdm := range lc.BlockDeviceMappings {
+		if aws.StringValue(bdm.DeviceName) == rootDevice && bdm.Ebs != nil {
+			settings["rootVolumeSize"] = formatInt64(bdm.Ebs.VolumeSize)
+			settings["rootVolumeType"] = aws.StringValue(bdm.Ebs.VolumeType)
+			settings["rootVolumeEncrypted"] = formatBool(bdm.Ebs.Encrypted)
+		}
+	}
+	if lc.MetadataOptions != nil {
+		settings["httpTokens"] = aws.StringValue(lc.MetadataOptions.HttpTokens)
+		settings["httpPutResponseHopLimit"] = formatInt64(lc.MetadataOptions.HttpPutResponseHopLimit)
+	}
+	if lc.InstanceMonitoring != nil {
+		settings["detailedMonitoring"] = formatBool(lc.InstanceMonitoring.Enabled)
+	}
+	return settings
+}
+
+// launchTemplateSettings returns the launch settings of launch template data, with the root volume on rootDevice
+func launchTemplateSettings(data ec2.ResponseLaunchTemplateData, rootDevice string) map[string]string {
+	settings := map[string]string{
+		"imageId":      aws.StringValue(data.ImageId),
+		"instanceType": aws.StringValue(data.InstanceType),
+	}
+	securityGroups := append(aws.StringValueSlice(data.SecurityGroupIds), aws.StringValueSlice(data.SecurityGroups)...)
+	for _, ni := range data.NetworkInterfaces {
+		if aws.Int64Value(ni.DeviceIndex) == 0 {
+			securityGroups = aws.StringValueSlice(ni.Groups)
+		}
+	}
+	settings["securityGroups"] = joinSorted(securityGroups)
+	addECSConfigSettings(settings, data.UserData)
+	for _, bdm := range data.BlockDeviceMappings {
+		if aws.StringValue(bdm.DeviceName) == rootDevice && bdm.Ebs != nil {
+			settings["rootVolumeSize"] = formatInt64(bdm.Ebs.VolumeSize)
+			settings["rootVolumeType"] = aws.StringValue(bdm.Ebs.VolumeType)
+			settings["rootVolumeEncrypted"] = formatBool(bdm.Ebs.Encrypted)
+		}
+	}
+	if data.MetadataOptions != nil {
+		settings["httpTokens"] = aws.StringValue(data.MetadataOptions.HttpTokens)
+		settings["httpPutResponseHopLimit"] = formatInt64(data.MetadataOptions.HttpPutResponseHopLimit)
+	}
+	if data.Monitoring != nil {
+		settings["detailedMonitoring"] = formatBool(data.Monitoring.Enabled)
+	}
+	return settings
+}
+
+// addECSConfigSettings adds the user data and the keys of ecs.config it writes to the settings
+func addECSConfigSettings(settings map[string]string, userData *string) {
+	settings["userData"] = aws.StringValue(userData)
+	for key, value := range ecsConfigFromUserData(userData) {
+		settings["ecsConfig."+key] = value
+	}
+}
+
+// diffLaunchSettings returns the launch settings that changed
+func diffLaunchSettings(before, after map[string]string) []LaunchSettingChange {
+	names := append([]string{}, launchSettingNames...)
+	var ecsConfigNames []string
+	for _, settings := range []map[string]string{before, after} {
+		for name := range settings {
+			if strings.HasPrefix(name, "ecsConfig.") && !stringInSlice(name, ecsConfigNames) {
+				ecsConfigNames = append(ecsConfigNames, name)
+			}
+		}
+	}
+	sort.Strings(ecsConfigNames)
+	var changes []LaunchSettingChange
+	for _, name := range append(names, ecsConfigNames...) {
+		if before[name] != after[name] {
+			changes = append(changes, LaunchSettingChange{Setting: name, Old: before[name], New: after[name]})
+		}
+	}
+	return changes
+}
+
+// getLaunchSettings returns the launch settings of a launch configuration, or of a launch template version when
+// useLaunchTemplates is set
+func (a *Autoscaling) getLaunchSettings(ctx context.Context, useLaunchTemplates, launchIdentifier string) (map[string]string, error) {
+	var imageId string
+	var lc autoscaling.LaunchConfiguration
+	var lt ec2.LaunchTemplateVersion
+	var err error
+	if useLaunchTemplates == "true" {
+		name, version := launchIdentifier, "$Latest"
+		if i := strings.LastIndex(launchIdentifier, ":"); i > 0 {
+			name, version = launchIdentifier[:i], launchIdentifier[i+1:]
+		}
+		lt, err = a.getLaunchTemplateVersion(ctx, name, version)
+		if err != nil {
+			return nil, err
+		}
+		if lt.LaunchTemplateData == nil {
+			return nil, fmt.Errorf("launch template %s not found", launchIdentifier)
+		}
+		imageId = aws.StringValue(lt.LaunchTemplateData.ImageId)
+	} else {
+		lc, err = a.getLaunchConfig(ctx, launchIdentifier)
+		if err != nil {
+			return nil, err
+		}
+		imageId = aws.StringValue(lc.ImageId)
+	}
+	image, err := a.getImage(ctx, imageId)
+	if err != nil {
+		return nil, err
+	}
+	if useLaunchTemplates == "true" {
+		return launchTemplateSettings(*lt.LaunchTemplateData, aws.StringValue(image.RootDeviceName)), nil
+	}
+	return launchConfigSettings(lc, aws.StringValue(image.RootDeviceName)), nil
+}
+
+// getLaunchChanges returns the launch settings that differ between the old and the new launch configuration or
+// launch template version, and the diff of the user data
+func (a *Autoscaling) getLaunchChanges(ctx context.Context, oldUseLaunchTemplates, oldLaunchIdentifier, newUseLaunchTemplates, newLaunchIdentifier string) ([]LaunchSettingChange, string, error) {
+	before, err := a.getLaunchSettings(ctx, oldUseLaunchTemplates, oldLaunchIdentifier)
+	if err != nil {
+		return nil, "", err
+	}
+	after, err := a.getLaunchSettings(ctx, newUseLaunchTemplates, newLaunchIdentifier)
+	if err != nil {
+		return nil, "", err
+	}
+	return diffLaunchSettings(before, after), userDataDiff(aws.String(before["userData"]), aws.String(after["userData"])), nil
+}
+
+func joinSorted(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func formatInt64(i *int64) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.FormatInt(*i, 10)
+}
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
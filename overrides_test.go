@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestGetLaunchOverridesFromEnv(t *testing.T) {
+	t.Setenv("INSTANCE_TYPE", "m6i.large")
+	t.Setenv("ROOT_VOLUME_SIZE", "50")
+	t.Setenv("ROOT_VOLUME_TYPE", "gp3")
+	t.Setenv("REQUIRE_IMDSV2", "true")
+	t.Setenv("SECURITY_GROUPS", "sg-1, sg-2")
+	o, err := getLaunchOverrides(Target{})
+	if err != nil {
+		t.Fatalf("getLaunchOverrides error: %v", err)
+	}
+	expected := LaunchOverrides{InstanceType: "m6i.large", VolumeSize: 50, VolumeType: "gp3", RequireIMDSv2: true, SecurityGroups: []string{"sg-1", "sg-2"}}
+	if !reflect.DeepEqual(o, expected) {
+		t.Errorf("expected %+v, got %+v", expected, o)
+	}
+	// the launch settings of the target replace the environment
+	o, err = getLaunchOverrides(Target{Cluster: "production", InstanceType: "m7g.large", SecurityGroups: []string{"sg-3"}})
+	if err != nil || o.InstanceType != "m7g.large" || !reflect.DeepEqual(o.SecurityGroups, []string{"sg-3"}) || o.VolumeSize != 50 {
+		t.Errorf("unexpected overrides of the target %+v (%v)", o, err)
+	}
+	for name, value := range map[string]string{"ROOT_VOLUME_SIZE": "-1", "ROOT_VOLUME_TYPE": "ssd", "SECURITY_GROUPS": "default"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := getLaunchOverrides(Target{}); err == nil {
+				t.Errorf("expected an error for %s=%s", name, value)
+			}
+		})
+	}
+}
+
+func TestApplyToLaunchConfig(t *testing.T) {
+	lc := autoscaling.LaunchConfiguration{
+		InstanceType:   aws.String("m5.large"),
+		SecurityGroups: aws.StringSlice([]string{"sg-old"}),
+		BlockDeviceMappings: []*autoscaling.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &autoscaling.Ebs{VolumeSize: aws.Int64(30), VolumeType: aws.String("gp3"), Throughput: aws.Int64(250), Encrypted: aws.Bool(true)}},
+			{DeviceName: aws.String("/dev/xvdcz"), Ebs: &autoscaling.Ebs{VolumeSize: aws.Int64(22)}},
+		},
+		MetadataOptions: &autoscaling.InstanceMetadataOptions{HttpPutResponseHopLimit: aws.Int64(2)},
+	}
+	o := LaunchOverrides{InstanceType: "m6i.large", VolumeSize: 50, VolumeType: "gp2", RequireIMDSv2: true, SecurityGroups: []string{"sg-1"}}
+	newLc, err := o.applyToLaunchConfig(lc, "/dev/xvda")
+	if err != nil {
+		t.Fatalf("applyToLaunchConfig error: %v", err)
+	}
+	if aws.StringValue(newLc.InstanceType) != "m6i.large" || aws.StringValueSlice(newLc.SecurityGroups)[0] != "sg-1" {
+		t.Errorf("unexpected launch configuration %+v", newLc)
+	}
+	root := newLc.BlockDeviceMappings[0].Ebs
+	if aws.Int64Value(root.VolumeSize) != 50 || aws.StringValue(root.VolumeType) != "gp2" || root.Throughput != nil || !aws.BoolValue(root.Encrypted) {
+		t.Errorf("unexpected root volume %+v", root)
+	}
+	if aws.Int64Value(newLc.BlockDeviceMappings[1].Ebs.VolumeSize) != 22 {
+		t.Errorf("other volume was changed: %+v", newLc.BlockDeviceMappings[1].Ebs)
+	}
+	if aws.StringValue(newLc.MetadataOptions.HttpTokens) != "required" || aws.Int64Value(newLc.MetadataOptions.HttpPutResponseHopLimit) != 2 {
+		t.Errorf("unexpected metadata options %+v", newLc.MetadataOptions)
+	}
+	// the launch configuration itself doesn't change
+	if aws.StringValue(lc.InstanceType) != "m5.large" || aws.Int64Value(lc.BlockDeviceMappings[0].Ebs.VolumeSize) != 30 || lc.MetadataOptions.HttpTokens != nil {
+		t.Errorf("launch configuration was modified: %+v", lc)
+	}
+	// without a mapping for the root device, one is added
+	newLc, _ = LaunchOverrides{VolumeSize: 100}.applyToLaunchConfig(autoscaling.LaunchConfiguration{}, "/dev/xvda")
+	if len(newLc.BlockDeviceMappings) != 1 || aws.StringValue(newLc.BlockDeviceMappings[0].DeviceName) != "/dev/xvda" || aws.Int64Value(newLc.BlockDeviceMappings[0].Ebs.VolumeSize) != 100 {
+		t.Errorf("unexpected block device mappings %v", newLc.BlockDeviceMappings)
+	}
+	// overrides that match the launch configuration don't change it
+	if newLc, _ = (LaunchOverrides{InstanceType: "m5.large", SecurityGroups: []string{"sg-old"}}).applyToLaunchConfig(lc, ""); !reflect.DeepEqual(newLc, lc) {
+		t.Errorf("expected no changes")
+	}
+}
+
+func TestApplyToLaunchTemplateData(t *testing.T) {
+	data := ec2.ResponseLaunchTemplateData{
+		ImageId:      aws.String("ami-old"),
+		InstanceType: aws.String("m5.large"),
+		NetworkInterfaces: []*ec2.LaunchTemplateInstanceNetworkInterfaceSpecification{
+			{DeviceIndex: aws.Int64(0), AssociatePublicIpAddress: aws.Bool(true), Groups: aws.StringSlice([]string{"sg-old"})},
+		},
+	}
+	o := LaunchOverrides{InstanceType: "m6i.large", VolumeSize: 50, RequireIMDSv2: true, SecurityGroups: []string{"sg-1"}}
+	newData, err := o.applyToLaunchTemplateData(data, "/dev/xvda")
+	if err != nil {
+		t.Fatalf("applyToLaunchTemplateData error: %v", err)
+	}
+	request := o.launchTemplateRequestData(newData, "ami-new")
+	if aws.StringValue(request.ImageId) != "ami-new" || aws.StringValue(request.InstanceType) != "m6i.large" {
+		t.Errorf("unexpected request %+v", request)
+	}
+	if len(request.BlockDeviceMappings) != 1 || aws.Int64Value(request.BlockDeviceMappings[0].Ebs.VolumeSize) != 50 {
+		t.Errorf("unexpected block device mappings %v", request.BlockDeviceMappings)
+	}
+	if aws.StringValue(request.MetadataOptions.HttpTokens) != "required" {
+		t.Errorf("unexpected metadata options %+v", request.MetadataOptions)
+	}
+	// with network interfaces, the security groups are set on the primary network interface
+	if request.SecurityGroupIds != nil || len(request.NetworkInterfaces) != 1 || aws.StringValueSlice(request.NetworkInterfaces[0].Groups)[0] != "sg-1" || !aws.BoolValue(request.NetworkInterfaces[0].AssociatePublicIpAddress) {
+		t.Errorf("unexpected network interfaces %v", request.NetworkInterfaces)
+	}
+	if aws.StringValueSlice(data.NetworkInterfaces[0].Groups)[0] != "sg-old" {
+		t.Errorf("launch template data was modified")
+	}
+	// only the overridden settings are in the request, the others come from the source version
+	request = LaunchOverrides{}.launchTemplateRequestData(data, "ami-new")
+	if !reflect.DeepEqual(request, &ec2.RequestLaunchTemplateData{ImageId: aws.String("ami-new")}) {
+		t.Errorf("unexpected request %+v", request)
+	}
+}
+
+func TestValidateLaunchOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides LaunchOverrides
+		trunking  bool
+		err       string
+	}{
+		{"valid", LaunchOverrides{InstanceType: "m6i.large", VolumeSize: 50, SecurityGroups: []string{"sg-1"}}, true, ""},
+		{"unknown instance type", LaunchOverrides{InstanceType: "m99.large"}, false, "InvalidInstanceType"},
+		{"architecture", LaunchOverrides{InstanceType: "m7g.large"}, false, "doesn't support the architecture x86_64"},
+		{"trunking", LaunchOverrides{InstanceType: "m4.large"}, true, "ENI trunking"},
+		{"no trunking", LaunchOverrides{InstanceType: "m4.large"}, false, ""},
+		{"availability zone", LaunchOverrides{InstanceType: "m7i.large"}, false, "not available in eu-west-1b"},
+		{"volume size", LaunchOverrides{VolumeSize: 20}, false, "smaller than the 30 GiB snapshot"},
+		{"security group vpc", LaunchOverrides{SecurityGroups: []string{"sg-2"}}, false, "not in the VPC vpc-1"},
+		{"unknown security group", LaunchOverrides{SecurityGroups: []string{"sg-3"}}, false, "InvalidGroup.NotFound"},
+	}
+	f := newFakeAWS(1, 1, false)
+	c := f.clients()
+	asg, err := c.Autoscaling.describeAutoscalingGroup(context.Background(), f.asgName)
+	if err != nil {
+		t.Fatalf("describeAutoscalingGroup error: %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := c.Autoscaling
+			a.overrides = test.overrides
+			err := a.validateLaunchOverrides(context.Background(), asg, fakeNewAMI, test.trunking)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected an error with %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestHardening(t *testing.T) {
+	t.Setenv("HARDENING", "true")
+	o, err := getLaunchOverrides(Target{})
+	if err != nil {
+		t.Fatalf("getLaunchOverrides error: %v", err)
+	}
+	lc := autoscaling.LaunchConfiguration{
+		ImageId:            aws.String("ami-old"),
+		InstanceMonitoring: &autoscaling.InstanceMonitoring{Enabled: aws.Bool(false)},
+		MetadataOptions:    &autoscaling.InstanceMetadataOptions{HttpTokens: aws.String("optional"), HttpPutResponseHopLimit: aws.Int64(3)},
+		BlockDeviceMappings: []*autoscaling.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &autoscaling.Ebs{VolumeSize: aws.Int64(30), Encrypted: aws.Bool(false)}},
+		},
+	}
+	newLc, err := o.applyToLaunchConfig(lc, "/dev/xvda")
+	if err != nil {
+		t.Fatalf("applyToLaunchConfig error: %v", err)
+	}
+	newLc.ImageId = aws.String("ami-new")
+	changes := diffLaunchSettings(launchConfigSettings(lc, "/dev/xvda"), launchConfigSettings(newLc, "/dev/xvda"))
+	// a higher hop limit is kept
+	expected := []LaunchSettingChange{
+		{Setting: "imageId", Old: "ami-old", New: "ami-new"},
+		{Setting: "rootVolumeEncrypted", Old: "false", New: "true"},
+		{Setting: "httpTokens", Old: "optional", New: "required"},
+		{Setting: "detailedMonitoring", Old: "false", New: "true"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %+v, got %+v", expected, changes)
+	}
+	// a hardened launch configuration doesn't change
+	if hardened, _ := o.applyToLaunchConfig(newLc, "/dev/xvda"); !reflect.DeepEqual(hardened, newLc) {
+		t.Errorf("expected no changes to a hardened launch configuration")
+	}
+}
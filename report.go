@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// logging
+var reportLogger = getLogger("report")
+
+// Report is the machine-readable summary of a run, written at the end of every run
+type Report struct {
+	Mode             string `json:"mode"`
+	RunID            string `json:"runId"`
+	Cluster          string `json:"cluster"`
+	AutoscalingGroup string `json:"autoscalingGroup,omitempty"`
+	Region           string `json:"region,omitempty"`
+	OldAMI           string `json:"oldAmi,omitempty"`
+	NewAMI           string `json:"newAmi,omitempty"`
+	// AMISelection is why the new AMI was chosen
+	AMISelection             *AMISelection `json:"amiSelection,omitempty"`
+	OldLaunchConfiguration   string        `json:"oldLaunchConfiguration,omitempty"`
+	NewLaunchConfiguration   string        `json:"newLaunchConfiguration,omitempty"`
+	LaunchTemplateName       string        `json:"launchTemplateName,omitempty"`
+	OldLaunchTemplateVersion string        `json:"oldLaunchTemplateVersion,omitempty"`
+	NewLaunchTemplateVersion string        `json:"newLaunchTemplateVersion,omitempty"`
+	// LaunchChanges are the launch settings that changed compared to the old launch configuration or template version
+	LaunchChanges []LaunchSettingChange `json:"launchChanges,omitempty"`
+	// UserDataDiff is the diff of the user data of the old and the new launch configuration or template version
+	UserDataDiff        string              `json:"userDataDiff,omitempty"`
+	StartedAt           time.Time           `json:"startedAt"`
+	FinishedAt          time.Time           `json:"finishedAt"`
+	Duration            string              `json:"duration"`
+	Phases              []PhaseReport       `json:"phases"`
+	InstancesLaunched   []string            `json:"instancesLaunched"`
+	InstancesDrained    []string            `json:"instancesDrained"`
+	InstancesTerminated []string            `json:"instancesTerminated"`
+	TasksRescheduled    int64               `json:"tasksRescheduled"`
+	TargetHealth        *TargetHealthReport `json:"targetHealth,omitempty"`
+	// Versions compares the ECS agent, Docker and the attributes of the old and the new container instances
+	Versions     *VersionReport      `json:"versions,omitempty"`
+	AgentUpdates []AgentUpdateResult `json:"agentUpdates,omitempty"`
+	// Outcome is succeeded, already-latest, planned, failed, rolled-back or cancelled
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PhaseReport is one phase of the timeline of a run
+type PhaseReport struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Duration   string    `json:"duration"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// TargetHealthReport is the health of the targets of the new instances at the end of the target health check
+type TargetHealthReport struct {
+	TargetGroups []string         `json:"targetGroups"`
+	States       map[string]int64 `json:"states"`
+	AllHealthy   bool             `json:"allHealthy"`
+}
+
+type S3 struct {
+	svc s3iface.S3API
+}
+
+func NewS3(sess *session.Session) S3 {
+	return S3{
+		svc: s3.New(sess),
+	}
+}
+
+func newReport(mode, clusterName, asgName, runID string, startedAt time.Time) *Report {
+	return &Report{
+		Mode:             mode,
+		RunID:            runID,
+		Cluster:          clusterName,
+		AutoscalingGroup: asgName,
+		StartedAt:        startedAt,
+	}
+}
+
+// startPhase ends the current phase and starts a new one
+func (r *Report) startPhase(name string, now time.Time) {
+	r.endPhase(now, nil)
+	r.Phases = append(r.Phases, PhaseReport{Name: name, StartedAt: now})
+}
+
+// endPhase ends the current phase, if it is still running
+func (r *Report) endPhase(now time.Time, err error) {
+	if len(r.Phases) == 0 {
+		return
+	}
+	phase := &r.Phases[len(r.Phases)-1]
+	if !phase.FinishedAt.IsZero() {
+		return
+	}
+	phase.FinishedAt = now
+	phase.Duration = now.Sub(phase.StartedAt).String()
+	if err != nil {
+		phase.Error = err.Error()
+	}
+}
+
+// finish ends the run. When no outcome was set, it is derived from the return code
+func (r *Report) finish(now time.Time, ret int) {
+	var err error
+	if r.Error != "" {
+		err = fmt.Errorf("%s", r.Error)
+	}
+	r.endPhase(now, err)
+	r.FinishedAt = now
+	r.Duration = now.Sub(r.StartedAt).String()
+	if r.Outcome == "" {
+		if ret == 0 {
+			r.Outcome = "succeeded"
+		} else {
+			r.Outcome = "failed"
+		}
+	}
+}
+
+// setLaunchIdentifiers fills in the old and new launch configuration or template version. The new launch identifier is a
+// launch template version when useLaunchTemplates is set, also when the autoscaling group used a launch configuration before
+func (r *Report) setLaunchIdentifiers(asg AutoscalingGroup, newLaunchIdentifier, useLaunchTemplates string) {
+	if asg.LaunchTemplateName != "" {
+		r.LaunchTemplateName = asg.LaunchTemplateName
+		r.OldLaunchTemplateVersion = asg.LaunchTemplateVersion
+	} else {
+		r.OldLaunchConfiguration = asg.LaunchConfigurationName
+	}
+	if useLaunchTemplates == "true" {
+		if i := strings.LastIndex(newLaunchIdentifier, ":"); i > 0 {
+			r.LaunchTemplateName = newLaunchIdentifier[:i]
+			r.NewLaunchTemplateVersion = newLaunchIdentifier[i+1:]
+		}
+		return
+	}
+	r.NewLaunchConfiguration = newLaunchIdentifier
+}
+
+// write writes the report to filename, or to stdout when it isn't set, and uploads it to REPORT_S3_BUCKET when set
+func (r *Report) write(s S3, filename string) error {
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	if filename != "" {
+		err = os.WriteFile(filename, out, 0644)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%s", out)
+	}
+	if bucket := os.Getenv("REPORT_S3_BUCKET"); bucket != "" {
+		key := os.Getenv("REPORT_S3_PREFIX")
+		if r.Region != "" {
+			key += r.Region + "/"
+		}
+		key += r.Cluster + "/"
+		if r.AutoscalingGroup != "" {
+			key += r.AutoscalingGroup + "/"
+		}
+		key += r.StartedAt.UTC().Format("20060102T150405Z") + ".json"
+		// the run context can be cancelled already
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err = s.putObject(ctx, bucket, key, out)
+		if err != nil {
+			return err
+		}
+		reportLogger.Debugf("Uploaded report to s3://%s/%s", bucket, key)
+	}
+	return nil
+}
+
+func (s *S3) putObject(ctx context.Context, bucket, key string, body []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	_, err := s.svc.PutObjectWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			reportLogger.Errorf("%v", aerr.Error())
+		} else {
+			reportLogger.Errorf("%v", err.Error())
+		}
+	}
+	return err
+}
+
+// getInstanceIds returns the instance ids of container instance arns, or the arn when the instance id is unknown
+func getInstanceIds(containerInstances map[string]ContainerInstance, containerArns []string) []string {
+	var instanceIds []string
+	for _, arn := range containerArns {
+		instanceId := arn
+		for id, containerInstance := range containerInstances {
+			if containerInstance.ContainerInstanceArn == arn {
+				instanceId = id
+			}
+		}
+		instanceIds = append(instanceIds, instanceId)
+	}
+	return instanceIds
+}
+
+// getRunningTasksCount returns the number of tasks running on the container instances, before they were drained
+func getRunningTasksCount(containerInstances map[string]ContainerInstance, containerArns []string) int64 {
+	var runningTasksCount int64
+	drained := make(map[string]bool)
+	for _, containerArn := range containerArns {
+		drained[containerArn] = true
+	}
+	for _, containerInstance := range containerInstances {
+		if drained[containerInstance.ContainerInstanceArn] {
+			runningTasksCount += containerInstance.RunningTasksCount
+		}
+	}
+	return runningTasksCount
+}
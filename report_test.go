@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func readReport(t *testing.T, filename string) Report {
+	out, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+	var report Report
+	err = json.Unmarshal(out, &report)
+	if err != nil {
+		t.Fatalf("invalid report: %v", err)
+	}
+	return report
+}
+
+func TestUpgradeReport(t *testing.T) {
+	f := newFakeAWS(2, 2, true)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": "true", "REPORT_FILE": reportFile, "REPORT_S3_BUCKET": "reports", "REPORT_S3_PREFIX": "ecs-upgrade/"})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	report := readReport(t, reportFile)
+	if report.Outcome != "succeeded" || report.Error != "" {
+		t.Errorf("unexpected outcome %s (%s)", report.Outcome, report.Error)
+	}
+	if report.OldAMI != fakeOldAMI || report.NewAMI != fakeNewAMI {
+		t.Errorf("unexpected AMIs: %s -> %s", report.OldAMI, report.NewAMI)
+	}
+	if report.LaunchTemplateName != "lt" || report.OldLaunchTemplateVersion != "1" || report.NewLaunchTemplateVersion != "2" {
+		t.Errorf("unexpected launch template versions: %s %s -> %s", report.LaunchTemplateName, report.OldLaunchTemplateVersion, report.NewLaunchTemplateVersion)
+	}
+	var phases []string
+	for _, phase := range report.Phases {
+		if phase.FinishedAt.IsZero() || phase.Duration == "" {
+			t.Errorf("phase %s not finished", phase.Name)
+		}
+		phases = append(phases, phase.Name)
+	}
+	expected := []string{"prepare", "scale-out", "instance-health", "new-nodes", "drain", "target-health", "scale-down"}
+	if len(phases) != len(expected) {
+		t.Fatalf("expected phases %v, got %v", expected, phases)
+	}
+	for i := range expected {
+		if phases[i] != expected[i] {
+			t.Errorf("expected phases %v, got %v", expected, phases)
+			break
+		}
+	}
+	if len(report.InstancesLaunched) != 2 || len(report.InstancesDrained) != 2 || len(report.InstancesTerminated) != 2 {
+		t.Errorf("expected 2 instances launched, drained and terminated, got %v, %v, %v", report.InstancesLaunched, report.InstancesDrained, report.InstancesTerminated)
+	}
+	for _, id := range report.InstancesDrained {
+		if !stringInSlice(id, report.InstancesTerminated) || stringInSlice(id, report.InstancesLaunched) {
+			t.Errorf("drained instance %s is not an old instance", id)
+		}
+	}
+	if report.TargetHealth == nil || !report.TargetHealth.AllHealthy || report.TargetHealth.States["healthy"] != 2 {
+		t.Errorf("unexpected target health: %+v", report.TargetHealth)
+	}
+	if report.Versions == nil || !reflect.DeepEqual(report.Versions.Old.AgentVersions, []string{"1.70.0"}) || !reflect.DeepEqual(report.Versions.New.AgentVersions, []string{"1.80.0"}) {
+		t.Errorf("unexpected versions: %+v", report.Versions)
+	}
+	if out, _ := os.ReadFile(reportFile); !strings.Contains(string(out), `"agentVersions"`) {
+		t.Errorf("versions not in the report: %s", out)
+	}
+	key := "reports/ecs-upgrade/cluster/asg/" + report.StartedAt.UTC().Format("20060102T150405Z") + ".json"
+	if _, ok := f.s3Objects[key]; !ok {
+		t.Errorf("report not uploaded to %s (objects: %d)", key, len(f.s3Objects))
+	}
+}
+
+func TestAgentUpdateReport(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"MODE": "agent-update", "REPORT_FILE": reportFile})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+		t.Fatalf("agent update returned %d", ret)
+	}
+	report := readReport(t, reportFile)
+	if len(report.AgentUpdates) != 2 || report.AgentUpdates[0].NewVersion != "1.80.0" {
+		t.Errorf("unexpected agent updates: %+v", report.AgentUpdates)
+	}
+	out, _ := os.ReadFile(reportFile)
+	for _, key := range []string{`"instanceId"`, `"containerInstanceArn"`, `"oldVersion"`, `"newVersion"`, `"status"`} {
+		if !strings.Contains(string(out), key) {
+			t.Errorf("%s not in the report", key)
+		}
+	}
+}
+
+func TestUpgradeReportRolledBack(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	f.alarmOnImage = fakeNewAMI
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setUpgradeEnv(t, f, map[string]string{"ALARM_NAMES": "api-5xx", "ROLLBACK_ON_FAILURE": "true", "REPORT_FILE": reportFile})
+	if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 1 {
+		t.Fatalf("expected upgrade to fail, got %d", ret)
+	}
+	report := readReport(t, reportFile)
+	if report.Outcome != "rolled-back" || report.Error == "" {
+		t.Errorf("unexpected outcome %s (%s)", report.Outcome, report.Error)
+	}
+	if report.OldLaunchConfiguration != "lc" || report.NewLaunchConfiguration == "" {
+		t.Errorf("unexpected launch configurations: %s -> %s", report.OldLaunchConfiguration, report.NewLaunchConfiguration)
+	}
+	if len(report.InstancesTerminated) != 2 {
+		t.Errorf("expected the 2 new instances to be terminated, got %v", report.InstancesTerminated)
+	}
+	last := report.Phases[len(report.Phases)-1]
+	if last.Name != "instance-health" || last.Error == "" {
+		t.Errorf("expected the instance-health phase to fail, got %+v", last)
+	}
+}
+
+func TestReportLaunchChanges(t *testing.T) {
+	expected := []LaunchSettingChange{
+		{Setting: "imageId", Old: fakeOldAMI, New: fakeNewAMI},
+		{Setting: "rootVolumeEncrypted", Old: "", New: "true"},
+		{Setting: "httpTokens", Old: "", New: "required"},
+		{Setting: "httpPutResponseHopLimit", Old: "", New: "2"},
+		{Setting: "detailedMonitoring", Old: "", New: "true"},
+	}
+	for _, useLaunchTemplates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("launch templates %v", useLaunchTemplates), func(t *testing.T) {
+			f := newFakeAWS(2, 2, useLaunchTemplates)
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			setUpgradeEnv(t, f, map[string]string{"LAUNCH_TEMPLATES": fmt.Sprintf("%v", useLaunchTemplates), "HARDENING": "true", "REPORT_FILE": reportFile})
+			if ret := runWithReturnCode(context.Background(), f.clients(), f.target()); ret != 0 {
+				t.Fatalf("upgrade returned %d", ret)
+			}
+			report := readReport(t, reportFile)
+			if !reflect.DeepEqual(report.LaunchChanges, expected) {
+				t.Errorf("expected launch changes %+v, got %+v", expected, report.LaunchChanges)
+			}
+		})
+	}
+}
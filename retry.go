@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// logging
+var retryLogger = getLogger("retry")
+
+// throttleCodes are the error codes of AWS APIs that reject a call because of a rate limit
+var throttleCodes = []string{
+	"Throttling",
+	"ThrottlingException",
+	"ThrottledException",
+	"RequestThrottled",
+	"RequestThrottledException",
+	"TooManyRequestsException",
+	"RequestLimitExceeded",
+	"ProvisionedThroughputExceededException",
+	"SlowDown",
+	"EC2ThrottledException",
+	"PriorRequestNotComplete",
+	"BandwidthLimitExceeded",
+}
+
+// retryableCodes are the error codes of AWS APIs for transient failures
+var retryableCodes = []string{
+	"RequestError",
+	"RequestTimeout",
+	"RequestTimeoutException",
+	"ResponseTimeout",
+	"InternalError",
+	"InternalFailure",
+	"InternalServerError",
+	"ServerException",
+	"ServiceUnavailable",
+	"ServiceUnavailableException",
+	"Unavailable",
+	"IDPCommunicationError",
+}
+
+// classifyAWSError returns "throttle" when the call was rate limited, "retryable" when it failed because of a
+// transient error, or "" when retrying won't help
+func classifyAWSError(err error, statusCode int) string {
+	if err == nil {
+		return ""
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		if stringInSlice(aerr.Code(), throttleCodes) {
+			return "throttle"
+		}
+		if stringInSlice(aerr.Code(), retryableCodes) {
+			return "retryable"
+		}
+	}
+	if statusCode == 429 {
+		return "throttle"
+	}
+	if statusCode >= 500 && statusCode != 501 {
+		return "retryable"
+	}
+	// connection resets and other errors that the SDK knows to be transient
+	if _, ok := err.(awserr.Error); ok && request.IsErrorRetryable(err) {
+		return "retryable"
+	}
+	return ""
+}
+
+// RetryPolicy is the retry policy of all AWS calls: exponential backoff with full jitter, with a longer base delay
+// when the call was throttled
+type RetryPolicy struct {
+	MaxAttempts       int
+	BaseDelay         time.Duration
+	ThrottleBaseDelay time.Duration
+	MaxDelay          time.Duration
+	random            func() float64
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       8,
+		BaseDelay:         200 * time.Millisecond,
+		ThrottleBaseDelay: time.Second,
+		MaxDelay:          20 * time.Second,
+		random:            rand.Float64,
+	}
+}
+
+// getRetryPolicyFromEnv returns the retry policy with RETRY_MAX_ATTEMPTS, RETRY_BASE_DELAY, RETRY_THROTTLE_BASE_DELAY
+// and RETRY_MAX_DELAY
+func getRetryPolicyFromEnv() (RetryPolicy, error) {
+	policy := defaultRetryPolicy()
+	var err error
+	if os.Getenv("RETRY_MAX_ATTEMPTS") != "" {
+		policy.MaxAttempts, err = getEnvInt("RETRY_MAX_ATTEMPTS")
+		if err != nil {
+			return policy, err
+		}
+		if policy.MaxAttempts < 1 {
+			return policy, fmt.Errorf("RETRY_MAX_ATTEMPTS must be at least 1")
+		}
+	}
+	for name, value := range map[string]*time.Duration{"RETRY_BASE_DELAY": &policy.BaseDelay, "RETRY_THROTTLE_BASE_DELAY": &policy.ThrottleBaseDelay, "RETRY_MAX_DELAY": &policy.MaxDelay} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		*value, err = getEnvDuration(name)
+		if err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// MaxRetries implements request.Retryer
+func (p RetryPolicy) MaxRetries() int {
+	return p.MaxAttempts - 1
+}
+
+// ShouldRetry implements request.Retryer
+func (p RetryPolicy) ShouldRetry(r *request.Request) bool {
+	if r.Retryable != nil {
+		return *r.Retryable
+	}
+	return classifyAWSError(r.Error, statusCode(r)) != ""
+}
+
+// RetryRules implements request.Retryer. It is called for every retry, so it also logs and counts the retries
+func (p RetryPolicy) RetryRules(r *request.Request) time.Duration {
+	base := p.BaseDelay
+	var throttles int64
+	if classifyAWSError(r.Error, statusCode(r)) == "throttle" {
+		base = p.ThrottleBaseDelay
+		throttles = 1
+	}
+	delay := p.delay(base, r.RetryCount)
+	awsStats.add(r.ClientInfo.ServiceName, 1, throttles)
+	retryLogger.Warningf("%s %s failed (%s, attempt %d/%d), retrying in %s", r.ClientInfo.ServiceName, operationName(r), errorCode(r.Error), r.RetryCount+1, r.MaxRetries()+1, delay)
+	return delay
+}
+
+// delay returns a random delay between 0 and base * 2^retryCount, capped at the maximum delay
+func (p RetryPolicy) delay(base time.Duration, retryCount int) time.Duration {
+	backoff := float64(base) * math.Pow(2, float64(retryCount))
+	if backoff > float64(p.MaxDelay) {
+		backoff = float64(p.MaxDelay)
+	}
+	random := p.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return time.Duration(random() * backoff)
+}
+
+func statusCode(r *request.Request) int {
+	if r.HTTPResponse == nil {
+		return 0
+	}
+	return r.HTTPResponse.StatusCode
+}
+
+// rateLimiter is a token bucket that allows rate calls per second, with bursts of up to rate calls
+type rateLimiter struct {
+	mu       sync.Mutex
+	clock    Clock
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(clock Clock, rate float64) *rateLimiter {
+	return &rateLimiter{
+		clock:    clock,
+		interval: time.Duration(float64(time.Second) / rate),
+		burst:    math.Max(rate, 1),
+		tokens:   math.Max(rate, 1),
+		last:     clock.Now(),
+	}
+}
+
+// wait waits until a call is allowed
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens = math.Min(l.burst, l.tokens+float64(now.Sub(l.last))/float64(l.interval))
+	l.last = now
+	// reserve a token, the calls that don't get one wait in line
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens * float64(l.interval))
+	}
+	l.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	return sleep(ctx, l.clock, delay)
+}
+
+// getRateLimitsFromEnv returns the rate limit of every service and the default rate limit. RATE_LIMIT is the number of calls per second to a service
+// (default: 10, 0 disables the limit) and RATE_LIMITS overrides it per service, e.g. ecs=20,autoscaling=5
+func getRateLimitsFromEnv() (map[string]float64, float64, error) {
+	defaultLimit := 10.0
+	if value := os.Getenv("RATE_LIMIT"); value != "" {
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit < 0 {
+			return nil, 0, fmt.Errorf("RATE_LIMIT must be a number of calls per second")
+		}
+		defaultLimit = limit
+	}
+	limits := make(map[string]float64)
+	for _, serviceLimit := range splitEnv("RATE_LIMITS") {
+		parts := strings.SplitN(serviceLimit, "=", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("invalid RATE_LIMITS %s, expected service=calls per second", serviceLimit)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || limit < 0 {
+			return nil, 0, fmt.Errorf("invalid RATE_LIMITS %s, expected service=calls per second", serviceLimit)
+		}
+		limits[strings.ToLower(strings.TrimSpace(parts[0]))] = limit
+	}
+	return limits, defaultLimit, nil
+}
+
+// awsCallStats counts the retries of AWS calls per service, for the logs and the metrics
+type awsCallStats struct {
+	mu        sync.Mutex
+	retries   map[string]int64
+	throttles map[string]int64
+}
+
+var awsStats = &awsCallStats{retries: make(map[string]int64), throttles: make(map[string]int64)}
+
+func (s *awsCallStats) add(service string, retries, throttles int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries[service] += retries
+	s.throttles[service] += throttles
+}
+
+// snapshot returns the services with their retries and throttles
+func (s *awsCallStats) snapshot() ([]string, map[string]int64, map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retries := make(map[string]int64)
+	throttles := make(map[string]int64)
+	var services []string
+	for service, count := range s.retries {
+		services = append(services, service)
+		retries[service] = count
+		throttles[service] = s.throttles[service]
+	}
+	sort.Strings(services)
+	return services, retries, throttles
+}
+
+// newSessionFromEnv returns a session with the retry policy and the rate limits in the environment
+func newSessionFromEnv(clock Clock) (*session.Session, error) {
+	policy, err := getRetryPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	limits, defaultLimit, err := getRateLimitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(request.WithRetryer(aws.NewConfig(), policy))
+	if err != nil {
+		return nil, err
+	}
+	installRetryHandlers(sess, clock, limits, defaultLimit)
+	return sess, nil
+}
+
+// installRetryHandlers rate limits every attempt of a call per service, and logs the result of calls that were retried
+func installRetryHandlers(sess *session.Session, clock Clock, limits map[string]float64, defaultLimit float64) {
+	var mu sync.Mutex
+	limiters := make(map[string]*rateLimiter)
+	limiter := func(service string) *rateLimiter {
+		mu.Lock()
+		defer mu.Unlock()
+		if l, ok := limiters[service]; ok {
+			return l
+		}
+		limit, ok := limits[strings.ToLower(service)]
+		if !ok {
+			limit = defaultLimit
+		}
+		var l *rateLimiter
+		if limit > 0 {
+			l = newRateLimiter(clock, limit)
+		}
+		limiters[service] = l
+		return l
+	}
+	sess.Handlers.Sign.PushFrontNamed(request.NamedHandler{Name: "ecs-upgrade.RateLimit", Fn: func(r *request.Request) {
+		if l := limiter(r.ClientInfo.ServiceName); l != nil {
+			if err := l.wait(r.Context()); err != nil {
+				r.Error = awserr.New(request.CanceledErrorCode, "request context canceled", err)
+			}
+		}
+	}})
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "ecs-upgrade.RetryResult", Fn: func(r *request.Request) {
+		if r.RetryCount == 0 {
+			return
+		}
+		if r.Error != nil {
+			retryLogger.Errorf("%s %s failed after %d attempts: %v", r.ClientInfo.ServiceName, operationName(r), r.RetryCount+1, errorCode(r.Error))
+			return
+		}
+		retryLogger.Infof("%s %s succeeded after %d attempts", r.ClientInfo.ServiceName, operationName(r), r.RetryCount+1)
+	}})
+}
+
+func operationName(r *request.Request) string {
+	if r.Operation == nil {
+		return ""
+	}
+	return r.Operation.Name
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestClassifyAWSError(t *testing.T) {
+	tests := []struct {
+		err        error
+		statusCode int
+		class      string
+	}{
+		{nil, 200, ""},
+		{awserr.New("ThrottlingException", "Rate exceeded", nil), 400, "throttle"},
+		{awserr.New("RequestLimitExceeded", "Request limit exceeded", nil), 503, "throttle"},
+		{awserr.New("ServiceUnavailableException", "", nil), 503, "retryable"},
+		{awserr.New("InternalError", "", nil), 500, "retryable"},
+		{awserr.New("SomethingNew", "", nil), 429, "throttle"},
+		{awserr.New("SomethingNew", "", nil), 502, "retryable"},
+		{awserr.New("ValidationError", "invalid", nil), 400, ""},
+		{awserr.New("AccessDeniedException", "", nil), 403, ""},
+		// quotas and conflicts are not rate limits
+		{awserr.New("LimitExceededException", "launch template limit", nil), 400, ""},
+		{awserr.New("TransactionInProgressException", "", nil), 400, ""},
+		{awserr.New("EC2ThrottledException", "", nil), 400, "throttle"},
+		{errors.New("boom"), 0, ""},
+	}
+	for _, test := range tests {
+		if class := classifyAWSError(test.err, test.statusCode); class != test.class {
+			t.Errorf("%v (%d): expected %q, got %q", test.err, test.statusCode, test.class, class)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := defaultRetryPolicy()
+	p.random = func() float64 { return 1 }
+	for retryCount, expected := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond} {
+		if delay := p.delay(p.BaseDelay, retryCount); delay != expected {
+			t.Errorf("retry %d: expected %s, got %s", retryCount, expected, delay)
+		}
+	}
+	if delay := p.delay(p.ThrottleBaseDelay, 10); delay != p.MaxDelay {
+		t.Errorf("expected the delay to be capped at %s, got %s", p.MaxDelay, delay)
+	}
+	p.random = func() float64 { return 0.5 }
+	if delay := p.delay(p.ThrottleBaseDelay, 1); delay != time.Second {
+		t.Errorf("expected a jittered delay of 1s, got %s", delay)
+	}
+}
+
+func TestGetRetryPolicyFromEnv(t *testing.T) {
+	t.Setenv("RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("RETRY_MAX_DELAY", "5s")
+	p, err := getRetryPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("getRetryPolicyFromEnv error: %v", err)
+	}
+	if p.MaxRetries() != 2 || p.MaxDelay != 5*time.Second || p.BaseDelay != defaultRetryPolicy().BaseDelay {
+		t.Errorf("unexpected retry policy %+v", p)
+	}
+	t.Setenv("RETRY_MAX_ATTEMPTS", "0")
+	if _, err := getRetryPolicyFromEnv(); err == nil {
+		t.Errorf("expected an error for RETRY_MAX_ATTEMPTS=0")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(clock, 2)
+	start := clock.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait error: %v", err)
+		}
+	}
+	if waited := clock.Now().Sub(start); waited != 0 {
+		t.Errorf("expected a burst without waiting, waited %s", waited)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait error: %v", err)
+		}
+	}
+	if waited := clock.Now().Sub(start); waited != time.Second {
+		t.Errorf("expected to wait 1s for 2 more calls, waited %s", waited)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err == nil {
+		t.Errorf("expected an error when the context is cancelled")
+	}
+}
+
+func TestGetRateLimitsFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "5")
+	t.Setenv("RATE_LIMITS", "ECS=20, autoscaling=0")
+	limits, defaultLimit, err := getRateLimitsFromEnv()
+	if err != nil {
+		t.Fatalf("getRateLimitsFromEnv error: %v", err)
+	}
+	if defaultLimit != 5 || limits["ecs"] != 20 || limits["autoscaling"] != 0 || len(limits) != 2 {
+		t.Errorf("unexpected rate limits %v (default %v)", limits, defaultLimit)
+	}
+	for _, invalid := range []string{"ecs", "ecs=fast", "ecs=-1"} {
+		t.Setenv("RATE_LIMITS", invalid)
+		if _, _, err := getRateLimitsFromEnv(); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+// newThrottlingServer returns an ECS endpoint that throttles the first calls
+func newThrottlingServer(t *testing.T, throttled int) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if calls <= throttled {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ThrottlingException","message":"Rate exceeded"}`))
+			return
+		}
+		w.Write([]byte(`{"clusterArns":[]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func newTestSession(t *testing.T, endpoint string, maxAttempts int) *session.Session {
+	p := RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: time.Millisecond, ThrottleBaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	config := aws.NewConfig().WithRegion("us-east-1").WithEndpoint(endpoint).WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))
+	sess, err := session.NewSession(request.WithRetryer(config, p))
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	installRetryHandlers(sess, realClock{}, map[string]float64{"ecs": 1000}, 0)
+	return sess
+}
+
+func TestRetryThrottledCalls(t *testing.T) {
+	srv, calls := newThrottlingServer(t, 2)
+	_, retriesBefore, throttlesBefore := awsStats.snapshot()
+	svc := ecs.New(newTestSession(t, srv.URL, 5))
+	if _, err := svc.ListClustersWithContext(context.Background(), &ecs.ListClustersInput{}); err != nil {
+		t.Fatalf("ListClusters error: %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected 3 calls, got %d", *calls)
+	}
+	_, retries, throttles := awsStats.snapshot()
+	if retries["ecs"]-retriesBefore["ecs"] != 2 || throttles["ecs"]-throttlesBefore["ecs"] != 2 {
+		t.Errorf("expected 2 retries and throttles, got %d and %d", retries["ecs"]-retriesBefore["ecs"], throttles["ecs"]-throttlesBefore["ecs"])
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv, calls := newThrottlingServer(t, 10)
+	svc := ecs.New(newTestSession(t, srv.URL, 3))
+	_, err := svc.ListClustersWithContext(context.Background(), &ecs.ListClustersInput{})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "ThrottlingException" {
+		t.Fatalf("expected ThrottlingException, got %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", *calls)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import "context"
+
+// rollback puts the autoscaling group back on the launch configuration or template it used before the upgrade,
+// reactivates the drained container instances and terminates the instances that were launched by the upgrade with
+// newLaunchIdentifier, a launch template version when useLaunchTemplates is set. The terminated instance ids are returned
+func rollback(ctx context.Context, a Autoscaling, e ECS, clusterName string, asg AutoscalingGroup, newLaunchIdentifier, useLaunchTemplates string, drainedContainerArns []string) ([]string, error) {
+	mainLogger.Infof("Rolling back upgrade of autoscaling group %s", asg.AutoscalingGroupName)
+	var terminated []string
+	var err error
+	if asg.LaunchTemplateName != "" {
+		err = a.updateAutoscalingLaunchTemplate(ctx, asg.AutoscalingGroupName, asg.LaunchTemplateName, asg.LaunchTemplateVersion)
+	} else {
+		err = a.updateAutoscalingLaunchConfig(ctx, asg.AutoscalingGroupName, asg.LaunchConfigurationName)
+	}
+	if err != nil {
+		return terminated, err
+	}
+	// reactivate old instances first, so tasks can move back before the new instances are terminated
+	if len(drainedContainerArns) > 0 {
+		mainLogger.Debugf("Reactivating %d drained container instances", len(drainedContainerArns))
+		err = e.activateNodes(ctx, clusterName, drainedContainerArns)
+		if err != nil {
+			return terminated, err
+		}
+	}
+	instances, err := a.getAutoscalingInstanceHealth(ctx, asg.AutoscalingGroupName)
+	if err != nil {
+		return terminated, err
+	}
+	for _, instance := range instances {
+		if checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
+			mainLogger.Instance(instance.InstanceId).Debugf("Terminating new instance %s", instance.InstanceId)
+			err = a.terminateInstance(ctx, instance.InstanceId, true)
+			if err != nil {
+				return terminated, err
+			}
+			terminated = append(terminated, instance.InstanceId)
+		}
+	}
+	// make sure the group ends up at the capacity it had before the upgrade
+	err = a.scaleAutoscalingGroup(ctx, asg.AutoscalingGroupName, asg.DesiredCapacity)
+	if err != nil {
+		return terminated, err
+	}
+	mainLogger.Infof("Rollback of autoscaling group %s completed", asg.AutoscalingGroupName)
+	return terminated, nil
+}
+
+// restoreCapacity reactivates the drained container instances and scales the autoscaling group back to the
+// capacity it had before the upgrade. The launch configuration or template is not changed
+func restoreCapacity(ctx context.Context, a Autoscaling, e ECS, clusterName string, asg AutoscalingGroup, drainedContainerArns []string) error {
+	mainLogger.Infof("Restoring capacity of autoscaling group %s", asg.AutoscalingGroupName)
+	if len(drainedContainerArns) > 0 {
+		mainLogger.Debugf("Reactivating %d drained container instances", len(drainedContainerArns))
+		err := e.activateNodes(ctx, clusterName, drainedContainerArns)
+		if err != nil {
+			return err
+		}
+	}
+	return a.scaleAutoscalingGroup(ctx, asg.AutoscalingGroupName, asg.DesiredCapacity)
+}
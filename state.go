@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// UpgradeState is written when an upgrade stops before it completed, so the autoscaling group
+// and the cluster can be inspected and repaired afterwards
+type UpgradeState struct {
+	RunID                        string    `json:"runId"`
+	Cluster                      string    `json:"cluster"`
+	AutoscalingGroup             string    `json:"autoscalingGroup"`
+	Phase                        string    `json:"phase"`
+	UseLaunchTemplates           bool      `json:"useLaunchTemplates"`
+	LaunchConfigurationName      string    `json:"launchConfigurationName,omitempty"`
+	LaunchTemplateName           string    `json:"launchTemplateName,omitempty"`
+	LaunchTemplateVersion        string    `json:"launchTemplateVersion,omitempty"`
+	NewLaunchIdentifier          string    `json:"newLaunchIdentifier,omitempty"`
+	DesiredCapacity              int64     `json:"desiredCapacity"`
+	DrainedContainerInstanceArns []string  `json:"drainedContainerInstanceArns"`
+	StartedAt                    time.Time `json:"startedAt"`
+	StoppedAt                    time.Time `json:"stoppedAt"`
+	Cancelled                    bool      `json:"cancelled"`
+	CancelAction                 string    `json:"cancelAction,omitempty"`
+	CancelActionError            string    `json:"cancelActionError,omitempty"`
+	Error                        string    `json:"error,omitempty"`
+}
+
+func newUpgradeState(clusterName string, asg AutoscalingGroup, useLaunchTemplates, runID string, startedAt time.Time) UpgradeState {
+	return UpgradeState{
+		RunID:                   runID,
+		Cluster:                 clusterName,
+		AutoscalingGroup:        asg.AutoscalingGroupName,
+		Phase:                   "start",
+		UseLaunchTemplates:      useLaunchTemplates == "true",
+		LaunchConfigurationName: asg.LaunchConfigurationName,
+		LaunchTemplateName:      asg.LaunchTemplateName,
+		LaunchTemplateVersion:   asg.LaunchTemplateVersion,
+		DesiredCapacity:         asg.DesiredCapacity,
+		StartedAt:               startedAt,
+	}
+}
+
+// write logs the state and writes it to filename, if set
+func (s UpgradeState) write(filename string) error {
+	out, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	mainLogger.Infof("Upgrade state: %s", out)
+	if filename == "" {
+		return nil
+	}
+	return os.WriteFile(filename, append(out, '\n'), 0644)
+}
+
+// getCancelAction returns what to do when the upgrade is cancelled: none, rollback or restore
+func getCancelAction() (string, error) {
+	action := os.Getenv("ON_CANCEL")
+	switch action {
+	case "":
+		return "none", nil
+	case "none", "rollback", "restore":
+		return action, nil
+	}
+	return "", fmt.Errorf("ON_CANCEL must be none, rollback or restore (got %s)", action)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// logging
+var targetsLogger = getLogger("targets")
+
+// Target is a cluster and autoscaling group to upgrade. When RoleArn is set, the target is upgraded with the
+// credentials of that role, e.g. in another account. When Region is set, the target is upgraded in that region
+// instead of the region of the runner. Regions lists the regions of the same cluster, which are upgraded one at a time
+type Target struct {
+	Cluster          string   `json:"cluster"`
+	AutoscalingGroup string   `json:"autoscalingGroup"`
+	Region           string   `json:"region,omitempty"`
+	Regions          []string `json:"regions,omitempty"`
+	RoleArn          string   `json:"roleArn,omitempty"`
+	ExternalID       string   `json:"externalId,omitempty"`
+	SessionName      string   `json:"sessionName,omitempty"`
+	// AMIMinAgeDays is the minimum age of the AMI to upgrade to, instead of AMI_MIN_AGE_DAYS
+	AMIMinAgeDays *int `json:"amiMinAgeDays,omitempty"`
+	// InstanceType, SecurityGroups and LaunchTemplates are the launch settings of the target, instead of INSTANCE_TYPE,
+	// SECURITY_GROUPS and LAUNCH_TEMPLATES
+	InstanceType    string   `json:"instanceType,omitempty"`
+	SecurityGroups  []string `json:"securityGroups,omitempty"`
+	LaunchTemplates *bool    `json:"launchTemplates,omitempty"`
+	// several is set when the target is upgraded with other targets in one run, to write REPORT_FILE and STATE_FILE per target
+	several bool
+}
+
+// getUseLaunchTemplates returns "true" when the autoscaling group of the target uses a launch template: the
+// launchTemplates of the target, or LAUNCH_TEMPLATES
+func getUseLaunchTemplates(target Target) string {
+	if target.LaunchTemplates != nil {
+		return fmt.Sprintf("%v", *target.LaunchTemplates)
+	}
+	return os.Getenv("LAUNCH_TEMPLATES")
+}
+
+func (t Target) String() string {
+	s := t.Cluster
+	if t.AutoscalingGroup != "" {
+		s += "/" + t.AutoscalingGroup
+	}
+	if t.Region != "" {
+		s += " in " + t.Region
+	}
+	if t.RoleArn != "" {
+		s += " (" + t.RoleArn + ")"
+	}
+	return s
+}
+
+// account returns the account of the role of the target, or an empty string without a role
+func (t Target) account() string {
+	// arn:aws:iam::123456789012:role/ecs-upgrade
+	parts := strings.Split(t.RoleArn, ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+// targetFile returns the file of the target: with several targets, the account, region, cluster and autoscaling group
+// of the target are added to the name, e.g. report-eu-west-1-cluster-asg.json
+func targetFile(filename string, target Target) string {
+	if filename == "" || !target.several {
+		return filename
+	}
+	var parts []string
+	for _, part := range []string{target.account(), target.Region, target.Cluster, target.AutoscalingGroup} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + strings.Join(parts, "-") + ext
+}
+
+// logicalCluster identifies the cluster of the target across regions
+func (t Target) logicalCluster() string {
+	return t.RoleArn + "|" + t.Cluster + "|" + t.AutoscalingGroup
+}
+
+// expandRegions returns a target per region of the targets with Regions
+func expandRegions(targets []Target) []Target {
+	var expanded []Target
+	for _, target := range targets {
+		if len(target.Regions) == 0 {
+			expanded = append(expanded, target)
+			continue
+		}
+		for _, region := range target.Regions {
+			regionTarget := target
+			regionTarget.Region, regionTarget.Regions = region, nil
+			expanded = append(expanded, regionTarget)
+		}
+	}
+	return expanded
+}
+
+// getTargetsFromEnv returns the targets in TARGETS, a JSON list, or in the JSON file TARGETS_FILE. Without them, the target is
+// ECS_CLUSTER and ECS_ASG in the regions in ECS_REGIONS, with the role in ASSUME_ROLE_ARN, ASSUME_ROLE_EXTERNAL_ID and
+// ASSUME_ROLE_SESSION_NAME. Targets with several regions are returned as a target per region
+func getTargetsFromEnv() ([]Target, error) {
+	value := os.Getenv("TARGETS")
+	if filename := os.Getenv("TARGETS_FILE"); filename != "" {
+		if value != "" {
+			return nil, fmt.Errorf("set either TARGETS or TARGETS_FILE")
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("TARGETS_FILE: %v", err)
+		}
+		value = string(content)
+	}
+	if strings.TrimSpace(value) == "" {
+		target := Target{
+			Cluster:          os.Getenv("ECS_CLUSTER"),
+			AutoscalingGroup: os.Getenv("ECS_ASG"),
+			RoleArn:          os.Getenv("ASSUME_ROLE_ARN"),
+			ExternalID:       os.Getenv("ASSUME_ROLE_EXTERNAL_ID"),
+			SessionName:      os.Getenv("ASSUME_ROLE_SESSION_NAME"),
+			Regions:          splitEnv("ECS_REGIONS"),
+		}
+		if target.Cluster == "" {
+			return nil, fmt.Errorf("ECS_CLUSTER not set")
+		}
+		return expandRegions([]Target{target}), nil
+	}
+	var targets []Target
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&targets); err != nil {
+		return nil, fmt.Errorf("invalid targets: %v", err)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("invalid targets: no targets")
+	}
+	for i, target := range targets {
+		if target.Cluster == "" {
+			return nil, fmt.Errorf("invalid targets: target %d has no cluster", i+1)
+		}
+		if target.RoleArn == "" && (target.ExternalID != "" || target.SessionName != "") {
+			return nil, fmt.Errorf("invalid targets: target %d has an external id or session name without a role", i+1)
+		}
+		if target.Region != "" && len(target.Regions) > 0 {
+			return nil, fmt.Errorf("invalid targets: target %d has both region and regions", i+1)
+		}
+		if target.AMIMinAgeDays != nil && *target.AMIMinAgeDays < 0 {
+			return nil, fmt.Errorf("invalid targets: target %d has a negative amiMinAgeDays", i+1)
+		}
+		for _, sg := range target.SecurityGroups {
+			if !strings.HasPrefix(sg, "sg-") {
+				return nil, fmt.Errorf("invalid targets: target %d: %s is not a security group id", i+1, sg)
+			}
+		}
+	}
+	return expandRegions(targets), nil
+}
+
+// newClientsForTarget returns the clients of a target. The autoscaling group, the AMIs, the cluster, the load balancers,
+// the alarms and the asg-tags lock are accessed in the region and with the role of the target. The report, the
+// notifications, the events and the dynamodb lock stay in the account and the region of the runner
+func newClientsForTarget(sess *session.Session, target Target) Clients {
+	c := NewClients(sess)
+	if target.RoleArn == "" && target.Region == "" {
+		return c
+	}
+	config := aws.NewConfig()
+	if target.Region != "" {
+		config = config.WithRegion(target.Region)
+	}
+	if target.RoleArn != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(sess, target.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = target.SessionName
+			if p.RoleSessionName == "" {
+				p.RoleSessionName = "ecs-upgrade"
+			}
+			if target.ExternalID != "" {
+				p.ExternalID = aws.String(target.ExternalID)
+			}
+		}))
+	}
+	targetSess := sess.Copy(config)
+	c.Autoscaling = NewAutoscaling(targetSess)
+	c.ECS = NewECS(targetSess)
+	c.LB = NewLB(targetSess)
+	c.CloudWatch = NewCloudWatch(targetSess)
+	c.Lock = Lock{
+		svcAutoscaling: autoscaling.New(targetSess),
+		svcECS:         ecs.New(targetSess),
+		svcDynamoDB:    dynamodb.New(sess),
+		region:         aws.StringValue(targetSess.Config.Region),
+		clock:          realClock{},
+	}
+	return c
+}
+
+// runTargets upgrades the targets one after another, with the clients returned by clients. A failed target doesn't stop
+// the upgrade of the next targets, but it stops the upgrade of the same cluster in the next regions.
+// It returns 1 when a target failed or was skipped, or the run was cancelled
+func runTargets(ctx context.Context, targets []Target, clients func(Target) Clients) int {
+	// every target writes its own report and state
+	files := make(map[string]string)
+	for i := range targets {
+		targets[i].several = len(targets) > 1
+		for _, name := range []string{"REPORT_FILE", "STATE_FILE"} {
+			filename := targetFile(os.Getenv(name), targets[i])
+			if filename == "" {
+				continue
+			}
+			if other, ok := files[filename]; ok {
+				targetsLogger.Errorf("%s: %s and %s would write to the same file %s", name, other, targets[i], filename)
+				return 1
+			}
+			files[filename] = targets[i].String()
+		}
+	}
+	var failed, skipped []string
+	failedClusters := make(map[string]bool)
+	for i, target := range targets {
+		if ctx.Err() != nil {
+			targetsLogger.Errorf("Cancelled before upgrading %d of %d targets", len(targets)-i, len(targets))
+			return 1
+		}
+		if target.Region != "" && failedClusters[target.logicalCluster()] {
+			targetsLogger.Warningf("Skipping %s, the upgrade failed in a previous region", target)
+			skipped = append(skipped, target.String())
+			continue
+		}
+		if len(targets) > 1 {
+			targetsLogger.Infof("Upgrading target %d of %d: %s", i+1, len(targets), target)
+		}
+		if ret := runWithReturnCode(ctx, clients(target), target); ret != 0 {
+			failed = append(failed, target.String())
+			failedClusters[target.logicalCluster()] = true
+		}
+	}
+	if len(skipped) > 0 {
+		targetsLogger.Errorf("%d of %d targets skipped: %s", len(skipped), len(targets), strings.Join(skipped, ", "))
+	}
+	if len(failed) > 0 {
+		targetsLogger.Errorf("%d of %d targets failed: %s", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+	if len(failed) > 0 || len(skipped) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestGetTargetsFromEnv(t *testing.T) {
+	t.Setenv("ECS_CLUSTER", "cluster")
+	t.Setenv("ECS_ASG", "asg")
+	t.Setenv("ASSUME_ROLE_ARN", "arn:aws:iam::111111111111:role/ecs-upgrade")
+	t.Setenv("ASSUME_ROLE_EXTERNAL_ID", "secret")
+	targets, err := getTargetsFromEnv()
+	if err != nil {
+		t.Fatalf("getTargetsFromEnv error: %v", err)
+	}
+	expected := Target{Cluster: "cluster", AutoscalingGroup: "asg", RoleArn: "arn:aws:iam::111111111111:role/ecs-upgrade", ExternalID: "secret"}
+	if len(targets) != 1 || !reflect.DeepEqual(targets[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, targets)
+	}
+
+	t.Setenv("TARGETS", `[{"cluster":"a","autoscalingGroup":"asg-a"},{"cluster":"b","autoscalingGroup":"asg-b","roleArn":"arn:aws:iam::222222222222:role/ecs-upgrade","sessionName":"central"}]`)
+	targets, err = getTargetsFromEnv()
+	if err != nil {
+		t.Fatalf("getTargetsFromEnv error: %v", err)
+	}
+	if len(targets) != 2 || targets[0].Cluster != "a" || targets[0].RoleArn != "" || targets[1].RoleArn != "arn:aws:iam::222222222222:role/ecs-upgrade" || targets[1].SessionName != "central" {
+		t.Errorf("unexpected targets %+v", targets)
+	}
+
+	filename := t.TempDir() + "/targets.json"
+	if err := os.WriteFile(filename, []byte(`[{"cluster":"c"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TARGETS", "")
+	t.Setenv("TARGETS_FILE", filename)
+	targets, err = getTargetsFromEnv()
+	if err != nil || len(targets) != 1 || targets[0].Cluster != "c" {
+		t.Errorf("unexpected targets from file %+v (%v)", targets, err)
+	}
+	t.Setenv("TARGETS_FILE", "")
+
+	t.Setenv("TARGETS", `[{"cluster":"a","regions":["eu-west-1","us-east-1"]},{"cluster":"b","region":"ap-southeast-2"}]`)
+	targets, err = getTargetsFromEnv()
+	if err != nil {
+		t.Fatalf("getTargetsFromEnv error: %v", err)
+	}
+	var regions []string
+	for _, target := range targets {
+		regions = append(regions, target.Cluster+" "+target.Region)
+	}
+	if !reflect.DeepEqual(regions, []string{"a eu-west-1", "a us-east-1", "b ap-southeast-2"}) {
+		t.Errorf("unexpected targets per region %v", regions)
+	}
+
+	for _, invalid := range []string{`[]`, `{"cluster":"a"}`, `[{"autoscalingGroup":"asg"}]`, `[{"cluster":"a","role":"x"}]`, `[{"cluster":"a","externalId":"secret"}]`, `[{"cluster":"a","region":"eu-west-1","regions":["us-east-1"]}]`, `[{"cluster":"a","amiMinAgeDays":-1}]`, `[{"cluster":"a","securityGroups":["default"]}]`} {
+		t.Setenv("TARGETS", invalid)
+		if _, err := getTargetsFromEnv(); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+// newAssumeRoleServer returns an endpoint for STS and ECS. It records the AssumeRole calls and the access keys of the ECS calls
+func newAssumeRoleServer(t *testing.T) (*httptest.Server, *[]string, *[]string) {
+	var mu sync.Mutex
+	var assumeRoles, accessKeys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-Amz-Target") == "" {
+			r.ParseForm()
+			assumeRoles = append(assumeRoles, r.Form.Get("Action")+" "+r.Form.Get("RoleArn")+" "+r.Form.Get("RoleSessionName")+" "+r.Form.Get("ExternalId"))
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials>` +
+				`<AccessKeyId>ASSUMED</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>` +
+				`</Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		start := strings.Index(authorization, "Credential=") + len("Credential=")
+		accessKeys = append(accessKeys, strings.SplitN(authorization[start:], "/", 2)[0])
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"clusterArns":[]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &assumeRoles, &accessKeys
+}
+
+func TestClientsForTargetAssumeRole(t *testing.T) {
+	srv, assumeRoles, accessKeys := newAssumeRoleServer(t)
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("us-east-1").WithEndpoint(srv.URL).WithCredentials(credentials.NewStaticCredentials("CENTRAL", "secret", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listClusters := func(c Clients) {
+		if _, err := c.ECS.svc.ListClustersWithContext(context.Background(), &ecs.ListClustersInput{}); err != nil {
+			t.Fatalf("ListClusters error: %v", err)
+		}
+	}
+	listClusters(newClientsForTarget(sess, Target{Cluster: "central"}))
+	listClusters(newClientsForTarget(sess, Target{Cluster: "remote", RoleArn: "arn:aws:iam::111111111111:role/ecs-upgrade", ExternalID: "secret"}))
+	if len(*accessKeys) != 2 || (*accessKeys)[0] != "CENTRAL" || (*accessKeys)[1] != "ASSUMED" {
+		t.Errorf("expected the central and then the assumed credentials, got %v", *accessKeys)
+	}
+	if len(*assumeRoles) != 1 || (*assumeRoles)[0] != "AssumeRole arn:aws:iam::111111111111:role/ecs-upgrade ecs-upgrade secret" {
+		t.Errorf("unexpected AssumeRole calls %v", *assumeRoles)
+	}
+}
+
+func TestRunTargets(t *testing.T) {
+	central := newFakeAWS(2, 2, false)
+	remote := newFakeAWS(2, 2, false)
+	remote.cluster, remote.asgName = "remote", "remote-asg"
+	remote.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("ALARM")}}
+	dir := t.TempDir()
+	setUpgradeEnv(t, central, map[string]string{"REPORT_FILE": dir + "/report.json", "ALARM_NAMES": "api-5xx"})
+	central.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	var upgraded []string
+	clients := func(target Target) Clients {
+		upgraded = append(upgraded, target.Cluster)
+		if target.RoleArn != "" {
+			return remote.clients()
+		}
+		return central.clients()
+	}
+	targets := []Target{remote.target(), central.target()}
+	targets[0].RoleArn = "arn:aws:iam::111111111111:role/ecs-upgrade"
+	if ret := runTargets(context.Background(), targets, clients); ret != 1 {
+		t.Fatalf("expected 1 when a target failed, got %d", ret)
+	}
+	if len(upgraded) != 2 || upgraded[0] != "remote" || upgraded[1] != "cluster" {
+		t.Errorf("expected both targets to be upgraded in order, got %v", upgraded)
+	}
+	checkUpgraded(t, central, 2)
+	if remote.currentImage() != fakeOldAMI {
+		t.Errorf("remote target upgraded while its alarm is in ALARM state")
+	}
+	// every target has its own report
+	if report := readReport(t, dir+"/report-111111111111-remote-remote-asg.json"); report.Cluster != "remote" || report.Outcome == "succeeded" {
+		t.Errorf("unexpected report of the remote target: %s %s", report.Cluster, report.Outcome)
+	}
+	if report := readReport(t, dir+"/report-cluster-asg.json"); report.Cluster != "cluster" || report.Outcome != "succeeded" {
+		t.Errorf("unexpected report of the central target: %s %s", report.Cluster, report.Outcome)
+	}
+}
+
+func TestRunTargetsSameStateFile(t *testing.T) {
+	f := newFakeAWS(2, 2, false)
+	setUpgradeEnv(t, f, map[string]string{"STATE_FILE": t.TempDir() + "/state.json"})
+	var upgraded int
+	clients := func(target Target) Clients {
+		upgraded++
+		return f.clients()
+	}
+	// the same target twice writes to the same state file
+	targets := []Target{f.target(), f.target()}
+	if ret := runTargets(context.Background(), targets, clients); ret != 1 {
+		t.Fatalf("expected 1 for targets with the same state file, got %d", ret)
+	}
+	if upgraded != 0 {
+		t.Errorf("expected no target to be upgraded, got %d", upgraded)
+	}
+}
+
+func TestTargetFile(t *testing.T) {
+	for _, tc := range []struct {
+		target   Target
+		expected string
+	}{
+		{Target{Cluster: "cluster", AutoscalingGroup: "asg"}, "/tmp/state.json"},
+		{Target{Cluster: "cluster", AutoscalingGroup: "asg", several: true}, "/tmp/state-cluster-asg.json"},
+		{Target{Cluster: "cluster", Region: "eu-west-1", RoleArn: "arn:aws:iam::111111111111:role/ecs-upgrade", several: true}, "/tmp/state-111111111111-eu-west-1-cluster.json"},
+	} {
+		if filename := targetFile("/tmp/state.json", tc.target); filename != tc.expected {
+			t.Errorf("expected %s for %s, got %s", tc.expected, tc.target, filename)
+		}
+	}
+}
+
+func TestClientsForTargetRegion(t *testing.T) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("us-east-1").WithCredentials(credentials.NewStaticCredentials("CENTRAL", "secret", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClientsForTarget(sess, Target{Cluster: "cluster", Region: "eu-west-1"})
+	for name, region := range map[string]string{
+		"autoscaling": aws.StringValue(c.Autoscaling.svcAutoscaling.(*autoscaling.AutoScaling).Client.Config.Region),
+		"ec2":         aws.StringValue(c.Autoscaling.svcEC2.(*ec2.EC2).Client.Config.Region),
+		"ecs":         aws.StringValue(c.ECS.svc.(*ecs.ECS).Client.Config.Region),
+		"s3":          aws.StringValue(c.S3.svc.(*s3.S3).Client.Config.Region),
+	} {
+		expected := "eu-west-1"
+		if name == "s3" {
+			expected = "us-east-1"
+		}
+		if region != expected {
+			t.Errorf("%s: expected region %s, got %s", name, expected, region)
+		}
+	}
+}
+
+func TestRunTargetsRegions(t *testing.T) {
+	regions := map[string]*fakeAWS{"eu-west-1": newFakeAWS(2, 2, false), "us-east-1": newFakeAWS(2, 2, false), "ap-southeast-2": newFakeAWS(2, 2, false)}
+	// the AMI ids differ per region
+	us := regions["us-east-1"]
+	us.images[1].ImageId = aws.String("ami-new-us")
+	us.agentVersions["ami-new-us"], us.attributes["ami-new-us"] = us.agentVersions[fakeNewAMI], us.attributes[fakeNewAMI]
+	setUpgradeEnv(t, regions["eu-west-1"], map[string]string{"REPORT_FILE": t.TempDir() + "/report.json", "ALARM_NAMES": "api-5xx"})
+	for _, f := range regions {
+		f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	}
+	clients := func(target Target) Clients {
+		return regions[target.Region].clients()
+	}
+	targets := expandRegions([]Target{{Cluster: "cluster", AutoscalingGroup: "asg", Regions: []string{"eu-west-1", "us-east-1"}}})
+	if ret := runTargets(context.Background(), targets, clients); ret != 0 {
+		t.Fatalf("upgrade returned %d", ret)
+	}
+	checkUpgraded(t, regions["eu-west-1"], 2)
+	if image := regions["us-east-1"].currentImage(); image != "ami-new-us" {
+		t.Errorf("expected the AMI of us-east-1, got %s", image)
+	}
+
+	// a failure in the first region stops the next regions
+	regions = map[string]*fakeAWS{"eu-west-1": newFakeAWS(2, 2, false), "us-east-1": newFakeAWS(2, 2, false), "ap-southeast-2": newFakeAWS(2, 2, false)}
+	for _, f := range regions {
+		f.alarms = []*cloudwatch.MetricAlarm{{AlarmName: aws.String("api-5xx"), StateValue: aws.String("OK")}}
+	}
+	regions["eu-west-1"].alarms[0].StateValue = aws.String("ALARM")
+	before := len(regions["us-east-1"].launchConfigs)
+	targets = expandRegions([]Target{{Cluster: "cluster", AutoscalingGroup: "asg", Regions: []string{"eu-west-1", "us-east-1"}}, {Cluster: "other", AutoscalingGroup: "asg", Region: "ap-southeast-2"}})
+	if ret := runTargets(context.Background(), targets, clients); ret != 1 {
+		t.Fatalf("expected 1 when a region failed, got %d", ret)
+	}
+	if len(regions["us-east-1"].launchConfigs) != before {
+		t.Errorf("upgraded the next region after a failure")
+	}
+	if image := regions["ap-southeast-2"].currentImage(); image != fakeNewAMI {
+		t.Errorf("expected the other cluster to be upgraded, got %s", image)
+	}
+}
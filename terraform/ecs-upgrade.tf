@@ -56,6 +56,8 @@ resource "aws_iam_role_policy" "ecs-upgrade-policy" {
         "ecs:Describe*",
         "ecs:List*",
         "ecs:Update*",
+        "ecs:TagResource",
+        "ecs:UntagResource",
         "ec2:Describe*",
         "ec2:RunInstances",
         "ec2:Create*",
@@ -64,7 +66,21 @@ resource "aws_iam_role_policy" "ecs-upgrade-policy" {
         "autoscaling:CreateLaunchConfiguration",
         "autoscaling:UpdateAutoScalingGroup",
         "autoscaling:DeleteLaunchConfiguration",
-        "elasticloadbalancing:Describe*"
+        "autoscaling:TerminateInstanceInAutoScalingGroup",
+        "autoscaling:CreateOrUpdateTags",
+        "autoscaling:DeleteTags",
+        "cloudwatch:DescribeAlarms",
+        "elasticloadbalancing:Describe*",
+        "dynamodb:GetItem",
+        "dynamodb:PutItem",
+        "dynamodb:UpdateItem",
+        "dynamodb:DeleteItem",
+        "s3:PutObject",
+        "sts:AssumeRole",
+        "sns:Publish",
+        "events:PutEvents",
+        "ssm:GetParameter",
+        "ssm:GetParameterHistory"
       ],
       "Resource": "*"
     },
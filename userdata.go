@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ecsConfigFile is the configuration file of the ECS agent, written by the user data
+const ecsConfigFile = "/etc/ecs/ecs.config"
+
+var (
+	ecsConfigKeyPattern  = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	ecsConfigEchoPattern = regexp.MustCompile(`^(\s*)echo\s+(.+?)\s*(>>?)\s*` + regexp.QuoteMeta(ecsConfigFile) + `\s*$`)
+	heredocPattern       = regexp.MustCompile(`<<-?\s*(['"\\]?)([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+	shellSafePattern     = regexp.MustCompile(`^[A-Za-z0-9_.,:/=+@%-]*$`)
+	// heredocEscaper escapes the characters that the shell expands in a heredoc with an unquoted delimiter
+	heredocEscaper   = strings.NewReplacer(`\`, `\\`, `$`, `\$`, "`", "\\`")
+	heredocUnescaper = strings.NewReplacer(`\\`, `\`, `\$`, `$`, "\\`", "`")
+)
+
+// ECSConfigChanges are the keys of ecs.config to set in the user data. A nil value removes the key
+type ECSConfigChanges map[string]*string
+
+// getECSConfigChangesFromEnv returns the changes in ECS_CONFIG, a JSON object with the keys of ecs.config to set,
+// or null to remove a key, e.g. {"ECS_CONTAINER_STOP_TIMEOUT":"2m","ECS_ENABLE_SPOT_INSTANCE_DRAINING":"true"}
+func getECSConfigChangesFromEnv() (ECSConfigChanges, error) {
+	value := os.Getenv("ECS_CONFIG")
+	if value == "" {
+		return nil, nil
+	}
+	var c ECSConfigChanges
+	err := json.Unmarshal([]byte(value), &c)
+	if err != nil {
+		return nil, fmt.Errorf("ECS_CONFIG must be a JSON object with the keys of %s: %v", ecsConfigFile, err)
+	}
+	for key, value := range c {
+		if !ecsConfigKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("ECS_CONFIG: %s is not a key of %s", key, ecsConfigFile)
+		}
+		if value != nil && strings.ContainsAny(*value, "\n\r") {
+			return nil, fmt.Errorf("ECS_CONFIG: the value of %s can't contain a newline", key)
+		}
+	}
+	return c, nil
+}
+
+// ecsConfigEntry is a line of the user data that writes a key of ecs.config, with an echo or in a heredoc.
+// In a heredoc with an unquoted delimiter (<<EOF), the shell expands $, ` and \ in the lines
+type ecsConfigEntry struct {
+	index    int
+	key      string
+	value    string
+	heredoc  bool
+	expanded bool
+	indent   string
+	quote    string
+	redirect string
+}
+
+// line returns the line of the entry with value
+func (e ecsConfigEntry) line(value string) string {
+	if e.heredoc && e.expanded {
+		return e.indent + e.key + "=" + heredocEscaper.Replace(value)
+	}
+	if e.heredoc {
+		return e.indent + e.key + "=" + value
+	}
+	return e.indent + "echo " + shellQuote(e.key+"="+value, e.quote) + " " + e.redirect + " " + ecsConfigFile
+}
+
+// ecsConfigScript is a user data script with the lines that write ecs.config
+type ecsConfigScript struct {
+	lines   []string
+	entries []ecsConfigEntry
+	// lastEcho is the index of the last echo to ecs.config, lastHeredocEnd the end of the last heredoc to ecs.config
+	// and lastHeredocExpanded is set when its delimiter is unquoted
+	lastEcho            int
+	lastHeredocEnd      int
+	lastHeredocExpanded bool
+}
+
+// parseECSConfigScript finds the lines of the script that write ecs.config: echo KEY=value >> /etc/ecs/ecs.config
+// and the lines of a heredoc to /etc/ecs/ecs.config
+func parseECSConfigScript(script string) ecsConfigScript {
+	s := ecsConfigScript{lines: strings.Split(script, "\n"), lastEcho: -1, lastHeredocEnd: -1}
+	delimiter, inECSConfig, expanded := "", false, false
+	for i, line := range s.lines {
+		if delimiter != "" {
+			if strings.TrimSpace(line) == delimiter {
+				if inECSConfig {
+					s.lastHeredocEnd, s.lastHeredocExpanded = i, expanded
+				}
+				delimiter = ""
+				continue
+			}
+			trimmed := strings.TrimSpace(line)
+			if key, value, ok := strings.Cut(trimmed, "="); inECSConfig && ok && ecsConfigKeyPattern.MatchString(key) {
+				if expanded {
+					value = heredocUnescaper.Replace(value)
+				}
+				s.entries = append(s.entries, ecsConfigEntry{index: i, key: key, value: value, heredoc: true, expanded: expanded, indent: line[:strings.Index(line, trimmed)]})
+			}
+			continue
+		}
+		if m := ecsConfigEchoPattern.FindStringSubmatch(line); m != nil {
+			arg, quote := m[2], ""
+			if len(arg) >= 2 && (arg[0] == '"' || arg[0] == '\'') && arg[len(arg)-1] == arg[0] {
+				arg, quote = arg[1:len(arg)-1], arg[:1]
+			}
+			if key, value, ok := strings.Cut(arg, "="); ok && ecsConfigKeyPattern.MatchString(key) {
+				s.entries = append(s.entries, ecsConfigEntry{index: i, key: key, value: value, indent: m[1], quote: quote, redirect: m[3]})
+				s.lastEcho = i
+			}
+			continue
+		}
+		if m := heredocPattern.FindStringSubmatch(line); m != nil {
+			delimiter, inECSConfig, expanded = m[2], strings.Contains(line, ecsConfigFile), m[1] == ""
+		}
+	}
+	return s
+}
+
+// config returns the keys of ecs.config written by the script. When a key is written more than once, the last value is returned
+func (s ecsConfigScript) config() map[string]string {
+	config := make(map[string]string)
+	for _, entry := range s.entries {
+		config[entry.key] = entry.value
+	}
+	return config
+}
+
+// applyToScript returns the script with the changes. Keys that are written are changed or removed where they are written,
+// new keys are added to the last heredoc to ecs.config, after the last echo to ecs.config or at the end of the script
+func (c ECSConfigChanges) applyToScript(script string) (string, error) {
+	s := parseECSConfigScript(script)
+	lines := make(map[int]string)
+	removed := make(map[int]bool)
+	written := make(map[string]bool)
+	for _, entry := range s.entries {
+		value, ok := c[entry.key]
+		if !ok {
+			continue
+		}
+		written[entry.key] = true
+		if value == nil {
+			removed[entry.index] = true
+		} else {
+			lines[entry.index] = entry.line(*value)
+		}
+	}
+	var keys []string
+	for key, value := range c {
+		if value != nil && !written[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var added []string
+	insertAt := len(s.lines)
+	if len(keys) > 0 {
+		entry := ecsConfigEntry{redirect: ">>"}
+		switch {
+		case s.lastHeredocEnd >= 0:
+			entry.heredoc, entry.expanded = true, s.lastHeredocExpanded
+			insertAt = s.lastHeredocEnd
+		case s.lastEcho >= 0:
+			insertAt = s.lastEcho + 1
+			entry.indent = s.lines[s.lastEcho][:len(s.lines[s.lastEcho])-len(strings.TrimLeft(s.lines[s.lastEcho], " \t"))]
+		case strings.TrimSpace(script) == "":
+			s.lines = []string{"#!/bin/bash", ""}
+			insertAt = 1
+		case strings.HasPrefix(script, "#!"):
+			// keep the trailing newline of the script
+			if s.lines[len(s.lines)-1] == "" {
+				insertAt--
+			}
+		default:
+			return "", fmt.Errorf("the user data is not a shell script and doesn't write %s", ecsConfigFile)
+		}
+		for _, key := range keys {
+			entry.key = key
+			added = append(added, entry.line(*c[key]))
+		}
+	}
+	var result []string
+	for i, line := range s.lines {
+		if i == insertAt {
+			result = append(result, added...)
+		}
+		if removed[i] {
+			continue
+		}
+		if l, ok := lines[i]; ok {
+			line = l
+		}
+		result = append(result, line)
+	}
+	if insertAt == len(s.lines) {
+		result = append(result, added...)
+	}
+	return strings.Join(result, "\n"), nil
+}
+
+// applyToUserData returns the base64 encoded user data with the changes
+func (c ECSConfigChanges) applyToUserData(userData *string) (*string, error) {
+	script, err := decodeUserData(aws.StringValue(userData))
+	if err != nil {
+		return nil, err
+	}
+	newScript, err := c.applyToScript(script)
+	if err != nil {
+		return nil, err
+	}
+	if newScript == script {
+		return userData, nil
+	}
+	return aws.String(base64.StdEncoding.EncodeToString([]byte(newScript))), nil
+}
+
+// decodeUserData returns the script in the base64 encoded user data
+func decodeUserData(userData string) (string, error) {
+	script, err := base64.StdEncoding.DecodeString(userData)
+	if err != nil {
+		return "", fmt.Errorf("could not decode the user data: %v", err)
+	}
+	if len(script) >= 2 && script[0] == 0x1f && script[1] == 0x8b {
+		return "", fmt.Errorf("compressed user data is not supported")
+	}
+	return string(script), nil
+}
+
+// ecsConfigFromUserData returns the keys of ecs.config written by the base64 encoded user data
+func ecsConfigFromUserData(userData *string) map[string]string {
+	script, err := decodeUserData(aws.StringValue(userData))
+	if err != nil {
+		return nil
+	}
+	return parseECSConfigScript(script).config()
+}
+
+// userDataDiff returns the lines that differ between the scripts of the base64 encoded user data, with two lines of context
+func userDataDiff(before, after *string) string {
+	if aws.StringValue(before) == aws.StringValue(after) {
+		return ""
+	}
+	beforeScript, err := decodeUserData(aws.StringValue(before))
+	if err != nil {
+		return ""
+	}
+	afterScript, err := decodeUserData(aws.StringValue(after))
+	if err != nil {
+		return ""
+	}
+	ops := diffLines(strings.Split(beforeScript, "\n"), strings.Split(afterScript, "\n"))
+	const context = 2
+	var diff []string
+	last := -1
+	for i, op := range ops {
+		near := false
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(ops) && ops[j][0] != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last >= 0 && i > last+1 {
+			diff = append(diff, "@@")
+		}
+		diff = append(diff, op)
+		last = i
+	}
+	if len(diff) == 0 {
+		return ""
+	}
+	return strings.Join(append([]string{"--- user data", "+++ new user data"}, diff...), "\n")
+}
+
+// diffLines returns the lines of a and b, prefixed with "-" when only in a, "+" when only in b and " " when in both
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, "-"+a[i])
+			i++
+		default:
+			ops = append(ops, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, "+"+b[j])
+	}
+	return ops
+}
+
+// shellQuote returns word as a shell word, with quote when possible
+func shellQuote(word, quote string) string {
+	switch {
+	case quote == "" && shellSafePattern.MatchString(word):
+		return word
+	case quote == `"` && !strings.ContainsAny(word, "\"$`\\!"):
+		return `"` + word + `"`
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
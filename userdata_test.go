@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const testUserData = `#!/bin/bash
+echo ECS_CLUSTER=cluster >> /etc/ecs/ecs.config
+echo "ECS_CONTAINER_STOP_TIMEOUT=30s" >> /etc/ecs/ecs.config
+echo ECS_ENABLE_TASK_IAM_ROLE=true >> /etc/ecs/ecs.config
+yum install -y amazon-ssm-agent
+`
+
+func TestGetECSConfigChangesFromEnv(t *testing.T) {
+	t.Setenv("ECS_CONFIG", `{"ECS_CONTAINER_STOP_TIMEOUT":"2m","ECS_ENABLE_TASK_IAM_ROLE":null}`)
+	c, err := getECSConfigChangesFromEnv()
+	if err != nil {
+		t.Fatalf("getECSConfigChangesFromEnv error: %v", err)
+	}
+	expected := ECSConfigChanges{"ECS_CONTAINER_STOP_TIMEOUT": aws.String("2m"), "ECS_ENABLE_TASK_IAM_ROLE": nil}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %v, got %v", expected, c)
+	}
+	for _, value := range []string{`ECS_CLUSTER=cluster`, `{"ecs_cluster":"cluster"}`, `{"ECS_CLUSTER":"a\nb"}`} {
+		t.Setenv("ECS_CONFIG", value)
+		if _, err := getECSConfigChangesFromEnv(); err == nil {
+			t.Errorf("expected an error for ECS_CONFIG=%s", value)
+		}
+	}
+}
+
+func TestECSConfigApplyToScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		changes  ECSConfigChanges
+		expected string
+	}{
+		{
+			name:    "echo",
+			script:  testUserData,
+			changes: ECSConfigChanges{"ECS_CONTAINER_STOP_TIMEOUT": aws.String("2m"), "ECS_ENABLE_TASK_IAM_ROLE": nil, "ECS_ENABLE_SPOT_INSTANCE_DRAINING": aws.String("true")},
+			expected: `#!/bin/bash
+echo ECS_CLUSTER=cluster >> /etc/ecs/ecs.config
+echo "ECS_CONTAINER_STOP_TIMEOUT=2m" >> /etc/ecs/ecs.config
+echo ECS_ENABLE_SPOT_INSTANCE_DRAINING=true >> /etc/ecs/ecs.config
+yum install -y amazon-ssm-agent
+`,
+		},
+		{
+			name: "heredoc",
+			script: `#!/bin/bash
+cat <<'EOF' >> /etc/ecs/ecs.config
+ECS_CLUSTER=cluster
+ECS_CONTAINER_STOP_TIMEOUT=30s
+EOF
+`,
+			changes: ECSConfigChanges{"ECS_CONTAINER_STOP_TIMEOUT": aws.String("2m"), "ECS_AVAILABLE_LOGGING_DRIVERS": aws.String(`["json-file","awslogs"]`)},
+			expected: `#!/bin/bash
+cat <<'EOF' >> /etc/ecs/ecs.config
+ECS_CLUSTER=cluster
+ECS_CONTAINER_STOP_TIMEOUT=2m
+ECS_AVAILABLE_LOGGING_DRIVERS=["json-file","awslogs"]
+EOF
+`,
+		},
+		{
+			name: "unquoted heredoc",
+			script: `#!/bin/bash
+cat <<EOF >> /etc/ecs/ecs.config
+ECS_CLUSTER=$CLUSTER
+ECS_ENGINE_AUTH_DATA=a\$b
+EOF
+`,
+			changes: ECSConfigChanges{"ECS_ENGINE_AUTH_DATA": aws.String(`c$d\e`), "ECS_INSTANCE_ATTRIBUTES": aws.String(`{"a":"$b"}`)},
+			expected: `#!/bin/bash
+cat <<EOF >> /etc/ecs/ecs.config
+ECS_CLUSTER=$CLUSTER
+ECS_ENGINE_AUTH_DATA=c\$d\\e
+ECS_INSTANCE_ATTRIBUTES={"a":"\$b"}
+EOF
+`,
+		},
+		{
+			name:    "quoted value",
+			script:  "#!/bin/bash\necho ECS_CLUSTER=cluster > /etc/ecs/ecs.config\n",
+			changes: ECSConfigChanges{"ECS_AVAILABLE_LOGGING_DRIVERS": aws.String(`["json-file","awslogs"]`)},
+			expected: `#!/bin/bash
+echo ECS_CLUSTER=cluster > /etc/ecs/ecs.config
+echo 'ECS_AVAILABLE_LOGGING_DRIVERS=["json-file","awslogs"]' >> /etc/ecs/ecs.config
+`,
+		},
+		{
+			name:     "no ecs.config",
+			script:   "#!/bin/bash\nyum update -y\n",
+			changes:  ECSConfigChanges{"ECS_CLUSTER": aws.String("cluster")},
+			expected: "#!/bin/bash\nyum update -y\necho ECS_CLUSTER=cluster >> /etc/ecs/ecs.config\n",
+		},
+		{
+			name:     "no user data",
+			changes:  ECSConfigChanges{"ECS_CLUSTER": aws.String("cluster")},
+			expected: "#!/bin/bash\necho ECS_CLUSTER=cluster >> /etc/ecs/ecs.config\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, err := test.changes.applyToScript(test.script)
+			if err != nil {
+				t.Fatalf("applyToScript error: %v", err)
+			}
+			if script != test.expected {
+				t.Errorf("expected script:\n%s\ngot:\n%s", test.expected, script)
+			}
+		})
+	}
+	if _, err := (ECSConfigChanges{"ECS_CLUSTER": aws.String("cluster")}).applyToScript("#cloud-config\nruncmd: []\n"); err == nil {
+		t.Errorf("expected an error for user data that is not a shell script")
+	}
+	if config := parseECSConfigScript("cat <<EOF >> /etc/ecs/ecs.config\nECS_ENGINE_AUTH_DATA=c\\$d\nEOF\n").config(); config["ECS_ENGINE_AUTH_DATA"] != "c$d" {
+		t.Errorf("expected ECS_ENGINE_AUTH_DATA=c$d in an unquoted heredoc, got %s", config["ECS_ENGINE_AUTH_DATA"])
+	}
+}
+
+func TestUserDataDiff(t *testing.T) {
+	before := aws.String(base64.StdEncoding.EncodeToString([]byte(testUserData)))
+	after, err := ECSConfigChanges{"ECS_CONTAINER_STOP_TIMEOUT": aws.String("2m")}.applyToUserData(before)
+	if err != nil {
+		t.Fatalf("applyToUserData error: %v", err)
+	}
+	expected := strings.Join([]string{
+		"--- user data",
+		"+++ new user data",
+		" #!/bin/bash",
+		" echo ECS_CLUSTER=cluster >> /etc/ecs/ecs.config",
+		`-echo "ECS_CONTAINER_STOP_TIMEOUT=30s" >> /etc/ecs/ecs.config`,
+		`+echo "ECS_CONTAINER_STOP_TIMEOUT=2m" >> /etc/ecs/ecs.config`,
+		" echo ECS_ENABLE_TASK_IAM_ROLE=true >> /etc/ecs/ecs.config",
+		" yum install -y amazon-ssm-agent",
+	}, "\n")
+	if diff := userDataDiff(before, after); diff != expected {
+		t.Errorf("expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+	if diff := userDataDiff(before, before); diff != "" {
+		t.Errorf("expected no diff, got:\n%s", diff)
+	}
+	if config := ecsConfigFromUserData(after); config["ECS_CONTAINER_STOP_TIMEOUT"] != "2m" || config["ECS_CLUSTER"] != "cluster" {
+		t.Errorf("unexpected ecs.config %v", config)
+	}
+}
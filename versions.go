@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type InstanceVersions struct {
+	AgentVersions  []string `json:"agentVersions"`
+	DockerVersions []string `json:"dockerVersions"`
+	Attributes     []string `json:"attributes"`
+}
+
+// VersionReport compares the ECS agent, Docker and the registered attributes of the old and the new container instances
+type VersionReport struct {
+	Old               InstanceVersions `json:"old"`
+	New               InstanceVersions `json:"new"`
+	MissingAttributes []string         `json:"missingAttributes,omitempty"`
+	AddedAttributes   []string         `json:"addedAttributes,omitempty"`
+}
+
+// compareContainerInstances compares the old and the new container instances. Attributes that are registered on the
+// old instances but not on the new instances are missing, unless they're in ignoreAttributes
+func compareContainerInstances(containerInstances map[string]ContainerInstance, instances []AutoscalingInstance, newLaunchIdentifier, useLaunchTemplates string, ignoreAttributes []string) VersionReport {
+	var report VersionReport
+	oldInstances, newInstances := make(map[string]map[string]bool), make(map[string]map[string]bool)
+	for _, m := range []map[string]map[string]bool{oldInstances, newInstances} {
+		m["agent"] = make(map[string]bool)
+		m["docker"] = make(map[string]bool)
+		m["attributes"] = make(map[string]bool)
+	}
+	for _, instance := range instances {
+		containerInstance, ok := containerInstances[instance.InstanceId]
+		if !ok {
+			continue
+		}
+		m := oldInstances
+		if checkInstanceLaunchConfigOrTemplate(useLaunchTemplates, instance, newLaunchIdentifier) {
+			m = newInstances
+		}
+		m["agent"][containerInstance.AgentVersion] = true
+		m["docker"][containerInstance.DockerVersion] = true
+		for _, attribute := range containerInstance.Attributes {
+			m["attributes"][attribute] = true
+		}
+	}
+	report.Old = InstanceVersions{AgentVersions: sortedKeys(oldInstances["agent"]), DockerVersions: sortedKeys(oldInstances["docker"]), Attributes: sortedKeys(oldInstances["attributes"])}
+	report.New = InstanceVersions{AgentVersions: sortedKeys(newInstances["agent"]), DockerVersions: sortedKeys(newInstances["docker"]), Attributes: sortedKeys(newInstances["attributes"])}
+	for _, attribute := range report.Old.Attributes {
+		if !newInstances["attributes"][attribute] && !stringInSlice(attribute, ignoreAttributes) {
+			report.MissingAttributes = append(report.MissingAttributes, attribute)
+		}
+	}
+	for _, attribute := range report.New.Attributes {
+		if !oldInstances["attributes"][attribute] {
+			report.AddedAttributes = append(report.AddedAttributes, attribute)
+		}
+	}
+	return report
+}
+
+// checkVersions logs the version report and returns an error when attributes of the old instances are missing on the new instances
+func checkVersions(containerInstances map[string]ContainerInstance, instances []AutoscalingInstance, newLaunchIdentifier, useLaunchTemplates string, ignoreAttributes []string) (VersionReport, error) {
+	report := compareContainerInstances(containerInstances, instances, newLaunchIdentifier, useLaunchTemplates, ignoreAttributes)
+	report.log()
+	if len(report.MissingAttributes) > 0 {
+		return report, gateError{reason: fmt.Sprintf("New instances are missing attributes of the old instances: %s", strings.Join(report.MissingAttributes, ", "))}
+	}
+	return report, nil
+}
+
+func (v VersionReport) log() {
+	mainLogger.Infof("ECS agent version: %s -> %s", strings.Join(v.Old.AgentVersions, ","), strings.Join(v.New.AgentVersions, ","))
+	mainLogger.Infof("Docker version: %s -> %s", strings.Join(v.Old.DockerVersions, ","), strings.Join(v.New.DockerVersions, ","))
+	if len(v.AddedAttributes) > 0 {
+		mainLogger.Infof("New attributes on new instances: %s", strings.Join(v.AddedAttributes, ", "))
+	}
+	if len(v.MissingAttributes) > 0 {
+		mainLogger.Errorf("Attributes missing on new instances: %s", strings.Join(v.MissingAttributes, ", "))
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
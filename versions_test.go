@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCompareContainerInstances(t *testing.T) {
+	instances := []AutoscalingInstance{
+		{InstanceId: "i-1", LaunchConfig: "lc-old"},
+		{InstanceId: "i-2", LaunchConfig: "lc-new"},
+	}
+	containerInstances := map[string]ContainerInstance{
+		"i-1": {
+			InstanceId:    "i-1",
+			AgentVersion:  "1.70.0",
+			DockerVersion: "20.10.17",
+			Attributes:    []string{"ecs.capability.secrets.ssm.environment-variables", "ecs.capability.gpu-driver-version", "ecs.ami-id"},
+		},
+		"i-2": {
+			InstanceId:    "i-2",
+			AgentVersion:  "1.80.0",
+			DockerVersion: "24.0.5",
+			Attributes:    []string{"ecs.capability.secrets.ssm.environment-variables", "ecs.ami-id", "ecs.capability.service-connect-v1"},
+		},
+	}
+	report := compareContainerInstances(containerInstances, instances, "lc-new", "false", []string{})
+	if len(report.Old.AgentVersions) != 1 || report.Old.AgentVersions[0] != "1.70.0" {
+		t.Errorf("unexpected old agent versions: %v", report.Old.AgentVersions)
+	}
+	if len(report.New.DockerVersions) != 1 || report.New.DockerVersions[0] != "24.0.5" {
+		t.Errorf("unexpected new docker versions: %v", report.New.DockerVersions)
+	}
+	if len(report.MissingAttributes) != 1 || report.MissingAttributes[0] != "ecs.capability.gpu-driver-version" {
+		t.Errorf("expected gpu attribute to be missing, got %v", report.MissingAttributes)
+	}
+	if len(report.AddedAttributes) != 1 || report.AddedAttributes[0] != "ecs.capability.service-connect-v1" {
+		t.Errorf("expected service connect attribute to be added, got %v", report.AddedAttributes)
+	}
+	report = compareContainerInstances(containerInstances, instances, "lc-new", "false", []string{"ecs.capability.gpu-driver-version"})
+	if len(report.MissingAttributes) != 0 {
+		t.Errorf("expected no missing attributes, got %v", report.MissingAttributes)
+	}
+}